@@ -72,6 +72,7 @@ var whitelist = map[string]bool{
 	"API.WebsocketClientEventQueue":                false,
 	"API.SendTimeout":                              true,
 	"API.WebsocketServerEventQueue":                false,
+	"API.KeepServiceHedgeDelay":                    false,
 	"API.KeepServiceRequestTimeout":                false,
 	"AuditLogs":                                    false,
 	"AuditLogs.MaxAge":                             false,
@@ -87,10 +88,15 @@ var whitelist = map[string]bool{
 	"Collections.ManagedProperties":                true,
 	"Collections.ManagedProperties.*":              true,
 	"Collections.ManagedProperties.*.*":            true,
+	"Collections.MaxShareLinkTTL":                  false,
 	"Collections.PreserveVersionIfIdle":            true,
+	"Collections.ResumableUploadTTL":               false,
+	"Collections.ShareLinkSigningKey":              false,
 	"Collections.TrashSweepInterval":               false,
 	"Collections.TrustAllContent":                  false,
+	"Collections.WebDAVAuditLogFile":               false,
 	"Collections.WebDAVCache":                      false,
+	"Collections.WebDAVLogEvents":                  false,
 	"Containers":                                   true,
 	"Containers.CloudVMs":                          false,
 	"Containers.CrunchRunCommand":                  false,
@@ -215,6 +215,13 @@ Clusters:
       # Timeout on requests to internal Keep services.
       KeepServiceRequestTimeout: 15s
 
+      # When reading a block, if a Keep service has not responded
+      # after this long, send the same request to the next Keep
+      # service that might have the block, and use whichever
+      # response arrives first. 0s means wait for each service to
+      # succeed or fail before trying the next one.
+      KeepServiceHedgeDelay: 0s
+
     Users:
       # Config parameters to automatically setup new users.  If enabled,
       # this users will be able to self-activate.  Enable this if you want
@@ -401,6 +408,45 @@ Clusters:
       # The default setting (false) is appropriate for a multi-user site.
       TrustAllContent: false
 
+      # ShareLinkSigningKey is a string of alphanumeric characters
+      # used by keep-web to sign expiring, read-only share links for
+      # collections. IMPORTANT: This is a site secret. It should be at
+      # least 50 characters. If it is empty, share links are
+      # disabled. Share links also require SystemRootToken.
+      #
+      # Modifying ShareLinkSigningKey invalidates all existing share
+      # links.
+      ShareLinkSigningKey: ""
+
+      # Maximum lifetime of a share link. This is also the default
+      # lifetime when the user does not specify one.
+      MaxShareLinkTTL: 168h
+
+      # Partial uploads made with keep-web's resumable upload (tus)
+      # API are stored in temporary collections in the user's home
+      # project. A temporary collection is moved to the trash if the
+      # upload is not completed within this time.
+      ResumableUploadTTL: 168h
+
+      # Record file downloads (GET), uploads (PUT), and deletions
+      # (DELETE) done through keep-web, including WebDAV and S3
+      # requests, for auditing. Each record includes the user UUID,
+      # collection UUID/PDH, file path, requested byte range, and
+      # number of bytes transferred.
+      #
+      # If WebDAVLogEvents is true, records are saved as Arvados log
+      # entries (event_type file_download, file_upload, or
+      # file_delete). If SystemRootToken is set, log entries are
+      # owned by the system user so regular users cannot delete them.
+      #
+      # If WebDAVAuditLogFile is not empty, records are also appended
+      # to the given local file, one JSON object per line.
+      #
+      # Records are queued and written in the background, so a slow
+      # or unavailable API server does not delay keep-web responses.
+      WebDAVLogEvents: false
+      WebDAVAuditLogFile: ""
+
       # Cache parameters for WebDAV content serving:
       # * TTL: Maximum time to cache manifests and permission checks.
       # * UUIDTTL: Maximum time to cache collection state.
@@ -409,6 +455,18 @@ Clusters:
       # * MaxCollectionBytes: Approximate memory limit for collection cache.
       # * MaxPermissionEntries: Maximum number of permission cache entries.
       # * MaxUUIDEntries: Maximum number of UUID cache entries.
+      # * ReadAheadBlocks: Maximum number of blocks to prefetch when
+      #   a file is being read sequentially (0 disables
+      #   read-ahead). This should be less than MaxBlockEntries.
+      # * ReadAheadBytes: Maximum total size of the prefetched
+      #   blocks (0 means no limit other than ReadAheadBlocks).
+      # * DiskCacheDirectory: Local directory where blocks are
+      #   cached, so they can be reused after keep-web restarts
+      #   ("" means no disk cache). Multiple keep-web processes on
+      #   the same host can share a directory if they run as the
+      #   same user; the cache is not readable by other users.
+      # * MaxDiskCacheBytes: Approximate size limit for the disk
+      #   cache.
       WebDAVCache:
         TTL: 300s
         UUIDTTL: 5s
@@ -417,6 +475,10 @@ Clusters:
         MaxCollectionBytes:   100000000
         MaxPermissionEntries: 1000
         MaxUUIDEntries:       1000
+        ReadAheadBlocks:      0
+        ReadAheadBytes:       0
+        DiskCacheDirectory:   ""
+        MaxDiskCacheBytes:    1000000000
 
     Login:
       # These settings are provided by your OAuth2 provider (eg
@@ -7,6 +7,7 @@ package arvados
 import (
 	"bufio"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,12 +35,30 @@ type Collection struct {
 	DeleteAt                  *time.Time             `json:"delete_at"`
 	IsTrashed                 bool                   `json:"is_trashed"`
 	Properties                map[string]interface{} `json:"properties"`
+	Version                   int                    `json:"version"`
+	CurrentVersionUUID        string                 `json:"current_version_uuid"`
 }
 
 func (c Collection) resourceName() string {
 	return "collection"
 }
 
+// ParseCollectionVersion splits an ID like
+// "zzzzz-4zz18-xxxxxxxxxxxxxxx@3", which refers to a specific version
+// of a collection, into the collection UUID and version number. It
+// returns ok==false if id is not in that form.
+func ParseCollectionVersion(id string) (uuid string, version int, ok bool) {
+	i := strings.LastIndex(id, "@")
+	if i < 0 || !strings.Contains(id[:i], "-4zz18-") {
+		return "", 0, false
+	}
+	version, err := strconv.Atoi(id[i+1:])
+	if err != nil || version < 1 {
+		return "", 0, false
+	}
+	return id[:i], version, true
+}
+
 // SizedDigests returns the hash+size part of each data block
 // referenced by the collection.
 func (c *Collection) SizedDigests() ([]SizedDigest, error) {
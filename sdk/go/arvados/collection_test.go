@@ -0,0 +1,37 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&CollectionSuite{})
+
+type CollectionSuite struct{}
+
+func (s *CollectionSuite) TestParseCollectionVersion(c *check.C) {
+	for _, trial := range []struct {
+		id      string
+		uuid    string
+		version int
+		ok      bool
+	}{
+		{"zzzzz-4zz18-25k12570yk134b3@1", "zzzzz-4zz18-25k12570yk134b3", 1, true},
+		{"zzzzz-4zz18-25k12570yk134b3@123", "zzzzz-4zz18-25k12570yk134b3", 123, true},
+		{"zzzzz-4zz18-25k12570yk134b3", "", 0, false},
+		{"zzzzz-4zz18-25k12570yk134b3@", "", 0, false},
+		{"zzzzz-4zz18-25k12570yk134b3@0", "", 0, false},
+		{"zzzzz-4zz18-25k12570yk134b3@-1", "", 0, false},
+		{"zzzzz-4zz18-25k12570yk134b3@x", "", 0, false},
+		{"zzzzz-j7d0g-v955i6s2oi1cbso@1", "", 0, false},
+		{"1f4b0bc7583c2a7f9102c395f4ffc5e3+45@1", "", 0, false},
+	} {
+		uuid, version, ok := ParseCollectionVersion(trial.id)
+		c.Check(uuid, check.Equals, trial.uuid, check.Commentf("%+v", trial))
+		c.Check(version, check.Equals, trial.version, check.Commentf("%+v", trial))
+		c.Check(ok, check.Equals, trial.ok, check.Commentf("%+v", trial))
+	}
+}
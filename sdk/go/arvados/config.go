@@ -65,6 +65,10 @@ type WebDAVCacheConfig struct {
 	MaxCollectionBytes   int64
 	MaxPermissionEntries int
 	MaxUUIDEntries       int
+	ReadAheadBlocks      int
+	ReadAheadBytes       int64
+	DiskCacheDirectory   string
+	MaxDiskCacheBytes    int64
 }
 type Cluster struct {
 	ClusterID       string `json:"-"`
@@ -89,6 +93,7 @@ type Cluster struct {
 		WebsocketClientEventQueue      int
 		WebsocketServerEventQueue      int
 		KeepServiceRequestTimeout      Duration
+		KeepServiceHedgeDelay          Duration
 	}
 	AuditLogs struct {
 		MaxAge             Duration
@@ -110,6 +115,11 @@ type Cluster struct {
 		PreserveVersionIfIdle Duration
 		TrashSweepInterval    Duration
 		TrustAllContent       bool
+		ShareLinkSigningKey   string
+		MaxShareLinkTTL       Duration
+		ResumableUploadTTL    Duration
+		WebDAVLogEvents       bool
+		WebDAVAuditLogFile    string
 
 		WebDAVCache WebDAVCacheConfig
 	}
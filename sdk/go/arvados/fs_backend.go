@@ -24,6 +24,20 @@ type keepClient interface {
 	LocalLocator(locator string) (string, error)
 }
 
+// A keepPrefetcher can retrieve blocks in the background, so a
+// subsequent ReadAt doesn't have to wait.
+type keepPrefetcher interface {
+	Prefetch(locator string)
+}
+
+// Prefetch starts retrieving the given block, if the underlying
+// keepClient supports it.
+func (kb keepBackend) Prefetch(locator string) {
+	if kp, ok := kb.keepClient.(keepPrefetcher); ok {
+		kp.Prefetch(locator)
+	}
+}
+
 type apiClient interface {
 	RequestAndDecode(dst interface{}, method, path string, body io.Reader, params interface{}) error
 }
@@ -61,6 +61,9 @@ type FileSystem interface {
 	// create a new node with nil parent.
 	newNode(name string, perm os.FileMode, modTime time.Time) (node inode, err error)
 
+	// current read-ahead limits (see SetReadAhead).
+	readAhead() ReadAhead
+
 	// analogous to os.Stat()
 	Stat(name string) (os.FileInfo, error)
 
@@ -87,6 +90,30 @@ type FileSystem interface {
 	RemoveAll(name string) error
 	Rename(oldname, newname string) error
 	Sync() error
+
+	// Prefetch file data into the block cache, within the given
+	// limits, when a file is being read sequentially. The
+	// default is no read-ahead. The limits also apply to
+	// collections that are subsequently mounted in the
+	// filesystem.
+	SetReadAhead(ReadAhead)
+}
+
+// ReadAhead specifies how much file data a FileSystem prefetches
+// ahead of a sequential reader. Blocks are retrieved concurrently, so
+// a large read-ahead can hide Keep latency when reading large files.
+//
+// Prefetched blocks are stored in the keep client's block cache, so
+// Blocks should be smaller than the cache size; otherwise prefetched
+// blocks will be evicted before they are read.
+type ReadAhead struct {
+	// Maximum number of blocks to prefetch. Zero disables
+	// read-ahead.
+	Blocks int
+
+	// Maximum total size of the prefetched blocks. Zero means
+	// no limit other than Blocks.
+	Bytes int64
 }
 
 type inode interface {
@@ -288,12 +315,35 @@ type fileSystem struct {
 	root inode
 	fsBackend
 	mutex sync.Mutex
+
+	ra    ReadAhead
+	raMtx sync.Mutex
 }
 
 func (fs *fileSystem) rootnode() inode {
 	return fs.root
 }
 
+func (fs *fileSystem) SetReadAhead(ra ReadAhead) {
+	fs.raMtx.Lock()
+	defer fs.raMtx.Unlock()
+	fs.ra = ra
+}
+
+func (fs *fileSystem) readAhead() ReadAhead {
+	fs.raMtx.Lock()
+	defer fs.raMtx.Unlock()
+	return fs.ra
+}
+
+// Prefetch starts retrieving the given block, if the backend
+// supports it.
+func (fs *fileSystem) Prefetch(locator string) {
+	if kp, ok := fs.fsBackend.(keepPrefetcher); ok {
+		kp.Prefetch(locator)
+	}
+}
+
 func (fs *fileSystem) locker() sync.Locker {
 	return &fs.mutex
 }
@@ -0,0 +1,58 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+var (
+	// In content-defined chunking mode, blocks (other than the
+	// last block of a file) are at least cdcMinBlockSize and at
+	// most maxBlockSize bytes. Beyond the minimum, a boundary
+	// occurs with probability 2^-cdcBoundaryBits at each byte,
+	// so the average block size is about cdcMinBlockSize +
+	// 2^cdcBoundaryBits.
+	cdcMinBlockSize = 1 << 22
+	cdcBoundaryBits = uint(23)
+)
+
+// gearTable maps each byte value to a pseudorandom 64-bit number
+// for the rolling hash. It must never change: otherwise, data
+// written by different versions would not be deduplicated.
+var gearTable = func() (t [256]uint64) {
+	// splitmix64
+	x := uint64(0x61727661646f7321)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// A chunker finds content-defined chunk boundaries in a stream of
+// data, using a "gear" rolling hash: the boundaries depend only on
+// the preceding 64 bytes (and the distance from the previous
+// boundary), so inserting or deleting data in a file only changes
+// the chunks near the edit.
+type chunker struct {
+	hash uint64
+	size int // bytes since previous boundary
+}
+
+// next scans p, and returns the number of bytes up to and including
+// the next chunk boundary, or -1 if there is no boundary in p. The
+// chunker's state carries over to the next call, so a stream can be
+// scanned in pieces.
+func (c *chunker) next(p []byte) int {
+	for i, b := range p {
+		c.size++
+		c.hash = c.hash<<1 + gearTable[b]
+		if c.size >= maxBlockSize || (c.size >= cdcMinBlockSize && c.hash>>(64-cdcBoundaryBits) == 0) {
+			c.hash, c.size = 0, 0
+			return i + 1
+		}
+	}
+	return -1
+}
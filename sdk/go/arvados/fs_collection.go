@@ -6,6 +6,7 @@ package arvados
 
 import (
 	"context"
+	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -38,11 +40,20 @@ type CollectionFileSystem interface {
 
 	// Total data bytes in all files.
 	Size() int64
+
+	// Enable or disable content-defined chunking. When enabled,
+	// file data is split into blocks at boundaries determined by
+	// the data itself (using a rolling hash) rather than at fixed
+	// offsets, so files that differ only by small insertions or
+	// deletions still share most of their blocks. It affects data
+	// written after it is called.
+	SetContentDefinedChunking(bool)
 }
 
 type collectionFileSystem struct {
 	fileSystem
 	uuid string
+	cdc  int32 // 1 if content-defined chunking is enabled (accessed atomically)
 }
 
 // FileSystem returns a CollectionFileSystem for the collection.
@@ -153,6 +164,18 @@ func (fs *collectionFileSystem) Size() int64 {
 	return fs.fileSystem.root.(*dirnode).TreeSize()
 }
 
+func (fs *collectionFileSystem) SetContentDefinedChunking(enable bool) {
+	var cdc int32
+	if enable {
+		cdc = 1
+	}
+	atomic.StoreInt32(&fs.cdc, cdc)
+}
+
+func (fs *collectionFileSystem) contentDefinedChunking() bool {
+	return atomic.LoadInt32(&fs.cdc) != 0
+}
+
 // filenodePtr is an offset into a file that is (usually) efficient to
 // seek to. Specifically, if filenode.repacked==filenodePtr.repacked
 // then
@@ -292,6 +315,59 @@ func (fn *filenode) Read(p []byte, startPtr filenodePtr) (n int, ptr filenodePtr
 	return
 }
 
+// prefetch starts retrieving the blocks that a sequential reader at
+// ptr will need next, up to the filesystem's read-ahead limits,
+// skipping data before file offset "through" (which has already been
+// prefetched). It returns the file offset through which data has now
+// been prefetched. Caller must have lock.
+func (fn *filenode) prefetch(ptr filenodePtr, through int64) int64 {
+	ra := fn.fs.readAhead()
+	if ra.Blocks <= 0 {
+		return through
+	}
+	ptr = fn.seek(ptr)
+	if ptr.segmentIdx >= len(fn.segments) {
+		return through
+	}
+	off := ptr.off - int64(ptr.segmentOff)
+	blocks, bytes, lastLocator := 0, int64(0), ""
+	if seg, ok := fn.segments[ptr.segmentIdx].(storedSegment); ok && ptr.segmentOff > 0 {
+		// The reader is already using this block, so it
+		// doesn't count toward the read-ahead limits.
+		lastLocator = seg.locator
+		if end := ptr.off + int64(seg.Len()-ptr.segmentOff); end > through {
+			through = end
+		}
+	}
+	for idx := ptr.segmentIdx; idx < len(fn.segments); idx++ {
+		start := off
+		off += int64(fn.segments[idx].Len())
+		seg, ok := fn.segments[idx].(storedSegment)
+		if !ok {
+			continue
+		}
+		if seg.locator != lastLocator {
+			lastLocator = seg.locator
+			blocks++
+			bytes += int64(seg.size)
+			if blocks > ra.Blocks || (ra.Bytes > 0 && bytes > ra.Bytes) {
+				if start > through {
+					through = start
+				}
+				return through
+			}
+		}
+		if off <= through {
+			continue
+		}
+		if kp, ok := seg.kc.(keepPrefetcher); ok {
+			kp.Prefetch(seg.locator)
+		}
+		through = off
+	}
+	return through
+}
+
 func (fn *filenode) Size() int64 {
 	fn.RLock()
 	defer fn.RUnlock()
@@ -301,7 +377,50 @@ func (fn *filenode) Size() int64 {
 func (fn *filenode) FileInfo() os.FileInfo {
 	fn.RLock()
 	defer fn.RUnlock()
-	return fn.fileinfo
+	return collectionFileInfo{
+		fileinfo: fn.fileinfo,
+		segments: append([]segment(nil), fn.segments...),
+	}
+}
+
+// segmentsETag returns a strong entity tag derived from the block
+// locators and byte ranges that make up a file's content, or "" if
+// some of the file's data has not been written to Keep yet.
+//
+// Permission signatures and other hints are not included, so the
+// etag does not change when the manifest is re-signed.
+func segmentsETag(segments []segment) string {
+	h := md5.New()
+	for _, seg := range segments {
+		se, ok := seg.(storedSegment)
+		if !ok {
+			return ""
+		}
+		locator := se.locator
+		if i := strings.Index(locator, "+"); i >= 0 {
+			if j := strings.Index(locator[i+1:], "+"); j >= 0 {
+				locator = locator[:i+1+j]
+			}
+		}
+		fmt.Fprintf(h, "%s %d %d\n", locator, se.offset, se.length)
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil))
+}
+
+// collectionFileInfo is the os.FileInfo for a file in a collection.
+//
+// It keeps a copy of the file's segment list, so the ETag can be
+// computed only when a caller asks for it.
+type collectionFileInfo struct {
+	fileinfo
+	segments []segment
+}
+
+// ETag returns a strong entity tag (including the surrounding double
+// quotes) that changes whenever the file's content changes, or "" if
+// the file has data that has not been written to Keep yet.
+func (fi collectionFileInfo) ETag() string {
+	return segmentsETag(fi.segments)
 }
 
 func (fn *filenode) Truncate(size int64) error {
@@ -488,7 +607,10 @@ func (fn *filenode) Write(p []byte, startPtr filenodePtr) (n int, ptr filenodePt
 		if ptr.segmentOff >= maxBlockSize {
 			fn.pruneMemSegments()
 		}
-		if fn.segments[ptr.segmentIdx].Len() == ptr.segmentOff {
+		if ptr.repacked != fn.repacked {
+			// pruneMemSegments rearranged the segments.
+			ptr = fn.seek(ptr)
+		} else if fn.segments[ptr.segmentIdx].Len() == ptr.segmentOff {
 			ptr.segmentOff = 0
 			ptr.segmentIdx++
 		}
@@ -507,6 +629,10 @@ func (fn *filenode) pruneMemSegments() {
 		// TODO: share a throttle with filesystem
 		fn.throttle = newThrottle(writeAheadBlocks)
 	}
+	if fn.contentDefinedChunking() {
+		fn.pruneChunks()
+		return
+	}
 	for idx, seg := range fn.segments {
 		seg, ok := seg.(*memSegment)
 		if !ok || seg.Len() < maxBlockSize || seg.flushing != nil {
@@ -556,6 +682,212 @@ func (fn *filenode) pruneMemSegments() {
 	}
 }
 
+// pruneChunks is the content-defined chunking variant of
+// pruneMemSegments: it starts a background job for each run of
+// consecutive *memSegments totalling at least maxBlockSize, which
+// writes the run's complete chunks to Keep and then replaces the run
+// with the resulting segments. Caller must have write lock.
+func (fn *filenode) pruneChunks() {
+	for start := 0; start < len(fn.segments); {
+		end, runLen := start, 0
+		var bufs [][]byte
+		for ; end < len(fn.segments); end++ {
+			seg, ok := fn.segments[end].(*memSegment)
+			if !ok || seg.flushing != nil {
+				break
+			}
+			bufs = append(bufs, seg.buf)
+			runLen += seg.Len()
+		}
+		if runLen < maxBlockSize || (start > 0 && fn.isFlushing(start-1)) {
+			// Too short, or follows a run that is still
+			// being flushed (so we don't know yet where
+			// its last chunk ends).
+			if end == start {
+				end++
+			}
+			start = end
+			continue
+		}
+		// As in pruneMemSegments, setting seg.flushing
+		// guarantees the bufs will not be modified in place.
+		run := append([]segment(nil), fn.segments[start:end]...)
+		done := make(chan struct{})
+		for _, seg := range run {
+			seg.(*memSegment).flushing = done
+		}
+		fn.throttle.Acquire()
+		go func(start, runLen int) {
+			defer close(done)
+			chunked, err := fn.commitRun(context.Background(), newThrottle(1), bufs, runLen)
+			fn.throttle.Release()
+			fn.Lock()
+			defer fn.Unlock()
+			unchanged := len(fn.segments) >= start+len(run)
+			for i, seg := range run {
+				seg := seg.(*memSegment)
+				buf := bufs[i]
+				if len(seg.buf) != len(buf) || (len(buf) > 0 && &seg.buf[0] != &buf[0]) {
+					// Segment has been resized or
+					// a new seg.buf has been
+					// allocated.
+					unchanged = false
+					continue
+				}
+				seg.flushing = nil
+				if unchanged && fn.segments[start+i] != seg {
+					// Segment has been
+					// dropped/moved.
+					unchanged = false
+				}
+			}
+			if err != nil || !unchanged {
+				// The data is still in memory, so
+				// a subsequent sync will try again
+				// (and report the error if it
+				// fails again).
+				return
+			}
+			segments := make([]segment, 0, len(fn.segments)-len(run)+len(chunked))
+			segments = append(segments, fn.segments[:start]...)
+			segments = append(segments, chunked...)
+			segments = append(segments, fn.segments[start+len(run):]...)
+			for _, seg := range chunked {
+				if seg, ok := seg.(storedSegment); ok {
+					fn.memsize -= int64(seg.length)
+				}
+			}
+			fn.segments = segments
+			fn.repacked++
+		}(start, runLen)
+		start = end
+	}
+}
+
+func (fn *filenode) isFlushing(idx int) bool {
+	seg, ok := fn.segments[idx].(*memSegment)
+	return ok && seg.flushing != nil
+}
+
+func (fn *filenode) contentDefinedChunking() bool {
+	cfs, ok := fn.fs.(*collectionFileSystem)
+	return ok && cfs.contentDefinedChunking()
+}
+
+// commitChunks finds each run of consecutive *memSegments totalling
+// at least minRun bytes, splits the run into content-defined chunks,
+// writes each complete chunk out to Keep as a single block, and
+// replaces the run with storedSegments that reference the new blocks,
+// followed by a *memSegment with the data (if any) after the last
+// chunk boundary.
+//
+// Caller must have write lock.
+func (fn *filenode) commitChunks(ctx context.Context, throttle *throttle, minRun int) error {
+	var segments []segment
+	changed := false
+	for start := 0; start < len(fn.segments); {
+		end, runLen := start, 0
+		for ; end < len(fn.segments); end++ {
+			seg, ok := fn.segments[end].(*memSegment)
+			if !ok || seg.flushing != nil {
+				break
+			}
+			runLen += seg.Len()
+		}
+		if end == start {
+			segments = append(segments, fn.segments[start])
+			start++
+			continue
+		} else if runLen < minRun {
+			segments = append(segments, fn.segments[start:end]...)
+			start = end
+			continue
+		}
+		var bufs [][]byte
+		for _, seg := range fn.segments[start:end] {
+			bufs = append(bufs, seg.(*memSegment).buf)
+		}
+		chunked, err := fn.commitRun(ctx, throttle, bufs, runLen)
+		if err != nil {
+			// Keep the runs that were already
+			// committed (fn.memsize already reflects
+			// them) and leave the rest in memory.
+			if changed {
+				fn.segments = append(segments, fn.segments[start:]...)
+				fn.repacked++
+			}
+			return err
+		}
+		for _, seg := range chunked {
+			if seg, ok := seg.(storedSegment); ok {
+				fn.memsize -= int64(seg.length)
+			}
+		}
+		segments = append(segments, chunked...)
+		changed = true
+		start = end
+	}
+	if changed {
+		fn.segments = segments
+		fn.repacked++
+	}
+	return nil
+}
+
+// commitRun writes the complete content-defined chunks of the given
+// data (the bufs of a run of *memSegments) to Keep, and returns the
+// segments that should replace the run. It does not access
+// fn.segments, so the caller does not need to hold the lock as long
+// as the bufs are not modified.
+func (fn *filenode) commitRun(ctx context.Context, throttle *throttle, bufs [][]byte, size int) ([]segment, error) {
+	data := make([]byte, 0, size)
+	for _, buf := range bufs {
+		data = append(data, buf...)
+	}
+	var chunks [][]byte
+	var c chunker
+	for len(data) > 0 {
+		n := c.next(data)
+		if n < 0 {
+			break
+		}
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	segments := make([]segment, len(chunks), len(chunks)+1)
+	cg := newContextGroup(ctx)
+	defer cg.Cancel()
+	for i, chunk := range chunks {
+		i, chunk := i, chunk
+		cg.Go(func() error {
+			throttle.Acquire()
+			defer throttle.Release()
+			if err := cg.Context().Err(); err != nil {
+				return err
+			}
+			locator, _, err := fn.FS().PutB(chunk)
+			if err != nil {
+				return err
+			}
+			segments[i] = storedSegment{
+				kc:      fn.FS(),
+				locator: locator,
+				size:    len(chunk),
+				offset:  0,
+				length:  len(chunk),
+			}
+			return nil
+		})
+	}
+	if err := cg.Wait(); err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		segments = append(segments, &memSegment{buf: append([]byte(nil), data...)})
+	}
+	return segments, nil
+}
+
 // Block until all pending pruneMemSegments work is finished. Caller
 // must NOT have lock.
 func (fn *filenode) waitPrune() {
@@ -661,6 +993,19 @@ func (dn *dirnode) sync(ctx context.Context, throttle *throttle, names []string)
 		})
 	}
 
+	if dn.fs.contentDefinedChunking() {
+		// Write all complete chunks as blocks of their own;
+		// only the last part of each file (after the last
+		// chunk boundary) is packed with other data below.
+		for _, name := range names {
+			if fn, ok := dn.inodes[name].(*filenode); ok {
+				if err := fn.commitChunks(ctx, throttle, cdcMinBlockSize); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
 	var pending []fnSegmentRef
 	var pendingLen int = 0
 	localLocator := map[string]string{}
@@ -32,6 +32,7 @@ type keepClientStub struct {
 	blocks      map[string][]byte
 	refreshable map[string]bool
 	onPut       func(bufcopy []byte) // called from PutB, before acquiring lock
+	prefetched  []string
 	sync.RWMutex
 }
 
@@ -60,6 +61,12 @@ func (kcs *keepClientStub) PutB(p []byte) (string, int, error) {
 	return locator, 1, nil
 }
 
+func (kcs *keepClientStub) Prefetch(locator string) {
+	kcs.Lock()
+	defer kcs.Unlock()
+	kcs.prefetched = append(kcs.prefetched, locator[:32])
+}
+
 var localOrRemoteSignature = regexp.MustCompile(`\+[AR][^+]*`)
 
 func (kcs *keepClientStub) LocalLocator(locator string) (string, error) {
@@ -474,6 +481,206 @@ func (s *CollectionFSSuite) TestMarshalSmallBlocks(c *check.C) {
 	c.Check(m, check.Equals, ". c3c23db5285662ef7172373df0003206+6 acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:bar 3:3:baz 6:3:foo\n")
 }
 
+func (s *CollectionFSSuite) TestContentDefinedChunking(c *check.C) {
+	maxBlockSize = 4096
+	cdcMinBlockSize = 256
+	cdcBoundaryBits = 8
+	defer func() {
+		maxBlockSize = 2 << 26
+		cdcMinBlockSize = 1 << 22
+		cdcBoundaryBits = 23
+	}()
+
+	data := make([]byte, 1<<16)
+	rand.Read(data)
+	expect := map[string][]byte{
+		"orig": data,
+		// Same data with a few bytes inserted near the
+		// beginning.
+		"edited": append(append(append([]byte(nil), data[:1000]...), "inserted"...), data[1000:]...),
+	}
+
+	var err error
+	s.fs, err = (&Collection{}).FileSystem(s.client, s.kc)
+	c.Assert(err, check.IsNil)
+	s.fs.SetContentDefinedChunking(true)
+	blocks := map[string][]string{}
+	for _, name := range []string{"orig", "edited"} {
+		f, err := s.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0)
+		c.Assert(err, check.IsNil)
+		buf := expect[name]
+		for i := 0; i < len(buf); i += 100 {
+			end := i + 100
+			if end > len(buf) {
+				end = len(buf)
+			}
+			_, err = f.Write(buf[i:end])
+			c.Assert(err, check.IsNil)
+		}
+		// Full-size runs should have been flushed in the
+		// background while writing.
+		fn := f.(*filehandle).inode.(*filenode)
+		fn.waitPrune()
+		s.checkMemSize(c, f)
+		c.Check(fn.memsize < int64(len(buf)), check.Equals, true)
+		c.Check(f.Close(), check.IsNil)
+
+		// Save each file in its own manifest, so blocks
+		// aren't shared by packing small segments together.
+		m, err := s.fs.MarshalManifest(".")
+		c.Assert(err, check.IsNil)
+		blocks[name] = regexp.MustCompile(`[0-9a-f]{32}\+\d+`).FindAllString(m, -1)
+		c.Assert(s.fs.Remove(name), check.IsNil)
+
+		persisted, err := (&Collection{ManifestText: m}).FileSystem(s.client, s.kc)
+		c.Assert(err, check.IsNil)
+		rf, err := persisted.Open(name)
+		c.Assert(err, check.IsNil)
+		buf, err = ioutil.ReadAll(rf)
+		c.Check(err, check.IsNil)
+		c.Check(bytes.Equal(buf, expect[name]), check.Equals, true)
+		rf.Close()
+	}
+
+	c.Logf("orig blocks %v", blocks["orig"])
+	c.Logf("edited blocks %v", blocks["edited"])
+	c.Check(len(blocks["orig"]) > 10, check.Equals, true)
+	orig := map[string]bool{}
+	for _, loc := range blocks["orig"] {
+		var size int
+		fmt.Sscanf(loc[33:], "%d", &size)
+		c.Check(size <= maxBlockSize, check.Equals, true)
+		orig[loc] = true
+	}
+	shared := 0
+	for _, loc := range blocks["edited"] {
+		if orig[loc] {
+			shared++
+		}
+	}
+	c.Check(shared >= len(blocks["edited"])-3, check.Equals, true, check.Commentf("%d of %d blocks shared", shared, len(blocks["edited"])))
+}
+
+// Toggling content-defined chunking while writing must not race with
+// the writers (run with -race) or corrupt the file data.
+func (s *CollectionFSSuite) TestContentDefinedChunkingToggle(c *check.C) {
+	defer func(max, min int, bits uint) {
+		maxBlockSize, cdcMinBlockSize, cdcBoundaryBits = max, min, bits
+	}(maxBlockSize, cdcMinBlockSize, cdcBoundaryBits)
+	maxBlockSize = 4096
+	cdcMinBlockSize = 256
+	cdcBoundaryBits = 8
+
+	fs, err := (&Collection{}).FileSystem(s.client, s.kc)
+	c.Assert(err, check.IsNil)
+
+	stop := make(chan struct{})
+	toggled := make(chan struct{})
+	go func() {
+		defer close(toggled)
+		for enable := true; ; enable = !enable {
+			select {
+			case <-stop:
+				return
+			default:
+				fs.SetContentDefinedChunking(enable)
+			}
+		}
+	}()
+
+	data := make([]byte, 1<<16)
+	rand.Read(data)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0)
+			if !c.Check(err, check.IsNil) {
+				return
+			}
+			defer f.Close()
+			for off := 0; off < len(data); off += 100 {
+				end := off + 100
+				if end > len(data) {
+					end = len(data)
+				}
+				_, err = f.Write(data[off:end])
+				if !c.Check(err, check.IsNil) {
+					return
+				}
+			}
+		}(fmt.Sprintf("file%d", i))
+	}
+	wg.Wait()
+	c.Check(fs.Sync(), check.IsNil)
+	close(stop)
+	<-toggled
+
+	m, err := fs.MarshalManifest(".")
+	c.Assert(err, check.IsNil)
+	persisted, err := (&Collection{ManifestText: m}).FileSystem(s.client, s.kc)
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 4; i++ {
+		f, err := persisted.Open(fmt.Sprintf("file%d", i))
+		c.Assert(err, check.IsNil)
+		buf, err := ioutil.ReadAll(f)
+		c.Check(err, check.IsNil)
+		c.Check(bytes.Equal(buf, data), check.Equals, true)
+		f.Close()
+	}
+}
+
+func (s *CollectionFSSuite) TestReadAhead(c *check.C) {
+	var locators []string
+	for _, data := range []string{"foo", "barbar", "bazbazbaz", "waz"} {
+		locator, _, err := s.kc.PutB([]byte(data))
+		c.Assert(err, check.IsNil)
+		locators = append(locators, locator[:32])
+	}
+	m := fmt.Sprintf(". %s+3 %s+6 %s+9 %s+3 0:21:file\n", locators[0], locators[1], locators[2], locators[3])
+	fs, err := (&Collection{ManifestText: m}).FileSystem(s.client, s.kc)
+	c.Assert(err, check.IsNil)
+	fs.SetReadAhead(ReadAhead{Blocks: 10, Bytes: 15})
+
+	f, err := fs.Open("file")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	buf := make([]byte, 1)
+	_, err = f.Read(buf)
+	c.Check(err, check.IsNil)
+	// The next 15 bytes of blocks don't include the last block.
+	c.Check(s.kc.prefetched, check.DeepEquals, []string{locators[1], locators[2]})
+
+	// After seeking, there is no read-ahead until a sequential
+	// read.
+	s.kc.prefetched = nil
+	_, err = f.Seek(10, io.SeekStart)
+	c.Check(err, check.IsNil)
+	_, err = f.Read(buf)
+	c.Check(err, check.IsNil)
+	c.Check(s.kc.prefetched, check.HasLen, 0)
+	_, err = f.Read(buf)
+	c.Check(err, check.IsNil)
+	c.Check(s.kc.prefetched, check.DeepEquals, []string{locators[3]})
+
+	data, err := ioutil.ReadAll(f)
+	c.Check(err, check.IsNil)
+	c.Check(string(data), check.Equals, "bazbazwaz")
+
+	// Read-ahead is disabled by default.
+	s.kc.prefetched = nil
+	fs, err = (&Collection{ManifestText: m}).FileSystem(s.client, s.kc)
+	c.Assert(err, check.IsNil)
+	f, err = fs.Open("file")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	data, err = ioutil.ReadAll(f)
+	c.Check(err, check.IsNil)
+	c.Check(string(data), check.Equals, "foobarbarbazbazbazwaz")
+	c.Check(s.kc.prefetched, check.HasLen, 0)
+}
+
 func (s *CollectionFSSuite) TestMkdir(c *check.C) {
 	err := s.fs.Mkdir("foo/bar", 0755)
 	c.Check(err, check.Equals, os.ErrNotExist)
@@ -1154,6 +1361,41 @@ func (s *CollectionFSSuite) TestEdgeCaseManifests(c *check.C) {
 	}
 }
 
+func (s *CollectionFSSuite) TestETag(c *check.C) {
+	etag := func(fs FileSystem, name string) string {
+		fi, err := fs.Stat(name)
+		c.Assert(err, check.IsNil)
+		return fi.(interface{ ETag() string }).ETag()
+	}
+	fs1, err := (&Collection{ManifestText: ". 3858f62230ac3c915f300c664312c63f+6+A12345@abcde 0:3:foo 3:3:bar 0:3:foo2\n"}).FileSystem(s.client, s.kc)
+	c.Assert(err, check.IsNil)
+	fs2, err := (&Collection{ManifestText: "./dir 3858f62230ac3c915f300c664312c63f+6+Afedcba@12345 0:3:foo\n"}).FileSystem(s.client, s.kc)
+	c.Assert(err, check.IsNil)
+
+	foo := etag(fs1, "foo")
+	c.Check(foo, check.Matches, `"[0-9a-f]{32}"`)
+	c.Check(etag(fs1, "foo2"), check.Equals, foo)
+	c.Check(etag(fs2, "dir/foo"), check.Equals, foo)
+	c.Check(etag(fs1, "bar"), check.Not(check.Equals), foo)
+
+	// A FileInfo reports the ETag of the file as it was when
+	// Stat was called
+	fi, err := fs1.Stat("foo")
+	c.Assert(err, check.IsNil)
+
+	f, err := fs1.OpenFile("foo", os.O_WRONLY|os.O_APPEND, 0)
+	c.Assert(err, check.IsNil)
+	_, err = f.Write([]byte("baz"))
+	c.Assert(err, check.IsNil)
+	c.Assert(f.Close(), check.IsNil)
+	c.Check(etag(fs1, "foo"), check.Equals, "")
+	c.Check(fi.(interface{ ETag() string }).ETag(), check.Equals, foo)
+	_, err = fs1.(CollectionFileSystem).MarshalManifest(".")
+	c.Assert(err, check.IsNil)
+	c.Check(etag(fs1, "foo"), check.Matches, `"[0-9a-f]{32}"`)
+	c.Check(etag(fs1, "foo"), check.Not(check.Equals), foo)
+}
+
 func (s *CollectionFSSuite) checkMemSize(c *check.C, f File) {
 	fn := f.(*filehandle).inode.(*filenode)
 	var memsize int64
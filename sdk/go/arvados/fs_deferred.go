@@ -39,6 +39,7 @@ func deferredCollectionFS(fs FileSystem, parent inode, coll Collection) inode {
 			log.Printf("BUG: unhandled error: %s", err)
 			return placeholder
 		}
+		cfs.SetReadAhead(fs.readAhead())
 		root := cfs.rootnode()
 		root.SetParent(parent, coll.Name)
 		return root
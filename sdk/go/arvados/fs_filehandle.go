@@ -16,6 +16,10 @@ type filehandle struct {
 	readable   bool
 	writable   bool
 	unreaddirs []os.FileInfo
+
+	// File offset through which data has been prefetched, or
+	// -1 if the last operation was a seek.
+	prefetched int64
 }
 
 func (f *filehandle) Read(p []byte) (n int, err error) {
@@ -25,6 +29,16 @@ func (f *filehandle) Read(p []byte) (n int, err error) {
 	f.inode.RLock()
 	defer f.inode.RUnlock()
 	n, f.ptr, err = f.inode.Read(p, f.ptr)
+	if fn, ok := f.inode.(*filenode); ok && n > 0 {
+		if f.prefetched < 0 {
+			// First read after a seek: don't prefetch
+			// until the next read shows that access is
+			// sequential.
+			f.prefetched = f.ptr.off
+		} else {
+			f.prefetched = fn.prefetch(f.ptr, f.prefetched)
+		}
+	}
 	return
 }
 
@@ -47,6 +61,7 @@ func (f *filehandle) Seek(off int64, whence int) (pos int64, err error) {
 		// force filenode to recompute f.ptr fields on next
 		// use
 		f.ptr.repacked = -1
+		f.prefetched = -1
 	}
 	return f.ptr.off, nil
 }
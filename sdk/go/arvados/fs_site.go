@@ -16,6 +16,14 @@ type CustomFileSystem interface {
 	MountByID(mount string)
 	MountProject(mount, uuid string)
 	MountUsers(mount string)
+
+	// Return the collection that contains the named file or
+	// directory: its UUID ("" if it was loaded by PDH), its
+	// filesystem, and the path of the named file relative to the
+	// collection's root directory ("" for the root directory
+	// itself). Return ErrInvalidArgument if the named file is
+	// not inside a collection.
+	LookupCollection(name string) (uuid string, cfs CollectionFileSystem, relpath string, err error)
 }
 
 type customFileSystem struct {
@@ -105,6 +113,29 @@ func (c *Client) SiteFileSystem(kc keepClient) CustomFileSystem {
 	return fs
 }
 
+func (fs *customFileSystem) LookupCollection(name string) (string, CollectionFileSystem, string, error) {
+	f, err := fs.openFile(strings.TrimSuffix(name, "/"), os.O_RDONLY, 0)
+	if err != nil {
+		return "", nil, "", err
+	}
+	defer f.Close()
+	node := f.inode
+	// If node is a deferred collection, load it now so FS()
+	// returns the collection filesystem.
+	node.RLock()
+	node.RUnlock()
+	cfs, ok := node.FS().(*collectionFileSystem)
+	if !ok {
+		return "", nil, "", ErrInvalidArgument
+	}
+	var elems []string
+	for node.Parent().FS() == node.FS() && node.Parent() != node {
+		elems = append([]string{node.FileInfo().Name()}, elems...)
+		node = node.Parent()
+	}
+	return cfs.uuid, cfs, strings.Join(elems, "/"), nil
+}
+
 func (fs *customFileSystem) Sync() error {
 	fs.staleLock.Lock()
 	defer fs.staleLock.Unlock()
@@ -125,7 +156,9 @@ func (fs *customFileSystem) newNode(name string, perm os.FileMode, modTime time.
 }
 
 func (fs *customFileSystem) mountByID(parent inode, id string) inode {
-	if strings.Contains(id, "-4zz18-") || pdhRegexp.MatchString(id) {
+	if uuid, version, ok := ParseCollectionVersion(id); ok {
+		return fs.mountCollectionVersion(parent, id, uuid, version)
+	} else if strings.Contains(id, "-4zz18-") || pdhRegexp.MatchString(id) {
 		return fs.mountCollection(parent, id)
 	} else if strings.Contains(id, "-j7d0g-") {
 		return fs.newProjectNode(fs.root, id, id)
@@ -144,11 +177,36 @@ func (fs *customFileSystem) mountCollection(parent inode, id string) inode {
 	if err != nil {
 		return nil
 	}
+	cfs.SetReadAhead(fs.readAhead())
 	root := cfs.rootnode()
 	root.SetParent(parent, id)
 	return root
 }
 
+// mountCollectionVersion mounts the given version of a collection,
+// which can be the current version or a preserved past version, as
+// id (e.g., "zzzzz-4zz18-xxxxxxxxxxxxxxx@3").
+func (fs *customFileSystem) mountCollectionVersion(parent inode, id, uuid string, version int) inode {
+	var colls CollectionList
+	err := fs.RequestAndDecode(&colls, "GET", "arvados/v1/collections", nil, ResourceListParams{
+		Filters: []Filter{
+			{"current_version_uuid", "=", uuid},
+			{"version", "=", version},
+		},
+		IncludeOldVersions: true,
+		Select:             []string{"uuid"},
+	})
+	if err != nil || len(colls.Items) != 1 {
+		return nil
+	}
+	root := fs.mountCollection(parent, colls.Items[0].UUID)
+	if root == nil {
+		return nil
+	}
+	root.SetParent(parent, id)
+	return root
+}
+
 func (fs *customFileSystem) newProjectNode(root inode, name, uuid string) inode {
 	return &lookupnode{
 		stale:   fs.Stale,
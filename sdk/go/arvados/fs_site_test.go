@@ -5,8 +5,10 @@
 package arvados
 
 import (
+	"fmt"
 	"net/http"
 	"os"
+	"path"
 
 	check "gopkg.in/check.v1"
 )
@@ -22,6 +24,7 @@ const (
 	fixtureFooCollectionPDH        = "1f4b0bc7583c2a7f9102c395f4ffc5e3+45"
 	fixtureFooCollection           = "zzzzz-4zz18-fy296fx3hot09f7"
 	fixtureNonexistentCollection   = "zzzzz-4zz18-totallynotexist"
+	fixtureWazCollection           = "zzzzz-4zz18-25k12570yk134b3"
 )
 
 var _ = check.Suite(&SiteFSSuite{})
@@ -58,6 +61,21 @@ func (s *SiteFSSuite) TestByIDEmpty(c *check.C) {
 	c.Check(len(fis), check.Equals, 0)
 }
 
+func (s *SiteFSSuite) TestByIDVersion(c *check.C) {
+	for version, expect := range map[int]string{1: "waz", 2: "w a z"} {
+		f, err := s.fs.Open(fmt.Sprintf("/by_id/%s@%d", fixtureWazCollection, version))
+		c.Assert(err, check.IsNil)
+		fis, err := f.Readdir(-1)
+		c.Check(err, check.IsNil)
+		c.Assert(fis, check.HasLen, 1)
+		c.Check(fis[0].Name(), check.Equals, expect)
+	}
+	for _, id := range []string{fixtureWazCollection + "@3", fixtureWazCollection + "@0", fixtureFooCollectionPDH + "@1"} {
+		_, err := s.fs.Open("/by_id/" + id)
+		c.Check(err, check.Equals, os.ErrNotExist)
+	}
+}
+
 func (s *SiteFSSuite) TestByUUIDAndPDH(c *check.C) {
 	f, err := s.fs.Open("/by_id")
 	c.Assert(err, check.IsNil)
@@ -109,3 +127,33 @@ func (s *SiteFSSuite) TestByUUIDAndPDH(c *check.C) {
 	err = s.fs.Rename("/by_id", "/beep")
 	c.Check(err, check.Equals, ErrInvalidArgument)
 }
+
+func (s *SiteFSSuite) TestLookupCollection(c *check.C) {
+	for _, trial := range []struct {
+		name    string
+		uuid    string
+		relpath string
+	}{
+		{"/by_id/" + fixtureFooCollection, fixtureFooCollection, ""},
+		{"/by_id/" + fixtureFooCollection + "/", fixtureFooCollection, ""},
+		{"/by_id/" + fixtureFooCollection + "/foo", fixtureFooCollection, "foo"},
+		{"/by_id/" + fixtureFooAndBarFilesInDirUUID + "/dir1/bar", fixtureFooAndBarFilesInDirUUID, "dir1/bar"},
+		{"/by_id/" + fixtureAProjectUUID + "/" + fixtureFooCollectionName + "/foo", fixtureFooCollection, "foo"},
+	} {
+		uuid, cfs, relpath, err := s.fs.LookupCollection(trial.name)
+		c.Assert(err, check.IsNil, check.Commentf("%+v", trial))
+		c.Check(uuid, check.Equals, trial.uuid, check.Commentf("%+v", trial))
+		c.Check(relpath, check.Equals, trial.relpath, check.Commentf("%+v", trial))
+		fi, err := cfs.Stat(relpath)
+		if c.Check(err, check.IsNil) && relpath != "" {
+			c.Check(fi.Name(), check.Equals, path.Base(trial.relpath))
+		}
+	}
+
+	for _, name := range []string{"/", "/by_id", "/by_id/" + fixtureAProjectUUID, "/users"} {
+		_, _, _, err := s.fs.LookupCollection(name)
+		c.Check(err, check.Equals, ErrInvalidArgument, check.Commentf("%s", name))
+	}
+	_, _, _, err := s.fs.LookupCollection("/by_id/" + fixtureFooCollection + "/nonexistent")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
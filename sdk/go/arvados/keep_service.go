@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // KeepService is an arvados#keepService record
@@ -104,6 +105,25 @@ func (s *KeepService) IndexMount(c *Client, mountUUID string, prefix string) ([]
 	return s.index(c, s.url("mounts/"+mountUUID+"/blocks?prefix="+prefix))
 }
 
+// IndexMountSince is like IndexMount, but only returns blocks with an
+// mtime at or after since. A zero since means all blocks. (Keepstore
+// servers that don't support this return all blocks.)
+//
+// It also returns the mount's index generation reported by the
+// server, which changes whenever blocks are removed from the mount,
+// or "" if the server doesn't report one.
+func (s *KeepService) IndexMountSince(c *Client, mountUUID string, prefix string, since time.Time) ([]KeepServiceIndexEntry, string, error) {
+	url := s.url("mounts/" + mountUUID + "/blocks?prefix=" + prefix)
+	if !since.IsZero() {
+		url += fmt.Sprintf("&since=%d", since.UnixNano())
+	}
+	entries, hdr, err := s.indexWithHeader(c, url)
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, hdr.Get("X-Keep-Index-Generation"), nil
+}
+
 // Index returns an unsorted list of blocks that can be retrieved from
 // this server.
 func (s *KeepService) Index(c *Client, prefix string) ([]KeepServiceIndexEntry, error) {
@@ -111,15 +131,20 @@ func (s *KeepService) Index(c *Client, prefix string) ([]KeepServiceIndexEntry,
 }
 
 func (s *KeepService) index(c *Client, url string) ([]KeepServiceIndexEntry, error) {
+	entries, _, err := s.indexWithHeader(c, url)
+	return entries, err
+}
+
+func (s *KeepService) indexWithHeader(c *Client, url string) ([]KeepServiceIndexEntry, http.Header, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("NewRequest(%v): %v", url, err)
+		return nil, nil, fmt.Errorf("NewRequest(%v): %v", url, err)
 	}
 	resp, err := c.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("Do(%v): %v", url, err)
+		return nil, nil, fmt.Errorf("Do(%v): %v", url, err)
 	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("%v: %d %v", url, resp.StatusCode, resp.Status)
+		return nil, nil, fmt.Errorf("%v: %d %v", url, resp.StatusCode, resp.Status)
 	}
 	defer resp.Body.Close()
 
@@ -135,7 +160,7 @@ func (s *KeepService) index(c *Client, url string) ([]KeepServiceIndexEntry, err
 			break
 		}
 		if sawEOF {
-			return nil, fmt.Errorf("Index response contained non-terminal blank line")
+			return nil, nil, fmt.Errorf("Index response contained non-terminal blank line")
 		}
 		line := scanner.Text()
 		if line == "" {
@@ -144,11 +169,11 @@ func (s *KeepService) index(c *Client, url string) ([]KeepServiceIndexEntry, err
 		}
 		fields := strings.Split(line, " ")
 		if len(fields) != 2 {
-			return nil, fmt.Errorf("Malformed index line %q: %d fields", line, len(fields))
+			return nil, nil, fmt.Errorf("Malformed index line %q: %d fields", line, len(fields))
 		}
 		mtime, err := strconv.ParseInt(fields[1], 10, 64)
 		if err != nil {
-			return nil, fmt.Errorf("Malformed index line %q: mtime: %v", line, err)
+			return nil, nil, fmt.Errorf("Malformed index line %q: mtime: %v", line, err)
 		}
 		if mtime < 1e12 {
 			// An old version of keepstore is giving us
@@ -164,10 +189,10 @@ func (s *KeepService) index(c *Client, url string) ([]KeepServiceIndexEntry, err
 		})
 	}
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("Error scanning index response: %v", err)
+		return nil, nil, fmt.Errorf("Error scanning index response: %v", err)
 	}
 	if !sawEOF {
-		return nil, fmt.Errorf("Index response had no EOF marker")
+		return nil, nil, fmt.Errorf("Index response had no EOF marker")
 	}
-	return entries, nil
+	return entries, resp.Header, nil
 }
@@ -4,6 +4,8 @@
 
 package arvados
 
+import "time"
+
 // Link is an arvados#link record
 type Link struct {
 	UUID      string `json:"uuid,omiempty"`
@@ -14,6 +16,9 @@ type Link struct {
 	HeadKind  string `json:"head_kind"`
 	TailUUID  string `json:"tail_uuid"`
 	TailKind  string `json:"tail_kind"`
+
+	CreatedAt  *time.Time             `json:"created_at"`
+	Properties map[string]interface{} `json:"properties"`
 }
 
 // UserList is an arvados#userList resource.
@@ -20,6 +20,11 @@ type BlockCache struct {
 	// default size (currently 4) is used instead.
 	MaxBlocks int
 
+	// If not nil, blocks retrieved from Keep are also stored on
+	// disk, and blocks are read from disk (when available)
+	// instead of Keep.
+	DiskCache *DiskCache
+
 	cache map[string]*cacheBlock
 	mtx   sync.Mutex
 }
@@ -67,6 +72,27 @@ func (c *BlockCache) ReadAt(kc *KeepClient, locator string, p []byte, off int) (
 // Get returns data from the cache, first retrieving it from Keep if
 // necessary.
 func (c *BlockCache) Get(kc *KeepClient, locator string) ([]byte, error) {
+	b := c.fetch(kc, locator)
+
+	// Wait (with mtx unlocked) for the fetch goroutine to finish,
+	// in case it hasn't already.
+	<-b.fetched
+
+	c.mtx.Lock()
+	b.lastUse = time.Now()
+	c.mtx.Unlock()
+	return b.data, b.err
+}
+
+// Prefetch starts retrieving a block from Keep, unless it is already
+// in the cache, and returns without waiting for the data to arrive.
+func (c *BlockCache) Prefetch(kc *KeepClient, locator string) {
+	c.fetch(kc, locator)
+}
+
+// fetch returns the cache entry for the given block, starting a fetch
+// goroutine if the block is not cached or the last attempt failed.
+func (c *BlockCache) fetch(kc *KeepClient, locator string) *cacheBlock {
 	cacheKey := locator[:32]
 	bufsize := BLOCKSIZE
 	if parts := strings.SplitN(locator, "+", 3); len(parts) >= 2 {
@@ -87,14 +113,12 @@ func (c *BlockCache) Get(kc *KeepClient, locator string) ([]byte, error) {
 		}
 		c.cache[cacheKey] = b
 		go func() {
-			rdr, size, _, err := kc.Get(locator)
-			var data []byte
-			if err == nil {
-				data = make([]byte, size, bufsize)
-				_, err = io.ReadFull(rdr, data)
-				err2 := rdr.Close()
+			var err error
+			data := c.DiskCache.get(locator)
+			if data == nil {
+				data, err = c.getFromKeep(kc, locator, bufsize)
 				if err == nil {
-					err = err2
+					c.DiskCache.put(locator, data)
 				}
 			}
 			c.mtx.Lock()
@@ -105,17 +129,25 @@ func (c *BlockCache) Get(kc *KeepClient, locator string) ([]byte, error) {
 		}()
 	}
 	c.mtx.Unlock()
+	return b
+}
 
-	// Wait (with mtx unlocked) for the fetch goroutine to finish,
-	// in case it hasn't already.
-	<-b.fetched
-
-	c.mtx.Lock()
-	b.lastUse = time.Now()
-	c.mtx.Unlock()
-	return b.data, b.err
+func (c *BlockCache) getFromKeep(kc *KeepClient, locator string, bufsize int) ([]byte, error) {
+	rdr, size, _, err := kc.Get(locator)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size, bufsize)
+	_, err = io.ReadFull(rdr, data)
+	err2 := rdr.Close()
+	if err == nil {
+		err = err2
+	}
+	return data, err
 }
 
+// Clear deletes all blocks from the in-memory cache. It does not
+// affect DiskCache.
 func (c *BlockCache) Clear() {
 	c.mtx.Lock()
 	c.cache = nil
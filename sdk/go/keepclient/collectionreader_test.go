@@ -14,7 +14,9 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
 	check "gopkg.in/check.v1"
@@ -277,6 +279,53 @@ func (s *CollectionReaderUnit) TestCollectionReaderCloseEarly(c *check.C) {
 	c.Check(*s.handler.ops, check.Equals, opsBeforeRead+1)
 }
 
+func (s *CollectionReaderUnit) TestCollectionReaderReadAhead(c *check.C) {
+	s.kc.BlockCache = &BlockCache{MaxBlocks: 8}
+	s.kc.PutB([]byte("foo"))
+	s.kc.PutB([]byte("bar"))
+	s.kc.PutB([]byte("baz"))
+	s.kc.PutB([]byte("waz"))
+	mt := ". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 73feffa4b7f6bb68e44cf984c85f6e88+3 4d20280d5e516a0109768d49ab0f3318+3 0:12:foo.txt\n"
+	fs, err := (&arvados.Collection{ManifestText: mt}).FileSystem(nil, s.kc)
+	c.Assert(err, check.IsNil)
+	fs.SetReadAhead(arvados.ReadAhead{Blocks: 2})
+
+	countOps := func() int {
+		s.handler.lock <- struct{}{}
+		defer func() { <-s.handler.lock }()
+		return *s.handler.ops
+	}
+	waitOps := func(want int) {
+		for deadline := time.Now().Add(5 * time.Second); countOps() < want && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		c.Check(countOps(), check.Equals, want)
+	}
+
+	f, err := fs.Open("foo.txt")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	opsBeforeRead := countOps()
+	buf := make([]byte, 1)
+	_, err = f.Read(buf)
+	c.Assert(err, check.IsNil)
+	// The first read fetches "foo", and prefetches "bar" and
+	// "baz" but not "waz".
+	waitOps(opsBeforeRead + 3)
+
+	buf = make([]byte, 5)
+	_, err = io.ReadFull(f, buf)
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "oobar")
+	// Reading "bar" prefetches "waz".
+	waitOps(opsBeforeRead + 4)
+
+	buf, err = ioutil.ReadAll(f)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "bazwaz")
+	c.Check(countOps(), check.Equals, opsBeforeRead+4)
+}
+
 func (s *CollectionReaderUnit) TestCollectionReaderDataError(c *check.C) {
 	manifest := ". ffffffffffffffffffffffffffffffff+1 0:1:notfound.txt\n"
 	buf := make([]byte, 1)
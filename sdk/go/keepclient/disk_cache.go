@@ -0,0 +1,229 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDiskCacheBytes = 1 << 30
+
+// Temporary files older than this are assumed to have been abandoned
+// by crashed processes, and are deleted by Tidy.
+const diskCacheStaleTmp = time.Hour
+
+var errDiskCacheCorrupt = errors.New("cached block content does not match locator")
+
+// DiskCache stores blocks as files in a local directory, so they can
+// be reused after a process restarts. Several processes (on the same
+// host, running as the same user) can share a DiskCache directory:
+// blocks are written to temporary files and then renamed into place,
+// so readers never see partially written blocks, and every block is
+// checked against its hash when it is read.
+//
+// The cache is private to the user who owns it. Cached blocks are
+// only readable by that user, and the directories created by Put are
+// only accessible to that user, so processes running as other users
+// cannot share the directory.
+type DiskCache struct {
+	// Directory where blocks are stored. It is created (with
+	// mode 0700) if it does not exist.
+	Dir string
+
+	// Maximum total size of the cached blocks. If 0, a default
+	// size (currently 1 GiB) is used instead. The limit is
+	// enforced by Tidy, which runs automatically after enough
+	// blocks have been written, so it may be exceeded briefly.
+	MaxBytes int64
+
+	written int64 // bytes written since the last Tidy
+	tidying bool
+	mtx     sync.Mutex
+}
+
+func (dc *DiskCache) maxBytes() int64 {
+	if dc.MaxBytes > 0 {
+		return dc.MaxBytes
+	}
+	return defaultDiskCacheBytes
+}
+
+// path returns the filename used to store the block with the given
+// locator: Dir/abc/abc01234...
+func (dc *DiskCache) path(locator string) (string, error) {
+	if len(locator) < 32 {
+		return "", fmt.Errorf("invalid locator %q", locator)
+	}
+	hash := locator[:32]
+	return filepath.Join(dc.Dir, hash[:3], hash), nil
+}
+
+// Get returns the data for the given block, if it is in the
+// cache. If the block is not cached, the returned error satisfies
+// os.IsNotExist(). If the cached data does not match the locator, the
+// cache file is deleted and an error is returned.
+func (dc *DiskCache) Get(locator string) ([]byte, error) {
+	fnm, err := dc.path(locator)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(fnm)
+	if err != nil {
+		return nil, err
+	}
+	if fmt.Sprintf("%x", md5.Sum(data)) != locator[:32] {
+		os.Remove(fnm)
+		return nil, errDiskCacheCorrupt
+	}
+	// Update mtime so Tidy deletes the least recently used
+	// blocks first.
+	now := time.Now()
+	os.Chtimes(fnm, now, now)
+	return data, nil
+}
+
+// Put stores a block in the cache. The caller is responsible for
+// ensuring data matches the locator.
+func (dc *DiskCache) Put(locator string, data []byte) error {
+	fnm, err := dc.path(locator)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(fnm)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	_, err = tmp.Write(data)
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), fnm)
+	if err != nil {
+		return err
+	}
+
+	dc.mtx.Lock()
+	dc.written += int64(len(data))
+	startTidy := !dc.tidying && dc.written > dc.maxBytes()/10
+	if startTidy {
+		dc.tidying = true
+		dc.written = 0
+	}
+	dc.mtx.Unlock()
+	if startTidy {
+		go func() {
+			err := dc.Tidy()
+			if err != nil {
+				DebugPrintf("DEBUG: tidy disk cache %s: %v", dc.Dir, err)
+			}
+			dc.mtx.Lock()
+			dc.tidying = false
+			dc.mtx.Unlock()
+		}()
+	}
+	return nil
+}
+
+// get is like Get, but returns nil if dc is nil or the block is not
+// available, and logs errors other than "not cached".
+func (dc *DiskCache) get(locator string) []byte {
+	if dc == nil {
+		return nil
+	}
+	data, err := dc.Get(locator)
+	if err != nil && !os.IsNotExist(err) {
+		DebugPrintf("DEBUG: disk cache %s: get %s: %v", dc.Dir, locator, err)
+	}
+	return data
+}
+
+// put is like Put, but does nothing if dc is nil, and logs errors
+// instead of returning them.
+func (dc *DiskCache) put(locator string, data []byte) {
+	if dc == nil {
+		return
+	}
+	if err := dc.Put(locator, data); err != nil {
+		DebugPrintf("DEBUG: disk cache %s: put %s: %v", dc.Dir, locator, err)
+	}
+}
+
+// Tidy deletes the least recently used blocks until the total size of
+// the cached blocks is no more than MaxBytes. It also deletes
+// temporary files left behind by crashed processes.
+//
+// Tidy can safely run at the same time as Get and Put, in this
+// process and others.
+func (dc *DiskCache) Tidy() error {
+	type entry struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var ents []entry
+	var total int64
+	err := filepath.Walk(dc.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Deleted by another process.
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".tmp-") {
+			if time.Since(info.ModTime()) > diskCacheStaleTmp {
+				os.Remove(path)
+			}
+			return nil
+		}
+		ents = append(ents, entry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	max := dc.maxBytes()
+	if total <= max {
+		return nil
+	}
+	sort.Slice(ents, func(i, j int) bool {
+		return ents[i].mtime.Before(ents[j].mtime)
+	})
+	for _, ent := range ents {
+		if total <= max {
+			break
+		}
+		err := os.Remove(ent.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= ent.size
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&DiskCacheSuite{})
+
+type DiskCacheSuite struct {
+	dir string
+}
+
+func (s *DiskCacheSuite) SetUpTest(c *check.C) {
+	s.dir = c.MkDir()
+}
+
+func diskCacheLocator(data []byte) string {
+	return fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+}
+
+func (s *DiskCacheSuite) TestPutGet(c *check.C) {
+	dc := &DiskCache{Dir: s.dir}
+	data := []byte("foo")
+	loc := diskCacheLocator(data)
+
+	_, err := dc.Get(loc)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	c.Assert(dc.Put(loc, data), check.IsNil)
+	got, err := dc.Get(loc + "+Afakesignature@12345678")
+	c.Check(err, check.IsNil)
+	c.Check(string(got), check.Equals, "foo")
+
+	// Another DiskCache using the same directory (e.g., in a
+	// different process) sees the same blocks.
+	got, err = (&DiskCache{Dir: s.dir}).Get(loc)
+	c.Check(err, check.IsNil)
+	c.Check(string(got), check.Equals, "foo")
+
+	// Corrupt data is detected and removed.
+	fnm := filepath.Join(s.dir, loc[:3], loc[:32])
+	c.Assert(ioutil.WriteFile(fnm, []byte("bar"), 0600), check.IsNil)
+	_, err = dc.Get(loc)
+	c.Check(err, check.Equals, errDiskCacheCorrupt)
+	_, err = os.Stat(fnm)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *DiskCacheSuite) TestTidy(c *check.C) {
+	dc := &DiskCache{Dir: s.dir, MaxBytes: 10}
+	var locs []string
+	for i, data := range []string{"aaaa", "bbbb", "cccc", "dddd"} {
+		loc := diskCacheLocator([]byte(data))
+		locs = append(locs, loc)
+		c.Assert(dc.Put(loc, []byte(data)), check.IsNil)
+		t := time.Now().Add(time.Duration(i-10) * time.Minute)
+		c.Assert(os.Chtimes(filepath.Join(s.dir, loc[:3], loc[:32]), t, t), check.IsNil)
+	}
+	// Reading "aaaa" makes it the most recently used.
+	_, err := dc.Get(locs[0])
+	c.Check(err, check.IsNil)
+
+	// Abandoned temp files are removed, recent ones are not.
+	stale := filepath.Join(s.dir, ".tmp-stale")
+	c.Assert(ioutil.WriteFile(stale, nil, 0600), check.IsNil)
+	t := time.Now().Add(-2 * diskCacheStaleTmp)
+	c.Assert(os.Chtimes(stale, t, t), check.IsNil)
+	recent := filepath.Join(s.dir, ".tmp-recent")
+	c.Assert(ioutil.WriteFile(recent, nil, 0600), check.IsNil)
+
+	c.Check(dc.Tidy(), check.IsNil)
+	for i, loc := range locs {
+		_, err := dc.Get(loc)
+		if i == 1 || i == 2 {
+			c.Check(os.IsNotExist(err), check.Equals, true, check.Commentf("%d", i))
+		} else {
+			c.Check(err, check.IsNil, check.Commentf("%d", i))
+		}
+	}
+	_, err = os.Stat(stale)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	_, err = os.Stat(recent)
+	c.Check(err, check.IsNil)
+}
+
+func (s *DiskCacheSuite) TestBlockCache(c *check.C) {
+	data := []byte("foo")
+	loc := diskCacheLocator(data)
+	c.Assert((&DiskCache{Dir: s.dir}).Put(loc, data), check.IsNil)
+
+	// No keep services are configured, so the block can only
+	// come from the disk cache.
+	kc := &KeepClient{}
+	kc.SetServiceRoots(map[string]string{}, map[string]string{}, nil)
+	bc := &BlockCache{DiskCache: &DiskCache{Dir: s.dir}}
+	got, err := bc.Get(kc, loc)
+	c.Check(err, check.IsNil)
+	c.Check(string(got), check.Equals, "foo")
+
+	_, err = bc.Get(kc, diskCacheLocator([]byte("bar")))
+	c.Check(err, check.NotNil)
+}
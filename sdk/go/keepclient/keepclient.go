@@ -7,6 +7,7 @@ package keepclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"errors"
 	"fmt"
@@ -84,6 +85,9 @@ var ErrIncompleteIndex = errors.New("Got incomplete index")
 
 const X_Keep_Desired_Replicas = "X-Keep-Desired-Replicas"
 const X_Keep_Replicas_Stored = "X-Keep-Replicas-Stored"
+const X_Keep_Forward = "X-Keep-Forward"
+const X_Keep_Storage_Classes = "X-Keep-Storage-Classes"
+const X_Keep_Storage_Classes_Confirmed = "X-Keep-Storage-Classes-Confirmed"
 
 type HTTPClient interface {
 	Do(*http.Request) (*http.Response, error)
@@ -101,7 +105,15 @@ type KeepClient struct {
 	Retries            int
 	BlockCache         *BlockCache
 	RequestID          string
-	StorageClasses     []string
+
+	// Storage classes to write each block to. If set, each class
+	// must have Want_replicas replicas before a write succeeds.
+	StorageClasses []string
+
+	// If true, send each block to a single keep server and ask
+	// it to forward copies to other servers until Want_replicas
+	// is reached, instead of uploading each replica separately.
+	ForwardReplicas bool
 
 	// set to 1 if all writable services are of disk type, otherwise 0
 	replicasPerService int
@@ -111,6 +123,12 @@ type KeepClient struct {
 
 	// Disable automatic discovery of keep services
 	disableDiscovery bool
+
+	// If non-zero, when a GET or HEAD request to one keep server
+	// has not succeeded or failed after HedgeDelay, send the same
+	// request to the next server as well, and use whichever
+	// response succeeds first.
+	HedgeDelay time.Duration
 }
 
 // MakeKeepClient creates a new KeepClient, calls
@@ -139,6 +157,20 @@ func New(arv *arvadosclient.ArvadosClient) *KeepClient {
 	}
 }
 
+// PutResult describes the replicas written by a Put call.
+type PutResult struct {
+	// Locator for the written block.
+	Locator string
+
+	// Total number of replicas written.
+	Replicas int
+
+	// Number of replicas written in each storage class, as
+	// confirmed by the keep servers. Replicas written by servers
+	// that don't report storage classes are not counted here.
+	StorageClasses map[string]int
+}
+
 // Put a block given the block hash, a reader, and the number of bytes
 // to read from the reader (which must be between 0 and BLOCKSIZE).
 //
@@ -148,11 +180,18 @@ func New(arv *arvadosclient.ArvadosClient) *KeepClient {
 // Returns an InsufficientReplicasError if 0 <= replicas <
 // kc.Wants_replicas.
 func (kc *KeepClient) PutHR(hash string, r io.Reader, dataBytes int64) (string, int, error) {
+	result, err := kc.PutHRResult(hash, r, dataBytes)
+	return result.Locator, result.Replicas, err
+}
+
+// PutHRResult is like PutHR, but also reports the number of
+// replicas written in each storage class.
+func (kc *KeepClient) PutHRResult(hash string, r io.Reader, dataBytes int64) (PutResult, error) {
 	// Buffer for reads from 'r'
 	var bufsize int
 	if dataBytes > 0 {
 		if dataBytes > BLOCKSIZE {
-			return "", 0, ErrOversizeBlock
+			return PutResult{}, ErrOversizeBlock
 		}
 		bufsize = int(dataBytes)
 	} else {
@@ -172,6 +211,13 @@ func (kc *KeepClient) PutHR(hash string, r io.Reader, dataBytes int64) (string,
 //
 // Return values are the same as for PutHR.
 func (kc *KeepClient) PutHB(hash string, buf []byte) (string, int, error) {
+	result, err := kc.PutHBResult(hash, buf)
+	return result.Locator, result.Replicas, err
+}
+
+// PutHBResult is like PutHB, but also reports the number of
+// replicas written in each storage class.
+func (kc *KeepClient) PutHBResult(hash string, buf []byte) (PutResult, error) {
 	newReader := func() io.Reader { return bytes.NewBuffer(buf) }
 	return kc.putReplicas(hash, newReader, int64(len(buf)))
 }
@@ -198,6 +244,39 @@ func (kc *KeepClient) PutR(r io.Reader) (locator string, replicas int, err error
 	}
 }
 
+// getAttempt is the outcome of a GET or HEAD request to one server.
+type getAttempt struct {
+	host      string
+	resp      *http.Response
+	err       error
+	latency   time.Duration
+	cancelled bool // request was abandoned before it got a response
+}
+
+// failed returns true if the attempt failed in a way that reflects on
+// the server's health (a network error, or a 408, 429, or 5xx
+// response).
+func (attempt getAttempt) failed() bool {
+	if attempt.err != nil {
+		return true
+	}
+	code := attempt.resp.StatusCode
+	return code == 408 || code == 429 || code >= 500
+}
+
+// cancelOnClose is a response body that cancels the request's
+// context when it is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
 func (kc *KeepClient) getOrHead(method string, locator string, header http.Header) (io.ReadCloser, int64, string, http.Header, error) {
 	if strings.HasPrefix(locator, "d41d8cd98f00b204e9800998ecf8427e+0") {
 		return ioutil.NopCloser(bytes.NewReader(nil)), 0, "", nil, nil
@@ -218,7 +297,7 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 
 	tries_remaining := 1 + kc.Retries
 
-	serversToTry := kc.getSortedRoots(locator)
+	serversToTry := serverStats.healthyFirst(kc.getSortedRoots(locator))
 
 	numServers := len(serversToTry)
 	count404 := 0
@@ -229,50 +308,132 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 		tries_remaining -= 1
 		retryList = nil
 
-		for _, host := range serversToTry {
-			url := host + "/" + locator
-
-			req, err := http.NewRequest(method, url, nil)
-			if err != nil {
-				errs = append(errs, fmt.Sprintf("%s: %v", url, err))
-				continue
+		// Send a request to each server in turn, until one
+		// succeeds. If HedgeDelay is set, don't wait more
+		// than HedgeDelay for one server before sending a
+		// request to the next.
+		results := make(chan getAttempt, len(serversToTry))
+		cancels := map[string]context.CancelFunc{}
+		next := 0
+		var winner *getAttempt
+		var hedge <-chan time.Time
+		for winner == nil {
+			startNext := len(cancels) == 0
+			if !startNext {
+				select {
+				case <-hedge:
+					startNext = true
+				case attempt := <-results:
+					cancel := cancels[attempt.host]
+					delete(cancels, attempt.host)
+					resp, err := attempt.resp, attempt.err
+					url := attempt.host + "/" + locator
+					if err != nil {
+						// Probably a network error, may be transient,
+						// can try again.
+						cancel()
+						serverStats.recordResult(attempt.host, true, attempt.latency)
+						errs = append(errs, fmt.Sprintf("%s: %v", url, err))
+						retryList = append(retryList, attempt.host)
+						continue
+					}
+					if resp.StatusCode != http.StatusOK {
+						var respbody []byte
+						respbody, _ = ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 4096})
+						resp.Body.Close()
+						cancel()
+						errs = append(errs, fmt.Sprintf("%s: HTTP %d %q",
+							url, resp.StatusCode, bytes.TrimSpace(respbody)))
+
+						if attempt.failed() {
+							// Timeout, too many requests, or other
+							// server side failure, transient
+							// error, can try again.
+							serverStats.recordResult(attempt.host, true, attempt.latency)
+							retryList = append(retryList, attempt.host)
+						} else {
+							serverStats.recordResult(attempt.host, false, attempt.latency)
+							if resp.StatusCode == 404 {
+								count404++
+							}
+						}
+						continue
+					}
+					serverStats.recordResult(attempt.host, false, attempt.latency)
+					// Release the request context when
+					// the caller closes the response body.
+					resp.Body = cancelOnClose{resp.Body, cancel}
+					winner = &attempt
+					continue
+				}
 			}
-			for k, v := range header {
-				req.Header[k] = append([]string(nil), v...)
+			if !startNext {
+				continue
 			}
-			if req.Header.Get("Authorization") == "" {
-				req.Header.Set("Authorization", "OAuth2 "+kc.Arvados.ApiToken)
+			hedged := len(cancels) > 0
+			for ; next < len(serversToTry); next++ {
+				host := serversToTry[next]
+				url := host + "/" + locator
+				req, err := http.NewRequest(method, url, nil)
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("%s: %v", url, err))
+					continue
+				}
+				for k, v := range header {
+					req.Header[k] = append([]string(nil), v...)
+				}
+				if req.Header.Get("Authorization") == "" {
+					req.Header.Set("Authorization", "OAuth2 "+kc.Arvados.ApiToken)
+				}
+				if req.Header.Get("X-Request-Id") == "" {
+					req.Header.Set("X-Request-Id", reqid)
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				cancels[host] = cancel
+				if hedged {
+					serverStats.recordHedged(host)
+				}
+				go func() {
+					t0 := time.Now()
+					resp, err := kc.httpClient().Do(req.WithContext(ctx))
+					results <- getAttempt{host: host, resp: resp, err: err, latency: time.Since(t0), cancelled: err != nil && ctx.Err() != nil}
+				}()
+				next++
+				break
 			}
-			if req.Header.Get("X-Request-Id") == "" {
-				req.Header.Set("X-Request-Id", reqid)
+			if len(cancels) == 0 {
+				// All servers have failed.
+				break
 			}
-			resp, err := kc.httpClient().Do(req)
-			if err != nil {
-				// Probably a network error, may be transient,
-				// can try again.
-				errs = append(errs, fmt.Sprintf("%s: %v", url, err))
-				retryList = append(retryList, host)
-				continue
+			if kc.HedgeDelay > 0 && next < len(serversToTry) {
+				hedge = time.After(kc.HedgeDelay)
+			} else {
+				hedge = nil
 			}
-			if resp.StatusCode != http.StatusOK {
-				var respbody []byte
-				respbody, _ = ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 4096})
-				resp.Body.Close()
-				errs = append(errs, fmt.Sprintf("%s: HTTP %d %q",
-					url, resp.StatusCode, bytes.TrimSpace(respbody)))
-
-				if resp.StatusCode == 408 ||
-					resp.StatusCode == 429 ||
-					resp.StatusCode >= 500 {
-					// Timeout, too many requests, or other
-					// server side failure, transient
-					// error, can try again.
-					retryList = append(retryList, host)
-				} else if resp.StatusCode == 404 {
-					count404++
+		}
+		if len(cancels) > 0 {
+			// Abandon the requests that lost the race.
+			go func(cancels map[string]context.CancelFunc) {
+				for _, cancel := range cancels {
+					cancel()
 				}
-				continue
-			}
+				for range cancels {
+					attempt := <-results
+					if attempt.cancelled {
+						serverStats.recordCancelled(attempt.host, attempt.latency)
+					} else {
+						// Got a response (or error)
+						// before being cancelled.
+						serverStats.recordResult(attempt.host, attempt.failed(), attempt.latency)
+					}
+					if attempt.resp != nil {
+						attempt.resp.Body.Close()
+					}
+				}
+			}(cancels)
+		}
+		if winner != nil {
+			resp, url := winner.resp, winner.host+"/"+locator
 			if expectLength < 0 {
 				if resp.ContentLength < 0 {
 					resp.Body.Close()
@@ -351,6 +512,12 @@ func (kc *KeepClient) ReadAt(locator string, p []byte, off int) (int, error) {
 	return kc.cache().ReadAt(kc, locator, p, off)
 }
 
+// Prefetch() starts retrieving a block into the cache, so a
+// subsequent ReadAt() doesn't have to wait for the network.
+func (kc *KeepClient) Prefetch(locator string) {
+	kc.cache().Prefetch(kc, locator)
+}
+
 // Ask() verifies that a block with the given hash is available and
 // readable, according to at least one Keep service. Unlike Get, it
 // does not retrieve the data or verify that the data content matches
@@ -163,7 +163,7 @@ func (s *StandaloneSuite) TestUploadToStubKeepServer(c *C) {
 
 			<-st.handled
 			status := <-upload_status
-			c.Check(status, DeepEquals, uploadStatus{nil, fmt.Sprintf("%s/%s", url, st.expectPath), 200, 1, ""})
+			c.Check(status, DeepEquals, uploadStatus{nil, fmt.Sprintf("%s/%s", url, st.expectPath), 200, 1, "", nil})
 		})
 }
 
@@ -183,7 +183,7 @@ func (s *StandaloneSuite) TestUploadToStubKeepServerBufferReader(c *C) {
 			<-st.handled
 
 			status := <-upload_status
-			c.Check(status, DeepEquals, uploadStatus{nil, fmt.Sprintf("%s/%s", url, st.expectPath), 200, 1, ""})
+			c.Check(status, DeepEquals, uploadStatus{nil, fmt.Sprintf("%s/%s", url, st.expectPath), 200, 1, "", nil})
 		})
 }
 
@@ -457,6 +457,143 @@ func (s *StandaloneSuite) TestPutWithTooManyFail(c *C) {
 	c.Check(<-st.handled, Equals, ks1[0].url)
 }
 
+// StubForwardPutHandler reports forwardReplicas replicas stored for
+// requests with an X-Keep-Forward header, and 1 otherwise.
+type StubForwardPutHandler struct {
+	forwardReplicas int
+	handled         chan bool
+}
+
+func (sph StubForwardPutHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	forward := req.Header.Get(X_Keep_Forward) == "true"
+	if forward {
+		resp.Header().Set(X_Keep_Replicas_Stored, fmt.Sprint(sph.forwardReplicas))
+	}
+	resp.WriteHeader(200)
+	sph.handled <- forward
+}
+
+func (s *StandaloneSuite) TestPutForwardReplicas(c *C) {
+	for _, trial := range []struct {
+		forwardReplicas int
+		expectRequests  int
+	}{
+		{forwardReplicas: 3, expectRequests: 1},
+		// Server doesn't forward: fall back to uploading each
+		// replica separately.
+		{forwardReplicas: 1, expectRequests: 4},
+	} {
+		st := StubForwardPutHandler{trial.forwardReplicas, make(chan bool, 10)}
+
+		arv, _ := arvadosclient.MakeArvadosClient()
+		kc := New(arv)
+		kc.Want_replicas = 3
+		kc.ForwardReplicas = true
+		arv.ApiToken = "abc123"
+		localRoots := make(map[string]string)
+		writableLocalRoots := make(map[string]string)
+		ks := RunSomeFakeKeepServers(st, 5)
+		for i, k := range ks {
+			localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+			writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+			defer k.listener.Close()
+		}
+		kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+		_, replicas, err := kc.PutB([]byte("foo"))
+		c.Check(err, IsNil)
+		c.Check(replicas >= 3, Equals, true)
+		c.Check(len(st.handled), Equals, trial.expectRequests)
+		c.Check(<-st.handled, Equals, true)
+		for len(st.handled) > 0 {
+			c.Check(<-st.handled, Equals, false)
+		}
+	}
+}
+
+// StubStorageClassesPutHandler stores blocks in a single storage
+// class, and refuses requests for other classes.
+type StubStorageClassesPutHandler struct {
+	class   string
+	handled chan string
+}
+
+func (sph StubStorageClassesPutHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if want := req.Header.Get(X_Keep_Storage_Classes); want != "" && !strings.Contains(", "+want+", ", ", "+sph.class+", ") {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		sph.handled <- ""
+		return
+	}
+	resp.Header().Set(X_Keep_Storage_Classes_Confirmed, sph.class+"=1")
+	resp.WriteHeader(200)
+	sph.handled <- sph.class
+}
+
+func (s *StandaloneSuite) TestPutStorageClasses(c *C) {
+	for _, trial := range []struct {
+		classes       []string
+		replicas      int
+		expectClasses map[string]int
+		expectErr     bool
+	}{
+		{[]string{"default", "archive"}, 1, map[string]int{"default": 1, "archive": 1}, false},
+		{[]string{"archive"}, 2, map[string]int{"archive": 2}, false},
+		{[]string{"bogus"}, 1, map[string]int{}, true},
+	} {
+		handled := make(chan string, 10)
+		arv, _ := arvadosclient.MakeArvadosClient()
+		kc := New(arv)
+		kc.Want_replicas = trial.replicas
+		kc.StorageClasses = trial.classes
+		arv.ApiToken = "abc123"
+		localRoots := make(map[string]string)
+		writableLocalRoots := make(map[string]string)
+		for i, class := range []string{"default", "default", "archive", "archive"} {
+			ks := RunFakeKeepServer(StubStorageClassesPutHandler{class, handled})
+			defer ks.listener.Close()
+			localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = ks.url
+			writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = ks.url
+		}
+		kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+		result, err := kc.PutHBResult(Md5String("foo"), []byte("foo"))
+		if trial.expectErr {
+			_, ok := err.(InsufficientReplicasError)
+			c.Check(ok, Equals, true)
+		} else {
+			c.Check(err, IsNil)
+		}
+		c.Check(result.StorageClasses, DeepEquals, trial.expectClasses)
+	}
+}
+
+// Servers that don't report storage classes count toward the total
+// number of replicas, but not toward any storage class.
+func (s *StandaloneSuite) TestPutStorageClassesNotReported(c *C) {
+	hash := Md5String("foo")
+	st := StubPutHandler{c, hash, "abc123", "foo", "archive", make(chan string, 5)}
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc := New(arv)
+	kc.Want_replicas = 2
+	kc.StorageClasses = []string{"archive"}
+	arv.ApiToken = "abc123"
+	localRoots := make(map[string]string)
+	writableLocalRoots := make(map[string]string)
+	for i, k := range RunSomeFakeKeepServers(st, 5) {
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		writableLocalRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+	kc.SetServiceRoots(localRoots, writableLocalRoots, nil)
+
+	result, err := kc.PutHBResult(hash, []byte("foo"))
+	c.Check(err, IsNil)
+	c.Check(result.Replicas, Equals, 2)
+	c.Check(result.StorageClasses, DeepEquals, map[string]int{})
+	c.Check(len(st.handled), Equals, 2)
+}
+
 type StubGetHandler struct {
 	c              *C
 	expectPath     string
@@ -753,6 +890,73 @@ func (s *StandaloneSuite) TestGetWithServiceHintFailoverToLocals(c *C) {
 	c.Check(content, DeepEquals, []byte("foo"))
 }
 
+// StallHandler doesn't respond until the client gives up, then sends
+// the request URL to cancelled.
+type StallHandler struct {
+	cancelled chan string
+}
+
+func (sh StallHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	<-req.Context().Done()
+	sh.cancelled <- fmt.Sprintf("http://%s", req.Host)
+}
+
+func (s *StandaloneSuite) TestGetHedged(c *C) {
+	content := []byte("foo")
+	hash := fmt.Sprintf("%x", md5.Sum(content))
+
+	stall := StallHandler{make(chan string, 1)}
+	ksStall := RunFakeKeepServer(stall)
+	defer ksStall.listener.Close()
+	ksGood := RunFakeKeepServer(StubGetHandler{c, hash, "abc123", http.StatusOK, content})
+	defer ksGood.listener.Close()
+
+	// Arrange for the stalled server to be tried first.
+	localRoots := map[string]string{
+		"zzzzz-bi6l4-fakefakefake000": ksStall.url,
+		"zzzzz-bi6l4-fakefakefake001": ksGood.url,
+	}
+	if NewRootSorter(localRoots, hash).GetSortedRoots()[0] != ksStall.url {
+		localRoots = map[string]string{
+			"zzzzz-bi6l4-fakefakefake000": ksGood.url,
+			"zzzzz-bi6l4-fakefakefake001": ksStall.url,
+		}
+	}
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(arv)
+	arv.ApiToken = "abc123"
+	kc.SetServiceRoots(localRoots, nil, nil)
+	kc.HedgeDelay = 10 * time.Millisecond
+
+	r, n, url, err := kc.Get(hash)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, int64(3))
+	c.Check(url, Equals, ksGood.url+"/"+hash)
+	buf, err := ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(buf, DeepEquals, content)
+	c.Check(r.Close(), IsNil)
+
+	// The stalled request is cancelled.
+	select {
+	case u := <-stall.cancelled:
+		c.Check(u, Equals, ksStall.url)
+	case <-time.After(5 * time.Second):
+		c.Error("timed out waiting for stalled request to be cancelled")
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ServerStatistics()[ksStall.url].Cancelled == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	stats := ServerStatistics()
+	c.Check(stats[ksStall.url].Cancelled, Equals, int64(1))
+	c.Check(stats[ksStall.url].Requests, Equals, int64(0))
+	c.Check(stats[ksGood.url].Hedged, Equals, int64(1))
+	c.Check(stats[ksGood.url].Requests, Equals, int64(1))
+	c.Check(stats[ksGood.url].Errors, Equals, int64(0))
+}
+
 type BarHandler struct {
 	handled chan string
 }
@@ -0,0 +1,208 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Weight of the most recent request in the moving averages.
+const serverStatsDecay = 0.1
+
+// Servers whose recent error rate is above this threshold are tried
+// after the other servers.
+const serverStatsUnhealthy = 0.5
+
+// The error rate halves every serverStatsHalfLife while no requests
+// are sent to a server, so a server that was demoted because of its
+// error rate eventually gets requests (and another chance) again.
+const serverStatsHalfLife = time.Minute
+
+// Servers whose recent latency is more than serverStatsSlow times the
+// lowest latency of the other servers, and at least
+// serverStatsSlowMargin more, are tried after the faster servers (but
+// before unhealthy servers). Latency measured more than
+// serverStatsLatencyTTL ago is ignored.
+const (
+	serverStatsSlow       = 4
+	serverStatsSlowMargin = 100 * time.Millisecond
+	serverStatsLatencyTTL = time.Minute
+)
+
+// ServerStats are statistics about GET and HEAD requests sent to a
+// keep server by all KeepClients in this process.
+type ServerStats struct {
+	// Requests that got a response or an error.
+	Requests int64
+
+	// Requests that failed with a network error or a server-side
+	// error response (408, 429, or 5xx).
+	Errors int64
+
+	// Requests that were sent because an earlier request for
+	// the same block, to a different server, was taking longer
+	// than HedgeDelay.
+	Hedged int64
+
+	// Requests that were abandoned because a request to a
+	// different server succeeded first.
+	Cancelled int64
+
+	// Moving average of the time to receive response headers,
+	// for requests that did not fail. The time until an
+	// abandoned request was cancelled counts as well, if it is
+	// longer than the average.
+	Latency time.Duration
+
+	// Moving average of the fraction of requests that failed,
+	// decaying over time while no requests are sent.
+	ErrorRate float64
+
+	// Time of the last recorded result or cancellation.
+	updated time.Time
+}
+
+// errorRate returns the error rate, decayed according to the time
+// elapsed since the last update.
+func (st *ServerStats) errorRate(now time.Time) float64 {
+	if st.updated.IsZero() {
+		return st.ErrorRate
+	}
+	return st.ErrorRate * math.Pow(0.5, float64(now.Sub(st.updated))/float64(serverStatsHalfLife))
+}
+
+// touch applies the time decay to ErrorRate and updates the
+// timestamp.
+func (st *ServerStats) touch(now time.Time) {
+	st.ErrorRate = st.errorRate(now)
+	st.updated = now
+}
+
+// latency returns the recent latency, or 0 if it isn't known.
+func (st *ServerStats) latency(now time.Time) time.Duration {
+	if st.Requests == st.Errors || now.Sub(st.updated) > serverStatsLatencyTTL {
+		return 0
+	}
+	return st.Latency
+}
+
+type serverStatsRegistry struct {
+	stats map[string]*ServerStats
+	mtx   sync.Mutex
+}
+
+var serverStats = &serverStatsRegistry{}
+
+// ServerStatistics returns a snapshot of the statistics for each keep
+// server (identified by its root URL) that this process has sent
+// requests to.
+func ServerStatistics() map[string]ServerStats {
+	return serverStats.snapshot()
+}
+
+func (r *serverStatsRegistry) snapshot() map[string]ServerStats {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	now := time.Now()
+	snap := make(map[string]ServerStats, len(r.stats))
+	for root, st := range r.stats {
+		snapst := *st
+		snapst.ErrorRate = st.errorRate(now)
+		snap[root] = snapst
+	}
+	return snap
+}
+
+// get returns the stats for the given server. Caller must have lock.
+func (r *serverStatsRegistry) get(root string) *ServerStats {
+	if r.stats == nil {
+		r.stats = map[string]*ServerStats{}
+	}
+	st, ok := r.stats[root]
+	if !ok {
+		st = &ServerStats{}
+		r.stats[root] = st
+	}
+	return st
+}
+
+// recordResult updates the stats for a request that got a response
+// or an error, which took the given time.
+func (r *serverStatsRegistry) recordResult(root string, failed bool, latency time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	st := r.get(root)
+	st.touch(time.Now())
+	st.Requests++
+	if failed {
+		st.Errors++
+		st.ErrorRate += (1 - st.ErrorRate) * serverStatsDecay
+		return
+	}
+	st.ErrorRate -= st.ErrorRate * serverStatsDecay
+	if st.Requests == st.Errors+1 {
+		// first successful request
+		st.Latency = latency
+	} else {
+		st.Latency += time.Duration(float64(latency-st.Latency) * serverStatsDecay)
+	}
+}
+
+func (r *serverStatsRegistry) recordHedged(root string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.get(root).Hedged++
+}
+
+// recordCancelled updates the stats for a request that was abandoned
+// after the given time, without getting a response. The server would
+// have taken at least that long to respond, so a longer time than the
+// current average latency is counted as a latency sample.
+func (r *serverStatsRegistry) recordCancelled(root string, elapsed time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	st := r.get(root)
+	st.touch(time.Now())
+	st.Cancelled++
+	if elapsed > st.Latency {
+		st.Latency += time.Duration(float64(elapsed-st.Latency) * serverStatsDecay)
+	}
+}
+
+// healthyFirst returns the given server roots, reordered so servers
+// with a high recent latency come after the others, and servers with
+// a high recent error rate come last. Otherwise, the original order is
+// preserved.
+func (r *serverStatsRegistry) healthyFirst(roots []string) []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	now := time.Now()
+	var fastest time.Duration
+	for _, root := range roots {
+		if st, ok := r.stats[root]; ok && st.errorRate(now) <= serverStatsUnhealthy {
+			if lat := st.latency(now); lat > 0 && (fastest == 0 || lat < fastest) {
+				fastest = lat
+			}
+		}
+	}
+	sorted := make([]string, 0, len(roots))
+	var slow, unhealthy []string
+	for _, root := range roots {
+		st, ok := r.stats[root]
+		if !ok {
+			sorted = append(sorted, root)
+		} else if st.errorRate(now) > serverStatsUnhealthy {
+			unhealthy = append(unhealthy, root)
+		} else if lat := st.latency(now); lat > fastest*serverStatsSlow && lat > fastest+serverStatsSlowMargin {
+			slow = append(slow, root)
+		} else {
+			sorted = append(sorted, root)
+		}
+	}
+	sorted = append(sorted, slow...)
+	return append(sorted, unhealthy...)
+}
@@ -0,0 +1,58 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ServerStatsCollector is a prometheus.Collector that reports
+// ServerStatistics(), with a "server" label for each keep server.
+type ServerStatsCollector struct {
+	requests  *prometheus.Desc
+	errors    *prometheus.Desc
+	hedged    *prometheus.Desc
+	cancelled *prometheus.Desc
+	latency   *prometheus.Desc
+	errorRate *prometheus.Desc
+}
+
+// NewServerStatsCollector returns a ServerStatsCollector whose
+// metrics are named arvados_{subsystem}_keepclient_*.
+func NewServerStatsCollector(subsystem string) *ServerStatsCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("arvados", subsystem, "keepclient_"+name), help, []string{"server"}, nil)
+	}
+	return &ServerStatsCollector{
+		requests:  desc("requests", "Number of GET/HEAD requests sent to each keep server"),
+		errors:    desc("errors", "Number of GET/HEAD requests to each keep server that failed"),
+		hedged:    desc("hedged_requests", "Number of GET/HEAD requests sent to each keep server because another server was slow"),
+		cancelled: desc("cancelled_requests", "Number of GET/HEAD requests to each keep server abandoned because another server responded first"),
+		latency:   desc("latency_seconds", "Recent average time for each keep server to respond"),
+		errorRate: desc("error_rate", "Recent fraction of GET/HEAD requests to each keep server that failed"),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *ServerStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.requests
+	ch <- c.errors
+	ch <- c.hedged
+	ch <- c.cancelled
+	ch <- c.latency
+	ch <- c.errorRate
+}
+
+// Collect implements prometheus.Collector.
+func (c *ServerStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	for root, st := range ServerStatistics() {
+		ch <- prometheus.MustNewConstMetric(c.requests, prometheus.CounterValue, float64(st.Requests), root)
+		ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(st.Errors), root)
+		ch <- prometheus.MustNewConstMetric(c.hedged, prometheus.CounterValue, float64(st.Hedged), root)
+		ch <- prometheus.MustNewConstMetric(c.cancelled, prometheus.CounterValue, float64(st.Cancelled), root)
+		ch <- prometheus.MustNewConstMetric(c.latency, prometheus.GaugeValue, st.Latency.Seconds(), root)
+		ch <- prometheus.MustNewConstMetric(c.errorRate, prometheus.GaugeValue, st.ErrorRate, root)
+	}
+}
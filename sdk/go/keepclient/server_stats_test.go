@@ -0,0 +1,102 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *StandaloneSuite) TestServerStats(c *C) {
+	reg := &serverStatsRegistry{}
+	reg.recordResult("http://a", false, 100*time.Millisecond)
+	reg.recordResult("http://a", false, 200*time.Millisecond)
+	reg.recordResult("http://a", true, time.Minute)
+	reg.recordHedged("http://b")
+	reg.recordCancelled("http://b", time.Second)
+	reg.recordCancelled("http://b", time.Millisecond)
+
+	snap := reg.snapshot()
+	c.Check(snap["http://a"].Requests, Equals, int64(3))
+	c.Check(snap["http://a"].Errors, Equals, int64(1))
+	// Failed requests don't affect latency.
+	c.Check(snap["http://a"].Latency, Equals, 110*time.Millisecond)
+	c.Check(snap["http://a"].ErrorRate > 0.09 && snap["http://a"].ErrorRate < 0.11, Equals, true)
+	c.Check(snap["http://b"].Requests, Equals, int64(0))
+	c.Check(snap["http://b"].Hedged, Equals, int64(1))
+	c.Check(snap["http://b"].Cancelled, Equals, int64(2))
+	// The time until a request is cancelled is a lower bound:
+	// it only increases the latency.
+	c.Check(snap["http://b"].Latency, Equals, 100*time.Millisecond)
+}
+
+func (s *StandaloneSuite) TestServerStatsErrorRateDecay(c *C) {
+	reg := &serverStatsRegistry{}
+	for i := 0; i < 10; i++ {
+		reg.recordResult("http://a", true, time.Second)
+	}
+	rate := reg.snapshot()["http://a"].ErrorRate
+	c.Check(rate > serverStatsUnhealthy, Equals, true)
+
+	// With no requests for two half-lives, the error rate
+	// drops to a quarter.
+	reg.stats["http://a"].updated = reg.stats["http://a"].updated.Add(-2 * serverStatsHalfLife)
+	decayed := reg.snapshot()["http://a"].ErrorRate
+	c.Check(decayed > rate/4*0.99 && decayed < rate/4*1.01, Equals, true, Commentf("rate %v decayed %v", rate, decayed))
+
+	// The next error is added to the decayed rate.
+	reg.recordResult("http://a", true, time.Second)
+	rate = reg.snapshot()["http://a"].ErrorRate
+	c.Check(rate < decayed+0.11, Equals, true, Commentf("decayed %v rate %v", decayed, rate))
+}
+
+func (s *StandaloneSuite) TestServerStatsHealthyFirst(c *C) {
+	reg := &serverStatsRegistry{}
+	roots := []string{"http://a", "http://b", "http://c"}
+	c.Check(reg.healthyFirst(roots), DeepEquals, roots)
+
+	// After several consecutive errors, "a" is tried last.
+	for i := 0; i < 10; i++ {
+		reg.recordResult("http://a", true, time.Second)
+	}
+	c.Check(reg.healthyFirst(roots), DeepEquals, []string{"http://b", "http://c", "http://a"})
+
+	// After it recovers, "a" is tried first again.
+	for i := 0; i < 10; i++ {
+		reg.recordResult("http://a", false, time.Second)
+	}
+	c.Check(reg.healthyFirst(roots), DeepEquals, roots)
+
+	// After several consecutive errors and no requests for a
+	// while, "a" is tried first again.
+	for i := 0; i < 10; i++ {
+		reg.recordResult("http://a", true, time.Second)
+	}
+	c.Check(reg.healthyFirst(roots), DeepEquals, []string{"http://b", "http://c", "http://a"})
+	reg.stats["http://a"].updated = reg.stats["http://a"].updated.Add(-5 * serverStatsHalfLife)
+	c.Check(reg.healthyFirst(roots), DeepEquals, roots)
+}
+
+func (s *StandaloneSuite) TestServerStatsSlowLast(c *C) {
+	reg := &serverStatsRegistry{}
+	roots := []string{"http://a", "http://b", "http://c", "http://d"}
+	reg.recordResult("http://a", false, time.Second)
+	reg.recordResult("http://b", false, 200*time.Millisecond)
+	reg.recordResult("http://c", false, 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		reg.recordResult("http://d", true, time.Millisecond)
+	}
+	// "a" and "b" are much slower than "c"; "d" is unhealthy.
+	c.Check(reg.healthyFirst(roots), DeepEquals, []string{"http://c", "http://a", "http://b", "http://d"})
+
+	// Small differences in latency don't matter.
+	reg.stats["http://b"].Latency = 20 * time.Millisecond
+	c.Check(reg.healthyFirst(roots), DeepEquals, []string{"http://b", "http://c", "http://a", "http://d"})
+
+	// Old latency figures are ignored.
+	reg.stats["http://a"].updated = time.Now().Add(-2 * serverStatsLatencyTTL)
+	c.Check(reg.healthyFirst(roots), DeepEquals, []string{"http://a", "http://b", "http://c", "http://d"})
+}
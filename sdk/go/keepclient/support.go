@@ -53,17 +53,29 @@ type uploadStatus struct {
 	statusCode      int
 	replicas_stored int
 	response        string
+
+	// Replicas stored in each storage class, as reported by
+	// the server, or nil if the server did not report them.
+	classesConfirmed map[string]int
 }
 
 func (this *KeepClient) uploadToKeepServer(host string, hash string, body io.Reader,
 	upload_status chan<- uploadStatus, expectedLength int64, reqid string) {
+	this.upload(host, hash, body, upload_status, expectedLength, reqid, false)
+}
+
+// upload sends a block to a keep server. If forward is true, the
+// server is asked to store Want_replicas copies by forwarding the
+// block to other servers itself.
+func (this *KeepClient) upload(host string, hash string, body io.Reader,
+	upload_status chan<- uploadStatus, expectedLength int64, reqid string, forward bool) {
 
 	var req *http.Request
 	var err error
 	var url = fmt.Sprintf("%s/%s", host, hash)
 	if req, err = http.NewRequest("PUT", url, nil); err != nil {
 		DebugPrintf("DEBUG: [%s] Error creating request PUT %v error: %v", reqid, url, err.Error())
-		upload_status <- uploadStatus{err, url, 0, 0, ""}
+		upload_status <- uploadStatus{err, url, 0, 0, "", nil}
 		return
 	}
 
@@ -81,13 +93,16 @@ func (this *KeepClient) uploadToKeepServer(host string, hash string, body io.Rea
 	req.Header.Add("Content-Type", "application/octet-stream")
 	req.Header.Add(X_Keep_Desired_Replicas, fmt.Sprint(this.Want_replicas))
 	if len(this.StorageClasses) > 0 {
-		req.Header.Add("X-Keep-Storage-Classes", strings.Join(this.StorageClasses, ", "))
+		req.Header.Add(X_Keep_Storage_Classes, strings.Join(this.StorageClasses, ", "))
+	}
+	if forward {
+		req.Header.Add(X_Keep_Forward, "true")
 	}
 
 	var resp *http.Response
 	if resp, err = this.httpClient().Do(req); err != nil {
 		DebugPrintf("DEBUG: [%s] Upload failed %v error: %v", reqid, url, err.Error())
-		upload_status <- uploadStatus{err, url, 0, 0, err.Error()}
+		upload_status <- uploadStatus{err, url, 0, 0, err.Error(), nil}
 		return
 	}
 
@@ -95,6 +110,7 @@ func (this *KeepClient) uploadToKeepServer(host string, hash string, body io.Rea
 	if xr := resp.Header.Get(X_Keep_Replicas_Stored); xr != "" {
 		fmt.Sscanf(xr, "%d", &rep)
 	}
+	classes := parseStorageClassesConfirmed(resp.Header.Get(X_Keep_Storage_Classes_Confirmed))
 
 	defer resp.Body.Close()
 	defer io.Copy(ioutil.Discard, resp.Body)
@@ -103,29 +119,111 @@ func (this *KeepClient) uploadToKeepServer(host string, hash string, body io.Rea
 	response := strings.TrimSpace(string(respbody))
 	if err2 != nil && err2 != io.EOF {
 		DebugPrintf("DEBUG: [%s] Upload %v error: %v response: %v", reqid, url, err2.Error(), response)
-		upload_status <- uploadStatus{err2, url, resp.StatusCode, rep, response}
+		upload_status <- uploadStatus{err2, url, resp.StatusCode, rep, response, classes}
 	} else if resp.StatusCode == http.StatusOK {
 		DebugPrintf("DEBUG: [%s] Upload %v success", reqid, url)
-		upload_status <- uploadStatus{nil, url, resp.StatusCode, rep, response}
+		upload_status <- uploadStatus{nil, url, resp.StatusCode, rep, response, classes}
 	} else {
 		if resp.StatusCode >= 300 && response == "" {
 			response = resp.Status
 		}
 		DebugPrintf("DEBUG: [%s] Upload %v error: %v response: %v", reqid, url, resp.StatusCode, response)
-		upload_status <- uploadStatus{errors.New(resp.Status), url, resp.StatusCode, rep, response}
+		upload_status <- uploadStatus{errors.New(resp.Status), url, resp.StatusCode, rep, response, classes}
+	}
+}
+
+// parseStorageClassesConfirmed parses an
+// X-Keep-Storage-Classes-Confirmed header value like "default=1,
+// archive=2". It returns nil if the header is empty.
+func parseStorageClassesConfirmed(hdr string) map[string]int {
+	if hdr == "" {
+		return nil
+	}
+	classes := map[string]int{}
+	for _, cr := range strings.Split(hdr, ",") {
+		cr = strings.TrimSpace(cr)
+		eq := strings.Index(cr, "=")
+		if eq < 1 {
+			continue
+		}
+		var n int
+		if _, err := fmt.Sscanf(cr[eq+1:], "%d", &n); err != nil || n < 0 {
+			continue
+		}
+		classes[cr[:eq]] += n
+	}
+	return classes
+}
+
+// replicasTodo returns the number of replicas that still need to be
+// written, given the total replicas written so far and the replicas
+// confirmed in each storage class. If StorageClasses is set, every
+// requested class needs Want_replicas replicas -- unless classesKnown
+// is false, i.e., some server didn't report storage classes, in
+// which case only the total is checked.
+func (this *KeepClient) replicasTodo(done int, classesDone map[string]int, classesKnown bool) int {
+	if len(this.StorageClasses) == 0 || !classesKnown {
+		return this.Want_replicas - done
+	}
+	todo := 0
+	for _, class := range this.StorageClasses {
+		if n := this.Want_replicas - classesDone[class]; n > todo {
+			todo = n
+		}
+	}
+	return todo
+}
+
+// addClassesConfirmed adds the replicas reported by one upload to
+// classesDone. It returns false if the server did not report storage
+// classes (e.g., an older keepstore or keepproxy). The storage
+// classes of those replicas are unknown, so they are not counted in
+// classesDone.
+func (this *KeepClient) addClassesConfirmed(classesDone map[string]int, status uploadStatus) bool {
+	if status.classesConfirmed == nil {
+		return false
 	}
+	for class, n := range status.classesConfirmed {
+		classesDone[class] += n
+	}
+	return true
 }
 
 func (this *KeepClient) putReplicas(
 	hash string,
 	getReader func() io.Reader,
-	expectedLength int64) (locator string, replicas int, err error) {
+	expectedLength int64) (result PutResult, err error) {
 
 	reqid := this.getRequestID()
 
 	// Calculate the ordering for uploading to servers
 	sv := NewRootSorter(this.WritableLocalRoots(), hash).GetSortedRoots()
 
+	if this.ForwardReplicas && this.Want_replicas > 1 && len(sv) > 0 {
+		// Send the block once, and let the first server
+		// forward it to the others.
+		status := make(chan uploadStatus, 1)
+		DebugPrintf("DEBUG: [%s] Begin forwarding upload %s to %s", reqid, hash, sv[0])
+		this.upload(sv[0], hash, getReader(), status, expectedLength, reqid, true)
+		st := <-status
+		if st.statusCode == 200 {
+			classesDone := map[string]int{}
+			classesKnown := this.addClassesConfirmed(classesDone, st)
+			if this.replicasTodo(st.replicas_stored, classesDone, classesKnown) <= 0 {
+				return PutResult{
+					Locator:        st.response,
+					Replicas:       st.replicas_stored,
+					StorageClasses: classesDone,
+				}, nil
+			}
+		}
+		// We can't tell which servers the forwarded copies
+		// went to, so fall back to uploading to each server
+		// ourselves. Servers that already have the block
+		// will just report it as stored.
+		DebugPrintf("DEBUG: [%s] Forwarding upload %s stored %d replicas, falling back", reqid, hash, st.replicas_stored)
+	}
+
 	// The next server to try contacting
 	next_server := 0
 
@@ -146,8 +244,9 @@ func (this *KeepClient) putReplicas(
 		}()
 	}()
 
-	replicasDone := 0
-	replicasTodo := this.Want_replicas
+	result.StorageClasses = map[string]int{}
+	classesKnown := true
+	replicasTodo := this.replicasTodo(0, result.StorageClasses, classesKnown)
 
 	replicasPerThread := this.replicasPerService
 	if replicasPerThread < 1 {
@@ -179,7 +278,7 @@ func (this *KeepClient) putReplicas(
 							msg += resp + "; "
 						}
 						msg = msg[:len(msg)-2]
-						return locator, replicasDone, InsufficientReplicasError(errors.New(msg))
+						return result, InsufficientReplicasError(errors.New(msg))
 					} else {
 						break
 					}
@@ -195,9 +294,12 @@ func (this *KeepClient) putReplicas(
 
 				if status.statusCode == 200 {
 					// good news!
-					replicasDone += status.replicas_stored
-					replicasTodo -= status.replicas_stored
-					locator = status.response
+					result.Replicas += status.replicas_stored
+					if !this.addClassesConfirmed(result.StorageClasses, status) {
+						classesKnown = false
+					}
+					replicasTodo = this.replicasTodo(result.Replicas, result.StorageClasses, classesKnown)
+					result.Locator = status.response
 					delete(lastError, status.url)
 				} else {
 					msg := fmt.Sprintf("[%d] %s", status.statusCode, status.response)
@@ -221,5 +323,5 @@ func (this *KeepClient) putReplicas(
 		sv = retryServers
 	}
 
-	return locator, replicasDone, nil
+	return result, nil
 }
@@ -6,17 +6,28 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
 )
 
 // Return the current process's cgroup for the given subsystem.
 func findCgroup(subsystem string) string {
-	subsys := []byte(subsystem)
-	cgroups, err := ioutil.ReadFile("/proc/self/cgroup")
+	cgroup, err := cgroupFromProcFile("/proc/self/cgroup", subsystem)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return cgroup
+}
+
+// Return the cgroup for the given subsystem listed in procfile, which
+// is in the format of /proc/PID/cgroup.
+func cgroupFromProcFile(procfile, subsystem string) (string, error) {
+	subsys := []byte(subsystem)
+	cgroups, err := ioutil.ReadFile(procfile)
+	if err != nil {
+		return "", err
+	}
 	for _, line := range bytes.Split(cgroups, []byte("\n")) {
 		toks := bytes.SplitN(line, []byte(":"), 4)
 		if len(toks) < 3 {
@@ -24,10 +35,9 @@ func findCgroup(subsystem string) string {
 		}
 		for _, s := range bytes.Split(toks[1], []byte(",")) {
 			if bytes.Compare(s, subsys) == 0 {
-				return string(toks[2])
+				return string(toks[2]), nil
 			}
 		}
 	}
-	log.Fatalf("subsystem %q not found in /proc/self/cgroup", subsystem)
-	return ""
+	return "", fmt.Errorf("subsystem %q not found in %s", subsystem, procfile)
 }
@@ -59,6 +59,10 @@ type copier struct {
 	secretMounts  map[string]arvados.Mount
 	logger        printfer
 
+	// Split file data into content-defined chunks (see
+	// arvados.CollectionFileSystem).
+	contentDefinedChunking bool
+
 	dirs     []string
 	files    []filetodo
 	manifest string
@@ -76,6 +80,7 @@ func (cp *copier) Copy() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("error creating Collection.FileSystem: %v", err)
 	}
+	fs.SetContentDefinedChunking(cp.contentDefinedChunking)
 	for _, d := range cp.dirs {
 		err = fs.Mkdir(d, 0777)
 		if err != nil && err != os.ErrExist {
@@ -34,9 +34,6 @@ import (
 	"git.curoverse.com/arvados.git/sdk/go/manifest"
 	"golang.org/x/net/context"
 
-	dockertypes "github.com/docker/docker/api/types"
-	dockercontainer "github.com/docker/docker/api/types/container"
-	dockernetwork "github.com/docker/docker/api/types/network"
 	dockerclient "github.com/docker/docker/client"
 )
 
@@ -71,20 +68,6 @@ type RunArvMount func(args []string, tok string) (*exec.Cmd, error)
 
 type MkTempDir func(string, string) (string, error)
 
-// ThinDockerClient is the minimal Docker client interface used by crunch-run.
-type ThinDockerClient interface {
-	ContainerAttach(ctx context.Context, container string, options dockertypes.ContainerAttachOptions) (dockertypes.HijackedResponse, error)
-	ContainerCreate(ctx context.Context, config *dockercontainer.Config, hostConfig *dockercontainer.HostConfig,
-		networkingConfig *dockernetwork.NetworkingConfig, containerName string) (dockercontainer.ContainerCreateCreatedBody, error)
-	ContainerStart(ctx context.Context, container string, options dockertypes.ContainerStartOptions) error
-	ContainerRemove(ctx context.Context, container string, options dockertypes.ContainerRemoveOptions) error
-	ContainerWait(ctx context.Context, container string, condition dockercontainer.WaitCondition) (<-chan dockercontainer.ContainerWaitOKBody, <-chan error)
-	ContainerInspect(ctx context.Context, id string) (dockertypes.ContainerJSON, error)
-	ImageInspectWithRaw(ctx context.Context, image string) (dockertypes.ImageInspect, []byte, error)
-	ImageLoad(ctx context.Context, input io.Reader, quiet bool) (dockertypes.ImageLoadResponse, error)
-	ImageRemove(ctx context.Context, image string, options dockertypes.ImageRemoveOptions) ([]dockertypes.ImageDeleteResponseItem, error)
-}
-
 type PsProcess interface {
 	CmdlineSlice() ([]string, error)
 }
@@ -92,7 +75,7 @@ type PsProcess interface {
 // ContainerRunner is the main stateful struct used for a single execution of a
 // container.
 type ContainerRunner struct {
-	Docker ThinDockerClient
+	executor containerExecutor
 
 	// Dispatcher client is initialized with the Dispatcher token.
 	// This is a priviledged token used to manage container status
@@ -116,38 +99,35 @@ type ContainerRunner struct {
 	ContainerArvClient  IArvadosClient
 	ContainerKeepClient IKeepClient
 
-	Container       arvados.Container
-	ContainerConfig dockercontainer.Config
-	HostConfig      dockercontainer.HostConfig
-	token           string
-	ContainerID     string
-	ExitCode        *int
-	NewLogWriter    NewLogWriter
-	loggingDone     chan bool
-	CrunchLog       *ThrottledLogger
-	Stdout          io.WriteCloser
-	Stderr          io.WriteCloser
-	logUUID         string
-	logMtx          sync.Mutex
-	LogCollection   arvados.CollectionFileSystem
-	LogsPDH         *string
-	RunArvMount     RunArvMount
-	MkTempDir       MkTempDir
-	ArvMount        *exec.Cmd
-	ArvMountPoint   string
-	HostOutputDir   string
-	Binds           []string
-	Volumes         map[string]struct{}
-	OutputPDH       *string
-	SigChan         chan os.Signal
-	ArvMountExit    chan error
-	SecretMounts    map[string]arvados.Mount
-	MkArvClient     func(token string) (IArvadosClient, IKeepClient, *arvados.Client, error)
-	finalState      string
-	parentTemp      string
+	Container     arvados.Container
+	token         string
+	imageID       string
+	ExitCode      *int
+	NewLogWriter  NewLogWriter
+	CrunchLog     *ThrottledLogger
+	Stdout        io.WriteCloser
+	Stderr        io.WriteCloser
+	logUUID       string
+	logMtx        sync.Mutex
+	LogCollection arvados.CollectionFileSystem
+	LogsPDH       *string
+	RunArvMount   RunArvMount
+	MkTempDir     MkTempDir
+	ArvMount      *exec.Cmd
+	ArvMountPoint string
+	HostOutputDir string
+	Binds         []string
+	OutputPDH     *string
+	SigChan       chan os.Signal
+	ArvMountExit  chan error
+	SecretMounts  map[string]arvados.Mount
+	MkArvClient   func(token string) (IArvadosClient, IKeepClient, *arvados.Client, error)
+	finalState    string
+	parentTemp    string
 
 	statLogger       io.WriteCloser
 	statReporter     *crunchstat.Reporter
+	closeOnce        sync.Once // guards closeStdoutStderr
 	hoststatLogger   io.WriteCloser
 	hoststatReporter *crunchstat.Reporter
 	statInterval     time.Duration
@@ -167,18 +147,22 @@ type ContainerRunner struct {
 	setCgroupParent string
 
 	cStateLock sync.Mutex
+	cCreated   bool // CreateContainer() succeeded
 	cCancelled bool // StopContainer() invoked
-	cRemoved   bool // docker confirmed the container no longer exists
+	cRemoved   bool // executor confirmed the container no longer exists
 
 	enableNetwork string // one of "default" or "always"
-	networkMode   string // passed through to HostConfig.NetworkMode
+	networkMode   string // passed through to docker HostConfig.NetworkMode
 	arvMountLog   *ThrottledLogger
 
+	// split output files into content-defined chunks
+	contentDefinedChunking bool
+
 	containerWatchdogInterval time.Duration
 }
 
 // setupSignals sets up signal handling to gracefully terminate the underlying
-// Docker container and update state when receiving a TERM, INT or QUIT signal.
+// container and update state when receiving a TERM, INT or QUIT signal.
 func (runner *ContainerRunner) setupSignals() {
 	runner.SigChan = make(chan os.Signal, 1)
 	signal.Notify(runner.SigChan, syscall.SIGTERM)
@@ -192,23 +176,22 @@ func (runner *ContainerRunner) setupSignals() {
 	}(runner.SigChan)
 }
 
-// stop the underlying Docker container.
+// stop the underlying container.
 func (runner *ContainerRunner) stop(sig os.Signal) {
 	runner.cStateLock.Lock()
 	defer runner.cStateLock.Unlock()
 	if sig != nil {
 		runner.CrunchLog.Printf("caught signal: %v", sig)
 	}
-	if runner.ContainerID == "" {
+	if !runner.cCreated {
 		return
 	}
 	runner.cCancelled = true
 	runner.CrunchLog.Printf("removing container")
-	err := runner.Docker.ContainerRemove(context.TODO(), runner.ContainerID, dockertypes.ContainerRemoveOptions{Force: true})
+	err := runner.executor.Stop()
 	if err != nil {
 		runner.CrunchLog.Printf("error removing container: %s", err)
-	}
-	if err == nil || strings.Contains(err.Error(), "No such container: "+runner.ContainerID) {
+	} else {
 		runner.cRemoved = true
 	}
 }
@@ -255,7 +238,7 @@ func (runner *ContainerRunner) checkBrokenNode(goterr error) bool {
 }
 
 // LoadImage determines the docker image id from the container record and
-// checks if it is available in the local Docker image store.  If not, it loads
+// checks if it is available to the container executor.  If not, it loads
 // the image from Keep.
 func (runner *ContainerRunner) LoadImage() (err error) {
 
@@ -278,32 +261,18 @@ func (runner *ContainerRunner) LoadImage() (err error) {
 
 	runner.CrunchLog.Printf("Using Docker image id '%s'", imageID)
 
-	_, _, err = runner.Docker.ImageInspectWithRaw(context.TODO(), imageID)
-	if err != nil {
-		runner.CrunchLog.Print("Loading Docker image from keep")
-
-		var readCloser io.ReadCloser
-		readCloser, err = runner.ContainerKeepClient.ManifestFileReader(manifest, img)
-		if err != nil {
-			return fmt.Errorf("While creating ManifestFileReader for container image: %v", err)
-		}
-
-		response, err := runner.Docker.ImageLoad(context.TODO(), readCloser, true)
-		if err != nil {
-			return fmt.Errorf("While loading container image into Docker: %v", err)
-		}
-
-		defer response.Body.Close()
-		rbody, err := ioutil.ReadAll(response.Body)
+	err = runner.executor.LoadImage(imageID, runner.Container.ContainerImage, func() (io.ReadCloser, error) {
+		readCloser, err := runner.ContainerKeepClient.ManifestFileReader(manifest, img)
 		if err != nil {
-			return fmt.Errorf("Reading response to image load: %v", err)
+			return nil, fmt.Errorf("While creating ManifestFileReader for container image: %v", err)
 		}
-		runner.CrunchLog.Printf("Docker response: %s", rbody)
-	} else {
-		runner.CrunchLog.Print("Docker image is available")
+		return readCloser, nil
+	})
+	if err != nil {
+		return err
 	}
 
-	runner.ContainerConfig.Image = imageID
+	runner.imageID = imageID
 
 	runner.ContainerKeepClient.ClearBlockCache()
 
@@ -438,7 +407,6 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 
 	collectionPaths := []string{}
 	runner.Binds = nil
-	runner.Volumes = make(map[string]struct{})
 	needCertMount := true
 	type copyFile struct {
 		src  string
@@ -688,52 +656,35 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 	return nil
 }
 
-func (runner *ContainerRunner) ProcessDockerAttach(containerReader io.Reader) {
-	// Handle docker log protocol
-	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.15/#attach-to-a-container
-	defer close(runner.loggingDone)
-
-	header := make([]byte, 8)
-	var err error
-	for err == nil {
-		_, err = io.ReadAtLeast(containerReader, header, 8)
-		if err != nil {
-			if err == io.EOF {
-				err = nil
+// closeStdoutStderr closes the container's stdout and stderr logs
+// (or output files) and stops crunchstat. It is called by WaitFinish
+// once the container has exited and its output has been written, and
+// again by Run's cleanup in case the container failed to start or
+// WaitFinish returned early; only the first call has any effect.
+func (runner *ContainerRunner) closeStdoutStderr() {
+	runner.closeOnce.Do(func() {
+		if runner.Stdout != nil {
+			err := runner.Stdout.Close()
+			if err != nil {
+				runner.CrunchLog.Printf("error closing stdout logs: %v", err)
 			}
-			break
-		}
-		readsize := int64(header[7]) | (int64(header[6]) << 8) | (int64(header[5]) << 16) | (int64(header[4]) << 24)
-		if header[0] == 1 {
-			// stdout
-			_, err = io.CopyN(runner.Stdout, containerReader, readsize)
-		} else {
-			// stderr
-			_, err = io.CopyN(runner.Stderr, containerReader, readsize)
 		}
-	}
 
-	if err != nil {
-		runner.CrunchLog.Printf("error reading docker logs: %v", err)
-	}
-
-	err = runner.Stdout.Close()
-	if err != nil {
-		runner.CrunchLog.Printf("error closing stdout logs: %v", err)
-	}
-
-	err = runner.Stderr.Close()
-	if err != nil {
-		runner.CrunchLog.Printf("error closing stderr logs: %v", err)
-	}
+		if runner.Stderr != nil {
+			err := runner.Stderr.Close()
+			if err != nil {
+				runner.CrunchLog.Printf("error closing stderr logs: %v", err)
+			}
+		}
 
-	if runner.statReporter != nil {
-		runner.statReporter.Stop()
-		err = runner.statLogger.Close()
-		if err != nil {
-			runner.CrunchLog.Printf("error closing crunchstat logs: %v", err)
+		if runner.statReporter != nil {
+			runner.statReporter.Stop()
+			err := runner.statLogger.Close()
+			if err != nil {
+				runner.CrunchLog.Printf("error closing crunchstat logs: %v", err)
+			}
 		}
-	}
+	})
 }
 
 func (runner *ContainerRunner) stopHoststat() error {
@@ -764,13 +715,18 @@ func (runner *ContainerRunner) startHoststat() error {
 }
 
 func (runner *ContainerRunner) startCrunchstat() error {
+	cid := runner.executor.CgroupID()
+	if cid == "" {
+		runner.CrunchLog.Printf("Container does not have a cgroup of its own, not starting crunchstat")
+		return nil
+	}
 	w, err := runner.NewLogWriter("crunchstat")
 	if err != nil {
 		return err
 	}
 	runner.statLogger = NewThrottledLogger(w)
 	runner.statReporter = &crunchstat.Reporter{
-		CID:          runner.ContainerID,
+		CID:          cid,
 		Logger:       log.New(runner.statLogger, "", 0),
 		CgroupParent: runner.expectCgroupParent,
 		CgroupRoot:   runner.cgroupRoot,
@@ -913,13 +869,18 @@ func (runner *ContainerRunner) logAPIResponse(label, path string, params map[str
 	return true, nil
 }
 
-// AttachStreams connects the docker container stdin, stdout and stderr logs
-// to the Arvados logger which logs to Keep and the API server logs table.
-func (runner *ContainerRunner) AttachStreams() (err error) {
+// AttachStreams prepares the container's stdin, stdout and stderr:
+// stdin is read from the "stdin" mount (if any), and stdout and
+// stderr are written to the corresponding mounts or to the Arvados
+// logger, which logs to Keep and the API server logs table.
+//
+// It returns a reader for the container's stdin, or nil if the
+// container has no stdin.
+func (runner *ContainerRunner) AttachStreams() (stdin io.Reader, err error) {
 
 	runner.CrunchLog.Print("Attaching container streams")
 
-	// If stdin mount is provided, attach it to the docker container
+	// If stdin mount is provided, attach it to the container
 	var stdinRdr arvados.File
 	var stdinJson []byte
 	if stdinMnt, ok := runner.Container.Mounts["stdin"]; ok {
@@ -931,42 +892,33 @@ func (runner *ContainerRunner) AttachStreams() (err error) {
 			}
 			err = runner.ContainerArvClient.Get("collections", collId, nil, &stdinColl)
 			if err != nil {
-				return fmt.Errorf("While getting stdin collection: %v", err)
+				return nil, fmt.Errorf("While getting stdin collection: %v", err)
 			}
 
 			stdinRdr, err = runner.ContainerKeepClient.ManifestFileReader(
 				manifest.Manifest{Text: stdinColl.ManifestText},
 				stdinMnt.Path)
 			if os.IsNotExist(err) {
-				return fmt.Errorf("stdin collection path not found: %v", stdinMnt.Path)
+				return nil, fmt.Errorf("stdin collection path not found: %v", stdinMnt.Path)
 			} else if err != nil {
-				return fmt.Errorf("While getting stdin collection path %v: %v", stdinMnt.Path, err)
+				return nil, fmt.Errorf("While getting stdin collection path %v: %v", stdinMnt.Path, err)
 			}
 		} else if stdinMnt.Kind == "json" {
 			stdinJson, err = json.Marshal(stdinMnt.Content)
 			if err != nil {
-				return fmt.Errorf("While encoding stdin json data: %v", err)
+				return nil, fmt.Errorf("While encoding stdin json data: %v", err)
 			}
 		}
 	}
 
-	stdinUsed := stdinRdr != nil || len(stdinJson) != 0
-	response, err := runner.Docker.ContainerAttach(context.TODO(), runner.ContainerID,
-		dockertypes.ContainerAttachOptions{Stream: true, Stdin: stdinUsed, Stdout: true, Stderr: true})
-	if err != nil {
-		return fmt.Errorf("While attaching container stdout/stderr streams: %v", err)
-	}
-
-	runner.loggingDone = make(chan bool)
-
 	if stdoutMnt, ok := runner.Container.Mounts["stdout"]; ok {
 		stdoutFile, err := runner.getStdoutFile(stdoutMnt.Path)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		runner.Stdout = stdoutFile
 	} else if w, err := runner.NewLogWriter("stdout"); err != nil {
-		return err
+		return nil, err
 	} else {
 		runner.Stdout = NewThrottledLogger(w)
 	}
@@ -974,39 +926,33 @@ func (runner *ContainerRunner) AttachStreams() (err error) {
 	if stderrMnt, ok := runner.Container.Mounts["stderr"]; ok {
 		stderrFile, err := runner.getStdoutFile(stderrMnt.Path)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		runner.Stderr = stderrFile
 	} else if w, err := runner.NewLogWriter("stderr"); err != nil {
-		return err
+		return nil, err
 	} else {
 		runner.Stderr = NewThrottledLogger(w)
 	}
 
+	// The executor reads stdin from a pipe, so errors reading
+	// the stdin source (e.g., from Keep) can be detected here.
 	if stdinRdr != nil {
+		pr, pw := io.Pipe()
 		go func() {
-			_, err := io.Copy(response.Conn, stdinRdr)
+			_, err := io.Copy(pw, stdinRdr)
 			if err != nil {
-				runner.CrunchLog.Printf("While writing stdin collection to docker container: %v", err)
+				runner.CrunchLog.Printf("While writing stdin collection to container: %v", err)
 				runner.stop(nil)
 			}
 			stdinRdr.Close()
-			response.CloseWrite()
+			pw.CloseWithError(err)
 		}()
+		return pr, nil
 	} else if len(stdinJson) != 0 {
-		go func() {
-			_, err := io.Copy(response.Conn, bytes.NewReader(stdinJson))
-			if err != nil {
-				runner.CrunchLog.Printf("While writing stdin json to docker container: %v", err)
-				runner.stop(nil)
-			}
-			response.CloseWrite()
-		}()
+		return bytes.NewReader(stdinJson), nil
 	}
-
-	go runner.ProcessDockerAttach(response.Reader)
-
-	return nil
+	return nil, nil
 }
 
 func (runner *ContainerRunner) getStdoutFile(mntPath string) (*os.File, error) {
@@ -1034,38 +980,27 @@ func (runner *ContainerRunner) getStdoutFile(mntPath string) (*os.File, error) {
 	return stdoutFile, nil
 }
 
-// CreateContainer creates the docker container.
+// CreateContainer creates the container.
 func (runner *ContainerRunner) CreateContainer() error {
-	runner.CrunchLog.Print("Creating Docker container")
-
-	runner.ContainerConfig.Cmd = runner.Container.Command
+	bindmounts, err := parseBinds(runner.Binds)
+	if err != nil {
+		return err
+	}
+	spec := containerSpec{
+		Image:        runner.imageID,
+		VCPUs:        runner.Container.RuntimeConstraints.VCPUs,
+		RAM:          int64(runner.Container.RuntimeConstraints.RAM),
+		BindMounts:   bindmounts,
+		Command:      runner.Container.Command,
+		NetworkMode:  runner.networkMode,
+		CgroupParent: runner.setCgroupParent,
+	}
 	if runner.Container.Cwd != "." {
-		runner.ContainerConfig.WorkingDir = runner.Container.Cwd
+		spec.WorkingDir = runner.Container.Cwd
 	}
 
 	for k, v := range runner.Container.Environment {
-		runner.ContainerConfig.Env = append(runner.ContainerConfig.Env, k+"="+v)
-	}
-
-	runner.ContainerConfig.Volumes = runner.Volumes
-
-	maxRAM := int64(runner.Container.RuntimeConstraints.RAM)
-	if maxRAM < 4*1024*1024 {
-		// Docker daemon won't let you set a limit less than 4 MiB
-		maxRAM = 4 * 1024 * 1024
-	}
-	runner.HostConfig = dockercontainer.HostConfig{
-		Binds: runner.Binds,
-		LogConfig: dockercontainer.LogConfig{
-			Type: "none",
-		},
-		Resources: dockercontainer.Resources{
-			CgroupParent: runner.setCgroupParent,
-			NanoCPUs:     int64(runner.Container.RuntimeConstraints.VCPUs) * 1000000000,
-			Memory:       maxRAM, // RAM
-			MemorySwap:   maxRAM, // RAM+swap
-			KernelMemory: maxRAM, // kernel portion
-		},
+		spec.Env = append(spec.Env, k+"="+v)
 	}
 
 	if wantAPI := runner.Container.RuntimeConstraints.API; wantAPI != nil && *wantAPI {
@@ -1073,47 +1008,42 @@ func (runner *ContainerRunner) CreateContainer() error {
 		if err != nil {
 			return err
 		}
-		runner.ContainerConfig.Env = append(runner.ContainerConfig.Env,
+		spec.Env = append(spec.Env,
 			"ARVADOS_API_TOKEN="+tok,
 			"ARVADOS_API_HOST="+os.Getenv("ARVADOS_API_HOST"),
 			"ARVADOS_API_HOST_INSECURE="+os.Getenv("ARVADOS_API_HOST_INSECURE"),
 		)
-		runner.HostConfig.NetworkMode = dockercontainer.NetworkMode(runner.networkMode)
+		spec.EnableNetwork = true
 	} else {
-		if runner.enableNetwork == "always" {
-			runner.HostConfig.NetworkMode = dockercontainer.NetworkMode(runner.networkMode)
-		} else {
-			runner.HostConfig.NetworkMode = dockercontainer.NetworkMode("none")
-		}
+		spec.EnableNetwork = runner.enableNetwork == "always"
 	}
 
-	_, stdinUsed := runner.Container.Mounts["stdin"]
-	runner.ContainerConfig.OpenStdin = stdinUsed
-	runner.ContainerConfig.StdinOnce = stdinUsed
-	runner.ContainerConfig.AttachStdin = stdinUsed
-	runner.ContainerConfig.AttachStdout = true
-	runner.ContainerConfig.AttachStderr = true
-
-	createdBody, err := runner.Docker.ContainerCreate(context.TODO(), &runner.ContainerConfig, &runner.HostConfig, nil, runner.Container.UUID)
+	spec.Stdin, err = runner.AttachStreams()
 	if err != nil {
-		return fmt.Errorf("While creating container: %v", err)
+		return err
 	}
+	spec.Stdout = runner.Stdout
+	spec.Stderr = runner.Stderr
 
-	runner.ContainerID = createdBody.ID
+	err = runner.executor.Create(spec)
+	if err != nil {
+		return err
+	}
 
-	return runner.AttachStreams()
+	runner.cStateLock.Lock()
+	runner.cCreated = true
+	runner.cStateLock.Unlock()
+	return nil
 }
 
-// StartContainer starts the docker container created by CreateContainer.
+// StartContainer starts the container created by CreateContainer.
 func (runner *ContainerRunner) StartContainer() error {
-	runner.CrunchLog.Printf("Starting Docker container id '%s'", runner.ContainerID)
 	runner.cStateLock.Lock()
 	defer runner.cStateLock.Unlock()
 	if runner.cCancelled {
 		return ErrCancelled
 	}
-	err := runner.Docker.ContainerStart(context.TODO(), runner.ContainerID,
-		dockertypes.ContainerStartOptions{})
+	err := runner.executor.Start()
 	if err != nil {
 		var advice string
 		if m, e := regexp.MatchString("(?ms).*(exec|System error).*(no such file or directory|file not found).*", err.Error()); m && e == nil {
@@ -1130,7 +1060,19 @@ func (runner *ContainerRunner) WaitFinish() error {
 	var runTimeExceeded <-chan time.Time
 	runner.CrunchLog.Print("Waiting for container to finish")
 
-	waitOk, waitErr := runner.Docker.ContainerWait(context.TODO(), runner.ContainerID, dockercontainer.WaitConditionNotRunning)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type waitResult struct {
+		exitCode int
+		err      error
+	}
+	waitDone := make(chan waitResult, 1)
+	go func() {
+		exitCode, err := runner.executor.Wait(ctx)
+		waitDone <- waitResult{exitCode, err}
+	}()
+
 	arvMountExit := runner.ArvMountExit
 	if timeout := runner.Container.SchedulingParameters.MaxRunTime; timeout > 0 {
 		runTimeExceeded = time.After(time.Duration(timeout) * time.Second)
@@ -1144,7 +1086,7 @@ func (runner *ContainerRunner) WaitFinish() error {
 		}
 		for range time.NewTicker(runner.containerWatchdogInterval).C {
 			ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(runner.containerWatchdogInterval))
-			ctr, err := runner.Docker.ContainerInspect(ctx, runner.ContainerID)
+			running, err := runner.executor.IsRunning(ctx)
 			cancel()
 			runner.cStateLock.Lock()
 			done := runner.cRemoved || runner.ExitCode != nil
@@ -1155,8 +1097,8 @@ func (runner *ContainerRunner) WaitFinish() error {
 				runner.CrunchLog.Printf("Error inspecting container: %s", err)
 				runner.checkBrokenNode(err)
 				return
-			} else if ctr.State == nil || !(ctr.State.Running || ctr.State.Status == "created") {
-				runner.CrunchLog.Printf("Container is not running: State=%v", ctr.State)
+			} else if !running {
+				runner.CrunchLog.Printf("Container is not running")
 				return
 			}
 		}
@@ -1164,18 +1106,19 @@ func (runner *ContainerRunner) WaitFinish() error {
 
 	for {
 		select {
-		case waitBody := <-waitOk:
-			runner.CrunchLog.Printf("Container exited with code: %v", waitBody.StatusCode)
-			code := int(waitBody.StatusCode)
+		case result := <-waitDone:
+			if result.err != nil {
+				return result.err
+			}
+			runner.CrunchLog.Printf("Container exited with code: %v", result.exitCode)
+			code := result.exitCode
+			runner.cStateLock.Lock()
 			runner.ExitCode = &code
+			runner.cStateLock.Unlock()
 
-			// wait for stdout/stderr to complete
-			<-runner.loggingDone
+			runner.closeStdoutStderr()
 			return nil
 
-		case err := <-waitErr:
-			return fmt.Errorf("container wait: %v", err)
-
 		case <-arvMountExit:
 			runner.CrunchLog.Printf("arv-mount exited while container is still running.  Stopping container.")
 			runner.stop(nil)
@@ -1189,7 +1132,7 @@ func (runner *ContainerRunner) WaitFinish() error {
 			runTimeExceeded = nil
 
 		case <-containerGone:
-			return errors.New("docker client never returned status")
+			return errors.New("container runtime never returned status")
 		}
 	}
 }
@@ -1270,6 +1213,8 @@ func (runner *ContainerRunner) CaptureOutput() error {
 		mounts:        runner.Container.Mounts,
 		secretMounts:  runner.SecretMounts,
 		logger:        runner.CrunchLog,
+
+		contentDefinedChunking: runner.contentDefinedChunking,
 	}).Copy()
 	if err != nil {
 		return err
@@ -1556,6 +1501,11 @@ func (runner *ContainerRunner) Run() (err error) {
 		// Log the error encountered in Run(), if any
 		checkErr("Run", err)
 
+		// WaitFinish normally does this, but not if the
+		// container failed to start or WaitFinish returned an
+		// error.
+		runner.closeStdoutStderr()
+
 		if runner.finalState == "Queued" {
 			runner.UpdateContainerFinal()
 			return
@@ -1692,14 +1642,12 @@ func (runner *ContainerRunner) fetchContainerRecord() error {
 func NewContainerRunner(dispatcherClient *arvados.Client,
 	dispatcherArvClient IArvadosClient,
 	dispatcherKeepClient IKeepClient,
-	docker ThinDockerClient,
 	containerUUID string) (*ContainerRunner, error) {
 
 	cr := &ContainerRunner{
 		dispatcherClient:     dispatcherClient,
 		DispatcherArvClient:  dispatcherArvClient,
 		DispatcherKeepClient: dispatcherKeepClient,
-		Docker:               docker,
 	}
 	cr.NewLogWriter = cr.NewArvLogWriter
 	cr.RunArvMount = cr.ArvMountCmd
@@ -1756,6 +1704,12 @@ func main() {
 	networkMode := flag.String("container-network-mode", "default",
 		`Set networking mode for container.  Corresponds to Docker network mode (--net).
     	`)
+	diskCacheDir := flag.String("disk-cache-dir", "", "Cache blocks (e.g., docker images) in `dir`, so they can be reused by subsequent containers on this host (the cache is only accessible to the user crunch-run runs as)")
+	diskCacheBytes := flag.Int64("disk-cache-bytes", 1<<30, "Size limit for -disk-cache-dir")
+	contentDefinedChunking := flag.Bool("content-defined-chunking", false, "Split output files into blocks at content-defined boundaries, so similar output files share blocks")
+	runtimeEngine := flag.String("runtime-engine", "docker", "container runtime: docker or singularity")
+	singularityImageCache := flag.String("singularity-image-cache", filepath.Join(os.TempDir(), "crunch-run-singularity"), "Save singularity images converted from docker images in `dir`, so they can be reused by subsequent containers on this host")
+	singularityLimitResources := flag.Bool("singularity-limit-resources", false, "Limit singularity containers' CPU and memory usage according to runtime constraints (requires cgroups support)")
 	memprofile := flag.String("memprofile", "", "write memory profile to `file` after running container")
 	getVersion := flag.Bool("version", false, "Print version information and exit.")
 	flag.Duration("check-containerd", 0, "Ignored. Exists for compatibility with older versions.")
@@ -1817,18 +1771,38 @@ func main() {
 	}
 	kc.BlockCache = &keepclient.BlockCache{MaxBlocks: 2}
 	kc.Retries = 4
+	if *diskCacheDir != "" {
+		// Blocks are read through the container's keep
+		// client, which uses the default block cache.
+		keepclient.DefaultBlockCache.DiskCache = &keepclient.DiskCache{
+			Dir:      *diskCacheDir,
+			MaxBytes: *diskCacheBytes,
+		}
+	}
 
-	// API version 1.21 corresponds to Docker 1.9, which is currently the
-	// minimum version we want to support.
-	docker, dockererr := dockerclient.NewClient(dockerclient.DefaultDockerHost, "1.21", nil, nil)
-
-	cr, err := NewContainerRunner(arvados.NewClientFromEnv(), api, kc, docker, containerId)
+	cr, err := NewContainerRunner(arvados.NewClientFromEnv(), api, kc, containerId)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if dockererr != nil {
-		cr.CrunchLog.Printf("%s: %v", containerId, dockererr)
-		cr.checkBrokenNode(dockererr)
+
+	switch *runtimeEngine {
+	case "docker":
+		// API version 1.21 corresponds to Docker 1.9, which is currently the
+		// minimum version we want to support.
+		docker, dockererr := dockerclient.NewClient(dockerclient.DefaultDockerHost, "1.21", nil, nil)
+		if dockererr != nil {
+			cr.CrunchLog.Printf("%s: %v", containerId, dockererr)
+			cr.checkBrokenNode(dockererr)
+			cr.CrunchLog.Close()
+			os.Exit(1)
+		}
+		cr.executor = newDockerExecutor(containerId, cr.CrunchLog.Printf, docker)
+	case "singularity":
+		e := newSingularityExecutor(cr.CrunchLog.Printf, *singularityImageCache)
+		e.limitResources = *singularityLimitResources
+		cr.executor = e
+	default:
+		cr.CrunchLog.Printf("%s: unsupported runtime engine %q", containerId, *runtimeEngine)
 		cr.CrunchLog.Close()
 		os.Exit(1)
 	}
@@ -1844,11 +1818,17 @@ func main() {
 	cr.expectCgroupParent = *cgroupParent
 	cr.enableNetwork = *enableNetwork
 	cr.networkMode = *networkMode
+	cr.contentDefinedChunking = *contentDefinedChunking
 	if *cgroupParentSubsystem != "" {
 		p := findCgroup(*cgroupParentSubsystem)
 		cr.setCgroupParent = p
 		cr.expectCgroupParent = p
 	}
+	if *runtimeEngine == "singularity" {
+		// The singularity executor's CgroupID() is a path
+		// relative to the cgroup root.
+		cr.expectCgroupParent = ""
+	}
 
 	runerr := cr.Run()
 
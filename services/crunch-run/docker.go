@@ -0,0 +1,234 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	dockertypes "github.com/docker/docker/api/types"
+	dockercontainer "github.com/docker/docker/api/types/container"
+	dockernetwork "github.com/docker/docker/api/types/network"
+)
+
+// ThinDockerClient is the minimal Docker client interface used by crunch-run.
+type ThinDockerClient interface {
+	ContainerAttach(ctx context.Context, container string, options dockertypes.ContainerAttachOptions) (dockertypes.HijackedResponse, error)
+	ContainerCreate(ctx context.Context, config *dockercontainer.Config, hostConfig *dockercontainer.HostConfig,
+		networkingConfig *dockernetwork.NetworkingConfig, containerName string) (dockercontainer.ContainerCreateCreatedBody, error)
+	ContainerStart(ctx context.Context, container string, options dockertypes.ContainerStartOptions) error
+	ContainerRemove(ctx context.Context, container string, options dockertypes.ContainerRemoveOptions) error
+	ContainerWait(ctx context.Context, container string, condition dockercontainer.WaitCondition) (<-chan dockercontainer.ContainerWaitOKBody, <-chan error)
+	ContainerInspect(ctx context.Context, id string) (dockertypes.ContainerJSON, error)
+	ImageInspectWithRaw(ctx context.Context, image string) (dockertypes.ImageInspect, []byte, error)
+	ImageLoad(ctx context.Context, input io.Reader, quiet bool) (dockertypes.ImageLoadResponse, error)
+	ImageRemove(ctx context.Context, image string, options dockertypes.ImageRemoveOptions) ([]dockertypes.ImageDeleteResponseItem, error)
+}
+
+// dockerExecutor is a containerExecutor that runs containers using
+// the Docker daemon.
+type dockerExecutor struct {
+	containerUUID string
+	logf          func(string, ...interface{})
+	dockerclient  ThinDockerClient
+	containerID   string
+	doneIO        chan struct{}
+}
+
+func newDockerExecutor(containerUUID string, logf func(string, ...interface{}), client ThinDockerClient) *dockerExecutor {
+	return &dockerExecutor{
+		containerUUID: containerUUID,
+		logf:          logf,
+		dockerclient:  client,
+	}
+}
+
+func (e *dockerExecutor) LoadImage(imageID, imagePDH string, tarball func() (io.ReadCloser, error)) error {
+	_, _, err := e.dockerclient.ImageInspectWithRaw(context.TODO(), imageID)
+	if err == nil {
+		e.logf("Docker image is available")
+		return nil
+	}
+
+	e.logf("Loading Docker image from keep")
+	readCloser, err := tarball()
+	if err != nil {
+		return err
+	}
+
+	response, err := e.dockerclient.ImageLoad(context.TODO(), readCloser, true)
+	if err != nil {
+		return fmt.Errorf("While loading container image into Docker: %v", err)
+	}
+	defer response.Body.Close()
+	rbody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("Reading response to image load: %v", err)
+	}
+	e.logf("Docker response: %s", rbody)
+	return nil
+}
+
+func (e *dockerExecutor) Create(spec containerSpec) error {
+	e.logf("Creating Docker container")
+	cfg := dockercontainer.Config{
+		Image:        spec.Image,
+		Cmd:          spec.Command,
+		WorkingDir:   spec.WorkingDir,
+		Env:          spec.Env,
+		OpenStdin:    spec.Stdin != nil,
+		StdinOnce:    spec.Stdin != nil,
+		AttachStdin:  spec.Stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+
+	maxRAM := spec.RAM
+	if maxRAM < 4*1024*1024 {
+		// Docker daemon won't let you set a limit less than 4 MiB
+		maxRAM = 4 * 1024 * 1024
+	}
+	hostCfg := dockercontainer.HostConfig{
+		LogConfig: dockercontainer.LogConfig{
+			Type: "none",
+		},
+		NetworkMode: dockercontainer.NetworkMode("none"),
+		Resources: dockercontainer.Resources{
+			CgroupParent: spec.CgroupParent,
+			NanoCPUs:     int64(spec.VCPUs) * 1000000000,
+			Memory:       maxRAM, // RAM
+			MemorySwap:   maxRAM, // RAM+swap
+			KernelMemory: maxRAM, // kernel portion
+		},
+	}
+	var binds []string
+	for path := range spec.BindMounts {
+		binds = append(binds, path)
+	}
+	sort.Strings(binds)
+	for _, path := range binds {
+		mount := spec.BindMounts[path]
+		if mount.ReadOnly {
+			hostCfg.Binds = append(hostCfg.Binds, mount.HostPath+":"+path+":ro")
+		} else {
+			hostCfg.Binds = append(hostCfg.Binds, mount.HostPath+":"+path)
+		}
+	}
+	if spec.EnableNetwork {
+		hostCfg.NetworkMode = dockercontainer.NetworkMode(spec.NetworkMode)
+	}
+
+	created, err := e.dockerclient.ContainerCreate(context.TODO(), &cfg, &hostCfg, nil, e.containerUUID)
+	if err != nil {
+		return fmt.Errorf("While creating container: %v", err)
+	}
+	e.containerID = created.ID
+	return e.startIO(spec.Stdin, spec.Stdout, spec.Stderr)
+}
+
+// startIO attaches to the container's stdin, stdout and stderr
+// streams, and starts copying them to/from the given reader and
+// writers.
+func (e *dockerExecutor) startIO(stdin io.Reader, stdout, stderr io.Writer) error {
+	resp, err := e.dockerclient.ContainerAttach(context.TODO(), e.containerID, dockertypes.ContainerAttachOptions{
+		Stream: true,
+		Stdin:  stdin != nil,
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		return fmt.Errorf("While attaching container stdout/stderr streams: %v", err)
+	}
+	if stdin != nil {
+		go func() {
+			// Errors reading stdin are handled by the
+			// caller, who supplied the reader.
+			io.Copy(resp.Conn, stdin)
+			resp.CloseWrite()
+		}()
+	}
+	e.doneIO = make(chan struct{})
+	go func() {
+		err := e.handleStdoutStderr(stdout, stderr, resp.Reader)
+		if err != nil {
+			e.logf("error reading docker logs: %v", err)
+		}
+		close(e.doneIO)
+	}()
+	return nil
+}
+
+// handleStdoutStderr demultiplexes the docker attach stream.
+// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.15/#attach-to-a-container
+func (e *dockerExecutor) handleStdoutStderr(stdout, stderr io.Writer, reader io.Reader) error {
+	header := make([]byte, 8)
+	var err error
+	for err == nil {
+		_, err = io.ReadAtLeast(reader, header, 8)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		readsize := int64(header[7]) | (int64(header[6]) << 8) | (int64(header[5]) << 16) | (int64(header[4]) << 24)
+		if header[0] == 1 {
+			// stdout
+			_, err = io.CopyN(stdout, reader, readsize)
+		} else {
+			// stderr
+			_, err = io.CopyN(stderr, reader, readsize)
+		}
+	}
+	return err
+}
+
+func (e *dockerExecutor) Start() error {
+	e.logf("Starting Docker container id '%s'", e.containerID)
+	return e.dockerclient.ContainerStart(context.TODO(), e.containerID, dockertypes.ContainerStartOptions{})
+}
+
+func (e *dockerExecutor) IsRunning(ctx context.Context) (bool, error) {
+	ctr, err := e.dockerclient.ContainerInspect(ctx, e.containerID)
+	if err != nil {
+		return false, err
+	}
+	if ctr.State == nil || !(ctr.State.Running || ctr.State.Status == "created") {
+		e.logf("Docker container state: %v", ctr.State)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (e *dockerExecutor) Stop() error {
+	err := e.dockerclient.ContainerRemove(context.TODO(), e.containerID, dockertypes.ContainerRemoveOptions{Force: true})
+	if err != nil && strings.Contains(err.Error(), "No such container: "+e.containerID) {
+		err = nil
+	}
+	return err
+}
+
+func (e *dockerExecutor) Wait(ctx context.Context) (int, error) {
+	waitOk, waitErr := e.dockerclient.ContainerWait(ctx, e.containerID, dockercontainer.WaitConditionNotRunning)
+	select {
+	case waitBody := <-waitOk:
+		// wait for stdout/stderr to complete
+		<-e.doneIO
+		return int(waitBody.StatusCode), nil
+	case err := <-waitErr:
+		return -1, fmt.Errorf("container wait: %v", err)
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+}
+
+func (e *dockerExecutor) CgroupID() string {
+	return e.containerID
+}
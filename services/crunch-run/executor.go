@@ -0,0 +1,98 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// bindmount is a host directory or file to be made available inside
+// the container.
+type bindmount struct {
+	HostPath string
+	ReadOnly bool
+}
+
+// containerSpec describes a container to be run by a
+// containerExecutor. It is independent of the container engine.
+type containerSpec struct {
+	Image         string // image ID (the docker image hash)
+	VCPUs         int
+	RAM           int64
+	WorkingDir    string
+	Env           []string // "NAME=value"
+	BindMounts    map[string]bindmount
+	Command       []string
+	EnableNetwork bool
+	NetworkMode   string // docker network mode, normally "default"
+	CgroupParent  string
+	Stdin         io.Reader // nil if the container has no stdin
+	Stdout        io.Writer
+	Stderr        io.Writer
+}
+
+// containerExecutor runs a single container using a container engine
+// such as Docker or Singularity.
+//
+// The methods are called in order: LoadImage, Create, Start, Wait.
+// Stop may be called at any time after Create, from any goroutine.
+type containerExecutor interface {
+	// LoadImage makes the given image available to the
+	// container engine. If the image is not already available,
+	// it is read from the docker image tarball returned by
+	// tarball, which is identified by the given portable data
+	// hash (the container_image collection).
+	LoadImage(imageID, imagePDH string, tarball func() (io.ReadCloser, error)) error
+
+	// Create prepares a new container. Output copying starts
+	// right away, but the container process does not start until
+	// Start is called.
+	Create(spec containerSpec) error
+
+	// Start starts the container process.
+	Start() error
+
+	// IsRunning returns false if the container is known to have
+	// exited (or never started). It is used to detect containers
+	// that have disappeared without Wait noticing.
+	IsRunning(ctx context.Context) (bool, error)
+
+	// Stop forcibly stops the container and cleans up engine
+	// resources. It returns nil if the container is already
+	// gone.
+	Stop() error
+
+	// Wait waits for the container to exit and for all of its
+	// stdout/stderr to be written to spec.Stdout and
+	// spec.Stderr, then returns its exit code.
+	Wait(ctx context.Context) (int, error)
+
+	// CgroupID returns the container ID used to find the
+	// container's cgroups for crunchstat, or "" if the container
+	// has no cgroup of its own (in which case crunchstat is not
+	// started).
+	CgroupID() string
+}
+
+// parseBinds converts docker-style bind specs ("src:dst" or
+// "src:dst:ro") to bindmounts, keyed by container path.
+func parseBinds(binds []string) (map[string]bindmount, error) {
+	mounts := map[string]bindmount{}
+	for _, bind := range binds {
+		parts := strings.Split(bind, ":")
+		if len(parts) == 3 && parts[2] == "ro" {
+			mounts[parts[1]] = bindmount{HostPath: parts[0], ReadOnly: true}
+		} else if len(parts) == 2 {
+			mounts[parts[1]] = bindmount{HostPath: parts[0]}
+		} else {
+			return nil, fmt.Errorf("cannot parse bind mount %q", bind)
+		}
+	}
+	return mounts, nil
+}
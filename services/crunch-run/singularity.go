@@ -0,0 +1,276 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/context"
+)
+
+// singularityExecutor is a containerExecutor that runs containers
+// using Singularity or Apptainer, which don't need a daemon or root
+// privileges on the host. Apptainer installs a "singularity" command
+// for compatibility, so both are run the same way.
+//
+// Docker images are converted to SIF files, which are cached in
+// imageCacheDir so subsequent containers using the same image (i.e.,
+// the same container_image collection) can reuse them.
+type singularityExecutor struct {
+	logf          func(string, ...interface{})
+	imageCacheDir string
+
+	// Apply the container's VCPUs and RAM constraints using
+	// singularity's --cpus and --memory options, which require
+	// cgroups support. Sites that run crunch-run in a batch
+	// scheduler that enforces resource limits (e.g., SLURM with
+	// cgroups) don't need this.
+	limitResources bool
+
+	sifPath string
+	spec    containerSpec
+	child   *exec.Cmd
+	mtx     sync.Mutex
+	started bool
+	exited  chan struct{}
+	errWait error
+}
+
+func newSingularityExecutor(logf func(string, ...interface{}), imageCacheDir string) *singularityExecutor {
+	return &singularityExecutor{
+		logf:          logf,
+		imageCacheDir: imageCacheDir,
+		exited:        make(chan struct{}),
+	}
+}
+
+// LoadImage converts the docker image tarball to a SIF file, unless
+// a SIF file for the given image collection is already in the cache.
+func (e *singularityExecutor) LoadImage(imageID, imagePDH string, tarball func() (io.ReadCloser, error)) error {
+	e.sifPath = filepath.Join(e.imageCacheDir, imagePDH+".sif")
+	if _, err := os.Stat(e.sifPath); err == nil {
+		e.logf("Using cached singularity image %s", e.sifPath)
+		return nil
+	}
+
+	err := os.MkdirAll(e.imageCacheDir, 0755)
+	if err != nil {
+		return fmt.Errorf("While creating singularity image cache directory: %v", err)
+	}
+	// Build in a temporary directory next to the cache, then
+	// rename into place, so concurrent crunch-run processes never
+	// see a partially written SIF file.
+	tmpdir, err := ioutil.TempDir(e.imageCacheDir, "build-")
+	if err != nil {
+		return fmt.Errorf("While creating singularity build directory: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	e.logf("Loading Docker image from keep")
+	tarPath := filepath.Join(tmpdir, imageID+".tar")
+	err = e.saveTarball(tarPath, tarball)
+	if err != nil {
+		return err
+	}
+
+	e.logf("Converting Docker image to singularity image")
+	sifPath := filepath.Join(tmpdir, "image.sif")
+	build := exec.Command("singularity", "build", sifPath, "docker-archive://"+tarPath)
+	// Singularity uses a lot of temporary space while building,
+	// so keep it off /tmp, which is often small.
+	build.Env = append(os.Environ(),
+		"SINGULARITY_TMPDIR="+tmpdir,
+		"SINGULARITY_CACHEDIR="+tmpdir,
+		"APPTAINER_TMPDIR="+tmpdir,
+		"APPTAINER_CACHEDIR="+tmpdir)
+	out, err := build.CombinedOutput()
+	e.logf("%v: %s", build.Args, out)
+	if err != nil {
+		return fmt.Errorf("While converting container image to singularity image: %v", err)
+	}
+	err = os.Rename(sifPath, e.sifPath)
+	if err != nil {
+		return fmt.Errorf("While saving singularity image: %v", err)
+	}
+	return nil
+}
+
+func (e *singularityExecutor) saveTarball(path string, tarball func() (io.ReadCloser, error)) error {
+	rdr, err := tarball()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("While creating image tarball: %v", err)
+	}
+	_, err = io.Copy(f, rdr)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("While writing image tarball: %v", err)
+	}
+	return f.Close()
+}
+
+func (e *singularityExecutor) Create(spec containerSpec) error {
+	e.spec = spec
+	e.child = exec.Command("singularity", e.execArgs()...)
+	e.child.Env = e.execEnv()
+	e.child.Stdin = spec.Stdin
+	e.child.Stdout = spec.Stdout
+	e.child.Stderr = spec.Stderr
+	// Run in a new process group so Stop can kill everything
+	// started by singularity.
+	e.child.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return nil
+}
+
+// execArgs returns the arguments for "singularity exec".
+func (e *singularityExecutor) execArgs() []string {
+	// --containall gives the container its own PID and IPC
+	// namespaces, an empty /tmp and home directory, and a clean
+	// environment, like a docker container.
+	args := []string{"exec", "--containall"}
+	if e.spec.WorkingDir != "" {
+		args = append(args, "--pwd", e.spec.WorkingDir)
+	}
+	if !e.spec.EnableNetwork {
+		args = append(args, "--net", "--network=none")
+	}
+	if e.limitResources {
+		if e.spec.VCPUs > 0 {
+			args = append(args, "--cpus", fmt.Sprintf("%d", e.spec.VCPUs))
+		}
+		if e.spec.RAM > 0 {
+			args = append(args, "--memory", fmt.Sprintf("%d", e.spec.RAM))
+		}
+	}
+	var binds []string
+	for path := range e.spec.BindMounts {
+		binds = append(binds, path)
+	}
+	sort.Strings(binds)
+	for _, path := range binds {
+		mount := e.spec.BindMounts[path]
+		mode := "rw"
+		if mount.ReadOnly {
+			mode = "ro"
+		}
+		args = append(args, "--bind", mount.HostPath+":"+path+":"+mode)
+	}
+	args = append(args, e.sifPath)
+	return append(args, e.spec.Command...)
+}
+
+// execEnv returns the environment for "singularity exec". The
+// container doesn't inherit crunch-run's environment, but variables
+// with the SINGULARITYENV_ prefix are passed into the container
+// without the prefix. Apptainer accepts the same prefix for
+// compatibility.
+func (e *singularityExecutor) execEnv() []string {
+	env := os.Environ()
+	for _, kv := range e.spec.Env {
+		env = append(env, "SINGULARITYENV_"+kv)
+	}
+	return env
+}
+
+func (e *singularityExecutor) Start() error {
+	e.logf("Starting singularity container: %v", e.child.Args)
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	err := e.child.Start()
+	if err != nil {
+		return err
+	}
+	e.started = true
+	go func() {
+		e.errWait = e.child.Wait()
+		close(e.exited)
+	}()
+	return nil
+}
+
+func (e *singularityExecutor) IsRunning(ctx context.Context) (bool, error) {
+	select {
+	case <-e.exited:
+		return false, nil
+	default:
+		// Either running, or created and not yet started.
+		return true, nil
+	}
+}
+
+func (e *singularityExecutor) Stop() error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if !e.started {
+		return nil
+	}
+	select {
+	case <-e.exited:
+		return nil
+	default:
+	}
+	err := syscall.Kill(-e.child.Process.Pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		err = nil
+	}
+	return err
+}
+
+func (e *singularityExecutor) Wait(ctx context.Context) (int, error) {
+	e.mtx.Lock()
+	started := e.started
+	e.mtx.Unlock()
+	if !started {
+		return -1, errors.New("container was not started")
+	}
+	select {
+	case <-e.exited:
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+	if e.errWait == nil {
+		return 0, nil
+	}
+	exiterr, ok := e.errWait.(*exec.ExitError)
+	if !ok {
+		return -1, e.errWait
+	}
+	status := exiterr.Sys().(syscall.WaitStatus)
+	if status.Signaled() {
+		// Report the same exit code as docker.
+		return 128 + int(status.Signal()), nil
+	}
+	return status.ExitStatus(), nil
+}
+
+// CgroupID returns crunch-run's own cgroup, relative to the cgroup
+// root. Singularity doesn't create a new cgroup for the container,
+// so crunchstat reports the resource usage of crunch-run and its
+// child processes (including arv-mount).
+//
+// It returns "" if crunch-run is in the root cgroup, or if there is
+// no cgroup v1 cpuacct hierarchy (e.g., on a cgroup v2 host): in
+// either case there is no cgroup that would report usage of this
+// container alone.
+func (e *singularityExecutor) CgroupID() string {
+	cgroup, err := cgroupFromProcFile("/proc/self/cgroup", "cpuacct")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(cgroup, "/")
+}
@@ -0,0 +1,184 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+	check "gopkg.in/check.v1"
+)
+
+// fakeSingularity is installed as "singularity" in PATH during tests.
+// "build" copies the docker image tarball to the SIF file, and "exec"
+// runs the given command on the host.
+const fakeSingularity = `#!/bin/sh
+case "$1" in
+build)
+	cp "${3#docker-archive://}" "$2"
+	;;
+exec)
+	while [ $# -gt 0 ]; do
+		case "$1" in
+		*.sif) shift; break ;;
+		esac
+		shift
+	done
+	exec "$@"
+	;;
+esac
+`
+
+var _ = check.Suite(&singularitySuite{})
+
+type singularitySuite struct {
+	tmpdir  string
+	oldPath string
+}
+
+func (s *singularitySuite) SetUpTest(c *check.C) {
+	var err error
+	s.tmpdir, err = ioutil.TempDir("", "crunch-run-singularity-test.")
+	c.Assert(err, check.IsNil)
+	err = os.Mkdir(s.tmpdir+"/bin", 0755)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(s.tmpdir+"/bin/singularity", []byte(fakeSingularity), 0755)
+	c.Assert(err, check.IsNil)
+	s.oldPath = os.Getenv("PATH")
+	os.Setenv("PATH", s.tmpdir+"/bin:"+s.oldPath)
+}
+
+func (s *singularitySuite) TearDownTest(c *check.C) {
+	os.Setenv("PATH", s.oldPath)
+	os.RemoveAll(s.tmpdir)
+}
+
+func (s *singularitySuite) TestParseBinds(c *check.C) {
+	mounts, err := parseBinds([]string{"/host/tmp:/tmp", "/host/keep/by_id/abc:/keep/abc:ro"})
+	c.Check(err, check.IsNil)
+	c.Check(mounts, check.DeepEquals, map[string]bindmount{
+		"/tmp":      {HostPath: "/host/tmp"},
+		"/keep/abc": {HostPath: "/host/keep/by_id/abc", ReadOnly: true},
+	})
+
+	_, err = parseBinds([]string{"/host/tmp:/tmp:rw:x"})
+	c.Check(err, check.NotNil)
+}
+
+func (s *singularitySuite) TestExecArgs(c *check.C) {
+	e := newSingularityExecutor(c.Logf, s.tmpdir+"/cache")
+	e.sifPath = "/cache/image.sif"
+	e.Create(containerSpec{
+		Command:    []string{"echo", "ok"},
+		WorkingDir: "/tmp",
+		VCPUs:      2,
+		RAM:        1 << 30,
+		BindMounts: map[string]bindmount{
+			"/tmp":      {HostPath: "/host/tmp"},
+			"/keep/abc": {HostPath: "/host/keep/by_id/abc", ReadOnly: true},
+		},
+		Env: []string{"FOO=bar", "ARVADOS_API_HOST=example.com"},
+	})
+	c.Check(e.child.Args[1:], check.DeepEquals, []string{
+		"exec", "--containall", "--pwd", "/tmp",
+		"--net", "--network=none",
+		"--bind", "/host/keep/by_id/abc:/keep/abc:ro",
+		"--bind", "/host/tmp:/tmp:rw",
+		"/cache/image.sif", "echo", "ok",
+	})
+	c.Check(e.child.Env[len(e.child.Env)-2:], check.DeepEquals, []string{
+		"SINGULARITYENV_FOO=bar",
+		"SINGULARITYENV_ARVADOS_API_HOST=example.com",
+	})
+
+	e.limitResources = true
+	e.Create(containerSpec{
+		Command:       []string{"true"},
+		VCPUs:         2,
+		RAM:           1 << 30,
+		EnableNetwork: true,
+	})
+	c.Check(e.child.Args[1:], check.DeepEquals, []string{
+		"exec", "--containall",
+		"--cpus", "2", "--memory", "1073741824",
+		"/cache/image.sif", "true",
+	})
+}
+
+func (s *singularitySuite) TestLoadImageCache(c *check.C) {
+	calls := 0
+	tarball := func() (io.ReadCloser, error) {
+		calls++
+		return ioutil.NopCloser(strings.NewReader("fake image")), nil
+	}
+	for i := 0; i < 2; i++ {
+		e := newSingularityExecutor(c.Logf, s.tmpdir+"/cache")
+		err := e.LoadImage("abcdef", "d4ab34d3d4f8a72f5c4973051ae69fab+122", tarball)
+		c.Assert(err, check.IsNil)
+		c.Check(e.sifPath, check.Equals, s.tmpdir+"/cache/d4ab34d3d4f8a72f5c4973051ae69fab+122.sif")
+		buf, err := ioutil.ReadFile(e.sifPath)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf), check.Equals, "fake image")
+	}
+	c.Check(calls, check.Equals, 1)
+
+	// Build directories are cleaned up
+	entries, err := filepath.Glob(s.tmpdir + "/cache/*")
+	c.Check(err, check.IsNil)
+	c.Check(entries, check.HasLen, 1)
+}
+
+func (s *singularitySuite) TestRun(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	e := newSingularityExecutor(c.Logf, s.tmpdir+"/cache")
+	e.sifPath = s.tmpdir + "/image.sif"
+	err := e.Create(containerSpec{
+		Command: []string{"sh", "-c", "read x; echo $x $SINGULARITYENV_FOO; echo err >&2; exit 3"},
+		Env:     []string{"FOO=bar"},
+		Stdin:   strings.NewReader("hello\n"),
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	})
+	c.Assert(err, check.IsNil)
+	running, err := e.IsRunning(context.Background())
+	c.Check(err, check.IsNil)
+	c.Check(running, check.Equals, true)
+
+	err = e.Start()
+	c.Assert(err, check.IsNil)
+	code, err := e.Wait(context.Background())
+	c.Check(err, check.IsNil)
+	c.Check(code, check.Equals, 3)
+	c.Check(stdout.String(), check.Equals, "hello bar\n")
+	c.Check(stderr.String(), check.Equals, "err\n")
+
+	running, err = e.IsRunning(context.Background())
+	c.Check(err, check.IsNil)
+	c.Check(running, check.Equals, false)
+	c.Check(e.Stop(), check.IsNil)
+}
+
+func (s *singularitySuite) TestStop(c *check.C) {
+	e := newSingularityExecutor(c.Logf, s.tmpdir+"/cache")
+	c.Check(e.Stop(), check.IsNil)
+	e.sifPath = s.tmpdir + "/image.sif"
+	err := e.Create(containerSpec{
+		Command: []string{"sleep", "60"},
+		Stdout:  ioutil.Discard,
+		Stderr:  ioutil.Discard,
+	})
+	c.Assert(err, check.IsNil)
+	err = e.Start()
+	c.Assert(err, check.IsNil)
+	c.Check(e.Stop(), check.IsNil)
+	code, err := e.Wait(context.Background())
+	c.Check(err, check.IsNil)
+	c.Check(code, check.Equals, 137)
+}
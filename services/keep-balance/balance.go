@@ -41,6 +41,22 @@ type Balancer struct {
 
 	LostBlocksFile string
 
+	// Destination filename for the computed change sets (see
+	// Config.ChangeSetFile).
+	ChangeSetFile string
+
+	// Destination filename for the block report (see
+	// Config.BlockReportFile).
+	BlockReportFile string
+
+	// Destination filename for the usage report (see
+	// Config.UsageReportFile).
+	UsageReportFile string
+
+	// Failure domain of each keep service, keyed by service
+	// UUID. See Config.FailureDomains.
+	FailureDomains map[string]string
+
 	*BlockStateMap
 	KeepServices       map[string]*KeepService
 	DefaultReplication int
@@ -48,13 +64,19 @@ type Balancer struct {
 
 	classes       []string
 	mounts        int
+	domains       int
 	mountsByClass map[string]map[*KeepMount]bool
 	collScanned   int
+	collections   *collectionState
+	partialIndex  bool
 	serviceRoots  map[string]string
 	errors        []error
 	stats         balancerStats
 	mutex         sync.Mutex
 	lostBlocks    io.Writer
+	blockReport   *blockReport
+	lastSeen      map[arvados.SizedDigest][]blockReportMount
+	usage         *usageReport
 }
 
 // Run performs a balance operation using the given config and
@@ -65,12 +87,17 @@ type Balancer struct {
 //
 // Typical usage:
 //
-//   runOptions, err = (&Balancer{}).Run(config, runOptions)
+//	runOptions, err = (&Balancer{}).Run(config, runOptions)
 func (bal *Balancer) Run(config Config, runOptions RunOptions) (nextRunOptions RunOptions, err error) {
 	nextRunOptions = runOptions
 
 	defer bal.time("sweep", "wall clock time to run one full sweep")()
 
+	window, err := parseTimeWindow(config.CommitWindow)
+	if err != nil {
+		return
+	}
+
 	var lbFile *os.File
 	if bal.LostBlocksFile != "" {
 		tmpfn := bal.LostBlocksFile + ".tmp"
@@ -95,23 +122,23 @@ func (bal *Balancer) Run(config Config, runOptions RunOptions) (nextRunOptions R
 		bal.lostBlocks = ioutil.Discard
 	}
 
-	if len(config.KeepServiceList.Items) > 0 {
-		err = bal.SetKeepServices(config.KeepServiceList)
-	} else {
-		err = bal.DiscoverKeepServices(&config.Client, config.KeepServiceTypes)
+	if bal.UsageReportFile != "" {
+		bal.usage = &usageReport{Owners: map[string]*ownerUsage{}}
 	}
-	if err != nil {
-		return
-	}
-
-	for _, srv := range bal.KeepServices {
-		err = srv.discoverMounts(&config.Client)
-		if err != nil {
-			return
+	if bal.BlockReportFile != "" {
+		bal.blockReport = &blockReport{Blocks: []blockReportEntry{}}
+		bal.lastSeen = runOptions.lastSeen
+		if bal.lastSeen == nil {
+			bal.lastSeen, err = loadLastSeen(bal.BlockReportFile)
+			if err != nil {
+				bal.logf("error loading previous block report: %s", err)
+			}
 		}
 	}
-	bal.cleanupMounts()
 
+	if err = bal.setupKeepServices(config); err != nil {
+		return
+	}
 	if err = bal.CheckSanityEarly(&config.Client); err != nil {
 		return
 	}
@@ -130,10 +157,33 @@ func (bal *Balancer) Run(config Config, runOptions RunOptions) (nextRunOptions R
 		// succeed in clearing existing trash lists.
 		nextRunOptions.SafeRendezvousState = rs
 	}
+	if config.IncrementalCollections {
+		bal.collections = bal.collectionStateForRun(config, runOptions.collections)
+		if !config.IncrementalIndexes {
+			bal.collections.Indexes = nil
+		}
+	}
 	if err = bal.GetCurrentState(&config.Client, config.CollectionBatchSize, config.CollectionBuffers); err != nil {
 		return
 	}
+	if bal.collections != nil {
+		nextRunOptions.collections = bal.collections
+		if config.StateFile != "" {
+			if err = bal.collections.Save(config.StateFile); err != nil {
+				return
+			}
+		}
+	}
+	if bal.usage != nil {
+		if err = bal.computeUsage(&config.Client, config.CollectionBatchSize); err != nil {
+			return
+		}
+		if err = writeFileAtomic(bal.UsageReportFile, func(w io.Writer) error { return writeUsageReport(w, bal.usage) }); err != nil {
+			return
+		}
+	}
 	bal.ComputeChangeSets()
+	bal.limitChangeSets(config)
 	bal.PrintStatistics()
 	if err = bal.CheckSanityLate(); err != nil {
 		return
@@ -149,6 +199,22 @@ func (bal *Balancer) Run(config Config, runOptions RunOptions) (nextRunOptions R
 		}
 		lbFile = nil
 	}
+	if bal.ChangeSetFile != "" {
+		if err = writeFileAtomic(bal.ChangeSetFile, func(w io.Writer) error { return WriteChangeSets(w, bal.KeepServices) }); err != nil {
+			return
+		}
+	}
+	if bal.blockReport != nil {
+		nextRunOptions.lastSeen = bal.finishBlockReport()
+		if err = writeFileAtomic(bal.BlockReportFile, func(w io.Writer) error { return writeBlockReport(w, bal.blockReport) }); err != nil {
+			return
+		}
+	}
+	if (runOptions.CommitPulls || runOptions.CommitTrash) && !window.Contains(time.Now()) {
+		bal.logf("outside CommitWindow %q, clearing pull/trash lists instead of committing changes", config.CommitWindow)
+		err = bal.clearLists(&config.Client, runOptions)
+		return
+	}
 	if runOptions.CommitPulls {
 		err = bal.CommitPulls(&config.Client)
 		if err != nil {
@@ -156,12 +222,36 @@ func (bal *Balancer) Run(config Config, runOptions RunOptions) (nextRunOptions R
 			return
 		}
 	}
-	if runOptions.CommitTrash {
+	if runOptions.CommitTrash && bal.partialIndex {
+		bal.logf("not committing trash lists until the next full scan, because some indexes are incomplete")
+	} else if runOptions.CommitTrash {
 		err = bal.CommitTrash(&config.Client)
 	}
 	return
 }
 
+// setupKeepServices gets the list of KeepServices to operate on
+// (from config, or by discovery), and their mounts.
+func (bal *Balancer) setupKeepServices(config Config) error {
+	var err error
+	if len(config.KeepServiceList.Items) > 0 {
+		err = bal.SetKeepServices(config.KeepServiceList)
+	} else {
+		err = bal.DiscoverKeepServices(&config.Client, config.KeepServiceTypes)
+	}
+	if err != nil {
+		return err
+	}
+	for _, srv := range bal.KeepServices {
+		err = srv.discoverMounts(&config.Client)
+		if err != nil {
+			return err
+		}
+	}
+	bal.cleanupMounts()
+	return nil
+}
+
 // SetKeepServices sets the list of KeepServices to operate on.
 func (bal *Balancer) SetKeepServices(srvList arvados.KeepServiceList) error {
 	bal.KeepServices = make(map[string]*KeepService)
@@ -301,6 +391,29 @@ func (bal *Balancer) ClearTrashLists(c *arvados.Client) error {
 	return bal.CommitTrash(c)
 }
 
+// clearLists sends empty pull and/or trash lists (whichever are
+// enabled in runOptions) to all keep services, so they stop working
+// on lists sent by previous runs. Unlike ClearTrashLists, it leaves
+// the computed change sets alone, so they can still be reported.
+func (bal *Balancer) clearLists(c *arvados.Client, runOptions RunOptions) error {
+	if runOptions.CommitPulls {
+		err := bal.commitAsync(c, "clear pull list",
+			func(srv *KeepService) error {
+				return srv.put(c, "pull", []Pull{})
+			})
+		if err != nil {
+			return err
+		}
+	}
+	if runOptions.CommitTrash {
+		return bal.commitAsync(c, "clear trash list",
+			func(srv *KeepService) error {
+				return srv.put(c, "trash", []Trash{})
+			})
+	}
+	return nil
+}
+
 // GetCurrentState determines the current replication state, and the
 // desired replication level, for every block that is either
 // retrievable or referenced.
@@ -348,15 +461,44 @@ func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) erro
 		}
 	}
 
+	// In incremental mode, update the indexes saved by previous
+	// runs instead of retrieving full indexes.
+	var mountIndexes map[*KeepMount]*mountIndex
+	if bal.collections != nil && bal.collections.Indexes != nil {
+		var indexed []*KeepMount
+		for mnt := range equivMount {
+			indexed = append(indexed, mnt)
+		}
+		mountIndexes = bal.collections.MountIndexes(indexed)
+	}
+	var partialMtx sync.Mutex
+
+	// indexesDone is closed when all indexes have been retrieved
+	// and added to BlockStateMap.
+	indexesDone := make(chan struct{})
+	idxWg := sync.WaitGroup{}
+
 	// Start one goroutine for each (non-redundant) mount:
 	// retrieve the index, and add the returned blocks to
 	// BlockStateMap.
 	for _, mounts := range equivMount {
-		wg.Add(1)
-		go func(mounts []*KeepMount) {
-			defer wg.Done()
+		idxWg.Add(1)
+		go func(mounts []*KeepMount, mi *mountIndex) {
+			defer idxWg.Done()
 			bal.logf("mount %s: retrieve index from %s", mounts[0], mounts[0].KeepService)
-			idx, err := mounts[0].KeepService.IndexMount(c, mounts[0].UUID, "")
+			var idx []arvados.KeepServiceIndexEntry
+			var err error
+			if mi != nil {
+				var partial bool
+				idx, partial, err = mi.Update(c, mounts[0])
+				if partial {
+					partialMtx.Lock()
+					bal.partialIndex = true
+					partialMtx.Unlock()
+				}
+			} else {
+				idx, err = mounts[0].KeepService.IndexMount(c, mounts[0].UUID, "")
+			}
 			if err != nil {
 				select {
 				case errs <- fmt.Errorf("%s: retrieve index: %v", mounts[0], err):
@@ -376,8 +518,14 @@ func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) erro
 				bal.logf("%s: added %d entries to map at %dx (%d replicas)", mount, len(idx), mount.Replication, len(idx)*mount.Replication)
 			}
 			bal.logf("mount %s: index done", mounts[0])
-		}(mounts)
+		}(mounts, mountIndexes[mounts[0]])
 	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		idxWg.Wait()
+		close(indexesDone)
+	}()
 
 	// collQ buffers incoming collections so we can start fetching
 	// the next page without waiting for the current page to
@@ -390,8 +538,23 @@ func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) erro
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		if bal.collections == nil && bal.BlockReportFile != "" {
+			// Don't start adding collections until all
+			// replicas are known, so the block report
+			// only keeps track of the collections
+			// referencing blocks that are actually
+			// underreplicated. (In incremental mode,
+			// collections are added after
+			// GetCurrentState has retrieved everything.)
+			<-indexesDone
+		}
 		for coll := range collQ {
-			err := bal.addCollection(coll)
+			var err error
+			if bal.collections != nil {
+				err = bal.collections.Update(coll)
+			} else {
+				err = bal.addCollection(coll)
+			}
 			if err != nil || len(errs) > 0 {
 				select {
 				case errs <- err:
@@ -407,10 +570,15 @@ func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) erro
 
 	// Start a goroutine to retrieve all collections from the
 	// Arvados database and send them to collQ for processing.
+	var since time.Time
+	if bal.collections != nil {
+		since = bal.collections.Since()
+		bal.logf("retrieving collections modified since %s", since)
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err = EachCollection(c, pageSize,
+		err = EachCollectionSince(c, pageSize, since,
 			func(coll arvados.Collection) error {
 				collQ <- coll
 				if len(errs) > 0 {
@@ -437,6 +605,15 @@ func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) erro
 	if len(errs) > 0 {
 		return <-errs
 	}
+	if bal.collections != nil {
+		// Apply all collections we know about, not just the
+		// ones we retrieved this time.
+		bal.logf("collections: %d retrieved, %d total", bal.collScanned, len(bal.collections.Collections))
+		for uuid, refs := range bal.collections.Collections {
+			bal.addCollectionRefs(uuid, refs)
+		}
+		bal.collScanned = len(bal.collections.Collections)
+	}
 	return nil
 }
 
@@ -445,19 +622,69 @@ func (bal *Balancer) addCollection(coll arvados.Collection) error {
 	if err != nil {
 		return fmt.Errorf("%v: %v", coll.UUID, err)
 	}
+	bal.addCollectionRefs(coll.UUID, collectionRefs{
+		PortableDataHash:      coll.PortableDataHash,
+		OwnerUUID:             coll.OwnerUUID,
+		ReplicationDesired:    coll.ReplicationDesired,
+		StorageClassesDesired: coll.StorageClassesDesired,
+		Blocks:                blkids,
+	})
+	return nil
+}
+
+func (bal *Balancer) addCollectionRefs(uuid string, refs collectionRefs) {
 	repl := bal.DefaultReplication
-	if coll.ReplicationDesired != nil {
-		repl = *coll.ReplicationDesired
+	if refs.ReplicationDesired != nil {
+		repl = *refs.ReplicationDesired
 	}
-	debugf("%v: %d block x%d", coll.UUID, len(blkids), repl)
+	debugf("%v: %d block x%d", uuid, len(refs.Blocks), repl)
 	// Pass pdh to IncreaseDesired only if LostBlocksFile is being
 	// written -- otherwise it's just a waste of memory.
 	pdh := ""
 	if bal.LostBlocksFile != "" {
-		pdh = coll.PortableDataHash
+		pdh = refs.PortableDataHash
 	}
-	bal.BlockStateMap.IncreaseDesired(pdh, coll.StorageClassesDesired, repl, blkids)
-	return nil
+	// Likewise, track the referring collection only if
+	// BlockReportFile is being written.
+	var ref *blockRef
+	if bal.BlockReportFile != "" {
+		ref = &blockRef{
+			UUID:               uuid,
+			PortableDataHash:   refs.PortableDataHash,
+			OwnerUUID:          refs.OwnerUUID,
+			ReplicationDesired: repl,
+		}
+	}
+	bal.BlockStateMap.IncreaseDesired(pdh, ref, refs.StorageClassesDesired, repl, refs.Blocks)
+	if bal.usage != nil {
+		bal.addCollectionUsage(refs)
+	}
+}
+
+// collectionStateForRun returns the collection state to start from
+// in an incremental run: the state from the previous run (or the
+// state file, if this is the first run), or a new empty state if a
+// full scan is due.
+func (bal *Balancer) collectionStateForRun(config Config, prev *collectionState) *collectionState {
+	cs := prev
+	if cs == nil && config.StateFile != "" {
+		var err error
+		cs, err = loadCollectionState(config.StateFile)
+		if err != nil {
+			bal.logf("error loading state file, starting full scan: %s", err)
+			cs = nil
+		}
+	}
+	period := time.Duration(config.FullScanPeriod)
+	if period <= 0 {
+		period = defaultFullScanPeriod
+	}
+	if cs == nil || time.Since(cs.FullScan) > period {
+		bal.logf("starting full collection scan")
+		return newCollectionState()
+	}
+	bal.logf("continuing from previous collection state (%d collections)", len(cs.Collections))
+	return cs
 }
 
 // ComputeChangeSets compares, for each known block, the current and
@@ -510,8 +737,16 @@ func (bal *Balancer) setupLookupTables() {
 	bal.classes = defaultClasses
 	bal.mountsByClass = map[string]map[*KeepMount]bool{"default": {}}
 	bal.mounts = 0
+	domains := map[string]bool{}
 	for _, srv := range bal.KeepServices {
 		bal.serviceRoots[srv.UUID] = srv.UUID
+		srv.failureDomain = bal.FailureDomains[srv.UUID]
+		if srv.failureDomain == "" {
+			// Unlabeled services are each in their own
+			// failure domain.
+			srv.failureDomain = "service:" + srv.UUID
+		}
+		domains[srv.failureDomain] = true
 		for _, mnt := range srv.mounts {
 			bal.mounts++
 
@@ -533,6 +768,7 @@ func (bal *Balancer) setupLookupTables() {
 			}
 		}
 	}
+	bal.domains = len(domains)
 	// Consider classes in lexicographic order to avoid flapping
 	// between balancing runs.  The outcome of the "prefer a mount
 	// we're already planning to use for a different storage
@@ -560,6 +796,7 @@ type balanceResult struct {
 	blkid      arvados.SizedDigest
 	have       int
 	want       int
+	domains    int // number of failure domains with replicas
 	classState map[string]balancedBlockState
 }
 
@@ -569,9 +806,10 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 	debugf("balanceBlock: %v %+v", blkid, blk)
 
 	type slot struct {
-		mnt  *KeepMount // never nil
-		repl *Replica   // replica already stored here (or nil)
-		want bool       // we should pull/leave a replica here
+		mnt   *KeepMount // never nil
+		repl  *Replica   // replica already stored here (or nil)
+		want  bool       // we should pull/leave a replica here
+		class string     // storage class that made us want it
 	}
 
 	// Build a list of all slots (one per mounted volume).
@@ -666,9 +904,10 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 			}
 		})
 
-		// Servers/mounts/devices (with or without existing
-		// replicas) that are part of the best achievable
-		// layout for this storage class.
+		// Failure domains/servers/mounts/devices (with or
+		// without existing replicas) that are part of the
+		// best achievable layout for this storage class.
+		wantDomain := map[string]bool{}
 		wantSrv := map[*KeepService]bool{}
 		wantMnt := map[*KeepMount]bool{}
 		wantDev := map[string]bool{}
@@ -700,6 +939,10 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 			}
 			if replWant < desired && (slot.repl != nil || !slot.mnt.ReadOnly) {
 				slots[i].want = true
+				if slots[i].class == "" {
+					slots[i].class = class
+				}
+				wantDomain[slot.mnt.KeepService.failureDomain] = true
 				wantSrv[slot.mnt.KeepService] = true
 				wantMnt[slot.mnt] = true
 				if slot.mnt.DeviceID != "" {
@@ -711,8 +954,16 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		}
 
 		// First try to achieve desired replication without
-		// using the same server twice.
+		// using the same failure domain twice.
 		done := false
+		for i := 0; i < len(slots) && !done; i++ {
+			if !wantDomain[slots[i].mnt.KeepService.failureDomain] {
+				done = trySlot(i)
+			}
+		}
+
+		// If that didn't suffice, try again without using the
+		// same server twice.
 		for i := 0; i < len(slots) && !done; i++ {
 			if !wantSrv[slots[i].mnt.KeepService] {
 				done = trySlot(i)
@@ -767,7 +1018,8 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 	// others.
 
 	countedDev := map[string]bool{}
-	var have, want int
+	haveDomain := map[string]bool{}
+	var have, want, copies int
 	for _, slot := range slots {
 		if countedDev[slot.mnt.DeviceID] {
 			continue
@@ -777,12 +1029,27 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		}
 		if slot.repl != nil {
 			have += slot.mnt.Replication
+			copies++
+			haveDomain[slot.mnt.KeepService.failureDomain] = true
 		}
 		if slot.mnt.DeviceID != "" {
 			countedDev[slot.mnt.DeviceID] = true
 		}
 	}
 
+	trashReason, pullReason := "rebalance", "rebalance"
+	if want == 0 {
+		trashReason = "unreferenced"
+	} else if have > want {
+		trashReason = "overreplicated"
+	}
+	if have < want && copies == 1 {
+		// Losing one volume would lose the block.
+		pullReason = "lost-risk"
+	} else if have < want {
+		pullReason = "underreplicated"
+	}
+
 	var changes []string
 	for _, slot := range slots {
 		// TODO: request a Touch if Mtime is duplicated.
@@ -793,6 +1060,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 				SizedDigest: blkid,
 				Mtime:       slot.repl.Mtime,
 				From:        slot.mnt,
+				Reason:      trashReason,
 			})
 			change = changeTrash
 		case len(blk.Replicas) > 0 && slot.repl == nil && slot.want && !slot.mnt.ReadOnly:
@@ -800,6 +1068,8 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 				SizedDigest: blkid,
 				From:        blk.Replicas[0].KeepMount.KeepService,
 				To:          slot.mnt,
+				Reason:      pullReason,
+				Class:       slot.class,
 			})
 			change = changePull
 		case slot.repl != nil:
@@ -824,6 +1094,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		blkid:      blkid,
 		have:       have,
 		want:       want,
+		domains:    len(haveDomain),
 		classState: classState,
 	}
 }
@@ -846,6 +1117,7 @@ type balancerStats struct {
 	underrep      blocksNBytes
 	unachievable  blocksNBytes
 	justright     blocksNBytes
+	singleDomain  blocksNBytes
 	desired       blocksNBytes
 	current       blocksNBytes
 	pulls         int
@@ -935,10 +1207,16 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 				fmt.Fprintf(bal.lostBlocks, " %s", pdh)
 			}
 			fmt.Fprint(bal.lostBlocks, "\n")
+			if bal.blockReport != nil {
+				bal.addToBlockReport(result)
+			}
 		case surplus < 0:
 			s.underrep.replicas -= surplus
 			s.underrep.blocks++
 			s.underrep.bytes += bytes * int64(-surplus)
+			if bal.blockReport != nil {
+				bal.addToBlockReport(result)
+			}
 		case surplus > 0 && result.want == 0:
 			counter := &s.garbage
 			for _, r := range result.blk.Replicas {
@@ -960,6 +1238,15 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 			s.justright.bytes += bytes * int64(result.want)
 		}
 
+		if bal.domains > 1 && result.want > 1 && result.domains == 1 {
+			// All replicas are in one failure domain,
+			// although more than one replica is wanted
+			// and other domains are available.
+			s.singleDomain.replicas += result.have
+			s.singleDomain.blocks++
+			s.singleDomain.bytes += bytes * int64(result.have)
+		}
+
 		if result.want > 0 {
 			s.desired.replicas += result.want
 			s.desired.blocks++
@@ -995,6 +1282,7 @@ func (bal *Balancer) PrintStatistics() {
 	bal.logf("%s overreplicated (have>want>0)", bal.stats.overrep)
 	bal.logf("%s unreferenced (have>want=0, new)", bal.stats.unref)
 	bal.logf("%s garbage (have>want=0, old)", bal.stats.garbage)
+	bal.logf("%s in a single failure domain (want>1)", bal.stats.singleDomain)
 	for _, class := range bal.classes {
 		cs := bal.stats.classStats[class]
 		bal.logf("===")
@@ -12,8 +12,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.curoverse.com/arvados.git/sdk/go/arvados"
@@ -185,9 +187,9 @@ func (s *stubServer) serveFooBarFileCollections() *reqTracker {
 			io.WriteString(w, `{"items_available":0,"items":[]}`)
 		} else {
 			io.WriteString(w, `{"items_available":3,"items":[
-				{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"},
-				{"uuid":"zzzzz-4zz18-ehbhgtheo8909or","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"},
-				{"uuid":"zzzzz-4zz18-znfnqtbbv4spc3w","portable_data_hash":"1f4b0bc7583c2a7f9102c395f4ffc5e3+45","manifest_text":". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n","modified_at":"2014-02-03T17:22:54Z"}]}`)
+				{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa","owner_uuid":"zzzzz-tpzed-000000000000000","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"},
+				{"uuid":"zzzzz-4zz18-ehbhgtheo8909or","owner_uuid":"zzzzz-j7d0g-000000000000000","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"},
+				{"uuid":"zzzzz-4zz18-znfnqtbbv4spc3w","owner_uuid":"zzzzz-tpzed-000000000000000","portable_data_hash":"1f4b0bc7583c2a7f9102c395f4ffc5e3+45","manifest_text":". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n","modified_at":"2014-02-03T17:22:54Z"}]}`)
 		}
 	})
 	return rt
@@ -215,6 +217,22 @@ func (s *stubServer) serveCollectionsButSkipOne() *reqTracker {
 	return rt
 }
 
+// serveGroups serves a single page of groups: a project owned by the
+// user who owns the collections from serveFooBarFileCollections.
+func (s *stubServer) serveGroups() *reqTracker {
+	rt := &reqTracker{}
+	s.mux.HandleFunc("/arvados/v1/groups", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		rt.Add(r)
+		if strings.Contains(r.Form.Get("filters"), `"uuid"`) {
+			io.WriteString(w, `{"items":[]}`)
+		} else {
+			io.WriteString(w, `{"items":[{"uuid":"zzzzz-j7d0g-000000000000000","owner_uuid":"zzzzz-tpzed-000000000000000"}]}`)
+		}
+	})
+	return rt
+}
+
 func (s *stubServer) serveZeroKeepServices() *reqTracker {
 	return s.serveJSON("/arvados/v1/keep_services", arvados.KeepServiceList{})
 }
@@ -271,6 +289,44 @@ func (s *stubServer) serveKeepstoreIndexFoo4Bar1() *reqTracker {
 	return rt
 }
 
+// serveKeepstoreIndexFoo4Bar1Since is like
+// serveKeepstoreIndexFoo4Bar1, but omits blocks with mtime before the
+// "since" parameter, and reports an index generation, like keepstore
+// does.
+//
+// If barRemoved is not nil, and becomes non-zero, the "bar" block is
+// removed from keep0 (and the generation of that mount changes).
+func (s *stubServer) serveKeepstoreIndexFoo4Bar1Since(barRemoved *int32) *reqTracker {
+	rt := &reqTracker{}
+	for _, mounts := range stubMounts {
+		for i, mnt := range mounts {
+			i := i
+			s.mux.HandleFunc(fmt.Sprintf("/mounts/%s/blocks", mnt.UUID), func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				rt.Add(r)
+				removed := barRemoved != nil && atomic.LoadInt32(barRemoved) != 0
+				if removed && i == 0 && r.Host == "keep0.zzzzz.arvadosapi.com:25107" {
+					w.Header().Set("X-Keep-Index-Generation", "gen2")
+				} else {
+					w.Header().Set("X-Keep-Index-Generation", "gen1")
+				}
+				since, _ := strconv.ParseInt(r.Form.Get("since"), 10, 64)
+				if i == 0 && since <= 12345678 {
+					if r.Host == "keep0.zzzzz.arvadosapi.com:25107" && !removed {
+						io.WriteString(w, "37b51d194a7513e45b56f6524f2d51f2+3 12345678\n")
+					}
+					// Replicas with identical mtimes
+					// aren't trashed, so use a
+					// different mtime on each server.
+					fmt.Fprintf(w, "acbd18db4cc2f85cedef654fccc4a4d8+3 %d\n", 12345678+int(r.Host[4]-'0'))
+				}
+				fmt.Fprintf(w, "\n")
+			})
+		}
+	}
+	return rt
+}
+
 func (s *stubServer) serveKeepstoreIndexFoo1() *reqTracker {
 	rt := &reqTracker{}
 	s.mux.HandleFunc("/index/", func(w http.ResponseWriter, r *http.Request) {
@@ -455,6 +511,178 @@ func (s *runSuite) TestWriteLostBlocks(c *check.C) {
 	c.Check(string(lost), check.Equals, "37b51d194a7513e45b56f6524f2d51f2 fa7aeb5140e2848d39b416daeef4ffc5+45\n")
 }
 
+func (s *runSuite) TestBlockReport(c *check.C) {
+	reportf, err := ioutil.TempFile("", "keep-balance-block-report-test-")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(reportf.Name())
+	// Report from a previous run, when "bar" was still stored
+	// on one mount.
+	_, err = reportf.Write([]byte(`{"blocks":[{"locator":"37b51d194a7513e45b56f6524f2d51f2+3","status":"underreplicated","have":1,"want":2,"mounts":[{"service_uuid":"zzzzz-bi6l4-000000000000003","mount_uuid":"zzzzz-mount-lostmount00000","mtime":12345678}]}]}`))
+	c.Assert(err, check.IsNil)
+	reportf.Close()
+
+	s.config.BlockReportFile = reportf.Name()
+	s.config.Listen = ":"
+	s.config.ManagementToken = "xyzzy"
+	opts := RunOptions{
+		Logger: s.logger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	srv, err := NewServer(s.config, opts)
+	c.Assert(err, check.IsNil)
+
+	for run := 0; run < 2; run++ {
+		_, err = srv.Run()
+		c.Check(err, check.IsNil)
+		buf, err := ioutil.ReadFile(reportf.Name())
+		c.Assert(err, check.IsNil)
+		var report blockReport
+		c.Assert(json.Unmarshal(buf, &report), check.IsNil)
+		c.Check(report.GeneratedAt.IsZero(), check.Equals, false)
+		c.Assert(report.Blocks, check.HasLen, 1)
+		ent := report.Blocks[0]
+		c.Check(ent.Locator, check.Equals, "37b51d194a7513e45b56f6524f2d51f2+3")
+		c.Check(ent.Status, check.Equals, "lost")
+		c.Check(ent.Have, check.Equals, 0)
+		c.Check(ent.Want, check.Equals, 2)
+		c.Check(ent.Mounts, check.HasLen, 0)
+		c.Check(ent.LastSeen, check.DeepEquals, []blockReportMount{{
+			ServiceUUID: "zzzzz-bi6l4-000000000000003",
+			MountUUID:   "zzzzz-mount-lostmount00000",
+			Mtime:       12345678,
+		}})
+		c.Check(ent.Collections, check.DeepEquals, []*blockRef{{
+			UUID:               "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+			PortableDataHash:   "fa7aeb5140e2848d39b416daeef4ffc5+45",
+			OwnerUUID:          "zzzzz-tpzed-000000000000000",
+			ReplicationDesired: 2,
+		}, {
+			UUID:               "zzzzz-4zz18-ehbhgtheo8909or",
+			PortableDataHash:   "fa7aeb5140e2848d39b416daeef4ffc5+45",
+			OwnerUUID:          "zzzzz-j7d0g-000000000000000",
+			ReplicationDesired: 2,
+		}})
+
+		resp, err := http.Get("http://" + srv.listening + "/block-report?api_token=xyzzy")
+		c.Assert(err, check.IsNil)
+		c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Check(err, check.IsNil)
+		c.Check(string(body), check.Equals, string(buf))
+	}
+}
+
+// Collections are only recorded for the block report after all
+// indexes have been retrieved, so fully replicated blocks don't
+// accumulate references to every collection that was processed
+// before their replicas were seen.
+func (s *runSuite) TestBlockReportCollectionsAfterIndexes(c *check.C) {
+	reportf, err := ioutil.TempFile("", "keep-balance-block-report-test-")
+	c.Assert(err, check.IsNil)
+	reportf.Close()
+	defer os.Remove(reportf.Name())
+
+	s.config.BlockReportFile = reportf.Name()
+	opts := RunOptions{
+		Logger: s.logger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	// Respond to index requests slowly, so the collections
+	// arrive first.
+	for _, mounts := range stubMounts {
+		for i, mnt := range mounts {
+			i := i
+			s.stub.mux.HandleFunc(fmt.Sprintf("/mounts/%s/blocks", mnt.UUID), func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(100 * time.Millisecond)
+				if i == 0 && r.Host == "keep0.zzzzz.arvadosapi.com:25107" {
+					io.WriteString(w, "37b51d194a7513e45b56f6524f2d51f2+3 12345678\n")
+				}
+				if i == 0 {
+					fmt.Fprintf(w, "acbd18db4cc2f85cedef654fccc4a4d8+3 %d\n", 12345678+int(r.Host[4]-'0'))
+				}
+				fmt.Fprintf(w, "\n")
+			})
+		}
+	}
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	srv, err := NewServer(s.config, opts)
+	c.Assert(err, check.IsNil)
+	bal, err := srv.Run()
+	c.Check(err, check.IsNil)
+
+	foo := bal.BlockStateMap.entries[arvados.SizedDigest("acbd18db4cc2f85cedef654fccc4a4d8+3")]
+	c.Assert(foo, check.NotNil)
+	c.Check(foo.Colls, check.HasLen, 0)
+	bar := bal.BlockStateMap.entries[arvados.SizedDigest("37b51d194a7513e45b56f6524f2d51f2+3")]
+	c.Assert(bar, check.NotNil)
+	c.Check(bar.Colls, check.HasLen, 2)
+}
+
+func (s *runSuite) TestUsageReport(c *check.C) {
+	reportf, err := ioutil.TempFile("", "keep-balance-usage-report-test-")
+	c.Assert(err, check.IsNil)
+	reportf.Close()
+	defer os.Remove(reportf.Name())
+	s.config.UsageReportFile = reportf.Name()
+	s.config.Listen = ":"
+	s.config.ManagementToken = "xyzzy"
+	opts := RunOptions{
+		Logger: s.logger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveGroups()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	srv, err := NewServer(s.config, opts)
+	c.Assert(err, check.IsNil)
+	_, err = srv.Run()
+	c.Check(err, check.IsNil)
+
+	buf, err := ioutil.ReadFile(reportf.Name())
+	c.Assert(err, check.IsNil)
+	var report usageReport
+	c.Assert(json.Unmarshal(buf, &report), check.IsNil)
+	c.Check(report.GeneratedAt.IsZero(), check.Equals, false)
+	// "bar" is referenced by both owners; "foo" only by the
+	// user. The project belongs to the user, so the user's totals
+	// include it, and "bar" is unique to the user and the
+	// project together.
+	c.Check(report.Owners, check.DeepEquals, map[string]*ownerUsage{
+		"zzzzz-tpzed-000000000000000": {Collections: 2, LogicalBytes: 6, UniqueBytes: 3, SharedBytes: 3,
+			TotalCollections: 3, TotalLogicalBytes: 9, TotalUniqueBytes: 6},
+		"zzzzz-j7d0g-000000000000000": {Collections: 1, LogicalBytes: 3, UniqueBytes: 0, SharedBytes: 3,
+			TotalCollections: 1, TotalLogicalBytes: 3, TotalUniqueBytes: 0},
+	})
+
+	resp, err := http.Get("http://" + srv.listening + "/usage-report?api_token=xyzzy")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Check(err, check.IsNil)
+	c.Check(string(body), check.Equals, string(buf))
+
+	metrics := s.getMetrics(c, srv)
+	c.Check(metrics, check.Matches, `(?ms).*\narvados_keep_usage_owners 2\n.*`)
+	c.Check(metrics, check.Matches, `(?ms).*\narvados_keep_usage_logical_bytes 9\n.*`)
+	c.Check(metrics, check.Matches, `(?ms).*\narvados_keep_usage_unique_bytes 3\n.*`)
+	c.Check(metrics, check.Matches, `(?ms).*\narvados_keep_usage_shared_bytes 3\n.*`)
+	c.Check(metrics, check.Not(check.Matches), `(?ms).*owner_uuid.*`)
+}
+
 func (s *runSuite) TestDryRun(c *check.C) {
 	opts := RunOptions{
 		CommitPulls: false,
@@ -483,6 +711,155 @@ func (s *runSuite) TestDryRun(c *check.C) {
 	c.Check(bal.stats.overrep.replicas, check.Not(check.Equals), 0)
 }
 
+func (s *runSuite) TestChangeSetReplay(c *check.C) {
+	csf, err := ioutil.TempFile("", "keep-balance-changesets-test-")
+	c.Assert(err, check.IsNil)
+	csf.Close()
+	defer os.Remove(csf.Name())
+	s.config.ChangeSetFile = csf.Name()
+	s.config.Listen = ":"
+	s.config.ManagementToken = "xyzzy"
+	opts := RunOptions{
+		Logger: s.logger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+	srv, err := NewServer(s.config, opts)
+	c.Assert(err, check.IsNil)
+
+	resp, err := http.Get("http://" + srv.listening + "/changesets?api_token=xyzzy")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusServiceUnavailable)
+
+	// Dry run
+	bal, err := srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(trashReqs.Count(), check.Equals, 0)
+	c.Check(pullReqs.Count(), check.Equals, 0)
+	report, err := ioutil.ReadFile(csf.Name())
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(strings.TrimSuffix(string(report), "\n"), "\n")
+	c.Check(lines, check.HasLen, bal.stats.pulls+bal.stats.trashes)
+	c.Check(string(report), check.Matches, `(?ms).*"type":"pull",.*"reason":"(lost-risk|underreplicated|rebalance)","class":"default"}.*`)
+	c.Check(string(report), check.Matches, `(?ms).*"type":"trash",.*"reason":"overreplicated"}.*`)
+
+	resp, err = http.Get("http://" + srv.listening + "/changesets")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusUnauthorized)
+	resp, err = http.Get("http://" + srv.listening + "/changesets?api_token=xyzzy")
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	buf, err := ioutil.ReadAll(resp.Body)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, string(report))
+
+	// Replay the reviewed report: each service gets a pull list
+	// and a trash list.
+	srv.runOptions.CommitPulls = true
+	srv.runOptions.CommitTrash = true
+	bal, err = srv.Replay(csf.Name())
+	c.Check(err, check.IsNil)
+	c.Check(trashReqs.Count(), check.Equals, 4)
+	c.Check(pullReqs.Count(), check.Equals, 4)
+	pulls, trashes := 0, 0
+	for _, srv := range bal.KeepServices {
+		pulls += len(srv.Pulls)
+		trashes += len(srv.Trashes)
+	}
+	c.Check(pulls+trashes, check.Equals, len(lines))
+
+	// Only the requests in the report that are still needed are
+	// sent: here, the reviewed pulls were removed, and a trash
+	// request for an underreplicated block was added.
+	var reviewed []string
+	for _, line := range lines {
+		if strings.Contains(line, `"type":"trash"`) {
+			reviewed = append(reviewed, line)
+		}
+	}
+	reviewed = append(reviewed, `{"type":"trash","locator":"37b51d194a7513e45b56f6524f2d51f2+3","service_uuid":"zzzzz-bi6l4-000000000000000","mount_uuid":"zzzzz-ivpuk-000000000000000","block_mtime":12345678,"reason":"overreplicated"}`)
+	err = ioutil.WriteFile(csf.Name(), []byte(strings.Join(reviewed, "\n")+"\n"), 0644)
+	c.Assert(err, check.IsNil)
+	bal, err = srv.Replay(csf.Name())
+	c.Check(err, check.IsNil)
+	pulls, trashes = 0, 0
+	for _, srv := range bal.KeepServices {
+		pulls += len(srv.Pulls)
+		trashes += len(srv.Trashes)
+		for _, t := range srv.Trashes {
+			c.Check(string(t.SizedDigest), check.Equals, "acbd18db4cc2f85cedef654fccc4a4d8+3")
+		}
+	}
+	c.Check(pulls, check.Equals, 0)
+	c.Check(trashes, check.Equals, len(reviewed)-1)
+
+	// Old reports are refused.
+	old := time.Now().Add(-2 * defaultReplayMaxAge)
+	c.Assert(os.Chtimes(csf.Name(), old, old), check.IsNil)
+	_, err = srv.Replay(csf.Name())
+	c.Check(err, check.ErrorMatches, `.*refusing to replay.*`)
+	trashCount, pullCount := trashReqs.Count(), pullReqs.Count()
+
+	// Requests for unknown services are rejected, and nothing
+	// is sent.
+	err = ioutil.WriteFile(csf.Name(), []byte(`{"type":"pull","service_uuid":"zzzzz-bi6l4-zzzzzzzzzzzzzzz"}`+"\n"), 0644)
+	c.Assert(err, check.IsNil)
+	_, err = srv.Replay(csf.Name())
+	c.Check(err, check.ErrorMatches, `.*entry 1: unknown keep service.*`)
+	c.Check(trashReqs.Count(), check.Equals, trashCount)
+	c.Check(pullReqs.Count(), check.Equals, pullCount)
+}
+
+func (s *runSuite) TestCommitWindow(c *check.C) {
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      s.logger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+
+	s.config.CommitWindow = "24:00-25:00"
+	_, err := NewServer(s.config, opts)
+	c.Check(err, check.ErrorMatches, `invalid time window.*`)
+
+	// A window that starts an hour from now
+	now := time.Now()
+	s.config.CommitWindow = now.Add(time.Hour).Format("15:04") + "-" + now.Add(2*time.Hour).Format("15:04")
+	srv, err := NewServer(s.config, opts)
+	c.Assert(err, check.IsNil)
+	bal, err := srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(bal.stats.pulls, check.Not(check.Equals), 0)
+	// Only empty lists are sent: the initial trash lists, and
+	// pull and trash lists to clear the keepstore queues.
+	c.Check(trashReqs.Count(), check.Equals, 8)
+	c.Check(pullReqs.Count(), check.Equals, 4)
+	// The computed changes are still reported.
+	pulls := 0
+	for _, srv := range bal.KeepServices {
+		pulls += len(srv.Pulls)
+	}
+	c.Check(pulls, check.Equals, bal.stats.pulls)
+
+	// A window that includes now
+	srv.config.CommitWindow = now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04")
+	_, err = srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(trashReqs.Count(), check.Equals, 12)
+	c.Check(pullReqs.Count(), check.Equals, 8)
+}
+
 func (s *runSuite) TestCommit(c *check.C) {
 	lostf, err := ioutil.TempFile("", "keep-balance-lost-blocks-test-")
 	c.Assert(err, check.IsNil)
@@ -528,6 +905,217 @@ func (s *runSuite) TestCommit(c *check.C) {
 	c.Check(metrics, check.Matches, `(?ms).*\narvados_keep_dedup_block_ratio 1\.5\n.*`)
 }
 
+func (s *runSuite) TestIncrementalCollections(c *check.C) {
+	statef, err := ioutil.TempFile("", "keep-balance-state-test-")
+	c.Assert(err, check.IsNil)
+	statef.Close()
+	os.Remove(statef.Name())
+	defer os.Remove(statef.Name())
+
+	s.config.IncrementalCollections = true
+	s.config.StateFile = statef.Name()
+	opts := RunOptions{
+		Logger: s.logger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	collReqs := s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+
+	// unfiltered returns the number of collection requests (since
+	// the last call) that weren't limited by modified_at, i.e.,
+	// were part of a full scan.
+	seen := 0
+	unfiltered := func() int {
+		collReqs.Lock()
+		defer collReqs.Unlock()
+		n := 0
+		for _, req := range collReqs.reqs[seen:] {
+			if !strings.Contains(req.Form.Get("filters"), "modified_at") {
+				n++
+			}
+		}
+		seen = len(collReqs.reqs)
+		return n
+	}
+
+	srv, err := NewServer(s.config, opts)
+	c.Assert(err, check.IsNil)
+	bal, err := srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(unfiltered(), check.Not(check.Equals), 0)
+	c.Check(bal.collScanned, check.Equals, 3)
+	pulls := bal.stats.pulls
+	c.Check(pulls, check.Not(check.Equals), 0)
+	_, err = os.Stat(statef.Name())
+	c.Check(err, check.IsNil)
+
+	// The next run only asks for recently modified collections
+	// (the stub server returns none) but still knows about the
+	// others.
+	bal, err = srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(unfiltered(), check.Equals, 0)
+	c.Check(bal.collScanned, check.Equals, 3)
+	c.Check(bal.stats.pulls, check.Equals, pulls)
+
+	// After a restart, the state is loaded from the state file.
+	srv, err = NewServer(s.config, opts)
+	c.Assert(err, check.IsNil)
+	bal, err = srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(unfiltered(), check.Equals, 0)
+	c.Check(bal.collScanned, check.Equals, 3)
+
+	// When a full scan is due, all collections are retrieved
+	// again.
+	s.config.FullScanPeriod = arvados.Duration(time.Nanosecond)
+	srv, err = NewServer(s.config, opts)
+	c.Assert(err, check.IsNil)
+	bal, err = srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(unfiltered(), check.Not(check.Equals), 0)
+	c.Check(bal.collScanned, check.Equals, 3)
+}
+
+func (s *runSuite) TestIncrementalIndexes(c *check.C) {
+	statef, err := ioutil.TempFile("", "keep-balance-state-test-")
+	c.Assert(err, check.IsNil)
+	statef.Close()
+	os.Remove(statef.Name())
+	defer os.Remove(statef.Name())
+
+	s.config.IncrementalCollections = true
+	s.config.IncrementalIndexes = true
+	s.config.StateFile = statef.Name()
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      s.logger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	indexReqs := s.stub.serveKeepstoreIndexFoo4Bar1Since(nil)
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+
+	// partial returns the number of index requests (since the
+	// last call) that had a "since" parameter.
+	seen := 0
+	partial := func() int {
+		indexReqs.Lock()
+		defer indexReqs.Unlock()
+		n := 0
+		for _, req := range indexReqs.reqs[seen:] {
+			if req.Form.Get("since") != "" {
+				n++
+			}
+		}
+		seen = len(indexReqs.reqs)
+		return n
+	}
+
+	// The first run retrieves full indexes, and commits trash
+	// lists.
+	srv, err := NewServer(s.config, opts)
+	c.Assert(err, check.IsNil)
+	bal, err := srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(partial(), check.Equals, 0)
+	c.Check(bal.stats.trashes, check.Equals, 2)
+	c.Check(bal.stats.pulls, check.Equals, 2)
+	c.Check(trashReqs.Count(), check.Equals, 8)
+	c.Check(pullReqs.Count(), check.Equals, 4)
+
+	// The next run only retrieves recently written blocks (the
+	// stub server returns none) but still knows about the
+	// others. It commits pull lists, but not trash lists.
+	bal, err = srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(partial(), check.Equals, len(indexReqs.reqs)/2)
+	c.Check(bal.stats.trashes, check.Equals, 2)
+	c.Check(bal.stats.pulls, check.Equals, 2)
+	c.Check(trashReqs.Count(), check.Equals, 8)
+	c.Check(pullReqs.Count(), check.Equals, 8)
+
+	// After a restart, the indexes are loaded from the state
+	// file.
+	srv, err = NewServer(s.config, opts)
+	c.Assert(err, check.IsNil)
+	bal, err = srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(partial(), check.Equals, len(indexReqs.reqs)/3)
+	c.Check(bal.stats.trashes, check.Equals, 2)
+
+	// When a full scan is due, full indexes are retrieved again,
+	// and trash lists are committed.
+	s.config.FullScanPeriod = arvados.Duration(time.Nanosecond)
+	srv, err = NewServer(s.config, opts)
+	c.Assert(err, check.IsNil)
+	trashBefore := trashReqs.Count()
+	bal, err = srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(partial(), check.Equals, 0)
+	c.Check(bal.stats.trashes, check.Equals, 2)
+	c.Check(trashReqs.Count() > trashBefore+len(stubServices), check.Equals, true)
+}
+
+// If a block is removed from a mount between two incremental runs,
+// the second run notices the changed index generation and retrieves
+// the full index of that mount, instead of counting the removed
+// replica.
+func (s *runSuite) TestIncrementalIndexesBlockRemoved(c *check.C) {
+	s.config.IncrementalCollections = true
+	s.config.IncrementalIndexes = true
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      s.logger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	var barRemoved int32
+	indexReqs := s.stub.serveKeepstoreIndexFoo4Bar1Since(&barRemoved)
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+
+	srv, err := NewServer(s.config, opts)
+	c.Assert(err, check.IsNil)
+	bal, err := srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(bal.stats.lost.blocks, check.Equals, 0)
+	c.Check(bal.stats.underrep.blocks, check.Equals, 1)
+	firstRun := len(indexReqs.reqs)
+
+	atomic.StoreInt32(&barRemoved, 1)
+	bal, err = srv.Run()
+	c.Check(err, check.IsNil)
+	c.Check(bal.stats.lost.blocks, check.Equals, 1)
+	c.Check(bal.stats.underrep.blocks, check.Equals, 0)
+
+	// keep0's first mount was indexed twice (partial, then
+	// full); all other mounts only once (partial).
+	indexReqs.Lock()
+	reqs := indexReqs.reqs[firstRun:]
+	indexReqs.Unlock()
+	c.Check(reqs, check.HasLen, firstRun+1)
+	full := 0
+	for _, req := range reqs {
+		if req.Form.Get("since") == "" {
+			full++
+			c.Check(req.Host, check.Equals, "keep0.zzzzz.arvadosapi.com:25107")
+		}
+	}
+	c.Check(full, check.Equals, 1)
+}
+
 func (s *runSuite) TestRunForever(c *check.C) {
 	s.config.Listen = ":"
 	s.config.ManagementToken = "xyzzy"
@@ -91,6 +91,7 @@ func (bal *balancerSuite) SetUpTest(c *check.C) {
 	}
 
 	bal.MinMtime = time.Now().UnixNano() - bal.signatureTTL*1e9
+	bal.FailureDomains = nil
 	bal.cleanupMounts()
 }
 
@@ -629,6 +630,77 @@ func (bal *balancerSuite) TestChangeStorageClasses(c *check.C) {
 		current: slots{0, 1}})
 }
 
+func (bal *balancerSuite) TestFailureDomains(c *check.C) {
+	// The two best servers for known0 are in the same rack.
+	bal.FailureDomains = map[string]string{}
+	for i, srv := range bal.srvList(known0, slots{0, 1, 2, 3}) {
+		bal.FailureDomains[srv.UUID] = []string{"rack1", "rack1", "rack2", "rack3"}[i]
+	}
+	// Pull a replica into a different rack, but don't trash the
+	// existing one until the new one exists.
+	bal.try(c, tester{
+		known:      0,
+		desired:    map[string]int{"default": 2},
+		current:    slots{0, 1},
+		shouldPull: slots{2},
+		expectResult: balanceResult{
+			have:    2,
+			want:    2,
+			domains: 1,
+		}})
+	bal.try(c, tester{
+		known:       0,
+		desired:     map[string]int{"default": 2},
+		current:     slots{0, 1, 2},
+		shouldTrash: slots{1},
+		expectResult: balanceResult{
+			domains: 2,
+		}})
+	// Replicas go in different racks, even if a better
+	// rendezvous position is available in the same rack.
+	bal.try(c, tester{
+		known:      0,
+		desired:    map[string]int{"default": 3},
+		current:    slots{0},
+		shouldPull: slots{2, 3}})
+	// If there aren't enough racks, use distinct servers in the
+	// same rack.
+	bal.FailureDomains = map[string]string{}
+	for _, srv := range bal.srvs {
+		bal.FailureDomains[srv.UUID] = "rack1"
+	}
+	bal.try(c, tester{
+		known:      0,
+		desired:    map[string]int{"default": 2},
+		current:    slots{0},
+		shouldPull: slots{1}})
+}
+
+func (bal *balancerSuite) TestSingleDomainStats(c *check.C) {
+	bal.FailureDomains = map[string]string{}
+	for i, srv := range bal.srvList(known0, slots{0, 1, 2}) {
+		bal.FailureDomains[srv.UUID] = []string{"rack1", "rack1", "rack2"}[i]
+	}
+	bal.setupLookupTables()
+	for _, srv := range bal.srvs {
+		srv.ChangeSet = &ChangeSet{}
+	}
+	results := make(chan balanceResult, 3)
+	for _, current := range []slots{{0, 1}, {0, 2}, {0}} {
+		blk := &BlockState{
+			Replicas: bal.replList(known0, current),
+			Desired:  map[string]int{"default": 2},
+		}
+		results <- bal.balanceBlock(knownBlkid(known0), blk)
+	}
+	close(results)
+	bal.Metrics = newMetrics()
+	bal.collectStatistics(results)
+	// {0, 1} and {0} are each in one rack; {0, 2} is in two
+	// racks.
+	c.Check(bal.stats.singleDomain, check.Equals, blocksNBytes{replicas: 3, blocks: 2, bytes: 3 * knownBlkid(known0).Size()})
+}
+
 // Clear all servers' changesets, balance a single block, and verify
 // the appropriate changes for that block have been added to the
 // changesets.
@@ -686,6 +758,9 @@ func (bal *balancerSuite) try(c *check.C, t tester) {
 	if t.expectResult.want > 0 {
 		c.Check(result.want, check.Equals, t.expectResult.want)
 	}
+	if t.expectResult.domains > 0 {
+		c.Check(result.domains, check.Equals, t.expectResult.domains)
+	}
 	if t.expectResult.classState != nil {
 		c.Check(result.classState, check.DeepEquals, t.expectResult.classState)
 	}
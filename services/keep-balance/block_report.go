@@ -0,0 +1,130 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// blockReport lists the lost and underreplicated blocks found by a
+// balancing run, with the collections that reference them and the
+// mounts where they are (or were last) stored.
+type blockReport struct {
+	GeneratedAt time.Time          `json:"generated_at"`
+	Blocks      []blockReportEntry `json:"blocks"`
+}
+
+type blockReportEntry struct {
+	Locator string `json:"locator"`
+	Status  string `json:"status"` // "lost" or "underreplicated"
+	Have    int    `json:"have"`
+	Want    int    `json:"want"`
+
+	// Mounts where the block is stored now.
+	Mounts []blockReportMount `json:"mounts"`
+
+	// For lost blocks: mounts where the block was stored when a
+	// previous run reported it as underreplicated, if any. Only
+	// the blocks in the previous report are remembered (keeping
+	// the locations of all blocks would double our memory use),
+	// so this is empty for a block that went straight from fully
+	// replicated to lost.
+	LastSeen []blockReportMount `json:"last_seen,omitempty"`
+
+	// Collections whose desired replication is not met.
+	Collections []*blockRef `json:"collections"`
+}
+
+type blockReportMount struct {
+	ServiceUUID string `json:"service_uuid"`
+	MountUUID   string `json:"mount_uuid"`
+	Mtime       int64  `json:"mtime"`
+}
+
+// addToBlockReport adds an entry for a lost or underreplicated
+// block.
+func (bal *Balancer) addToBlockReport(result balanceResult) {
+	ent := blockReportEntry{
+		Locator:     string(result.blkid),
+		Status:      "underreplicated",
+		Have:        result.have,
+		Want:        result.want,
+		Mounts:      []blockReportMount{},
+		Collections: []*blockRef{},
+	}
+	if result.have == 0 {
+		ent.Status = "lost"
+		ent.LastSeen = bal.lastSeen[result.blkid]
+	}
+	for _, r := range result.blk.Replicas {
+		ent.Mounts = append(ent.Mounts, blockReportMount{
+			ServiceUUID: r.KeepService.UUID,
+			MountUUID:   r.UUID,
+			Mtime:       r.Mtime,
+		})
+	}
+	for _, ref := range result.blk.Colls {
+		if ref.ReplicationDesired > result.have {
+			ent.Collections = append(ent.Collections, ref)
+		}
+	}
+	sort.Slice(ent.Collections, func(i, j int) bool {
+		return ent.Collections[i].UUID < ent.Collections[j].UUID
+	})
+	bal.blockReport.Blocks = append(bal.blockReport.Blocks, ent)
+}
+
+// finishBlockReport sorts the block report entries, and returns the
+// last-seen mounts of the reported blocks, for use in the next run.
+func (bal *Balancer) finishBlockReport() map[arvados.SizedDigest][]blockReportMount {
+	bal.blockReport.GeneratedAt = time.Now().UTC()
+	sort.Slice(bal.blockReport.Blocks, func(i, j int) bool {
+		return bal.blockReport.Blocks[i].Locator < bal.blockReport.Blocks[j].Locator
+	})
+	return lastSeenMounts(bal.blockReport)
+}
+
+func lastSeenMounts(report *blockReport) map[arvados.SizedDigest][]blockReportMount {
+	seen := map[arvados.SizedDigest][]blockReportMount{}
+	for _, ent := range report.Blocks {
+		if len(ent.Mounts) > 0 {
+			seen[arvados.SizedDigest(ent.Locator)] = ent.Mounts
+		} else if len(ent.LastSeen) > 0 {
+			seen[arvados.SizedDigest(ent.Locator)] = ent.LastSeen
+		}
+	}
+	return seen
+}
+
+// loadLastSeen returns the last-seen mounts of the blocks in a
+// previously written block report file. It returns nil and no error
+// if the file does not exist.
+func loadLastSeen(path string) (map[arvados.SizedDigest][]blockReportMount, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var report blockReport
+	err = json.NewDecoder(f).Decode(&report)
+	if err != nil {
+		return nil, err
+	}
+	return lastSeenMounts(&report), nil
+}
+
+func writeBlockReport(w io.Writer, report *blockReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(report)
+}
@@ -25,6 +25,11 @@ type Replica struct {
 type BlockState struct {
 	Refs     map[string]bool // pdh => true (only tracked when len(Replicas)==0)
 	RefCount int
+	// Collections whose desired replication exceeds the
+	// replicas stored (only tracked for the block report, and
+	// only after all replicas have been added)
+	Colls    []*blockRef
+	Owners   map[string]bool // owners of referring collections (only tracked for the usage report)
 	Replicas []Replica
 	Desired  map[string]int
 	// TODO: Support combinations of classes ("private + durable")
@@ -39,6 +44,15 @@ type BlockState struct {
 
 var defaultClasses = []string{"default"}
 
+// blockRef identifies a collection that references a block, for the
+// block report.
+type blockRef struct {
+	UUID               string `json:"uuid"`
+	PortableDataHash   string `json:"portable_data_hash"`
+	OwnerUUID          string `json:"owner_uuid"`
+	ReplicationDesired int    `json:"replication_desired"`
+}
+
 func (bs *BlockState) addReplica(r Replica) {
 	bs.Replicas = append(bs.Replicas, r)
 	// Free up memory wasted by tracking PDHs that will never be
@@ -46,7 +60,24 @@ func (bs *BlockState) addReplica(r Replica) {
 	bs.Refs = nil
 }
 
-func (bs *BlockState) increaseDesired(pdh string, classes []string, n int) {
+// replication returns the number of replicas seen so far, counting
+// N replicas for a mount with replication N.
+func (bs *BlockState) replication() int {
+	n := 0
+	for _, r := range bs.Replicas {
+		if r.Replication > 1 {
+			n += r.Replication
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+func (bs *BlockState) increaseDesired(pdh string, ref *blockRef, classes []string, n int) {
+	if ref != nil && bs.replication() < n {
+		bs.Colls = append(bs.Colls, ref)
+	}
 	if pdh != "" && len(bs.Replicas) == 0 {
 		// Note we only track PDHs if there's a possibility
 		// that we will report the list of referring PDHs,
@@ -124,12 +155,28 @@ func (bsm *BlockStateMap) AddReplicas(mnt *KeepMount, idx []arvados.KeepServiceI
 // for the given blocks in the given storage class is at least n.
 //
 // If pdh is non-empty, it will be tracked and reported in the "lost
-// blocks" report.
-func (bsm *BlockStateMap) IncreaseDesired(pdh string, classes []string, n int, blocks []arvados.SizedDigest) {
+// blocks" report. If ref is non-nil, it will be tracked and reported
+// in the block report for blocks that have fewer than n replicas.
+func (bsm *BlockStateMap) IncreaseDesired(pdh string, ref *blockRef, classes []string, n int, blocks []arvados.SizedDigest) {
 	bsm.mutex.Lock()
 	defer bsm.mutex.Unlock()
 
 	for _, blkid := range blocks {
-		bsm.get(blkid).increaseDesired(pdh, classes, n)
+		bsm.get(blkid).increaseDesired(pdh, ref, classes, n)
+	}
+}
+
+// AddOwner updates the map to indicate that the given blocks are
+// referenced by a collection owned by owner.
+func (bsm *BlockStateMap) AddOwner(owner string, blocks []arvados.SizedDigest) {
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+
+	for _, blkid := range blocks {
+		blk := bsm.get(blkid)
+		if blk.Owners == nil {
+			blk.Owners = map[string]bool{}
+		}
+		blk.Owners[owner] = true
 	}
 }
@@ -0,0 +1,106 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Priority of each pull reason when the number of pulls sent to a
+// server is limited. Higher priority pulls are sent first.
+var pullPriority = map[string]int{
+	"lost-risk":       3,
+	"underreplicated": 2,
+	"rebalance":       1,
+}
+
+// Priority of each trash reason when the number of trash requests
+// sent to a server is limited.
+var trashPriority = map[string]int{
+	"unreferenced":   3,
+	"overreplicated": 2,
+	"rebalance":      1,
+}
+
+// limitChangeSets truncates each server's change set according to
+// config.MaxPullsPerServer, MaxPullBytesPerServer, and
+// MaxTrashesPerServer, keeping the most urgent changes. The rest
+// will be computed again (if still needed) in a later run.
+func (bal *Balancer) limitChangeSets(config Config) {
+	if config.MaxPullsPerServer <= 0 && config.MaxPullBytesPerServer <= 0 && config.MaxTrashesPerServer <= 0 {
+		return
+	}
+	for _, srv := range bal.KeepServices {
+		cs := srv.ChangeSet
+		cs.mutex.Lock()
+		sort.SliceStable(cs.Pulls, func(i, j int) bool {
+			return pullPriority[cs.Pulls[i].Reason] > pullPriority[cs.Pulls[j].Reason]
+		})
+		sort.SliceStable(cs.Trashes, func(i, j int) bool {
+			return trashPriority[cs.Trashes[i].Reason] > trashPriority[cs.Trashes[j].Reason]
+		})
+		pulls, trashes := len(cs.Pulls), len(cs.Trashes)
+		if max := config.MaxPullsPerServer; max > 0 && len(cs.Pulls) > max {
+			cs.Pulls = cs.Pulls[:max]
+		}
+		if max := int64(config.MaxPullBytesPerServer); max > 0 {
+			var size int64
+			for i, p := range cs.Pulls {
+				size += p.Size()
+				if size > max {
+					cs.Pulls = cs.Pulls[:i]
+					break
+				}
+			}
+		}
+		if max := config.MaxTrashesPerServer; max > 0 && len(cs.Trashes) > max {
+			cs.Trashes = cs.Trashes[:max]
+		}
+		if pulls > len(cs.Pulls) || trashes > len(cs.Trashes) {
+			bal.logf("%s: deferring %d of %d pulls and %d of %d trashes to a later run", srv, pulls-len(cs.Pulls), pulls, trashes-len(cs.Trashes), trashes)
+		}
+		cs.mutex.Unlock()
+	}
+}
+
+// A timeWindow is a daily period, in local time, like "22:00-06:00".
+type timeWindow struct {
+	start, end time.Duration // since midnight
+}
+
+// parseTimeWindow parses a window like "22:00-06:00". An empty
+// string means "always".
+func parseTimeWindow(s string) (*timeWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var h1, m1, h2, m2 int
+	var extra string
+	n, _ := fmt.Sscanf(s, "%d:%d-%d:%d%s", &h1, &m1, &h2, &m2, &extra)
+	if n != 4 || h1 > 23 || h2 > 24 || m1 > 59 || m2 > 59 || h1 < 0 || h2 < 0 || m1 < 0 || m2 < 0 {
+		return nil, fmt.Errorf("invalid time window %q (should look like \"22:00-06:00\")", s)
+	}
+	return &timeWindow{
+		start: time.Duration(h1)*time.Hour + time.Duration(m1)*time.Minute,
+		end:   time.Duration(h2)*time.Hour + time.Duration(m2)*time.Minute,
+	}, nil
+}
+
+// Contains returns true if t is inside the window. A nil window
+// contains all times.
+func (w *timeWindow) Contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	h, m, s := t.Clock()
+	tod := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if w.start <= w.end {
+		return tod >= w.start && tod < w.end
+	}
+	// Window spans midnight.
+	return tod >= w.start || tod < w.end
+}
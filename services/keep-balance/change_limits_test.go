@@ -0,0 +1,108 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+func (bal *balancerSuite) TestPullReasons(c *check.C) {
+	bal.setupLookupTables()
+	for _, trial := range []struct {
+		current slots
+		reason  string
+	}{
+		{slots{0}, "lost-risk"},
+		{slots{0, 1}, "underreplicated"},
+		{slots{0, 4}, "underreplicated"},
+	} {
+		for _, srv := range bal.srvs {
+			srv.ChangeSet = &ChangeSet{}
+		}
+		bal.balanceBlock(knownBlkid(known0), &BlockState{
+			Replicas: bal.replList(known0, trial.current),
+			Desired:  map[string]int{"default": 3},
+		})
+		var reasons []string
+		for _, srv := range bal.srvs {
+			for _, pull := range srv.Pulls {
+				reasons = append(reasons, pull.Reason)
+			}
+		}
+		c.Check(len(reasons) > 0, check.Equals, true)
+		for _, reason := range reasons {
+			c.Check(reason, check.Equals, trial.reason, check.Commentf("current %v", trial.current))
+		}
+	}
+}
+
+func (bal *balancerSuite) TestLimitChangeSets(c *check.C) {
+	srv := bal.srvs[0]
+	mnt := srv.mounts[0]
+	from := bal.srvs[1]
+	for _, srv := range bal.srvs {
+		srv.ChangeSet = &ChangeSet{}
+	}
+	blkid := arvados.SizedDigest("acbd18db4cc2f85cedef654fccc4a4d8+3")
+	for _, reason := range []string{"rebalance", "underreplicated", "lost-risk", "rebalance", "lost-risk"} {
+		srv.AddPull(Pull{SizedDigest: blkid, From: from, To: mnt, Reason: reason})
+	}
+	for _, reason := range []string{"rebalance", "overreplicated", "unreferenced"} {
+		srv.AddTrash(Trash{SizedDigest: blkid, From: mnt, Reason: reason})
+	}
+
+	// No limits configured: nothing changes.
+	bal.limitChangeSets(Config{})
+	c.Check(srv.Pulls, check.HasLen, 5)
+	c.Check(srv.Trashes, check.HasLen, 3)
+
+	bal.limitChangeSets(Config{MaxPullsPerServer: 3, MaxTrashesPerServer: 2})
+	var reasons []string
+	for _, p := range srv.Pulls {
+		reasons = append(reasons, p.Reason)
+	}
+	c.Check(reasons, check.DeepEquals, []string{"lost-risk", "lost-risk", "underreplicated"})
+	reasons = nil
+	for _, t := range srv.Trashes {
+		reasons = append(reasons, t.Reason)
+	}
+	c.Check(reasons, check.DeepEquals, []string{"unreferenced", "overreplicated"})
+
+	// Each pull is 3 bytes.
+	bal.limitChangeSets(Config{MaxPullBytesPerServer: 7})
+	c.Check(srv.Pulls, check.HasLen, 2)
+	bal.limitChangeSets(Config{MaxPullBytesPerServer: 2})
+	c.Check(srv.Pulls, check.HasLen, 0)
+}
+
+func (bal *balancerSuite) TestTimeWindow(c *check.C) {
+	at := func(h, m int) time.Time {
+		return time.Date(2019, 1, 1, h, m, 0, 0, time.Local)
+	}
+	w, err := parseTimeWindow("")
+	c.Check(err, check.IsNil)
+	c.Check(w.Contains(at(12, 0)), check.Equals, true)
+
+	w, err = parseTimeWindow("09:30-17:00")
+	c.Check(err, check.IsNil)
+	c.Check(w.Contains(at(9, 29)), check.Equals, false)
+	c.Check(w.Contains(at(9, 30)), check.Equals, true)
+	c.Check(w.Contains(at(16, 59)), check.Equals, true)
+	c.Check(w.Contains(at(17, 0)), check.Equals, false)
+
+	w, err = parseTimeWindow("22:00-06:00")
+	c.Check(err, check.IsNil)
+	c.Check(w.Contains(at(23, 0)), check.Equals, true)
+	c.Check(w.Contains(at(3, 0)), check.Equals, true)
+	c.Check(w.Contains(at(12, 0)), check.Equals, false)
+
+	for _, bad := range []string{"22:00", "22-06", "25:00-06:00", "22:00-06:00x", "22:61-06:00"} {
+		_, err = parseTimeWindow(bad)
+		c.Check(err, check.NotNil, check.Commentf("%q", bad))
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// Default maximum age of a change set file that can be replayed.
+const defaultReplayMaxAge = 24 * time.Hour
+
+// changeReportEntry is one line of a change set report: a single pull
+// or trash request, and why keep-balance wants it.
+type changeReportEntry struct {
+	Type        string `json:"type"` // "pull" or "trash"
+	Locator     string `json:"locator"`
+	ServiceUUID string `json:"service_uuid"`
+	MountUUID   string `json:"mount_uuid"`
+	// For pulls: the service to copy the block from.
+	FromServiceUUID string `json:"from_service_uuid,omitempty"`
+	// For trash: the mtime of the replica to delete.
+	BlockMtime int64  `json:"block_mtime,omitempty"`
+	Reason     string `json:"reason"`
+	Class      string `json:"class,omitempty"`
+}
+
+// WriteChangeSets writes the computed change sets of all keep
+// services to w, as JSON lines, one pull or trash request per line.
+func WriteChangeSets(w io.Writer, services map[string]*KeepService) error {
+	uuids := make([]string, 0, len(services))
+	for uuid := range services {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	bufw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bufw)
+	for _, uuid := range uuids {
+		srv := services[uuid]
+		if srv.ChangeSet == nil {
+			continue
+		}
+		srv.ChangeSet.mutex.Lock()
+		pulls, trashes := srv.ChangeSet.Pulls, srv.ChangeSet.Trashes
+		srv.ChangeSet.mutex.Unlock()
+		for _, p := range pulls {
+			err := enc.Encode(changeReportEntry{
+				Type:            "pull",
+				Locator:         string(p.SizedDigest),
+				ServiceUUID:     uuid,
+				MountUUID:       p.To.UUID,
+				FromServiceUUID: p.From.UUID,
+				Reason:          p.Reason,
+				Class:           p.Class,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, t := range trashes {
+			err := enc.Encode(changeReportEntry{
+				Type:        "trash",
+				Locator:     string(t.SizedDigest),
+				ServiceUUID: uuid,
+				MountUUID:   t.From.UUID,
+				BlockMtime:  t.Mtime,
+				Reason:      t.Reason,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return bufw.Flush()
+}
+
+// LoadChangeSets reads change requests written by WriteChangeSets,
+// and adds them to the ChangeSets of bal.KeepServices, which must
+// already have their mounts discovered.
+//
+// An error is returned if any request refers to a service or mount
+// that doesn't exist (any more).
+func (bal *Balancer) LoadChangeSets(r io.Reader) error {
+	mounts := map[string]*KeepMount{}
+	for _, srv := range bal.KeepServices {
+		for _, mnt := range srv.mounts {
+			mounts[srv.UUID+"/"+mnt.UUID] = mnt
+		}
+	}
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var ent changeReportEntry
+		err := dec.Decode(&ent)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("entry %d: %s", line, err)
+		}
+		srv := bal.KeepServices[ent.ServiceUUID]
+		if srv == nil {
+			return fmt.Errorf("entry %d: unknown keep service %q", line, ent.ServiceUUID)
+		}
+		mnt := mounts[ent.ServiceUUID+"/"+ent.MountUUID]
+		if mnt == nil {
+			return fmt.Errorf("entry %d: unknown mount %q on %s", line, ent.MountUUID, srv)
+		}
+		blkid := arvados.SizedDigest(ent.Locator)
+		if len(blkid) < 32 {
+			return fmt.Errorf("entry %d: bad locator %q", line, ent.Locator)
+		}
+		switch ent.Type {
+		case "pull":
+			from := bal.KeepServices[ent.FromServiceUUID]
+			if from == nil {
+				return fmt.Errorf("entry %d: unknown keep service %q", line, ent.FromServiceUUID)
+			}
+			srv.AddPull(Pull{
+				SizedDigest: blkid,
+				From:        from,
+				To:          mnt,
+				Reason:      ent.Reason,
+				Class:       ent.Class,
+			})
+		case "trash":
+			srv.AddTrash(Trash{
+				SizedDigest: blkid,
+				Mtime:       ent.BlockMtime,
+				From:        mnt,
+				Reason:      ent.Reason,
+			})
+		default:
+			return fmt.Errorf("entry %d: unknown type %q", line, ent.Type)
+		}
+	}
+}
+
+// pullKey and trashKey identify a pull or trash request, for the
+// purpose of matching reviewed requests with newly computed ones.
+func pullKey(srv *KeepService, p Pull) string {
+	return "pull " + srv.UUID + " " + p.To.UUID + " " + string(p.SizedDigest)
+}
+
+func trashKey(srv *KeepService, t Trash) string {
+	return "trash " + srv.UUID + " " + t.From.UUID + " " + string(t.SizedDigest)
+}
+
+// Replay sends the change requests in a file written by
+// WriteChangeSets (typically by a dry run, and reviewed by an
+// operator) to the keepstore servers. Pulls and trashes are sent only
+// if enabled in runOptions.
+//
+// The reviewed requests might be out of date, so Replay computes the
+// changes that are needed now, and only sends the requests that
+// appear in both. Files older than Config.ReplayMaxAge are refused.
+func (bal *Balancer) Replay(config Config, runOptions RunOptions, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	maxAge := time.Duration(config.ReplayMaxAge)
+	if maxAge <= 0 {
+		maxAge = defaultReplayMaxAge
+	}
+	if age := time.Since(fi.ModTime()); age > maxAge {
+		return fmt.Errorf("%s: file was written %v ago, refusing to replay change sets older than ReplayMaxAge (%v)", path, age.Truncate(time.Second), maxAge)
+	}
+	if err = bal.setupKeepServices(config); err != nil {
+		return err
+	}
+	if err = bal.CheckSanityEarly(&config.Client); err != nil {
+		return err
+	}
+	if err = bal.LoadChangeSets(f); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	reviewed := map[string]bool{}
+	for _, srv := range bal.KeepServices {
+		for _, p := range srv.Pulls {
+			reviewed[pullKey(srv, p)] = true
+		}
+		for _, t := range srv.Trashes {
+			reviewed[trashKey(srv, t)] = true
+		}
+		srv.ChangeSet = &ChangeSet{}
+	}
+
+	bal.lostBlocks = ioutil.Discard
+	if err = bal.GetCurrentState(&config.Client, config.CollectionBatchSize, config.CollectionBuffers); err != nil {
+		return err
+	}
+	bal.ComputeChangeSets()
+	if err = bal.CheckSanityLate(); err != nil {
+		return err
+	}
+	stale := len(reviewed)
+	for _, srv := range bal.KeepServices {
+		var pulls []Pull
+		for _, p := range srv.Pulls {
+			if reviewed[pullKey(srv, p)] {
+				pulls = append(pulls, p)
+			}
+		}
+		var trashes []Trash
+		for _, t := range srv.Trashes {
+			if reviewed[trashKey(srv, t)] {
+				trashes = append(trashes, t)
+			}
+		}
+		srv.Pulls, srv.Trashes = pulls, trashes
+		stale -= len(pulls) + len(trashes)
+		bal.logf("%s: %v\n", srv, srv.ChangeSet)
+	}
+	if stale > 0 {
+		bal.logf("skipping %d requests from %s that are no longer needed", stale, path)
+	}
+	if runOptions.CommitPulls {
+		err = bal.CommitPulls(&config.Client)
+		if err != nil {
+			return err
+		}
+	}
+	if runOptions.CommitTrash {
+		err = bal.CommitTrash(&config.Client)
+	}
+	return err
+}
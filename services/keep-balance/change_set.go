@@ -18,6 +18,12 @@ type Pull struct {
 	arvados.SizedDigest
 	From *KeepService
 	To   *KeepMount
+
+	// Why the pull is needed, and which storage class it is
+	// for. These are reported in change set files, but not sent
+	// to keepstore.
+	Reason string
+	Class  string
 }
 
 // MarshalJSON formats a pull request the way keepstore wants to see
@@ -40,6 +46,10 @@ type Trash struct {
 	arvados.SizedDigest
 	Mtime int64
 	From  *KeepMount
+
+	// Why the replica can be deleted. This is reported in change
+	// set files, but not sent to keepstore.
+	Reason string
 }
 
 // MarshalJSON formats a trash request the way keepstore wants to see
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 
 	"git.curoverse.com/arvados.git/sdk/go/arvados"
@@ -42,3 +43,53 @@ func (s *changeSetSuite) TestJSONFormat(c *check.C) {
 	c.Check(err, check.IsNil)
 	c.Check(string(buf), check.Equals, `[{"locator":"acbd18db4cc2f85cedef654fccc4a4d8","block_mtime":123456789,"mount_uuid":"zzzzz-mount-abcdefghijklmno"}]`)
 }
+
+func (s *changeSetSuite) TestReportRoundTrip(c *check.C) {
+	mnt := &KeepMount{
+		KeepMount: arvados.KeepMount{
+			UUID: "zzzzz-mount-abcdefghijklmno"}}
+	srvs := map[string]*KeepService{}
+	for _, uuid := range []string{"zzzzz-bi6l4-000000000000001", "zzzzz-bi6l4-000000000000000"} {
+		srvs[uuid] = &KeepService{
+			KeepService: arvados.KeepService{UUID: uuid},
+			ChangeSet:   &ChangeSet{},
+			mounts:      []*KeepMount{mnt},
+		}
+	}
+	blkid := arvados.SizedDigest("acbd18db4cc2f85cedef654fccc4a4d8+3")
+	srvs["zzzzz-bi6l4-000000000000001"].AddPull(Pull{
+		SizedDigest: blkid,
+		From:        srvs["zzzzz-bi6l4-000000000000000"],
+		To:          mnt,
+		Reason:      "underreplicated",
+		Class:       "default"})
+	srvs["zzzzz-bi6l4-000000000000000"].AddTrash(Trash{
+		SizedDigest: blkid,
+		From:        mnt,
+		Mtime:       123456789,
+		Reason:      "overreplicated"})
+
+	var buf bytes.Buffer
+	err := WriteChangeSets(&buf, srvs)
+	c.Check(err, check.IsNil)
+	c.Check(buf.String(), check.Equals, `{"type":"trash","locator":"acbd18db4cc2f85cedef654fccc4a4d8+3","service_uuid":"zzzzz-bi6l4-000000000000000","mount_uuid":"zzzzz-mount-abcdefghijklmno","block_mtime":123456789,"reason":"overreplicated"}
+{"type":"pull","locator":"acbd18db4cc2f85cedef654fccc4a4d8+3","service_uuid":"zzzzz-bi6l4-000000000000001","mount_uuid":"zzzzz-mount-abcdefghijklmno","from_service_uuid":"zzzzz-bi6l4-000000000000000","reason":"underreplicated","class":"default"}
+`)
+
+	report := buf.String()
+	for _, srv := range srvs {
+		srv.ChangeSet = &ChangeSet{}
+	}
+	bal := &Balancer{KeepServices: srvs}
+	err = bal.LoadChangeSets(&buf)
+	c.Check(err, check.IsNil)
+	c.Check(srvs["zzzzz-bi6l4-000000000000001"].Pulls, check.HasLen, 1)
+	c.Check(srvs["zzzzz-bi6l4-000000000000000"].Trashes, check.HasLen, 1)
+	buf.Reset()
+	WriteChangeSets(&buf, srvs)
+	c.Check(buf.String(), check.Equals, report)
+
+	// Requests for unknown mounts are rejected.
+	err = bal.LoadChangeSets(bytes.NewBufferString(`{"type":"trash","locator":"acbd18db4cc2f85cedef654fccc4a4d8+3","service_uuid":"zzzzz-bi6l4-000000000000000","mount_uuid":"zzzzz-mount-000000000000000"}`))
+	c.Check(err, check.ErrorMatches, `entry 1: unknown mount .*`)
+}
@@ -31,11 +31,28 @@ func countCollections(c *arvados.Client, params arvados.ResourceListParams) (int
 // If pageSize > 0 it is used as the maximum page size in each API
 // call; otherwise the maximum allowed page size is requested.
 func EachCollection(c *arvados.Client, pageSize int, f func(arvados.Collection) error, progress func(done, total int)) error {
+	return EachCollectionSince(c, pageSize, time.Time{}, f, progress)
+}
+
+// EachCollectionSince is like EachCollection, but only calls f for
+// collections whose modified_at is at or after since. A zero since
+// means all collections.
+func EachCollectionSince(c *arvados.Client, pageSize int, since time.Time, f func(arvados.Collection) error, progress func(done, total int)) error {
 	if progress == nil {
 		progress = func(_, _ int) {}
 	}
 
+	var sinceFilters []arvados.Filter
+	if !since.IsZero() {
+		sinceFilters = []arvados.Filter{{
+			Attr:     "modified_at",
+			Operator: ">=",
+			Operand:  since,
+		}}
+	}
+
 	expectCount, err := countCollections(c, arvados.ResourceListParams{
+		Filters:            sinceFilters,
 		IncludeTrash:       true,
 		IncludeOldVersions: true,
 	})
@@ -64,7 +81,8 @@ func EachCollection(c *arvados.Client, pageSize int, f func(arvados.Collection)
 		Limit:              &limit,
 		Order:              "modified_at, uuid",
 		Count:              "none",
-		Select:             []string{"uuid", "unsigned_manifest_text", "modified_at", "portable_data_hash", "replication_desired"},
+		Filters:            sinceFilters,
+		Select:             []string{"uuid", "unsigned_manifest_text", "modified_at", "portable_data_hash", "owner_uuid", "replication_desired"},
 		IncludeTrash:       true,
 		IncludeOldVersions: true,
 	}
@@ -150,10 +168,10 @@ func EachCollection(c *arvados.Client, pageSize int, f func(arvados.Collection)
 	progress(callCount, expectCount)
 
 	if checkCount, err := countCollections(c, arvados.ResourceListParams{
-		Filters: []arvados.Filter{{
+		Filters: append([]arvados.Filter{{
 			Attr:     "modified_at",
 			Operator: "<=",
-			Operand:  filterTime}},
+			Operand:  filterTime}}, sinceFilters...),
 		IncludeTrash:       true,
 		IncludeOldVersions: true,
 	}); err != nil {
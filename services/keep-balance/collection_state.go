@@ -0,0 +1,215 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// When retrieving collections modified since the previous run, start
+// this long before the latest modified_at seen, in case a
+// transaction with an earlier modified_at was committed late.
+const incrementalOverlap = 10 * time.Minute
+
+// Default interval between full collection scans in incremental
+// mode. Full scans are needed to notice purged collections, which
+// don't show up in a list of recently modified collections.
+const defaultFullScanPeriod = 24 * time.Hour
+
+// collectionRefs is the part of a collection record that determines
+// the desired replication of its blocks.
+type collectionRefs struct {
+	PortableDataHash      string
+	OwnerUUID             string
+	ReplicationDesired    *int
+	StorageClassesDesired []string
+	Blocks                []arvados.SizedDigest
+}
+
+// mountIndex is the index of a keepstore mount retrieved by previous
+// balancing runs, with a full index and any partial indexes since
+// then applied.
+type mountIndex struct {
+	// Mtime of each block, in nanoseconds since Unix epoch
+	Blocks map[arvados.SizedDigest]int64
+
+	// Start time of the most recent index request
+	Retrieved time.Time
+
+	// Index generation reported by keepstore with the most recent
+	// index. It changes whenever blocks are removed from the
+	// mount.
+	Generation string
+}
+
+// Update retrieves the blocks written to the mount since the
+// previous update, applies them, and returns the resulting index.
+//
+// A partial index only lists blocks that have been added, so it is
+// only used if the mount's index generation shows that no blocks
+// have been removed since the previous update. Otherwise (or if this
+// is the first update, or keepstore doesn't report a generation),
+// Update retrieves a full index and replaces the saved one. The
+// returned partial flag reports which one was used.
+func (mi *mountIndex) Update(c *arvados.Client, mnt *KeepMount) (idx []arvados.KeepServiceIndexEntry, partial bool, err error) {
+	var since time.Time
+	if !mi.Retrieved.IsZero() && mi.Generation != "" {
+		since = mi.Retrieved.Add(-incrementalOverlap)
+	}
+	start := time.Now()
+	idx, gen, err := mnt.KeepService.IndexMountSince(c, mnt.UUID, "", since)
+	if err != nil {
+		return nil, false, err
+	}
+	if !since.IsZero() && gen != mi.Generation {
+		// Blocks have been removed from the mount (or
+		// keepstore has restarted) since the previous
+		// update, so the saved index might list blocks that
+		// are gone.
+		since = time.Time{}
+		start = time.Now()
+		idx, gen, err = mnt.KeepService.IndexMountSince(c, mnt.UUID, "", since)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if since.IsZero() {
+		mi.Blocks = make(map[arvados.SizedDigest]int64, len(idx))
+	}
+	for _, ent := range idx {
+		mi.Blocks[ent.SizedDigest] = ent.Mtime
+	}
+	mi.Retrieved = start
+	mi.Generation = gen
+	idx = make([]arvados.KeepServiceIndexEntry, 0, len(mi.Blocks))
+	for blkid, mtime := range mi.Blocks {
+		idx = append(idx, arvados.KeepServiceIndexEntry{SizedDigest: blkid, Mtime: mtime})
+	}
+	return idx, !since.IsZero(), nil
+}
+
+// collectionState is the set of collections retrieved by previous
+// balancing runs. In incremental mode it is kept between runs (and
+// saved in Config.StateFile, if set), so each run only retrieves the
+// collections that have been modified since the last one.
+//
+// If Config.IncrementalIndexes is enabled, it also holds the
+// keepstore mount indexes.
+type collectionState struct {
+	Collections map[string]collectionRefs
+
+	// Indexes of keepstore mounts, keyed by device ID (or mount
+	// UUID, if the device ID is empty).
+	Indexes map[string]*mountIndex
+
+	// Every collection with modified_at at or before
+	// ModifiedThrough has been applied.
+	ModifiedThrough time.Time
+
+	// Start time of the full scan this state is based on.
+	FullScan time.Time
+}
+
+func newCollectionState() *collectionState {
+	return &collectionState{
+		Collections: map[string]collectionRefs{},
+		Indexes:     map[string]*mountIndex{},
+		FullScan:    time.Now(),
+	}
+}
+
+// Since returns the modified_at threshold for retrieving collections
+// that might have changed since the state was last updated.
+func (cs *collectionState) Since() time.Time {
+	if cs.ModifiedThrough.IsZero() {
+		return time.Time{}
+	}
+	return cs.ModifiedThrough.Add(-incrementalOverlap)
+}
+
+// Update replaces the state's record of the given collection.
+func (cs *collectionState) Update(coll arvados.Collection) error {
+	blkids, err := coll.SizedDigests()
+	if err != nil {
+		return fmt.Errorf("%v: %v", coll.UUID, err)
+	}
+	cs.Collections[coll.UUID] = collectionRefs{
+		PortableDataHash:      coll.PortableDataHash,
+		OwnerUUID:             coll.OwnerUUID,
+		ReplicationDesired:    coll.ReplicationDesired,
+		StorageClassesDesired: coll.StorageClassesDesired,
+		Blocks:                blkids,
+	}
+	if coll.ModifiedAt != nil && coll.ModifiedAt.After(cs.ModifiedThrough) {
+		cs.ModifiedThrough = *coll.ModifiedAt
+	}
+	return nil
+}
+
+// MountIndexes returns the saved index of each of the given mounts
+// (creating empty ones for new mounts), and forgets the indexes of
+// mounts that are no longer present.
+func (cs *collectionState) MountIndexes(mounts []*KeepMount) map[*KeepMount]*mountIndex {
+	keep := map[string]bool{}
+	ret := map[*KeepMount]*mountIndex{}
+	for _, mnt := range mounts {
+		key := mnt.DeviceID
+		if key == "" {
+			key = mnt.UUID
+		}
+		mi := cs.Indexes[key]
+		if mi == nil {
+			mi = &mountIndex{Blocks: map[arvados.SizedDigest]int64{}}
+			cs.Indexes[key] = mi
+		}
+		keep[key] = true
+		ret[mnt] = mi
+	}
+	for key := range cs.Indexes {
+		if !keep[key] {
+			delete(cs.Indexes, key)
+		}
+	}
+	return ret
+}
+
+// loadCollectionState reads a collection state saved by
+// (*collectionState)Save. It returns nil and no error if the file
+// does not exist.
+func loadCollectionState(path string) (*collectionState, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cs collectionState
+	err = gob.NewDecoder(f).Decode(&cs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if cs.Collections == nil {
+		cs.Collections = map[string]collectionRefs{}
+	}
+	if cs.Indexes == nil {
+		cs.Indexes = map[string]*mountIndex{}
+	}
+	return &cs, nil
+}
+
+// Save writes the state to the given file, atomically replacing any
+// existing file.
+func (cs *collectionState) Save(path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(cs)
+	})
+}
@@ -17,7 +17,8 @@ import (
 // KeepService represents a keepstore server that is being rebalanced.
 type KeepService struct {
 	arvados.KeepService
-	mounts []*KeepMount
+	mounts        []*KeepMount
+	failureDomain string
 	*ChangeSet
 }
 
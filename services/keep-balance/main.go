@@ -35,6 +35,8 @@ func main() {
 		"send pull requests (make more replicas of blocks that are underreplicated or are not in optimal rendezvous probe order)")
 	flag.BoolVar(&runOptions.CommitTrash, "commit-trash", false,
 		"send trash requests (delete unreferenced old blocks, and excess replicas of overreplicated blocks)")
+	replayPath := flag.String("replay-changesets", "",
+		"balance once, but only send the pull/trash requests that are also listed in the given `file` (as written by a previous run, see ChangeSetFile), and exit; use with -commit-pulls and -commit-trash")
 	dumpConfig := flag.Bool("dump-config", false, "write current configuration to stdout and exit")
 	dumpFlag := flag.Bool("dump", false, "dump details for each block to stdout")
 	debugFlag := flag.Bool("debug", false, "enable debug messages")
@@ -75,6 +77,10 @@ func main() {
 			log.Printf("config is %s", j)
 		}
 	}
+	if *replayPath != "" {
+		// Replay once, regardless of RunPeriod.
+		runOptions.Once = true
+	}
 	if *dumpFlag {
 		dumper := logrus.New()
 		dumper.Out = os.Stdout
@@ -84,6 +90,8 @@ func main() {
 	srv, err := NewServer(cfg, runOptions)
 	if err != nil {
 		// (don't run)
+	} else if *replayPath != "" {
+		_, err = srv.Replay(*replayPath)
 	} else if runOptions.Once {
 		_, err = srv.Run()
 	} else {
@@ -20,6 +20,7 @@ type metrics struct {
 	reg         *prometheus.Registry
 	statsGauges map[string]setter
 	observers   map[string]observer
+	usageGauges map[string]prometheus.Gauge
 	setupOnce   sync.Once
 	mtx         sync.Mutex
 }
@@ -64,6 +65,7 @@ func (m *metrics) UpdateStats(s balancerStats) {
 		"overreplicated":    {s.overrep, "overreplicated"},
 		"underreplicated":   {s.underrep, "underreplicated"},
 		"lost":              {s.lost, "lost"},
+		"single_domain":     {s.singleDomain, "replicated, but all replicas in one failure domain"},
 		"dedup_byte_ratio":  {s.dedupByteRatio(), "deduplication ratio, bytes referenced / bytes stored"},
 		"dedup_block_ratio": {s.dedupBlockRatio(), "deduplication ratio, blocks referenced / blocks stored"},
 	}
@@ -111,6 +113,37 @@ func (m *metrics) UpdateStats(s balancerStats) {
 	}
 }
 
+// UpdateUsage updates the cluster-wide usage metrics using the
+// given usageReport. Per-owner figures are only available in the
+// report itself: labeling metrics by owner would give them unbounded
+// cardinality.
+func (m *metrics) UpdateUsage(u *usageReport) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.usageGauges == nil {
+		m.usageGauges = map[string]prometheus.Gauge{}
+		for name, help := range map[string]string{
+			"usage_owners":        "users and projects that own collections",
+			"usage_logical_bytes": "bytes referenced by collections, counting each reference",
+			"usage_unique_bytes":  "distinct bytes referenced by a single owner's collections",
+			"usage_shared_bytes":  "distinct bytes referenced by more than one owner's collections",
+		} {
+			g := prometheus.NewGauge(prometheus.GaugeOpts{
+				Namespace: "arvados",
+				Name:      name,
+				Subsystem: "keep",
+				Help:      help,
+			})
+			m.reg.MustRegister(g)
+			m.usageGauges[name] = g
+		}
+	}
+	m.usageGauges["usage_owners"].Set(float64(u.totals.Owners))
+	m.usageGauges["usage_logical_bytes"].Set(float64(u.totals.LogicalBytes))
+	m.usageGauges["usage_unique_bytes"].Set(float64(u.totals.UniqueBytes))
+	m.usageGauges["usage_shared_bytes"].Set(float64(u.totals.SharedBytes))
+}
+
 func (m *metrics) Handler(log promhttp.Logger) http.Handler {
 	return promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{
 		ErrorLog: log,
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -63,6 +64,77 @@ type Config struct {
 	// Destination filename for the list of lost block hashes, one
 	// per line. Updated atomically during each successful run.
 	LostBlocksFile string
+
+	// Failure domain (e.g., rack or availability zone) of each
+	// keep service, keyed by service UUID. Services that aren't
+	// listed are each treated as a separate failure domain.
+	FailureDomains map[string]string
+
+	// If true, keep the block references from all collections
+	// between runs, and only retrieve the collections that have
+	// been modified since the previous run.
+	IncrementalCollections bool
+
+	// If true (and IncrementalCollections is also true), keep the
+	// keepstore indexes between runs too, and only retrieve the
+	// blocks written since the previous run. Trash lists are
+	// only sent after a full scan.
+	IncrementalIndexes bool
+
+	// In incremental mode, retrieve all collections (and indexes)
+	// at least this often (default 24h), in order to notice
+	// purged collections and deleted blocks.
+	FullScanPeriod arvados.Duration
+
+	// In incremental mode, save the collection state in this file
+	// after each run, so it survives a restart.
+	StateFile string
+
+	// Destination filename for the pull and trash requests
+	// computed by each run, as JSON lines. Updated atomically
+	// during each successful run. The same report is available
+	// at /changesets on the management interface.
+	ChangeSetFile string
+
+	// Maximum age of a change set file that can be replayed with
+	// -replay-changesets (default 24h).
+	ReplayMaxAge arvados.Duration
+
+	// Maximum number of pull requests, total size of blocks to
+	// pull, and number of trash requests to send to each keep
+	// service in a single run. Zero means no limit. The most
+	// urgent changes (e.g., blocks with only one replica) are
+	// sent first; the rest are left for later runs.
+	MaxPullsPerServer     int
+	MaxPullBytesPerServer arvados.ByteSize
+	MaxTrashesPerServer   int
+
+	// Destination filename for a JSON report of lost and
+	// underreplicated blocks, with the collections (and their
+	// owners) that reference them, and the mounts where they are
+	// stored. For lost blocks, the mounts where they were last
+	// seen are included only if a previous report listed them as
+	// underreplicated. Updated atomically during each successful
+	// run. The same report is available at /block-report on the
+	// management interface.
+	BlockReportFile string
+
+	// Destination filename for a JSON report of the storage used
+	// by each owner (user or project): logical bytes, and
+	// deduplicated bytes that are unique to the owner or shared
+	// with other owners, with and without subprojects. Updated
+	// atomically during each successful run. The same report is
+	// available at /usage-report on the management interface.
+	// Cluster-wide totals are exported as arvados_keep_usage_*
+	// metrics.
+	UsageReportFile string
+
+	// Daily time window (local time, like "22:00-06:00") when
+	// pull and trash lists can be sent. Outside the window, runs
+	// compute and report changes without committing them, and
+	// send empty lists to clear any unfinished lists from earlier
+	// runs. Empty means any time.
+	CommitWindow string
 }
 
 // RunOptions controls runtime behavior. The flags/options that belong
@@ -84,6 +156,14 @@ type RunOptions struct {
 	// we need to watch out for races. See
 	// (*Balancer)ClearTrashLists.
 	SafeRendezvousState string
+
+	// Collections retrieved by the most recent balance
+	// operation, if Config.IncrementalCollections is enabled.
+	collections *collectionState
+
+	// Mounts where each block in the most recent block report
+	// was stored, if Config.BlockReportFile is enabled.
+	lastSeen map[arvados.SizedDigest][]blockReportMount
 }
 
 type Server struct {
@@ -92,6 +172,13 @@ type Server struct {
 	metrics    *metrics
 	listening  string // for tests
 
+	// Keep services (with change sets) from the most recent
+	// successful run, reported at /changesets.
+	lastServices    map[string]*KeepService
+	lastBlockReport *blockReport
+	lastUsage       *usageReport
+	lastMtx         sync.Mutex
+
 	Logger logrus.FieldLogger
 	Dumper logrus.FieldLogger
 }
@@ -105,6 +192,9 @@ func NewServer(config Config, runOptions RunOptions) (*Server, error) {
 	if !runOptions.Once && config.RunPeriod == arvados.Duration(0) {
 		return nil, fmt.Errorf("you must either use the -once flag, or specify RunPeriod in config")
 	}
+	if _, err := parseTimeWindow(config.CommitWindow); err != nil {
+		return nil, err
+	}
 
 	if runOptions.Logger == nil {
 		log := logrus.New()
@@ -130,12 +220,17 @@ func (srv *Server) start() error {
 		return nil
 	}
 	ctx := ctxlog.Context(context.Background(), srv.Logger)
+	mux := http.NewServeMux()
+	mux.Handle("/", srv.metrics.Handler(srv.Logger))
+	mux.HandleFunc("/changesets", srv.serveChangeSets)
+	mux.HandleFunc("/block-report", srv.serveBlockReport)
+	mux.HandleFunc("/usage-report", srv.serveUsageReport)
 	server := &httpserver.Server{
 		Server: http.Server{
 			Handler: httpserver.HandlerWithContext(ctx,
 				httpserver.LogRequests(
 					auth.RequireLiteralToken(srv.config.ManagementToken,
-						srv.metrics.Handler(srv.Logger)))),
+						mux))),
 		},
 		Addr: srv.config.Listen,
 	}
@@ -150,16 +245,55 @@ func (srv *Server) start() error {
 
 func (srv *Server) Run() (*Balancer, error) {
 	bal := &Balancer{
-		Logger:         srv.Logger,
-		Dumper:         srv.Dumper,
-		Metrics:        srv.metrics,
-		LostBlocksFile: srv.config.LostBlocksFile,
+		Logger:          srv.Logger,
+		Dumper:          srv.Dumper,
+		Metrics:         srv.metrics,
+		LostBlocksFile:  srv.config.LostBlocksFile,
+		ChangeSetFile:   srv.config.ChangeSetFile,
+		BlockReportFile: srv.config.BlockReportFile,
+		UsageReportFile: srv.config.UsageReportFile,
+		FailureDomains:  srv.config.FailureDomains,
 	}
 	var err error
 	srv.runOptions, err = bal.Run(srv.config, srv.runOptions)
+	if err == nil {
+		srv.lastMtx.Lock()
+		srv.lastServices = bal.KeepServices
+		srv.lastBlockReport = bal.blockReport
+		srv.lastUsage = bal.usage
+		srv.lastMtx.Unlock()
+	}
 	return bal, err
 }
 
+// Replay sends the pull and trash requests listed in the given change
+// set file (see Config.ChangeSetFile), instead of computing new ones.
+func (srv *Server) Replay(path string) (*Balancer, error) {
+	bal := &Balancer{
+		Logger:  srv.Logger,
+		Dumper:  srv.Dumper,
+		Metrics: srv.metrics,
+	}
+	return bal, bal.Replay(srv.config, srv.runOptions, path)
+}
+
+// serveChangeSets writes the change sets computed by the most recent
+// successful run, in the same format as Config.ChangeSetFile.
+func (srv *Server) serveChangeSets(w http.ResponseWriter, req *http.Request) {
+	srv.lastMtx.Lock()
+	services := srv.lastServices
+	srv.lastMtx.Unlock()
+	if services == nil {
+		http.Error(w, "no successful run yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	err := WriteChangeSets(w, services)
+	if err != nil {
+		srv.Logger.WithError(err).Warn("error writing change sets")
+	}
+}
+
 // RunForever runs forever, or (for testing purposes) until the given
 // stop channel is ready to receive.
 func (srv *Server) RunForever(stop <-chan interface{}) error {
@@ -204,3 +338,45 @@ func (srv *Server) RunForever(stop <-chan interface{}) error {
 		logger.Print("starting next run")
 	}
 }
+
+// serveBlockReport writes the block report from the most recent
+// successful run, in the same format as Config.BlockReportFile.
+func (srv *Server) serveBlockReport(w http.ResponseWriter, req *http.Request) {
+	if srv.config.BlockReportFile == "" {
+		http.Error(w, "block report is not enabled (see BlockReportFile config)", http.StatusNotFound)
+		return
+	}
+	srv.lastMtx.Lock()
+	report := srv.lastBlockReport
+	srv.lastMtx.Unlock()
+	if report == nil {
+		http.Error(w, "no successful run yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := writeBlockReport(w, report)
+	if err != nil {
+		srv.Logger.WithError(err).Warn("error writing block report")
+	}
+}
+
+// serveUsageReport writes the usage report from the most recent
+// successful run, in the same format as Config.UsageReportFile.
+func (srv *Server) serveUsageReport(w http.ResponseWriter, req *http.Request) {
+	if srv.config.UsageReportFile == "" {
+		http.Error(w, "usage report is not enabled (see UsageReportFile config)", http.StatusNotFound)
+		return
+	}
+	srv.lastMtx.Lock()
+	report := srv.lastUsage
+	srv.lastMtx.Unlock()
+	if report == nil {
+		http.Error(w, "no successful run yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := writeUsageReport(w, report)
+	if err != nil {
+		srv.Logger.WithError(err).Warn("error writing usage report")
+	}
+}
@@ -94,6 +94,165 @@ Tuning resource usage:
     block index from a keepstore server, or sending a trash or pull
     list to a keepstore server). Defaults to 30 minutes.
 
+Limiting pull and trash traffic:
+
+    MaxPullsPerServer, MaxPullBytesPerServer, and MaxTrashesPerServer
+    limit the size of the pull and trash lists sent to each keep
+    service in a single run. The most urgent changes are sent first:
+    pulls of blocks with only one replica, then other
+    underreplicated blocks, then rebalancing; trash for unreferenced
+    blocks, then overreplicated blocks, then rebalancing. The rest
+    are computed again (if still needed) in later runs.
+
+        MaxPullsPerServer: 10000
+        MaxPullBytesPerServer: 200GiB
+        MaxTrashesPerServer: 50000
+
+    CommitWindow is a daily time window (in the local time zone of
+    the keep-balance host) when pull and trash lists can be sent.
+    Runs outside the window compute and report changes, but don't
+    commit them. Instead, they send empty pull and trash lists, so
+    keepstore servers stop working on any lists left over from
+    earlier runs. The window can span midnight:
+
+        CommitWindow: "20:00-06:00"
+
+    These limits don't apply to -replay-changesets. To limit the
+    rate at which keepstore itself processes pull and trash lists,
+    see its PullRate and TrashRate configs.
+
+Incremental operation:
+
+    If IncrementalCollections is true, keep-balance remembers the
+    block references of all collections between runs, and each run
+    only retrieves the collections that have been modified since the
+    previous run. This makes each run much faster on sites with many
+    collections.
+
+    Purged collections don't appear in the list of recently modified
+    collections, so a full scan is still done every FullScanPeriod
+    (default 24h).
+
+    If StateFile is set, the collection state is saved there after
+    each run, so incremental operation can continue after a
+    restart. Otherwise the first run after a restart is a full scan.
+
+    Keepstore indexes are still retrieved in full on every run,
+    unless IncrementalIndexes is also true. In that case, the index
+    of each keepstore mount is saved along with the collection
+    state, and each run only retrieves the blocks that have been
+    written or touched since the previous run. Blocks that are
+    removed don't appear in these partial indexes, so whenever
+    keepstore reports that blocks have been removed from a mount
+    (e.g., by a trash list or the keepstore scrubber), or keepstore
+    has restarted, the full index of that mount is retrieved
+    instead. Blocks lost without keepstore's involvement (e.g., a
+    failed disk) are only noticed on the next full scan. For the
+    same reason, keep-balance only sends trash lists after a full
+    scan, when it has seen complete indexes; runs in between only
+    send pull lists.
+
+Failure domains:
+
+    FailureDomains maps keep service UUIDs to failure domain labels,
+    such as racks or availability zones. When choosing where to put
+    the desired replicas of a block, keep-balance prefers servers in
+    distinct failure domains, then distinct servers. Services that
+    are not listed are each treated as a separate failure domain.
+
+    For example:
+
+        FailureDomains:
+            zzzzz-bi6l4-000000000000000: rack1
+            zzzzz-bi6l4-000000000000001: rack1
+            zzzzz-bi6l4-000000000000002: rack2
+
+    Blocks whose replicas are all in one failure domain are reported
+    in the statistics, and in the
+    arvados_keep_single_domain_{blocks,bytes,replicas} metrics.
+
+Lost and underreplicated blocks:
+
+    If BlockReportFile is set, each run writes a JSON report listing
+    every lost or underreplicated block, with:
+
+        - the mounts where it is currently stored;
+
+        - for lost blocks, the mounts where it was stored when a
+          previous run last saw it. Only the blocks listed in the
+          previous report are remembered between runs, so this is
+          missing if the block was fully replicated in the previous
+          run (e.g., a block with desired replication 1 on a failed
+          disk). The previous report is read from BlockReportFile
+          when keep-balance restarts;
+
+        - the UUID, portable data hash, owner UUID, and desired
+          replication of each collection whose desired replication
+          is not met.
+
+    The same report of the most recent successful run is available
+    at /block-report on the management interface (Listen), using
+    ManagementToken.
+
+Storage usage by owner:
+
+    If UsageReportFile is set, each run computes the storage used by
+    the collections owned by each user or project, and writes a JSON
+    report:
+
+        {"generated_at":"...","owners":{"zzzzz-j7d0g-000000000000000":
+          {"collections":12,"logical_bytes":1000,"unique_bytes":600,
+           "shared_bytes":200,"total_collections":15,
+           "total_logical_bytes":1200,"total_unique_bytes":700}, ...}}
+
+    logical_bytes counts each block once for every reference (i.e.,
+    the total size of the files). unique_bytes is the size of the
+    distinct blocks referenced only by that owner's collections, i.e.,
+    what would be freed by deleting them; shared_bytes is the size of
+    the distinct blocks also referenced by other owners'
+    collections. These three only count the collections owned
+    directly by the owner.
+
+    The total_* fields also count the collections in the owner's
+    subprojects (recursively). total_unique_bytes is what would be
+    freed by deleting the project and everything in it: blocks that
+    are only shared between the project and its subprojects count
+    as unique.
+
+    All sizes are for a single replica. Trashed collections, trashed
+    projects, and old versions are included.
+
+    The same report is available at /usage-report on the management
+    interface. Cluster-wide totals are exported as the
+    arvados_keep_usage_owners, arvados_keep_usage_logical_bytes,
+    arvados_keep_usage_unique_bytes, and arvados_keep_usage_shared_bytes
+    metrics.
+
+Reviewing changes:
+
+    If ChangeSetFile is set, each run writes the pull and trash
+    requests it computed to that file, as JSON lines, e.g.:
+
+        {"type":"pull","locator":"acbd18db4cc2f85cedef654fccc4a4d8+3","service_uuid":"zzzzz-bi6l4-000000000000001","mount_uuid":"zzzzz-ivpuk-000000000000001","from_service_uuid":"zzzzz-bi6l4-000000000000000","reason":"underreplicated","class":"default"}
+        {"type":"trash","locator":"acbd18db4cc2f85cedef654fccc4a4d8+3","service_uuid":"zzzzz-bi6l4-000000000000002","mount_uuid":"zzzzz-ivpuk-000000000000002","block_mtime":1546300800000000000,"reason":"overreplicated"}
+
+    The reason is "lost-risk" (only one replica left),
+    "underreplicated", "overreplicated", "unreferenced", or
+    "rebalance" (moving a replica to a better position). The same
+    report of the most recent successful run is available at
+    /changesets on the management interface (Listen), using
+    ManagementToken.
+
+    To apply a reviewed report (after a dry run, possibly with
+    unwanted lines removed), use -replay-changesets together with
+    -commit-pulls and/or -commit-trash. keep-balance retrieves the
+    current state and computes changes as usual, but only sends the
+    requests that also appear in the report: requests that are no
+    longer needed (e.g., because a block has been pulled or trashed
+    since the report was written) are skipped. Reports older than
+    ReplayMaxAge (default 24h) are refused, and requests for keep
+    services or mounts that no longer exist are rejected.
+
 Limitations:
 
     keep-balance does not attempt to discover whether committed pull
@@ -0,0 +1,240 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// ownerUsage is the storage used by the collections owned by a
+// single user or project.
+type ownerUsage struct {
+	// Number of collections (including trashed collections and
+	// old versions).
+	Collections int `json:"collections"`
+
+	// Total size of the blocks referenced by the collections,
+	// counting a block once for each reference.
+	LogicalBytes int64 `json:"logical_bytes"`
+
+	// Total size of the distinct blocks that are referenced only
+	// by this owner's collections, i.e., the data that would be
+	// freed by deleting them.
+	UniqueBytes int64 `json:"unique_bytes"`
+
+	// Total size of the distinct blocks that are also referenced
+	// by other owners' collections.
+	SharedBytes int64 `json:"shared_bytes"`
+
+	// Collections, LogicalBytes, and UniqueBytes for the
+	// collections owned by this owner and by its subprojects
+	// (recursively). TotalUniqueBytes is the data that would be
+	// freed by deleting the project and everything in it.
+	TotalCollections  int   `json:"total_collections"`
+	TotalLogicalBytes int64 `json:"total_logical_bytes"`
+	TotalUniqueBytes  int64 `json:"total_unique_bytes"`
+}
+
+// usageReport is the per-owner storage usage computed by a balancing
+// run. Byte counts are for a single replica.
+type usageReport struct {
+	GeneratedAt time.Time              `json:"generated_at"`
+	Owners      map[string]*ownerUsage `json:"owners"`
+
+	// Cluster-wide totals, exported as metrics.
+	totals usageTotals
+}
+
+// usageTotals is the storage used by all collections.
+type usageTotals struct {
+	// Number of owners with at least one collection.
+	Owners int
+
+	// Sum of the owners' LogicalBytes.
+	LogicalBytes int64
+
+	// Total size of the distinct blocks that are referenced by a
+	// single owner's collections (the sum of the owners'
+	// UniqueBytes), and by more than one owner's collections.
+	UniqueBytes int64
+	SharedBytes int64
+}
+
+// addCollectionUsage adds a collection's references to the usage
+// report.
+func (bal *Balancer) addCollectionUsage(refs collectionRefs) {
+	bal.mutex.Lock()
+	u := bal.usage.Owners[refs.OwnerUUID]
+	if u == nil {
+		u = &ownerUsage{}
+		bal.usage.Owners[refs.OwnerUUID] = u
+	}
+	u.Collections++
+	for _, blkid := range refs.Blocks {
+		u.LogicalBytes += blkid.Size()
+	}
+	bal.mutex.Unlock()
+	bal.BlockStateMap.AddOwner(refs.OwnerUUID, refs.Blocks)
+}
+
+// computeUsage fills in the unique and shared byte counts of the
+// usage report, and the totals including subprojects. It should be
+// called after GetCurrentState.
+func (bal *Balancer) computeUsage(c *arvados.Client, pageSize int) error {
+	parents, err := getGroupOwners(c, pageSize)
+	if err != nil {
+		return fmt.Errorf("retrieving projects: %s", err)
+	}
+	ancestors := ownerAncestors(parents)
+
+	// commonSize[x] is the size of the distinct blocks whose
+	// owners are all x or x's subprojects, but not all in any
+	// single one of x's subprojects.
+	commonSize := map[string]int64{}
+	totals := usageTotals{}
+	bal.BlockStateMap.Apply(func(blkid arvados.SizedDigest, blk *BlockState) {
+		if len(blk.Owners) == 0 {
+			return
+		}
+		size := blkid.Size()
+		if len(blk.Owners) == 1 {
+			for owner := range blk.Owners {
+				bal.usage.Owners[owner].UniqueBytes += size
+			}
+			totals.UniqueBytes += size
+		} else {
+			for owner := range blk.Owners {
+				bal.usage.Owners[owner].SharedBytes += size
+			}
+			totals.SharedBytes += size
+		}
+		if common := commonAncestor(blk.Owners, ancestors); common != "" {
+			commonSize[common] += size
+		}
+	})
+
+	owners := make([]string, 0, len(bal.usage.Owners))
+	for owner, u := range bal.usage.Owners {
+		owners = append(owners, owner)
+		totals.Owners++
+		totals.LogicalBytes += u.LogicalBytes
+	}
+	total := func(uuid string) *ownerUsage {
+		u := bal.usage.Owners[uuid]
+		if u == nil {
+			u = &ownerUsage{}
+			bal.usage.Owners[uuid] = u
+		}
+		return u
+	}
+	for _, owner := range owners {
+		u := bal.usage.Owners[owner]
+		for _, uuid := range ancestors(owner) {
+			t := total(uuid)
+			t.TotalCollections += u.Collections
+			t.TotalLogicalBytes += u.LogicalBytes
+		}
+	}
+	for owner, size := range commonSize {
+		for _, uuid := range ancestors(owner) {
+			total(uuid).TotalUniqueBytes += size
+		}
+	}
+	bal.usage.GeneratedAt = time.Now().UTC()
+	bal.usage.totals = totals
+	bal.Metrics.UpdateUsage(bal.usage)
+	return nil
+}
+
+// getGroupOwners returns the owner UUID of every group (including
+// trashed groups), keyed by group UUID.
+func getGroupOwners(c *arvados.Client, pageSize int) (map[string]string, error) {
+	owners := map[string]string{}
+	params := arvados.ResourceListParams{
+		Select:       []string{"uuid", "owner_uuid"},
+		Order:        "uuid",
+		Count:        "none",
+		IncludeTrash: true,
+	}
+	if pageSize > 0 {
+		params.Limit = &pageSize
+	}
+	for {
+		var page arvados.GroupList
+		err := c.RequestAndDecode(&page, "GET", "arvados/v1/groups", nil, params)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Items) == 0 {
+			return owners, nil
+		}
+		for _, g := range page.Items {
+			owners[g.UUID] = g.OwnerUUID
+		}
+		params.Filters = []arvados.Filter{{
+			Attr:     "uuid",
+			Operator: ">",
+			Operand:  page.Items[len(page.Items)-1].UUID,
+		}}
+	}
+}
+
+// ownerAncestors returns a function that returns the given owner
+// UUID followed by the UUIDs of its parent project, grandparent, etc.,
+// up to a user (or other owner that isn't a group).
+func ownerAncestors(parents map[string]string) func(string) []string {
+	cache := map[string][]string{}
+	return func(uuid string) []string {
+		if chain, ok := cache[uuid]; ok {
+			return chain
+		}
+		chain := []string{uuid}
+		for p, ok := parents[uuid]; ok && p != ""; p, ok = parents[p] {
+			if len(chain) > len(parents) {
+				// Cycle in ownership graph.
+				break
+			}
+			chain = append(chain, p)
+		}
+		cache[uuid] = chain
+		return chain
+	}
+}
+
+// commonAncestor returns the closest owner that is one of the given
+// owners or an ancestor of all of them, or "" if there is none.
+func commonAncestor(owners map[string]bool, ancestors func(string) []string) string {
+	var common []string
+	first := true
+	for owner := range owners {
+		if first {
+			common = ancestors(owner)
+			first = false
+			continue
+		}
+		isAncestor := map[string]bool{}
+		for _, uuid := range ancestors(owner) {
+			isAncestor[uuid] = true
+		}
+		for len(common) > 0 && !isAncestor[common[0]] {
+			common = common[1:]
+		}
+	}
+	if len(common) == 0 {
+		return ""
+	}
+	return common[0]
+}
+
+func writeUsageReport(w io.Writer, report *usageReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(report)
+}
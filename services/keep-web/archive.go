@@ -0,0 +1,277 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// archiveMediaType maps supported archive formats to media types.
+var archiveMediaType = map[string]string{
+	"zip":    "application/zip",
+	"tar":    "application/x-tar",
+	"tar.gz": "application/gzip",
+}
+
+// archiveFormat returns the archive format requested by the client
+// ("zip", "tar", or "tar.gz"), or "" if the client did not ask for
+// an archive.
+//
+// The format can be given as an "archive" query parameter
+// (?archive=zip), or by sending a matching Accept header.
+func archiveFormat(r *http.Request) string {
+	switch f := r.FormValue("archive"); f {
+	case "zip", "tar", "tar.gz":
+		return f
+	case "tgz":
+		return "tar.gz"
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accept, ";", 2)[0])
+		for format, mt := range archiveMediaType {
+			if mediaType == mt {
+				return format
+			}
+		}
+	}
+	return ""
+}
+
+// archiveSitePathOK reports whether the given site filesystem path
+// can be served as an archive. To limit the amount of work a single
+// request can cause, archives are only offered for directories
+// inside a single collection ("/by_id/{collection ID}/..."), not for
+// projects, home directories, or the site root.
+func archiveSitePathOK(p string) bool {
+	parts := strings.SplitN(p, "/", 4)
+	if len(parts) < 3 || parts[0] != "" || parts[1] != "by_id" {
+		return false
+	}
+	id := parseCollectionIDFromURL(parts[2])
+	if uuid, _, ok := arvados.ParseCollectionVersion(id); ok {
+		id = uuid
+	}
+	return id != "" && (!arvadosclient.UUIDMatch(id) || strings.Contains(id, "-4zz18-"))
+}
+
+type archiveEntry struct {
+	name string // path relative to the archived directory
+	fi   os.FileInfo
+}
+
+// archiveFilter returns a func that reports whether a file (given its
+// path relative to the archived directory) should be included in the
+// archive requested by r.
+//
+// "files" parameters select files and directory subtrees by path.
+// "glob" parameters select files whose paths match a shell pattern
+// (see path.Match); a pattern without "/" is matched against the
+// file's base name. If both are given, a file must satisfy both.
+func archiveFilter(r *http.Request) (func(string) bool, error) {
+	r.ParseForm()
+	files := r.Form["files"]
+	globs := r.Form["glob"]
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, err
+		}
+	}
+	return func(name string) bool {
+		if len(files) > 0 {
+			ok := false
+			for _, f := range files {
+				f = strings.Trim(f, "/")
+				if name == f || strings.HasPrefix(name, f+"/") {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				return false
+			}
+		}
+		if len(globs) > 0 {
+			ok := false
+			for _, glob := range globs {
+				target := name
+				if !strings.Contains(glob, "/") {
+					target = path.Base(name)
+				}
+				if match, _ := path.Match(glob, target); match {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// serveArchive sends the files in the given directory (recursively)
+// as a single zip/tar/tar.gz archive. The archive is written as the
+// files are read, so memory use does not depend on the size of the
+// directory.
+//
+// Once the archive has started, errors can no longer be reported to
+// the client: they are logged, and the archive is left incomplete so
+// the client can tell it is truncated.
+func (h *handler) serveArchive(w http.ResponseWriter, r *http.Request, fs http.FileSystem, dir, name, format string) {
+	include, err := archiveFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	var ents []archiveEntry
+	var walk func(string) error
+	walk = func(rel string) error {
+		d, err := fs.Open(dir + "/" + rel)
+		if err != nil {
+			return err
+		}
+		fis, err := d.Readdir(-1)
+		d.Close()
+		if err != nil {
+			return err
+		}
+		sort.Slice(fis, func(i, j int) bool {
+			return fis[i].Name() < fis[j].Name()
+		})
+		for _, fi := range fis {
+			if fi.IsDir() {
+				err = walk(rel + fi.Name() + "/")
+				if err != nil {
+					return err
+				}
+			} else if include(rel + fi.Name()) {
+				ents = append(ents, archiveEntry{rel + fi.Name(), fi})
+			}
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if name == "" || name == "/" || name == "." {
+		name = "archive"
+	}
+	w.Header().Set("Content-Type", archiveMediaType[format])
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.QuoteToASCII(name+"."+format))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+
+	var aw archiveWriter
+	switch format {
+	case "zip":
+		aw = &zipArchiveWriter{zip.NewWriter(w)}
+	case "tar":
+		aw = &tarArchiveWriter{tw: tar.NewWriter(w)}
+	case "tar.gz":
+		gzw := gzip.NewWriter(w)
+		aw = &tarArchiveWriter{tw: tar.NewWriter(gzw), gzw: gzw}
+	}
+	for _, ent := range ents {
+		err = archiveFile(aw, fs, dir+"/"+ent.name, ent)
+		if err != nil {
+			log.WithField("RequestID", r.Header.Get("X-Request-Id")).Printf("error writing %s archive of %q: %s: %s", format, dir, ent.name, err)
+			return
+		}
+	}
+	if err = aw.Close(); err != nil {
+		log.WithField("RequestID", r.Header.Get("X-Request-Id")).Printf("error writing %s archive of %q: %s", format, dir, err)
+	}
+}
+
+func archiveFile(aw archiveWriter, fs http.FileSystem, fullpath string, ent archiveEntry) error {
+	f, err := fs.Open(fullpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fw, err := aw.Create(ent.name, ent.fi)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(fw, f)
+	if err != nil {
+		return err
+	}
+	if n != ent.fi.Size() {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// archiveWriter is implemented by zip and tar writers.
+type archiveWriter interface {
+	// Create adds a file to the archive and returns a writer for
+	// its content.
+	Create(name string, fi os.FileInfo) (io.Writer, error)
+	// Close finishes writing the archive.
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (zaw *zipArchiveWriter) Create(name string, fi os.FileInfo) (io.Writer, error) {
+	hdr := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		Modified:           fi.ModTime(),
+		UncompressedSize64: uint64(fi.Size()),
+	}
+	hdr.SetMode(0644)
+	return zaw.zw.CreateHeader(hdr)
+}
+
+func (zaw *zipArchiveWriter) Close() error {
+	return zaw.zw.Close()
+}
+
+type tarArchiveWriter struct {
+	tw  *tar.Writer
+	gzw *gzip.Writer
+}
+
+func (taw *tarArchiveWriter) Create(name string, fi os.FileInfo) (io.Writer, error) {
+	err := taw.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     fi.Size(),
+		Mode:     0644,
+		ModTime:  fi.ModTime(),
+	})
+	return taw.tw, err
+}
+
+func (taw *tarArchiveWriter) Close() error {
+	err := taw.tw.Close()
+	if err == nil && taw.gzw != nil {
+		err = taw.gzw.Close()
+	}
+	return err
+}
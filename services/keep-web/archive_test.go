@@ -0,0 +1,182 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+// archiveContents returns the names and contents of the files in a
+// zip/tar/tar.gz archive.
+func archiveContents(c *check.C, format string, data []byte) map[string]string {
+	files := map[string]string{}
+	switch format {
+	case "zip":
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		c.Assert(err, check.IsNil)
+		for _, f := range zr.File {
+			rdr, err := f.Open()
+			c.Assert(err, check.IsNil)
+			buf, err := ioutil.ReadAll(rdr)
+			c.Assert(err, check.IsNil)
+			files[f.Name] = string(buf)
+		}
+	case "tar", "tar.gz":
+		var rdr io.Reader = bytes.NewReader(data)
+		if format == "tar.gz" {
+			gzr, err := gzip.NewReader(rdr)
+			c.Assert(err, check.IsNil)
+			rdr = gzr
+		}
+		tr := tar.NewReader(rdr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, check.IsNil)
+			buf, err := ioutil.ReadAll(tr)
+			c.Assert(err, check.IsNil)
+			files[hdr.Name] = string(buf)
+		}
+	}
+	return files
+}
+
+func (s *UnitSuite) TestArchiveFormat(c *check.C) {
+	for _, trial := range []struct {
+		url    string
+		accept string
+		expect string
+	}{
+		{"/dir/", "", ""},
+		{"/dir/", "text/html,*/*;q=0.8", ""},
+		{"/dir/?archive=zip", "", "zip"},
+		{"/dir/?archive=tgz", "", "tar.gz"},
+		{"/dir/?archive=rar", "", ""},
+		{"/dir/", "application/x-tar", "tar"},
+		{"/dir/", "text/html, application/gzip;q=0.9", "tar.gz"},
+	} {
+		r := httptest.NewRequest("GET", trial.url, nil)
+		r.Header.Set("Accept", trial.accept)
+		c.Check(archiveFormat(r), check.Equals, trial.expect, check.Commentf("%+v", trial))
+	}
+}
+
+func (s *UnitSuite) TestArchiveSitePathOK(c *check.C) {
+	for _, trial := range []struct {
+		path   string
+		expect bool
+	}{
+		{"/", false},
+		{"/by_id", false},
+		{"/by_id/", false},
+		{"/users/active/foo", false},
+		{"/by_id/" + arvadostest.AProjectUUID, false},
+		{"/by_id/" + arvadostest.AProjectUUID + "/foo", false},
+		{"/by_id/" + arvadostest.FooCollection, true},
+		{"/by_id/" + arvadostest.FooCollection + "/dir1/", true},
+		{"/by_id/" + arvadostest.FooCollection + "@2", true},
+		{"/by_id/" + arvadostest.FooCollectionPDH, true},
+		{"/by_id/" + strings.Replace(arvadostest.FooCollectionPDH, "+", "-", 1) + "/", true},
+	} {
+		c.Check(archiveSitePathOK(trial.path), check.Equals, trial.expect, check.Commentf("%+v", trial))
+	}
+}
+
+func (s *UnitSuite) TestServeArchive(c *check.C) {
+	tmp := c.MkDir()
+	for fnm, data := range map[string]string{
+		"a.txt":           "aaa",
+		"b.dat":           "bbb",
+		"sub/c.txt":       "ccc",
+		"sub/deep/d.txt":  "ddd",
+		"other/e.txt":     "eee",
+		"other/empty.txt": "",
+	} {
+		c.Assert(os.MkdirAll(filepath.Dir(filepath.Join(tmp, fnm)), 0755), check.IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(tmp, fnm), []byte(data), 0644), check.IsNil)
+	}
+	h := handler{Config: newConfig(s.Config)}
+	for _, trial := range []struct {
+		query  string
+		dir    string
+		expect map[string]string
+	}{
+		{"", "/", map[string]string{"a.txt": "aaa", "b.dat": "bbb", "sub/c.txt": "ccc", "sub/deep/d.txt": "ddd", "other/e.txt": "eee", "other/empty.txt": ""}},
+		{"", "/sub/", map[string]string{"c.txt": "ccc", "deep/d.txt": "ddd"}},
+		{"&glob=*.txt", "/", map[string]string{"a.txt": "aaa", "sub/c.txt": "ccc", "sub/deep/d.txt": "ddd", "other/e.txt": "eee", "other/empty.txt": ""}},
+		{"&glob=sub/*", "/", map[string]string{"sub/c.txt": "ccc"}},
+		{"&files=b.dat&files=sub/deep", "/", map[string]string{"b.dat": "bbb", "sub/deep/d.txt": "ddd"}},
+		{"&files=other&glob=e.*", "/", map[string]string{"other/e.txt": "eee"}},
+	} {
+		for _, format := range []string{"zip", "tar", "tar.gz"} {
+			comment := check.Commentf("%s %s %s", format, trial.dir, trial.query)
+			r := httptest.NewRequest("GET", "/?archive="+format+trial.query, nil)
+			resp := httptest.NewRecorder()
+			h.serveArchive(resp, r, http.Dir(tmp), trial.dir, "test", format)
+			c.Check(resp.Code, check.Equals, http.StatusOK, comment)
+			c.Check(resp.Header().Get("Content-Type"), check.Equals, archiveMediaType[format], comment)
+			c.Check(resp.Header().Get("Content-Disposition"), check.Equals, `attachment; filename="test.`+format+`"`, comment)
+			c.Check(archiveContents(c, format, resp.Body.Bytes()), check.DeepEquals, trial.expect, comment)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/?archive=zip&glob=[", nil)
+	resp := httptest.NewRecorder()
+	h.serveArchive(resp, r, http.Dir(tmp), "/", "test", "zip")
+	c.Check(resp.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *IntegrationSuite) TestArchiveDownload(c *check.C) {
+	for _, format := range []string{"zip", "tar", "tar.gz"} {
+		req, err := http.NewRequest("GET", "http://"+s.testServer.Addr+"/c="+arvadostest.FooAndBarFilesInDirUUID+"/dir1?archive="+format, nil)
+		c.Assert(err, check.IsNil)
+		req.Header.Set("Authorization", "OAuth2 "+arvadostest.ActiveToken)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+		buf, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, check.IsNil)
+		c.Check(archiveContents(c, format, buf), check.DeepEquals, map[string]string{"bar": "bar", "foo": "foo"})
+	}
+}
+
+func (s *IntegrationSuite) TestArchiveDownloadSiteFS(c *check.C) {
+	s.testServer.Config.cluster.Services.WebDAVDownload.ExternalURL.Host = "download.example.com"
+	for _, trial := range []struct {
+		path string
+		code int
+	}{
+		{"/by_id/" + arvadostest.FooAndBarFilesInDirUUID + "/dir1/?archive=zip", http.StatusOK},
+		{"/by_id/" + arvadostest.AProjectUUID + "/?archive=zip", http.StatusBadRequest},
+		{"/users/active/?archive=zip", http.StatusBadRequest},
+	} {
+		u := mustParseURL("http://download.example.com" + trial.path)
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{"Authorization": {"Bearer " + arvadostest.ActiveToken}},
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.code, check.Commentf("%+v", trial))
+	}
+}
@@ -0,0 +1,363 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+	"github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Maximum number of audit events waiting to be written. If
+	// the queue is full (e.g., the API server is down), further
+	// events are dropped rather than delaying responses.
+	auditQueueSize = 10000
+	// Events are written in batches of up to auditBatchSize, or
+	// whatever has accumulated after auditFlushInterval.
+	auditBatchSize     = 100
+	auditFlushInterval = time.Second
+	// Maximum number of concurrent API calls used to create the
+	// log records for a batch.
+	auditAPIConcurrency = 4
+)
+
+var auditEventType = map[string]string{
+	"GET":    "file_download",
+	"PUT":    "file_upload",
+	"DELETE": "file_delete",
+}
+
+// auditEvent describes a file download, upload, or deletion.
+type auditEvent struct {
+	Time               time.Time `json:"time"`
+	EventType          string    `json:"event_type"`
+	RequestID          string    `json:"request_id"`
+	RemoteAddr         string    `json:"remote_addr"`
+	UserUUID           string    `json:"user_uuid"`
+	ShareLinkUUID      string    `json:"share_link_uuid,omitempty"`
+	CollectionUUID     string    `json:"collection_uuid"`
+	PortableDataHash   string    `json:"portable_data_hash"`
+	CollectionFilePath string    `json:"collection_file_path"`
+	RequestPath        string    `json:"request_path"`
+	Range              string    `json:"range,omitempty"`
+	StatusCode         int       `json:"status_code"`
+	Bytes              int64     `json:"bytes"`
+
+	token     string
+	body      *countingReadCloser
+	cancelled bool
+}
+
+// countingReadCloser counts the bytes read from a request body.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (rc *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := rc.ReadCloser.Read(p)
+	rc.n += int64(n)
+	return n, err
+}
+
+// auditLogger writes audit events to a JSON-lines file and/or
+// Arvados log records, using a background worker so slow writes
+// don't delay responses.
+type auditLogger struct {
+	// Destinations. Either may be nil.
+	out    io.Writer
+	client *arvados.Client
+
+	// Token used to create log records. If empty, each log
+	// record is created using the requesting user's token.
+	rootToken string
+
+	// Return the UUID of the user who owns the given token.
+	lookupUser func(token string) (string, error)
+
+	queue     chan *auditEvent
+	users     *lru.TwoQueueCache
+	dropped   int64
+	setupOnce sync.Once
+}
+
+// newAuditLogger returns an auditLogger for the given cluster
+// config, or nil if audit logging is not enabled. It returns an error
+// if the audit log file can't be opened, so a bad configuration is
+// reported at startup rather than when the first request arrives.
+func newAuditLogger(cluster *arvados.Cluster) (*auditLogger, error) {
+	al := &auditLogger{rootToken: cluster.SystemRootToken}
+	if fnm := cluster.Collections.WebDAVAuditLogFile; fnm != "" {
+		f, err := os.OpenFile(fnm, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("error opening WebDAVAuditLogFile: %s", err)
+		}
+		al.out = f
+	}
+	if cluster.Collections.WebDAVLogEvents {
+		al.client = arvados.NewClientFromEnv()
+		if al.rootToken == "" {
+			log.Print("SystemRootToken is not configured: audit log records will be owned by the users who download and upload files")
+		}
+	}
+	if al.out == nil && al.client == nil {
+		return nil, nil
+	}
+	al.lookupUser = al.apiLookupUser
+	return al, nil
+}
+
+func (al *auditLogger) setup() {
+	al.queue = make(chan *auditEvent, auditQueueSize)
+	al.users, _ = lru.New2Q(1000)
+	go al.run()
+}
+
+// start returns a new auditEvent for r, or nil if r is not an
+// audited request (or al is nil). For uploads, it replaces r.Body
+// with a wrapper that counts bytes received.
+//
+// The caller should fill in the collection fields, then call
+// finish after the response has been sent.
+func (al *auditLogger) start(r *http.Request, token string) *auditEvent {
+	if al == nil || auditEventType[r.Method] == "" {
+		return nil
+	}
+	al.setupOnce.Do(al.setup)
+	remoteAddr := r.RemoteAddr
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		remoteAddr = xff + "," + remoteAddr
+	}
+	ev := &auditEvent{
+		Time:        time.Now(),
+		EventType:   auditEventType[r.Method],
+		RequestID:   r.Header.Get("X-Request-Id"),
+		RemoteAddr:  remoteAddr,
+		RequestPath: r.URL.Path,
+		token:       token,
+	}
+	if r.Method == "GET" {
+		ev.Range = r.Header.Get("Range")
+	} else if r.Method == "PUT" && r.Body != nil {
+		ev.body = &countingReadCloser{ReadCloser: r.Body}
+		r.Body = ev.body
+	}
+	return ev
+}
+
+// setCollection fills in ev's collection fields, given a collection
+// ID (UUID, UUID@version, or PDH) and a path within the collection.
+// If id is not a collection ID (e.g., it's a project UUID), the
+// collection fields are left empty.
+func (ev *auditEvent) setCollection(id, fspath string) {
+	if arvadosclient.PDHMatch(id) {
+		ev.PortableDataHash = id
+	} else if uuid, _, ok := arvados.ParseCollectionVersion(id); ok {
+		ev.CollectionUUID = uuid
+	} else if strings.Contains(id, "-4zz18-") {
+		ev.CollectionUUID = id
+	} else {
+		return
+	}
+	ev.CollectionFilePath = "/" + strings.TrimPrefix(fspath, "/")
+}
+
+// cancel prevents ev from being logged, e.g., because the request
+// turned out to be a directory listing rather than a file download.
+// It is safe to call cancel on a nil event.
+func (ev *auditEvent) cancel() {
+	if ev != nil {
+		ev.cancelled = true
+	}
+}
+
+// finish queues ev if the response written to w indicates success.
+// If the queue is full, ev is dropped.
+func (al *auditLogger) finish(ev *auditEvent, w httpserver.ResponseWriter) {
+	if ev == nil || ev.cancelled {
+		return
+	}
+	ev.StatusCode = w.WroteStatus()
+	if ev.StatusCode < 200 || ev.StatusCode >= 300 {
+		return
+	}
+	if ev.body != nil {
+		ev.Bytes = ev.body.n
+	} else if ev.EventType == "file_download" {
+		ev.Bytes = int64(w.WroteBodyBytes())
+	}
+	select {
+	case al.queue <- ev:
+	default:
+		atomic.AddInt64(&al.dropped, 1)
+	}
+}
+
+func (al *auditLogger) run() {
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	var batch []*auditEvent
+	for {
+		select {
+		case ev := <-al.queue:
+			batch = append(batch, ev)
+			if len(batch) < auditBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if n := atomic.SwapInt64(&al.dropped, 0); n > 0 {
+			log.Printf("audit log queue is full: dropped %d events", n)
+		}
+		if len(batch) > 0 {
+			al.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// flush writes a batch of events to the configured destinations.
+func (al *auditLogger) flush(batch []*auditEvent) {
+	for _, ev := range batch {
+		if ev.ShareLinkUUID == "" {
+			ev.UserUUID = al.userUUID(ev.token)
+		}
+	}
+	if al.out != nil {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, ev := range batch {
+			enc.Encode(ev)
+		}
+		if _, err := al.out.Write(buf.Bytes()); err != nil {
+			log.Printf("error writing audit log: %s", err)
+		}
+	}
+	if al.client != nil {
+		al.createLogs(batch)
+	}
+}
+
+// auditLogKey identifies the events in a batch that can be saved in
+// the same log record.
+type auditLogKey struct {
+	token          string
+	eventType      string
+	collectionUUID string
+}
+
+// createLogs saves a batch of events as Arvados log records. Rather
+// than making one API call per event, it creates one log record for
+// each group of events in the batch that have the same event type,
+// collection UUID, and (if SystemRootToken is not configured)
+// requesting user's token, with the details of each event in its
+// "events" property.
+func (al *auditLogger) createLogs(batch []*auditEvent) {
+	groups := map[auditLogKey][]*auditEvent{}
+	var keys []auditLogKey
+	for _, ev := range batch {
+		key := auditLogKey{
+			token:          al.rootToken,
+			eventType:      ev.EventType,
+			collectionUUID: ev.CollectionUUID,
+		}
+		if key.token == "" {
+			key.token = ev.token
+		}
+		if groups[key] == nil {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], ev)
+	}
+	todo := make(chan auditLogKey, len(keys))
+	for _, key := range keys {
+		todo <- key
+	}
+	close(todo)
+	var wg sync.WaitGroup
+	for i := 0; i < auditAPIConcurrency && i < len(keys); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range todo {
+				if err := al.createLog(key, groups[key]); err != nil {
+					log.WithField("RequestID", groups[key][0].RequestID).Printf("error creating audit log record for %d events: %s", len(groups[key]), err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// createLog creates one Arvados log record for the given events,
+// which all have the same key.
+func (al *auditLogger) createLog(key auditLogKey, events []*auditEvent) error {
+	client := *al.client
+	client.AuthToken = key.token
+	var props []map[string]interface{}
+	for _, ev := range events {
+		props = append(props, map[string]interface{}{
+			"time":                 ev.Time,
+			"request_id":           ev.RequestID,
+			"remote_addr":          ev.RemoteAddr,
+			"user_uuid":            ev.UserUUID,
+			"share_link_uuid":      ev.ShareLinkUUID,
+			"collection_uuid":      ev.CollectionUUID,
+			"portable_data_hash":   ev.PortableDataHash,
+			"collection_file_path": ev.CollectionFilePath,
+			"request_path":         ev.RequestPath,
+			"range":                ev.Range,
+			"status_code":          ev.StatusCode,
+			"bytes":                ev.Bytes,
+		})
+	}
+	return client.RequestAndDecode(nil, "POST", "arvados/v1/logs", nil, map[string]interface{}{
+		"log": map[string]interface{}{
+			"object_uuid": key.collectionUUID,
+			"event_type":  key.eventType,
+			"event_at":    events[0].Time,
+			"properties":  map[string]interface{}{"events": props},
+		},
+	})
+}
+
+// userUUID returns the UUID of the user who owns the given token, or
+// "" if it can't be determined.
+func (al *auditLogger) userUUID(token string) string {
+	if token == "" {
+		return ""
+	}
+	if uuid, ok := al.users.Get(token); ok {
+		return uuid.(string)
+	}
+	uuid, err := al.lookupUser(token)
+	if err != nil {
+		log.Printf("error looking up user for audit log: %s", err)
+		return ""
+	}
+	al.users.Add(token, uuid)
+	return uuid
+}
+
+func (al *auditLogger) apiLookupUser(token string) (string, error) {
+	client := arvados.NewClientFromEnv()
+	client.AuthToken = token
+	user, err := client.CurrentUser()
+	return user.UUID, err
+}
@@ -0,0 +1,212 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+	"github.com/hashicorp/golang-lru"
+	check "gopkg.in/check.v1"
+)
+
+const anonymousUserUUID = "zzzzz-tpzed-anonymouspublic"
+
+func (s *UnitSuite) TestAuditLogDisabled(c *check.C) {
+	cluster, err := s.Config.GetCluster("")
+	c.Assert(err, check.IsNil)
+	al, err := newAuditLogger(cluster)
+	c.Check(err, check.IsNil)
+	c.Check(al, check.IsNil)
+	c.Check(al.start(httptest.NewRequest("GET", "/foo", nil), "token"), check.IsNil)
+	al.finish(nil, httpserver.WrapResponseWriter(httptest.NewRecorder()))
+}
+
+func (s *UnitSuite) TestAuditLogBadFile(c *check.C) {
+	cluster, err := s.Config.GetCluster("")
+	c.Assert(err, check.IsNil)
+	cluster.Collections.WebDAVAuditLogFile = c.MkDir() + "/nonexistent/audit.log"
+	al, err := newAuditLogger(cluster)
+	c.Check(err, check.ErrorMatches, `error opening WebDAVAuditLogFile: .*`)
+	c.Check(al, check.IsNil)
+}
+
+func (s *UnitSuite) TestAuditLogBatchAPI(c *check.C) {
+	var mtx sync.Mutex
+	var created []map[string]interface{}
+	var tokens []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/arvados/v1/logs")
+		var rec map[string]interface{}
+		c.Check(json.Unmarshal([]byte(r.FormValue("log")), &rec), check.IsNil)
+		mtx.Lock()
+		created = append(created, rec)
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		mtx.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	al := &auditLogger{
+		client:    &arvados.Client{APIHost: srv.Listener.Addr().String(), Insecure: true},
+		rootToken: "roottoken",
+	}
+	var batch []*auditEvent
+	for i := 0; i < 10; i++ {
+		ev := &auditEvent{EventType: "file_download", CollectionUUID: arvadostest.FooCollection, token: arvadostest.ActiveToken}
+		if i%5 == 0 {
+			ev.EventType = "file_upload"
+		}
+		batch = append(batch, ev)
+	}
+	batch = append(batch, &auditEvent{EventType: "file_download", PortableDataHash: arvadostest.FooCollectionPDH, token: arvadostest.ActiveToken})
+	al.createLogs(batch)
+
+	c.Assert(created, check.HasLen, 3)
+	counts := map[string]int{}
+	for i, rec := range created {
+		c.Check(tokens[i], check.Equals, "OAuth2 roottoken")
+		events, _ := rec["properties"].(map[string]interface{})["events"].([]interface{})
+		counts[fmt.Sprintf("%s %s", rec["event_type"], rec["object_uuid"])] = len(events)
+	}
+	c.Check(counts, check.DeepEquals, map[string]int{
+		"file_download " + arvadostest.FooCollection: 8,
+		"file_upload " + arvadostest.FooCollection:   2,
+		"file_download ": 1,
+	})
+}
+
+func (s *UnitSuite) TestAuditLogEvents(c *check.C) {
+	var buf bytes.Buffer
+	lookups := 0
+	al := &auditLogger{
+		out: &buf,
+		lookupUser: func(token string) (string, error) {
+			lookups++
+			return map[string]string{
+				arvadostest.ActiveToken:    arvadostest.ActiveUserUUID,
+				arvadostest.AnonymousToken: anonymousUserUUID,
+			}[token], nil
+		},
+	}
+	// Set up the queue without starting the background worker.
+	al.setupOnce.Do(func() {
+		al.queue = make(chan *auditEvent, 10)
+		al.users, _ = lru.New2Q(10)
+	})
+
+	r := httptest.NewRequest("GET", "/c="+arvadostest.FooCollection+"/foo", nil)
+	r.Header.Set("Range", "bytes=1-2")
+	r.Header.Set("X-Request-Id", "req-abc")
+	ev := al.start(r, arvadostest.ActiveToken)
+	c.Assert(ev, check.NotNil)
+	ev.setCollection(arvadostest.FooCollection, "foo")
+	w := httpserver.WrapResponseWriter(httptest.NewRecorder())
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write([]byte("oo"))
+	al.finish(ev, w)
+
+	r = httptest.NewRequest("PUT", "/c="+arvadostest.FooCollection+"/dir/bar", strings.NewReader("hello world"))
+	ev = al.start(r, arvadostest.ActiveToken)
+	c.Assert(ev, check.NotNil)
+	ev.setCollection(arvadostest.FooCollection, "dir/bar")
+	ioutil.ReadAll(r.Body)
+	w = httpserver.WrapResponseWriter(httptest.NewRecorder())
+	w.WriteHeader(http.StatusCreated)
+	al.finish(ev, w)
+
+	// Unsuccessful requests are not logged
+	r = httptest.NewRequest("DELETE", "/c="+arvadostest.FooCollection+"/nonexistent", nil)
+	ev = al.start(r, arvadostest.ActiveToken)
+	c.Assert(ev, check.NotNil)
+	w = httpserver.WrapResponseWriter(httptest.NewRecorder())
+	w.WriteHeader(http.StatusNotFound)
+	al.finish(ev, w)
+
+	// Cancelled events (e.g., directory listings) are not logged
+	r = httptest.NewRequest("GET", "/c="+arvadostest.FooCollection+"/", nil)
+	ev = al.start(r, arvadostest.ActiveToken)
+	c.Assert(ev, check.NotNil)
+	ev.cancel()
+	w = httpserver.WrapResponseWriter(httptest.NewRecorder())
+	w.Write([]byte("<html>listing</html>"))
+	al.finish(ev, w)
+
+	// Other methods are not audited
+	for _, method := range []string{"HEAD", "PROPFIND", "OPTIONS", "MKCOL"} {
+		c.Check(al.start(httptest.NewRequest(method, "/c="+arvadostest.FooCollection+"/", nil), arvadostest.ActiveToken), check.IsNil)
+	}
+
+	r = httptest.NewRequest("GET", "/by_id/"+arvadostest.FooCollection+"/foo", nil)
+	ev = al.start(r, arvadostest.AnonymousToken)
+	c.Assert(ev, check.NotNil)
+	w = httpserver.WrapResponseWriter(httptest.NewRecorder())
+	w.Write([]byte("foo"))
+	al.finish(ev, w)
+
+	c.Assert(al.queue, check.HasLen, 3)
+	var batch []*auditEvent
+	for len(al.queue) > 0 {
+		batch = append(batch, <-al.queue)
+	}
+	al.flush(batch)
+	c.Check(lookups, check.Equals, 2)
+
+	var logged []auditEvent
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var ev auditEvent
+		c.Check(json.Unmarshal([]byte(line), &ev), check.IsNil)
+		logged = append(logged, ev)
+	}
+	c.Assert(logged, check.HasLen, 3)
+
+	c.Check(logged[0].EventType, check.Equals, "file_download")
+	c.Check(logged[0].RequestID, check.Equals, "req-abc")
+	c.Check(logged[0].UserUUID, check.Equals, arvadostest.ActiveUserUUID)
+	c.Check(logged[0].CollectionUUID, check.Equals, arvadostest.FooCollection)
+	c.Check(logged[0].CollectionFilePath, check.Equals, "/foo")
+	c.Check(logged[0].Range, check.Equals, "bytes=1-2")
+	c.Check(logged[0].StatusCode, check.Equals, http.StatusPartialContent)
+	c.Check(logged[0].Bytes, check.Equals, int64(2))
+
+	c.Check(logged[1].EventType, check.Equals, "file_upload")
+	c.Check(logged[1].CollectionFilePath, check.Equals, "/dir/bar")
+	c.Check(logged[1].Range, check.Equals, "")
+	c.Check(logged[1].Bytes, check.Equals, int64(11))
+
+	c.Check(logged[2].EventType, check.Equals, "file_download")
+	c.Check(logged[2].UserUUID, check.Equals, anonymousUserUUID)
+	c.Check(logged[2].RequestPath, check.Equals, "/by_id/"+arvadostest.FooCollection+"/foo")
+	c.Check(logged[2].StatusCode, check.Equals, http.StatusOK)
+	c.Check(logged[2].Bytes, check.Equals, int64(3))
+}
+
+func (s *UnitSuite) TestAuditLogSetCollection(c *check.C) {
+	for _, trial := range []struct {
+		id, path   string
+		uuid, pdh  string
+		outputPath string
+	}{
+		{arvadostest.FooCollection, "foo", arvadostest.FooCollection, "", "/foo"},
+		{arvadostest.FooCollection + "@2", "/dir/foo", arvadostest.FooCollection, "", "/dir/foo"},
+		{arvadostest.FooCollectionPDH, "", "", arvadostest.FooCollectionPDH, "/"},
+		{arvadostest.AProjectUUID, "coll/foo", "", "", ""},
+	} {
+		ev := &auditEvent{}
+		ev.setCollection(trial.id, trial.path)
+		c.Check(ev.CollectionUUID, check.Equals, trial.uuid, check.Commentf("%+v", trial))
+		c.Check(ev.PortableDataHash, check.Equals, trial.pdh, check.Commentf("%+v", trial))
+		c.Check(ev.CollectionFilePath, check.Equals, trial.outputPath, check.Commentf("%+v", trial))
+	}
+}
@@ -5,6 +5,8 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
 	"sync"
 	"time"
 
@@ -23,6 +25,7 @@ type cache struct {
 	pdhs        *lru.TwoQueueCache
 	collections *lru.TwoQueueCache
 	permissions *lru.TwoQueueCache
+	versions    *lru.TwoQueueCache
 	setupOnce   sync.Once
 }
 
@@ -33,6 +36,7 @@ type cacheMetrics struct {
 	collectionHits    prometheus.Counter
 	pdhHits           prometheus.Counter
 	permissionHits    prometheus.Counter
+	versionHits       prometheus.Counter
 	apiCalls          prometheus.Counter
 }
 
@@ -65,6 +69,13 @@ func (m *cacheMetrics) setup(reg *prometheus.Registry) {
 		Help:      "Number of targetID-to-permission cache hits.",
 	})
 	reg.MustRegister(m.permissionHits)
+	m.versionHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepweb_collectioncache",
+		Name:      "version_hits",
+		Help:      "Number of uuid@version-to-uuid cache hits.",
+	})
+	reg.MustRegister(m.versionHits)
 	m.apiCalls = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "arvados",
 		Subsystem: "keepweb_collectioncache",
@@ -116,6 +127,10 @@ func (c *cache) setup() {
 	if err != nil {
 		panic(err)
 	}
+	c.versions, err = lru.New2Q(c.config.MaxUUIDEntries)
+	if err != nil {
+		panic(err)
+	}
 
 	reg := c.registry
 	if reg == nil {
@@ -165,10 +180,61 @@ func (c *cache) Update(client *arvados.Client, coll arvados.Collection, fs arvad
 	return err
 }
 
+// versionUUID returns the UUID of the collection record that holds
+// the given version of a collection.
+//
+// Past versions never change, so the mapping is cached without an
+// expiry time. (The current version is not cached: it is held by the
+// collection's own record, and moves to a new record when the
+// collection is next updated.) This doesn't bypass permission
+// checks: the caller still has to retrieve the version's record with
+// its own token.
+func (c *cache) versionUUID(arv *arvadosclient.ArvadosClient, uuid string, version int) (string, error) {
+	key := fmt.Sprintf("%s@%d", uuid, version)
+	if ent, cached := c.versions.Get(key); cached {
+		c.metrics.versionHits.Inc()
+		return ent.(string), nil
+	}
+	c.metrics.apiCalls.Inc()
+	var colls arvados.CollectionList
+	err := arv.List("collections", arvadosclient.Dict{
+		"filters": [][]interface{}{
+			{"current_version_uuid", "=", uuid},
+			{"version", "=", version},
+		},
+		"include_old_versions": true,
+		"select":               []string{"uuid"},
+	}, &colls)
+	if err != nil {
+		return "", err
+	} else if len(colls.Items) != 1 {
+		return "", arvadosclient.APIServerError{
+			ServerAddress:     arv.ApiServer,
+			HttpStatusCode:    http.StatusNotFound,
+			HttpStatusMessage: http.StatusText(http.StatusNotFound),
+			ErrorDetails:      []string{fmt.Sprintf("collection %s has no version %d", uuid, version)},
+		}
+	}
+	if colls.Items[0].UUID != uuid {
+		c.versions.Add(key, colls.Items[0].UUID)
+	}
+	return colls.Items[0].UUID, nil
+}
+
 func (c *cache) Get(arv *arvadosclient.ArvadosClient, targetID string, forceReload bool) (*arvados.Collection, error) {
 	c.setupOnce.Do(c.setup)
 	c.metrics.requests.Inc()
 
+	if uuid, version, ok := arvados.ParseCollectionVersion(targetID); ok {
+		// Past versions have their own UUIDs, which we
+		// can use like any other collection UUID.
+		var err error
+		targetID, err = c.versionUUID(arv, uuid, version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	permOK := false
 	permKey := arv.ApiToken + "\000" + targetID
 	if forceReload {
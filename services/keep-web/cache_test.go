@@ -29,6 +29,28 @@ func (s *UnitSuite) checkCacheMetrics(c *check.C, reg *prometheus.Registry, regs
 	}
 }
 
+func (s *UnitSuite) TestCachePastVersion(c *check.C) {
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, check.Equals, nil)
+
+	cache := newConfig(s.Config).Cache
+	cache.registry = prometheus.NewRegistry()
+
+	// Only the first request should need API calls to find the
+	// version's UUID and retrieve the collection.
+	arv.ApiToken = arvadostest.ActiveToken
+	for i := 0; i < 3; i++ {
+		coll, err := cache.Get(arv, arvadostest.WazCollection+"@1", false)
+		c.Check(err, check.Equals, nil)
+		c.Assert(coll, check.NotNil)
+		c.Check(coll.UUID, check.Equals, arvadostest.WazVersion1Collection)
+	}
+	s.checkCacheMetrics(c, cache.registry,
+		"requests 3",
+		"version_hits 2",
+		"api_calls 2")
+}
+
 func (s *UnitSuite) TestCache(c *check.C) {
 	arv, err := arvadosclient.MakeArvadosClient()
 	c.Assert(err, check.Equals, nil)
@@ -176,6 +176,27 @@
 // Collections can also be accessed (read-only) via "/by_id/X" where X
 // is a UUID or portable data hash.
 //
+// Copying and moving between collections
+//
+// The "/by_id/" and "/users/" trees are read-only, except that
+// WebDAV COPY and MOVE requests can copy or move files and
+// directories from one collection to another (or within a
+// collection):
+//
+//   COPY /by_id/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo/bar.txt HTTP/1.1
+//   Destination: https://collections.example.com/users/bob/MyProject/MyCollection/bar.txt
+//
+// No file data is downloaded or uploaded: the destination
+// collection's manifest is updated to refer to the same Keep blocks
+// as the source, so copying a large directory is as fast as copying
+// a small one. The source can be any readable collection, including
+// one accessed by portable data hash; the destination (and, for
+// MOVE, the source) must be a writable collection.
+//
+// A MOVE between collections updates the destination collection
+// first, then the source collection. If updating the source fails,
+// the result is a copy, and the response is an error.
+//
 // Authorization mechanisms
 //
 // A token can be provided in an Authorization header:
@@ -297,6 +318,166 @@
 // avoids redirecting requests to keep-web if they depend on
 // TrustAllContent being enabled.
 //
+// Past collection versions
+//
+// When collection versioning is enabled, a specific version of a
+// collection can be read by appending "@" and the version number to
+// the collection UUID, in either the "/c=" or the "/by_id/" form:
+//
+//   https://collections.example.com/c=zzzzz-4zz18-xxxxxxxxxxxxxxx@3/file.txt
+//   https://collections.example.com/by_id/zzzzz-4zz18-xxxxxxxxxxxxxxx@3/
+//
+// Past versions are read-only. The available version numbers can be
+// found by listing collections with include_old_versions=true and a
+// current_version_uuid filter.
+//
+// ETags and conditional requests
+//
+// File responses include a strong ETag derived from the file's
+// content (the block locators, sizes, and offsets that make up the
+// file), so the ETag stays the same when a file is copied, renamed,
+// or re-signed, and changes whenever its content changes. ETags are
+// also reported in WebDAV PROPFIND responses.
+//
+// GET and HEAD requests honor If-None-Match (responding 304 Not
+// Modified) and If-Match. PUT, DELETE, MOVE, and COPY requests honor
+// If-Match and If-None-Match, responding 412 Precondition Failed if
+// the target file has changed. In particular, "If-None-Match: *"
+// makes a PUT request fail instead of overwriting an existing file.
+// Successful PUT responses include the new file's ETag.
+//
+// Preconditions on write requests are always checked against the
+// current version of the collection. Read requests use keep-web's
+// cached copy unless the request has a "Cache-Control: no-cache" (or
+// "must-revalidate") header. Either way, if the cached copy is still
+// current, revalidating it costs a single lightweight API lookup
+// rather than a full reload.
+//
+// WebDAV locks
+//
+// Keep-web supports WebDAV LOCK and UNLOCK requests on writable
+// collections, so clients like macOS Finder, Windows Explorer, and
+// LibreOffice can prevent concurrent edits to the same file. While a
+// file or directory is locked, write requests that do not present
+// the lock token in an If header fail with 423 Locked.
+//
+// Locks are stored as Arvados links (link_class "keep-web-lock",
+// head_uuid is the collection UUID) so they are shared by all
+// keep-web processes; this requires SystemRootToken to be
+// configured. Otherwise, each keep-web process has its own locks.
+//
+// Locks expire after the timeout requested by the client, up to a
+// maximum of one hour, unless they are refreshed.
+//
+// Resumable uploads
+//
+// Large files can be uploaded with the tus resumable upload protocol
+// (https://tus.io/, version 1.0.0 with the "creation" and
+// "termination" extensions) at /_tus. The Upload-Metadata header
+// must include "collection" (the UUID of a writable collection) and
+// "filename" (the path of the new file in that collection).
+//
+// Data received so far is saved in a temporary collection in the
+// user's home project, so an interrupted upload can be resumed,
+// even through a different keep-web server. When the upload is
+// complete, the file is added to the target collection (replacing
+// any existing file with the same name) and the temporary collection
+// is deleted. Unfinished uploads are moved to the trash after
+// Collections.ResumableUploadTTL.
+//
+// The last request of an upload fails with 423 Locked if a WebDAV
+// client holds a lock on the target file, so the client should retry
+// it (after checking the offset with a HEAD request) once the lock is
+// released.
+//
+// Share links
+//
+// If Collections.ShareLinkSigningKey and SystemRootToken are
+// configured, users can create expiring, read-only links to a
+// collection (or a directory or file in a collection) that work
+// without an API token:
+//
+//   curl -H "Authorization: Bearer $ARVADOS_API_TOKEN" \
+//     -d collection=zzzzz-4zz18-xxxxxxxxxxxxxxx -d path=dir1 -d ttl=24h \
+//     https://collections.example.com/_share
+//
+// The response includes the share URL, its expiry time, and the UUID
+// of an Arvados link (link_class "keep-web-share") that records the
+// share. Deleting the link, with the API or with
+// "DELETE /_share/{uuid}", revokes the share URL; keep-web may keep
+// accepting it for up to Collections.WebDAVCache.TTL.
+//
+// Each request made with a share link is logged, with the link UUID
+// in the "shareLinkUUID" field.
+//
+// Archive download
+//
+// A directory (or an entire collection) can be downloaded as a single
+// zip, tar, or tar.gz archive by adding an "archive" parameter to the
+// directory URL, or by sending an Accept header with the
+// corresponding media type (application/zip, application/x-tar, or
+// application/gzip):
+//
+//   https://collections.example.com/c=zzzzz-4zz18-xxxxxxxxxxxxxxx/dir?archive=zip
+//
+// The archive includes all files below the directory, with names
+// relative to the directory. Zip archives are not compressed. The
+// selection can be narrowed with "files" parameters (files or
+// subdirectories to include) and "glob" parameters (shell patterns;
+// a pattern without "/" is matched against each file's base name):
+//
+//   ...?archive=tar.gz&files=dir1&files=dir2/foo.txt&glob=*.txt
+//
+// S3 API
+//
+// Requests signed with AWS Signature Version 4 are handled as S3 API
+// requests, using path-style URLs: "https://keep-web.example/BUCKET"
+// and "https://keep-web.example/BUCKET/KEY". A bucket is either a
+// collection (UUID, or portable data hash with "+" replaced by "-")
+// or a project (UUID). In a project bucket, the first component of
+// each key is the name of a collection in the project.
+//
+// The supported operations are ListBuckets (collections and projects
+// in the user's home project), HeadBucket, ListObjects,
+// ListObjectsV2, GetObject and HeadObject (including Range requests),
+// PutObject, and DeleteObject. PutObject creates parent directories
+// as needed, and creates a directory if the key ends with "/".
+// PutObject in a project bucket creates a new collection if there is
+// no collection with the given name.
+//
+// The secret key is an Arvados token, and the access key is either
+// the same token, or (if SystemRootToken is configured) the UUID of
+// the token, in which case the secret key is the secret part of a v2
+// token:
+//
+//   [default]
+//   aws_access_key_id = zzzzz-gj3su-yyyyyyyyyyyyyyy
+//   aws_secret_access_key = xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx
+//
+// Chunked ("aws-chunked") uploads are not supported.
+//
+// Audit logging
+//
+// Keep-web can record an audit event for each successful file
+// download (GET), upload (PUT), and deletion (DELETE), whether the
+// request arrives via a collection URL, /by_id/, /users/, or the S3
+// API. Each event includes the user UUID (or share link UUID),
+// collection UUID or portable data hash, file path, requested byte
+// range, and number of bytes sent or received.
+//
+// Events are saved as Arvados log records if
+// Collections.WebDAVLogEvents is true, and appended to a JSON-lines
+// file (one event per line) if Collections.WebDAVAuditLogFile is
+// set. Directory listings are not logged.
+//
+// Events are queued and written in batches by a background worker;
+// if the queue fills up because the API server is slow or
+// unavailable, further events are dropped (and the number dropped is
+// logged) rather than delaying responses. Each log record holds the
+// events in one batch that have the same event_type
+// ("file_download", "file_upload", or "file_delete") and collection
+// (object_uuid), as a list in its "events" property.
+//
 // Metrics
 //
 // Keep-web exposes request metrics in Prometheus text-based format at
@@ -18,6 +18,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"git.curoverse.com/arvados.git/sdk/go/arvados"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
@@ -36,6 +37,10 @@ type handler struct {
 	setupOnce     sync.Once
 	healthHandler http.Handler
 	webdavLS      webdav.LockSystem
+	memLocks      memLockBackend
+	shareLinks    shareLinkCache
+	s3Secrets     s3SecretCache
+	auditLog      *auditLogger
 }
 
 // parseCollectionIDFromDNSName returns a UUID or PDH if s begins with
@@ -63,32 +68,60 @@ func parseCollectionIDFromDNSName(s string) string {
 var urlPDHDecoder = strings.NewReplacer(" ", "+", "-", "+")
 
 // parseCollectionIDFromURL returns a UUID or PDH if s is a UUID or a
-// PDH (even if it is a PDH with "+" replaced by " " or "-");
+// PDH (even if it is a PDH with "+" replaced by " " or "-"), or a
+// UUID with a version number (like "zzzzz-4zz18-xxxxxxxxxxxxxxx@3");
 // otherwise "".
 func parseCollectionIDFromURL(s string) string {
 	if arvadosclient.UUIDMatch(s) {
 		return s
 	}
+	if uuid, _, ok := arvados.ParseCollectionVersion(s); ok && arvadosclient.UUIDMatch(uuid) {
+		// A specific (possibly past) version of a
+		// collection, like "zzzzz-4zz18-xxxxxxxxxxxxxxx@3"
+		return s
+	}
 	if pdh := urlPDHDecoder.Replace(s); arvadosclient.PDHMatch(pdh) {
 		return pdh
 	}
 	return ""
 }
 
+// readAhead returns the configured read-ahead limits for serving
+// file content.
+func (h *handler) readAhead() arvados.ReadAhead {
+	cfg := h.Config.cluster.Collections.WebDAVCache
+	return arvados.ReadAhead{
+		Blocks: cfg.ReadAheadBlocks,
+		Bytes:  cfg.ReadAheadBytes,
+	}
+}
+
 func (h *handler) setup() {
 	h.clientPool = arvadosclient.MakeClientPool()
 
 	keepclient.RefreshServiceDiscoveryOnSIGHUP()
 	keepclient.DefaultBlockCache.MaxBlocks = h.Config.cluster.Collections.WebDAVCache.MaxBlockEntries
+	if dir := h.Config.cluster.Collections.WebDAVCache.DiskCacheDirectory; dir != "" {
+		keepclient.DefaultBlockCache.DiskCache = &keepclient.DiskCache{
+			Dir:      dir,
+			MaxBytes: h.Config.cluster.Collections.WebDAVCache.MaxDiskCacheBytes,
+		}
+	}
 
 	h.healthHandler = &health.Handler{
 		Token:  h.Config.cluster.ManagementToken,
 		Prefix: "/_health/",
 	}
 
-	// Even though we don't accept LOCK requests, every webdav
-	// handler must have a non-nil LockSystem.
+	// Site filesystem (/users/, /by_id/) requests are read-only,
+	// so they don't need real locks, but every webdav handler
+	// must have a non-nil LockSystem. Collection requests use
+	// h.lockSystem() instead.
 	h.webdavLS = &noLockSystem{}
+
+	if h.Config.cluster.SystemRootToken == "" {
+		log.Print("SystemRootToken is not configured: WebDAV locks will not be shared with other keep-web processes")
+	}
 }
 
 func (h *handler) serveStatus(w http.ResponseWriter, r *http.Request) {
@@ -102,7 +135,12 @@ func (h *handler) serveStatus(w http.ResponseWriter, r *http.Request) {
 // are ignored (all response writes return the update error).
 type updateOnSuccess struct {
 	httpserver.ResponseWriter
-	update     func() error
+	update func() error
+	// If etag is not nil, it is called after a successful update
+	// to replace the ETag response header (if any), which might
+	// not be valid until the updated file has been written to
+	// Keep.
+	etag       func() string
 	sentHeader bool
 	err        error
 }
@@ -130,6 +168,13 @@ func (uos *updateOnSuccess) WriteHeader(code int) {
 				http.Error(uos.ResponseWriter, uos.err.Error(), code)
 				return
 			}
+			if uos.etag != nil && uos.Header().Get("ETag") != "" {
+				if etag := uos.etag(); etag != "" {
+					uos.Header().Set("ETag", etag)
+				} else {
+					uos.Header().Del("ETag")
+				}
+			}
 		}
 	}
 	uos.ResponseWriter.WriteHeader(code)
@@ -213,6 +258,11 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path == "/_tus" || strings.HasPrefix(r.URL.Path, "/_tus/") {
+		h.serveTus(w, r)
+		return
+	}
+
 	if method := r.Header.Get("Access-Control-Request-Method"); method != "" && r.Method == "OPTIONS" {
 		if !browserMethod[method] && !webdavMethod[method] {
 			statusCode = http.StatusMethodNotAllowed
@@ -226,6 +276,10 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.serveS3(w, r) {
+		return
+	}
+
 	if !browserMethod[r.Method] && !webdavMethod[r.Method] {
 		statusCode, statusText = http.StatusMethodNotAllowed, r.Method
 		return
@@ -268,6 +322,9 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	} else if strings.HasPrefix(r.URL.Path, "/metrics") {
 		h.MetricsAPI.ServeHTTP(w, r)
 		return
+	} else if r.URL.Path == "/_share" || strings.HasPrefix(r.URL.Path, "/_share/") {
+		h.serveShare(w, r)
+		return
 	} else if siteFSDir[pathParts[0]] {
 		useSiteFS = true
 	} else if len(pathParts) >= 1 && strings.HasPrefix(pathParts[0], "c=") {
@@ -300,6 +357,13 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	forceReload := false
 	if cc := r.Header.Get("Cache-Control"); strings.Contains(cc, "no-cache") || strings.Contains(cc, "must-revalidate") {
 		forceReload = true
+	} else if writeMethod[r.Method] {
+		// Writes (and their If-Match/If-None-Match
+		// preconditions) must be applied to the current
+		// version of the collection, not a cached one. If
+		// the cached manifest is still current, this costs
+		// only a PDH lookup.
+		forceReload = true
 	}
 
 	if credentialsOK {
@@ -338,7 +402,18 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	}
 
 	targetPath := pathParts[stripParts:]
-	if tokens == nil && len(targetPath) > 0 && strings.HasPrefix(targetPath[0], "t=") {
+	var shareToken, shareLinkUUID string
+	if tokens == nil && len(targetPath) > 0 && strings.HasPrefix(targetPath[0], "share=") {
+		// http://ID.example/share=LINKUUID.EXPIRY.SIGNATURE/PATH...
+		// /c=ID/share=LINKUUID.EXPIRY.SIGNATURE/PATH...
+		//
+		// A share link grants read-only access to PATH (or a
+		// directory containing PATH), see share.go.
+		shareToken = targetPath[0][6:]
+		pathToken = true
+		targetPath = targetPath[1:]
+		stripParts++
+	} else if tokens == nil && len(targetPath) > 0 && strings.HasPrefix(targetPath[0], "t=") {
 		// http://ID.example/t=TOKEN/PATH...
 		// /c=ID/t=TOKEN/PATH...
 		//
@@ -373,6 +448,32 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	}
 	defer h.clientPool.Put(arv)
 
+	if shareToken != "" {
+		if writeMethod[r.Method] {
+			statusCode, statusText = http.StatusMethodNotAllowed, errReadOnly.Error()
+			return
+		}
+		var shareLinkToken string
+		linkUUID, err := verifyShareToken([]byte(h.Config.cluster.Collections.ShareLinkSigningKey), shareToken, collectionID, targetPath)
+		if err == nil {
+			shareLinkToken, err = h.checkShareLink(arv, linkUUID, collectionID)
+		}
+		shareLinkUUID = linkUUID
+		if err != nil {
+			statusCode, statusText = http.StatusNotFound, err.Error()
+			return
+		}
+		log.WithFields(log.Fields{
+			"RequestID":     r.Header.Get("X-Request-Id"),
+			"remoteAddr":    remoteAddr,
+			"reqMethod":     r.Method,
+			"shareLinkUUID": linkUUID,
+			"collectionID":  collectionID,
+			"path":          "/" + strings.Join(targetPath, "/"),
+		}).Info("share link access")
+		tokens = []string{shareLinkToken}
+	}
+
 	var collection *arvados.Collection
 	tokenResult := make(map[string]int)
 	for _, arv.ApiToken = range tokens {
@@ -427,12 +528,22 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	auditEv := h.auditLog.start(r, arv.ApiToken)
+	if auditEv != nil {
+		auditEv.ShareLinkUUID = shareLinkUUID
+		auditEv.CollectionUUID = collection.UUID
+		auditEv.PortableDataHash = collection.PortableDataHash
+		auditEv.CollectionFilePath = "/" + strings.Join(targetPath, "/")
+		defer h.auditLog.finish(auditEv, w)
+	}
+
 	kc, err := keepclient.MakeKeepClient(arv)
 	if err != nil {
 		statusCode, statusText = http.StatusInternalServerError, err.Error()
 		return
 	}
 	kc.RequestID = r.Header.Get("X-Request-Id")
+	kc.HedgeDelay = time.Duration(h.Config.cluster.API.KeepServiceHedgeDelay)
 
 	var basename string
 	if len(targetPath) > 0 {
@@ -451,16 +562,23 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		statusCode, statusText = http.StatusInternalServerError, err.Error()
 		return
 	}
+	fs.SetReadAhead(h.readAhead())
 
 	writefs, writeOK := fs.(arvados.CollectionFileSystem)
+	_, _, targetIsVersion := arvados.ParseCollectionVersion(collectionID)
 	targetIsPDH := arvadosclient.PDHMatch(collectionID)
-	if (targetIsPDH || !writeOK) && writeMethod[r.Method] {
+	if (targetIsPDH || targetIsVersion || !writeOK) && writeMethod[r.Method] {
 		statusCode, statusText = http.StatusMethodNotAllowed, errReadOnly.Error()
 		return
 	}
 
 	if webdavMethod[r.Method] {
 		if writeMethod[r.Method] {
+			targetName := "/" + strings.Join(targetPath, "/")
+			if code := checkPreconditions(r, fs, targetName); code != 0 {
+				statusCode = code
+				return
+			}
 			// Save the collection only if/when all
 			// webdav->filesystem operations succeed --
 			// and send a 500 error if the modified
@@ -469,8 +587,35 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 				ResponseWriter: w,
 				update: func() error {
 					return h.Config.Cache.Update(client, *collection, writefs)
+				},
+				etag: func() string {
+					fi, err := fs.Stat(targetName)
+					if err != nil {
+						return ""
+					}
+					return fileETag(fi)
 				}}
 		}
+		ls := h.webdavLS
+		if writeOK && !targetIsPDH && !targetIsVersion {
+			cls := h.lockSystem(client, collection.UUID, r)
+			cls.etag = func(name string) string {
+				fi, err := fs.Stat(name)
+				if err != nil {
+					return ""
+				}
+				return fileETag(fi)
+			}
+			if r.Method == "LOCK" {
+				// Check here so the client gets a 403
+				// instead of webdav.Handler's 500.
+				if err := cls.writable(); err != nil {
+					statusCode, statusText = http.StatusForbidden, err.Error()
+					return
+				}
+			}
+			ls = cls
+		}
 		h := webdav.Handler{
 			Prefix: "/" + strings.Join(pathParts[:stripParts], "/"),
 			FileSystem: &webdavFS{
@@ -478,7 +623,7 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 				writing:       writeMethod[r.Method],
 				alwaysReadEOF: r.Method == "PROPFIND",
 			},
-			LockSystem: h.webdavLS,
+			LockSystem: ls,
 			Logger: func(_ *http.Request, err error) {
 				if err != nil {
 					log.Printf("error from webdav handler: %q", err)
@@ -499,6 +644,12 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	} else if stat, err := f.Stat(); err != nil {
 		// Can't get Size/IsDir (shouldn't happen with a collectionFS!)
 		statusCode, statusText = http.StatusInternalServerError, err.Error()
+	} else if format := archiveFormat(r); stat.IsDir() && format != "" {
+		name := basename
+		if openPath == "/" {
+			name = collection.Name
+		}
+		h.serveArchive(w, r, fs, openPath, name, format)
 	} else if stat.IsDir() && !strings.HasSuffix(r.URL.Path, "/") {
 		// If client requests ".../dirname", redirect to
 		// ".../dirname/". This way, relative links in the
@@ -506,10 +657,14 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		// "dirname/fnm".
 		h.seeOtherWithCookie(w, r, r.URL.Path+"/", credentialsOK)
 	} else if stat.IsDir() {
+		auditEv.cancel()
 		h.serveDirectory(w, r, collection.Name, fs, openPath, true)
 	} else {
+		if etag := fileETag(stat); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
 		http.ServeContent(w, r, basename, stat.ModTime(), f)
-		if r.Header.Get("Range") == "" && int64(w.WroteBodyBytes()) != stat.Size() {
+		if r.Header.Get("Range") == "" && w.WroteStatus() == http.StatusOK && int64(w.WroteBodyBytes()) != stat.Size() {
 			// If we wrote fewer bytes than expected, it's
 			// too late to change the real response code
 			// or send an error message to the client, but
@@ -522,13 +677,13 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *handler) serveSiteFS(w http.ResponseWriter, r *http.Request, tokens []string, credentialsOK, attachment bool) {
+func (h *handler) serveSiteFS(w httpserver.ResponseWriter, r *http.Request, tokens []string, credentialsOK, attachment bool) {
 	if len(tokens) == 0 {
 		w.Header().Add("WWW-Authenticate", "Basic realm=\"collections\"")
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
-	if writeMethod[r.Method] {
+	if writeMethod[r.Method] && r.Method != "COPY" && r.Method != "MOVE" {
 		http.Error(w, errReadOnly.Error(), http.StatusMethodNotAllowed)
 		return
 	}
@@ -546,12 +701,18 @@ func (h *handler) serveSiteFS(w http.ResponseWriter, r *http.Request, tokens []s
 		return
 	}
 	kc.RequestID = r.Header.Get("X-Request-Id")
+	kc.HedgeDelay = time.Duration(h.Config.cluster.API.KeepServiceHedgeDelay)
 	client := (&arvados.Client{
 		APIHost:   arv.ApiServer,
 		AuthToken: arv.ApiToken,
 		Insecure:  arv.ApiInsecure,
 	}).WithRequestID(r.Header.Get("X-Request-Id"))
 	fs := client.SiteFileSystem(kc)
+	fs.SetReadAhead(h.readAhead())
+	if r.Method == "COPY" || r.Method == "MOVE" {
+		h.serveSiteCopyMove(w, r, client, kc, fs)
+		return
+	}
 	f, err := fs.Open(r.URL.Path)
 	if os.IsNotExist(err) {
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -561,10 +722,26 @@ func (h *handler) serveSiteFS(w http.ResponseWriter, r *http.Request, tokens []s
 		return
 	}
 	defer f.Close()
+	auditEv := h.auditLog.start(r, arv.ApiToken)
+	if auditEv != nil {
+		// /by_id/{collection ID}/{path}
+		if parts := strings.SplitN(r.URL.Path, "/", 4); len(parts) > 2 && parts[1] == "by_id" {
+			if len(parts) == 3 {
+				parts = append(parts, "")
+			}
+			auditEv.setCollection(parts[2], parts[3])
+		}
+		defer h.auditLog.finish(auditEv, w)
+	}
 	if fi, err := f.Stat(); err == nil && fi.IsDir() && r.Method == "GET" {
-		if !strings.HasSuffix(r.URL.Path, "/") {
+		if format := archiveFormat(r); format != "" && !archiveSitePathOK(r.URL.Path) {
+			http.Error(w, "archive download is only available for directories within a single collection", http.StatusBadRequest)
+		} else if format != "" {
+			h.serveArchive(w, r, fs, r.URL.Path, fi.Name(), format)
+		} else if !strings.HasSuffix(r.URL.Path, "/") {
 			h.seeOtherWithCookie(w, r, r.URL.Path+"/", credentialsOK)
 		} else {
+			auditEv.cancel()
 			h.serveDirectory(w, r, fi.Name(), fs, r.URL.Path, false)
 		}
 		return
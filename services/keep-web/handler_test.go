@@ -402,6 +402,46 @@ func (s *IntegrationSuite) TestPastCollectionVersionFileAccess(c *check.C) {
 	c.Check(resp.Header().Get("Content-Disposition"), check.Matches, "attachment(;.*)?")
 }
 
+func (s *IntegrationSuite) TestCollectionVersionNumber(c *check.C) {
+	s.testServer.Config.cluster.Services.WebDAVDownload.ExternalURL.Host = "download.example.com"
+	for _, path := range []string{
+		"/c=" + arvadostest.WazCollection + "@1/waz",
+		"/by_id/" + arvadostest.WazCollection + "@1/waz",
+	} {
+		s.testVhostRedirectTokenToCookie(c, "GET",
+			"download.example.com"+path,
+			"?api_token="+arvadostest.ActiveToken,
+			"",
+			"",
+			http.StatusOK,
+			"waz",
+		)
+	}
+
+	for _, trial := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/c=" + arvadostest.WazCollection + "@2/waz", http.StatusNotFound},
+		{"GET", "/c=" + arvadostest.WazCollection + "@3/waz", http.StatusNotFound},
+		{"PUT", "/c=" + arvadostest.WazCollection + "@1/newfile", http.StatusMethodNotAllowed},
+	} {
+		u := mustParseURL("http://download.example.com" + trial.path)
+		req := &http.Request{
+			Method:     trial.method,
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{"Authorization": {"Bearer " + arvadostest.ActiveToken}},
+			Body:       ioutil.NopCloser(strings.NewReader("data")),
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.status, check.Commentf("%+v", trial))
+	}
+}
+
 func (s *IntegrationSuite) TestVhostRedirectQueryTokenTrustAllContent(c *check.C) {
 	s.testServer.Config.cluster.Collections.TrustAllContent = true
 	s.testVhostRedirectTokenToCookie(c, "GET",
@@ -884,3 +924,83 @@ func copyHeader(h http.Header) http.Header {
 	}
 	return hc
 }
+
+func (s *IntegrationSuite) TestConditionalRequests(c *check.C) {
+	var coll arvados.Collection
+	arv := arvados.NewClientFromEnv()
+	arv.AuthToken = arvadostest.ActiveToken
+	err := arv.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{"collection": map[string]interface{}{
+		"manifest_text": ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n",
+	}})
+	c.Assert(err, check.IsNil)
+
+	do := func(method, path string, hdr map[string]string, body string) *httptest.ResponseRecorder {
+		u := mustParseURL("http://collections.example.com/c=" + coll.UUID + path)
+		req := &http.Request{
+			Method:     method,
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{"Authorization": {"Bearer " + arvadostest.ActiveToken}},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := do("GET", "/foo", nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	etag := resp.Header().Get("ETag")
+	c.Check(etag, check.Matches, `"[0-9a-f]{32}"`)
+
+	resp = do("GET", "/foo", map[string]string{"If-None-Match": etag}, "")
+	c.Check(resp.Code, check.Equals, http.StatusNotModified)
+	resp = do("GET", "/foo", map[string]string{"If-None-Match": `"bogus"`}, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	resp = do("GET", "/foo", map[string]string{"If-Match": `"bogus"`}, "")
+	c.Check(resp.Code, check.Equals, http.StatusPreconditionFailed)
+
+	// Create-only PUT
+	resp = do("PUT", "/foo", map[string]string{"If-None-Match": "*"}, "new foo")
+	c.Check(resp.Code, check.Equals, http.StatusPreconditionFailed)
+	resp = do("PUT", "/bar", map[string]string{"If-None-Match": "*"}, "bar")
+	c.Check(resp.Code, check.Equals, http.StatusCreated)
+
+	// Update only if unchanged
+	resp = do("PUT", "/foo", map[string]string{"If-Match": etag}, "new foo")
+	c.Check(resp.Code, check.Equals, http.StatusCreated)
+	newEtag := resp.Header().Get("ETag")
+	c.Check(newEtag, check.Matches, `"[0-9a-f]{32}"`)
+	c.Check(newEtag, check.Not(check.Equals), etag)
+	resp = do("PUT", "/foo", map[string]string{"If-Match": etag}, "newer foo")
+	c.Check(resp.Code, check.Equals, http.StatusPreconditionFailed)
+	resp = do("DELETE", "/foo", map[string]string{"If-Match": etag}, "")
+	c.Check(resp.Code, check.Equals, http.StatusPreconditionFailed)
+
+	resp = do("GET", "/foo", nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "new foo")
+	c.Check(resp.Header().Get("ETag"), check.Equals, newEtag)
+
+	// Collection modified by another client after keep-web
+	// cached it: the precondition is checked against the
+	// current version, not the cached one.
+	err = arv.RequestAndDecode(&coll, "PATCH", "arvados/v1/collections/"+coll.UUID, nil, map[string]interface{}{"collection": map[string]interface{}{
+		"manifest_text": ". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:foo\n",
+	}})
+	c.Assert(err, check.IsNil)
+	resp = do("PUT", "/foo", map[string]string{"If-Match": newEtag}, "newest foo")
+	c.Check(resp.Code, check.Equals, http.StatusPreconditionFailed)
+	resp = do("GET", "/foo", map[string]string{"Cache-Control": "no-cache"}, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "bar")
+	otherEtag := resp.Header().Get("ETag")
+	c.Check(otherEtag, check.Not(check.Equals), newEtag)
+
+	resp = do("DELETE", "/foo", map[string]string{"If-Match": otherEtag}, "")
+	c.Check(resp.Code, check.Equals, http.StatusNoContent)
+}
@@ -0,0 +1,545 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV locks are recorded as links with this link_class, so every
+// keep-web process sees the same locks.
+const lockLinkClass = "keep-web-lock"
+
+// maxLockDuration is the longest lock timeout keep-web grants. Lock
+// requests with a longer (or infinite) timeout get this one instead;
+// clients are expected to refresh their locks before they expire.
+const maxLockDuration = time.Hour
+
+// lockRecord is a WebDAV lock on a file or directory in a collection.
+type lockRecord struct {
+	UUID       string // ID assigned by the lock backend
+	Token      string
+	Collection string // collection UUID
+	Root       string // path of the locked file/directory, with leading "/"
+	ZeroDepth  bool
+	OwnerXML   string
+	Expires    time.Time
+	Created    time.Time
+}
+
+// covers returns true if the lock applies to the named file.
+func (lr *lockRecord) covers(name string) bool {
+	if name == lr.Root {
+		return true
+	}
+	if lr.ZeroDepth {
+		return false
+	}
+	return lr.Root == "/" || strings.HasPrefix(name, lr.Root+"/")
+}
+
+// conflicts returns true if lr and other cannot both be held at the
+// same time.
+func (lr *lockRecord) conflicts(other *lockRecord) bool {
+	return lr.covers(other.Root) || other.covers(lr.Root)
+}
+
+// precedes returns true if lr was created before other. When two
+// conflicting locks are created concurrently by different keep-web
+// processes, the earlier one wins.
+func (lr *lockRecord) precedes(other *lockRecord) bool {
+	if !lr.Created.Equal(other.Created) {
+		return lr.Created.Before(other.Created)
+	}
+	return lr.UUID < other.UUID
+}
+
+func (lr *lockRecord) details(now time.Time) webdav.LockDetails {
+	return webdav.LockDetails{
+		Root:      lr.Root,
+		Duration:  lr.Expires.Sub(now),
+		OwnerXML:  lr.OwnerXML,
+		ZeroDepth: lr.ZeroDepth,
+	}
+}
+
+// lockBackend stores lock records.
+type lockBackend interface {
+	// List returns all lock records for the given collection,
+	// including expired ones.
+	List(collection string) ([]lockRecord, error)
+	// Create stores a new lock record, filling in its UUID and
+	// Created time.
+	Create(*lockRecord) error
+	// Update saves a new expiry time for an existing lock.
+	Update(*lockRecord) error
+	// Delete removes the lock record with the given UUID.
+	Delete(uuid string) error
+}
+
+// apiLockBackend stores lock records as Arvados links, using the
+// cluster's SystemRootToken.
+type apiLockBackend struct {
+	client *arvados.Client
+}
+
+func (be *apiLockBackend) List(collection string) ([]lockRecord, error) {
+	filters := []arvados.Filter{
+		{Attr: "link_class", Operator: "=", Operand: lockLinkClass},
+		{Attr: "head_uuid", Operator: "=", Operand: collection},
+	}
+	params := arvados.ResourceListParams{
+		Filters: filters,
+		Order:   "uuid",
+		Count:   "none",
+	}
+	var links []arvados.Link
+	for {
+		var page arvados.LinkList
+		err := be.client.RequestAndDecode(&page, "GET", "arvados/v1/links", nil, params)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Items) == 0 {
+			break
+		}
+		links = append(links, page.Items...)
+		params.Filters = append(filters, arvados.Filter{
+			Attr:     "uuid",
+			Operator: ">",
+			Operand:  page.Items[len(page.Items)-1].UUID,
+		})
+	}
+	var recs []lockRecord
+	for _, link := range links {
+		rec := lockRecord{
+			UUID:       link.UUID,
+			Token:      link.Name,
+			Collection: link.HeadUUID,
+		}
+		if link.CreatedAt != nil {
+			rec.Created = *link.CreatedAt
+		}
+		rec.Root, _ = link.Properties["path"].(string)
+		rec.OwnerXML, _ = link.Properties["owner_xml"].(string)
+		rec.ZeroDepth = link.Properties["depth"] == "0"
+		if exp, ok := link.Properties["expires_at"].(string); ok {
+			rec.Expires, _ = time.Parse(time.RFC3339Nano, exp)
+		}
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].precedes(&recs[j])
+	})
+	return recs, nil
+}
+
+func (be *apiLockBackend) Create(rec *lockRecord) error {
+	depth := "infinity"
+	if rec.ZeroDepth {
+		depth = "0"
+	}
+	var link arvados.Link
+	err := be.client.RequestAndDecode(&link, "POST", "arvados/v1/links", nil, map[string]interface{}{
+		"link": map[string]interface{}{
+			"link_class": lockLinkClass,
+			"head_uuid":  rec.Collection,
+			"name":       rec.Token,
+			"properties": map[string]interface{}{
+				"path":       rec.Root,
+				"depth":      depth,
+				"owner_xml":  rec.OwnerXML,
+				"expires_at": rec.Expires.UTC().Format(time.RFC3339Nano),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	rec.UUID = link.UUID
+	if link.CreatedAt != nil {
+		rec.Created = *link.CreatedAt
+	}
+	return nil
+}
+
+func (be *apiLockBackend) Update(rec *lockRecord) error {
+	depth := "infinity"
+	if rec.ZeroDepth {
+		depth = "0"
+	}
+	return be.client.RequestAndDecode(nil, "PATCH", "arvados/v1/links/"+rec.UUID, nil, map[string]interface{}{
+		"link": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"path":       rec.Root,
+				"depth":      depth,
+				"owner_xml":  rec.OwnerXML,
+				"expires_at": rec.Expires.UTC().Format(time.RFC3339Nano),
+			},
+		},
+	})
+}
+
+func (be *apiLockBackend) Delete(uuid string) error {
+	err := be.client.RequestAndDecode(nil, "DELETE", "arvados/v1/links/"+uuid, nil, nil)
+	if err, ok := err.(*arvados.TransactionError); ok && err.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// memLockBackend stores lock records in memory. It is used when
+// SystemRootToken is not configured, in which case locks are not
+// shared with other keep-web processes.
+type memLockBackend struct {
+	recs   map[string]lockRecord
+	serial int64
+	mtx    sync.Mutex
+}
+
+func (be *memLockBackend) List(collection string) ([]lockRecord, error) {
+	be.mtx.Lock()
+	defer be.mtx.Unlock()
+	var recs []lockRecord
+	for _, rec := range be.recs {
+		if rec.Collection == collection {
+			recs = append(recs, rec)
+		}
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].precedes(&recs[j])
+	})
+	return recs, nil
+}
+
+func (be *memLockBackend) Create(rec *lockRecord) error {
+	be.mtx.Lock()
+	defer be.mtx.Unlock()
+	if be.recs == nil {
+		be.recs = map[string]lockRecord{}
+	}
+	be.serial++
+	rec.UUID = fmt.Sprintf("%s-%016x", lockPrefix, be.serial)
+	rec.Created = time.Now()
+	be.recs[rec.UUID] = *rec
+	return nil
+}
+
+func (be *memLockBackend) Update(rec *lockRecord) error {
+	be.mtx.Lock()
+	defer be.mtx.Unlock()
+	if _, ok := be.recs[rec.UUID]; !ok {
+		return webdav.ErrNoSuchLock
+	}
+	be.recs[rec.UUID] = *rec
+	return nil
+}
+
+func (be *memLockBackend) Delete(uuid string) error {
+	be.mtx.Lock()
+	defer be.mtx.Unlock()
+	delete(be.recs, uuid)
+	return nil
+}
+
+// collectionLockSystem implements webdav.LockSystem for a single
+// collection, using a lockBackend to share locks with other keep-web
+// processes.
+//
+// The webdav handler calls Create and Unlock to make "temporary"
+// locks for the duration of each write request that doesn't have an
+// If header. Unless persist is true (i.e., the request is a LOCK
+// request) these are not stored in the backend: Create just checks
+// that nobody else holds a conflicting lock.
+//
+// Lock records are stored using the SystemRootToken, so before
+// storing, refreshing, or removing a lock, Create, Refresh, and Unlock
+// call checkWrite (if not nil) to make sure the client itself is
+// allowed to update the collection.
+//
+// ETag conditions in If headers are evaluated by calling etag (if
+// not nil) to get the current ETag of the named file.
+type collectionLockSystem struct {
+	backend    lockBackend
+	collection string
+	persist    bool
+	checkWrite func() error
+	etag       func(name string) string
+
+	writeOnce sync.Once
+	writeErr  error
+}
+
+// writable returns the result of checkWrite, calling it at most once.
+func (ls *collectionLockSystem) writable() error {
+	if ls.checkWrite == nil {
+		return nil
+	}
+	ls.writeOnce.Do(func() { ls.writeErr = ls.checkWrite() })
+	return ls.writeErr
+}
+
+func (ls *collectionLockSystem) current(now time.Time) ([]lockRecord, error) {
+	recs, err := ls.backend.List(ls.collection)
+	if err != nil {
+		return nil, err
+	}
+	current := recs[:0]
+	for _, rec := range recs {
+		if now.Before(rec.Expires) {
+			current = append(current, rec)
+		} else if err := ls.backend.Delete(rec.UUID); err != nil {
+			log.Printf("error deleting expired lock %s: %s", rec.UUID, err)
+		}
+	}
+	return current, nil
+}
+
+// Confirm checks the conditions in one list from an If header.
+//
+// A lock token condition is true if the token identifies a current
+// lock on name0 or name1. An ETag condition is true if it matches the
+// current ETag of name0 (a file without an ETag matches nothing). The
+// request can proceed if all of the conditions are true, and each of
+// name0 and name1 is either covered by one of the given locks or not
+// locked at all.
+func (ls *collectionLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	name0, name1 = lockName(name0), lockName(name1)
+	recs, err := ls.current(now)
+	if err != nil {
+		return nil, err
+	}
+	held := map[string]*lockRecord{}
+	for i := range recs {
+		held[recs[i].Token] = &recs[i]
+	}
+	var claimed []*lockRecord
+	for _, cond := range conditions {
+		if cond.ETag != "" {
+			etag := ""
+			if ls.etag != nil && name0 != "" {
+				etag = ls.etag(name0)
+			}
+			if (etag != "" && etag == cond.ETag) == cond.Not {
+				return nil, webdav.ErrConfirmationFailed
+			}
+			continue
+		}
+		if cond.Token == "" {
+			continue
+		}
+		rec := held[cond.Token]
+		ok := rec != nil && ((name0 != "" && rec.covers(name0)) || (name1 != "" && rec.covers(name1)))
+		if ok == cond.Not {
+			return nil, webdav.ErrConfirmationFailed
+		}
+		if ok {
+			claimed = append(claimed, rec)
+		}
+	}
+	for _, name := range []string{name0, name1} {
+		if name == "" {
+			continue
+		}
+		mine, locked := false, false
+		for _, rec := range claimed {
+			mine = mine || rec.covers(name)
+		}
+		for _, rec := range recs {
+			locked = locked || rec.covers(name)
+		}
+		if locked && !mine {
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+	return noop, nil
+}
+
+func (ls *collectionLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	if details.Duration < 0 || details.Duration > maxLockDuration {
+		details.Duration = maxLockDuration
+	}
+	rec := lockRecord{
+		Collection: ls.collection,
+		Root:       lockName(details.Root),
+		ZeroDepth:  details.ZeroDepth,
+		OwnerXML:   details.OwnerXML,
+		Expires:    now.Add(details.Duration),
+	}
+	recs, err := ls.current(now)
+	if err != nil {
+		return "", err
+	}
+	for _, other := range recs {
+		if rec.conflicts(&other) {
+			return "", webdav.ErrLocked
+		}
+	}
+	if !ls.persist {
+		return fmt.Sprintf("opaquelocktoken:%s-%x", lockPrefix, atomic.AddInt64(&nextLockSuffix, 1)), nil
+	}
+	if err := ls.writable(); err != nil {
+		return "", err
+	}
+	rec.Token = "opaquelocktoken:" + uuid()
+	err = ls.backend.Create(&rec)
+	if err != nil {
+		return "", err
+	}
+	// Another keep-web process might have created a conflicting
+	// lock since we checked above. If so, the earlier one wins.
+	recs, err = ls.current(now)
+	if err != nil {
+		return "", err
+	}
+	for _, other := range recs {
+		if other.UUID != rec.UUID && rec.conflicts(&other) && other.precedes(&rec) {
+			ls.backend.Delete(rec.UUID)
+			return "", webdav.ErrLocked
+		}
+	}
+	return rec.Token, nil
+}
+
+func (ls *collectionLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	if duration < 0 || duration > maxLockDuration {
+		duration = maxLockDuration
+	}
+	rec, err := ls.find(now, token)
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+	if err := ls.writable(); err != nil {
+		return webdav.LockDetails{}, err
+	}
+	rec.Expires = now.Add(duration)
+	err = ls.backend.Update(rec)
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+	return rec.details(now), nil
+}
+
+func (ls *collectionLockSystem) Unlock(now time.Time, token string) error {
+	if strings.HasPrefix(token, "opaquelocktoken:"+lockPrefix+"-") {
+		// Temporary lock, see Create.
+		return nil
+	}
+	rec, err := ls.find(now, token)
+	if err != nil {
+		return err
+	}
+	if err := ls.writable(); err != nil {
+		return err
+	}
+	return ls.backend.Delete(rec.UUID)
+}
+
+func (ls *collectionLockSystem) find(now time.Time, token string) (*lockRecord, error) {
+	recs, err := ls.current(now)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range recs {
+		if rec.Token == token {
+			return &rec, nil
+		}
+	}
+	return nil, webdav.ErrNoSuchLock
+}
+
+// checkLocked returns webdav.ErrLocked if the named file, or
+// anything below it, is covered by a current lock whose token is not
+// one of the given tokens.
+//
+// This is used for requests that webdav.Handler doesn't handle (and
+// therefore doesn't check with Confirm), like cross-collection COPY
+// and MOVE.
+func (ls *collectionLockSystem) checkLocked(now time.Time, name string, tokens []string) error {
+	recs, err := ls.current(now)
+	if err != nil {
+		return err
+	}
+	held := map[string]bool{}
+	for _, tok := range tokens {
+		held[tok] = true
+	}
+	target := lockRecord{Root: lockName(name)}
+	for i := range recs {
+		if !held[recs[i].Token] && recs[i].conflicts(&target) {
+			return webdav.ErrLocked
+		}
+	}
+	return nil
+}
+
+var lockTokenRegexp = regexp.MustCompile(`<(opaquelocktoken:[^>]*)>`)
+
+// requestLockTokens returns the lock tokens submitted in the If
+// header of r, ignoring the rest of the If header syntax.
+func requestLockTokens(r *http.Request) []string {
+	var tokens []string
+	for _, m := range lockTokenRegexp.FindAllStringSubmatch(r.Header.Get("If"), -1) {
+		tokens = append(tokens, m[1])
+	}
+	return tokens
+}
+
+// lockName returns the canonical form of a lock root: "" or a clean
+// path with a leading "/" and no trailing "/".
+func lockName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return path.Clean("/" + name)
+}
+
+// checkCollectionWritable returns an error if the client's token
+// does not have permission to update the given collection.
+//
+// It sends an update request with no changes: the API server checks
+// write permission (and token scopes) as usual, but does not modify
+// the collection.
+func checkCollectionWritable(client *arvados.Client, collectionUUID string) error {
+	return client.RequestAndDecode(nil, "PATCH", "arvados/v1/collections/"+collectionUUID, nil, map[string]interface{}{
+		"collection": map[string]interface{}{},
+	})
+}
+
+// lockSystem returns a webdav.LockSystem for the given collection.
+// Locks can only be created, refreshed, or removed if the given
+// (caller's) client has permission to update the collection.
+func (h *handler) lockSystem(client *arvados.Client, collectionUUID string, r *http.Request) *collectionLockSystem {
+	var backend lockBackend = &h.memLocks
+	if tok := h.Config.cluster.SystemRootToken; tok != "" {
+		backend = &apiLockBackend{
+			client: (&arvados.Client{
+				APIHost:   client.APIHost,
+				AuthToken: tok,
+				Insecure:  client.Insecure,
+			}).WithRequestID(r.Header.Get("X-Request-Id")),
+		}
+	}
+	return &collectionLockSystem{
+		backend:    backend,
+		collection: collectionUUID,
+		persist:    r.Method == "LOCK",
+		checkWrite: func() error {
+			return checkCollectionWritable(client, collectionUUID)
+		},
+	}
+}
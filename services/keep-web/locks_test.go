@@ -0,0 +1,318 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	"golang.org/x/net/webdav"
+	check "gopkg.in/check.v1"
+)
+
+const lockTestCollection = "zzzzz-4zz18-locktestlocktes"
+
+func (s *UnitSuite) TestLockConflicts(c *check.C) {
+	now := time.Now()
+	be := &memLockBackend{}
+	ls := &collectionLockSystem{backend: be, collection: lockTestCollection, persist: true}
+	other := &collectionLockSystem{backend: be, collection: "zzzzz-4zz18-otherotherothe", persist: true}
+
+	tok, err := ls.Create(now, webdav.LockDetails{Root: "/dir", Duration: time.Minute})
+	c.Assert(err, check.IsNil)
+	c.Check(tok, check.Matches, `opaquelocktoken:.*`)
+
+	for _, trial := range []struct {
+		root      string
+		zeroDepth bool
+		locked    bool
+	}{
+		{"/dir", true, true},
+		{"/dir/", true, true},
+		{"/dir/file", true, true},
+		{"/dir/sub/file", false, true},
+		{"/", true, false},
+		{"/", false, true},
+		{"/dir2", false, false},
+		{"/di", false, false},
+	} {
+		_, err := ls.Create(now, webdav.LockDetails{Root: trial.root, Duration: time.Minute, ZeroDepth: trial.zeroDepth})
+		if trial.locked {
+			c.Check(err, check.Equals, webdav.ErrLocked, check.Commentf("%+v", trial))
+		} else {
+			c.Check(err, check.IsNil, check.Commentf("%+v", trial))
+		}
+	}
+
+	// Same path in a different collection is a different
+	// resource.
+	_, err = other.Create(now, webdav.LockDetails{Root: "/dir", Duration: time.Minute})
+	c.Check(err, check.IsNil)
+
+	// Lock expires
+	_, err = ls.Create(now.Add(2*time.Minute), webdav.LockDetails{Root: "/dir/file", Duration: time.Minute})
+	c.Check(err, check.IsNil)
+	_, err = ls.Refresh(now.Add(2*time.Minute), tok, time.Minute)
+	c.Check(err, check.Equals, webdav.ErrNoSuchLock)
+}
+
+func (s *UnitSuite) TestLockRefreshUnlock(c *check.C) {
+	now := time.Now()
+	ls := &collectionLockSystem{backend: &memLockBackend{}, collection: lockTestCollection, persist: true}
+	tok, err := ls.Create(now, webdav.LockDetails{Root: "/file", Duration: -1, OwnerXML: "<href>me</href>"})
+	c.Assert(err, check.IsNil)
+
+	now = now.Add(maxLockDuration - time.Minute)
+	details, err := ls.Refresh(now, tok, 10*time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Check(details.Root, check.Equals, "/file")
+	c.Check(details.OwnerXML, check.Equals, "<href>me</href>")
+	c.Check(details.Duration, check.Equals, 10*time.Minute)
+
+	// Refreshed lock outlives the original timeout
+	now = now.Add(5 * time.Minute)
+	_, err = ls.Create(now, webdav.LockDetails{Root: "/file", Duration: time.Minute})
+	c.Check(err, check.Equals, webdav.ErrLocked)
+
+	c.Check(ls.Unlock(now, "opaquelocktoken:bogus"), check.Equals, webdav.ErrNoSuchLock)
+	c.Check(ls.Unlock(now, tok), check.IsNil)
+	c.Check(ls.Unlock(now, tok), check.Equals, webdav.ErrNoSuchLock)
+	_, err = ls.Create(now, webdav.LockDetails{Root: "/file", Duration: time.Minute})
+	c.Check(err, check.IsNil)
+}
+
+func (s *UnitSuite) TestLockTemporary(c *check.C) {
+	now := time.Now()
+	be := &memLockBackend{}
+	ls := &collectionLockSystem{backend: be, collection: lockTestCollection}
+	tok, err := ls.Create(now, webdav.LockDetails{Root: "/file", Duration: -1, ZeroDepth: true})
+	c.Assert(err, check.IsNil)
+	recs, _ := be.List(lockTestCollection)
+	c.Check(recs, check.HasLen, 0)
+	c.Check(ls.Unlock(now, tok), check.IsNil)
+
+	ls.persist = true
+	_, err = ls.Create(now, webdav.LockDetails{Root: "/", Duration: time.Minute})
+	c.Assert(err, check.IsNil)
+	ls.persist = false
+	_, err = ls.Create(now, webdav.LockDetails{Root: "/file", Duration: -1, ZeroDepth: true})
+	c.Check(err, check.Equals, webdav.ErrLocked)
+}
+
+func (s *UnitSuite) TestLockConfirm(c *check.C) {
+	now := time.Now()
+	ls := &collectionLockSystem{backend: &memLockBackend{}, collection: lockTestCollection, persist: true, etag: func(name string) string {
+		return map[string]string{"/a": `"abc"`, "/c": `"def"`}[name]
+	}}
+	tokA, err := ls.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	c.Assert(err, check.IsNil)
+	tokB, err := ls.Create(now, webdav.LockDetails{Root: "/b", Duration: time.Minute, ZeroDepth: true})
+	c.Assert(err, check.IsNil)
+
+	for _, trial := range []struct {
+		name0, name1 string
+		conditions   []webdav.Condition
+		ok           bool
+	}{
+		{"/a", "", []webdav.Condition{{Token: tokA}}, true},
+		{"/a/file", "", []webdav.Condition{{Token: tokA}}, true},
+		{"/a", "", []webdav.Condition{{Token: tokB}}, false},
+		{"/a", "", []webdav.Condition{{Token: "opaquelocktoken:bogus"}}, false},
+		{"/a", "", []webdav.Condition{{Not: true, Token: "opaquelocktoken:bogus"}}, false},
+		{"/c", "", []webdav.Condition{{Not: true, Token: "opaquelocktoken:bogus"}}, true},
+		{"/a", "", []webdav.Condition{{Token: tokA}, {Not: true, Token: tokA}}, false},
+		{"/a", "", []webdav.Condition{{Token: tokA}, {ETag: `"abc"`}}, true},
+		{"/a", "", []webdav.Condition{{Token: tokA}, {ETag: `"def"`}}, false},
+		{"/a", "", []webdav.Condition{{Token: tokA}, {Not: true, ETag: `"abc"`}}, false},
+		{"/a", "", []webdav.Condition{{Token: tokA}, {Not: true, ETag: `"def"`}}, true},
+		{"/c", "", []webdav.Condition{{ETag: `"def"`}}, true},
+		{"/c", "", []webdav.Condition{{ETag: `"abc"`}}, false},
+		{"/d", "", []webdav.Condition{{ETag: `""`}}, false},
+		{"/d", "", []webdav.Condition{{Not: true, ETag: `"abc"`}}, true},
+		{"/b/file", "", []webdav.Condition{{Token: tokB}}, false},
+		{"/a", "/b", []webdav.Condition{{Token: tokA}}, false},
+		{"/a", "/b", []webdav.Condition{{Token: tokA}, {Token: tokB}}, true},
+		{"/a", "/c", []webdav.Condition{{Token: tokA}}, true},
+	} {
+		release, err := ls.Confirm(now, trial.name0, trial.name1, trial.conditions...)
+		if trial.ok {
+			c.Check(err, check.IsNil, check.Commentf("%+v", trial))
+			c.Check(release, check.NotNil)
+		} else {
+			c.Check(err, check.Equals, webdav.ErrConfirmationFailed, check.Commentf("%+v", trial))
+		}
+	}
+
+	// Expired lock can't be confirmed
+	_, err = ls.Confirm(now.Add(2*time.Minute), "/a", "", webdav.Condition{Token: tokA})
+	c.Check(err, check.Equals, webdav.ErrConfirmationFailed)
+}
+
+func (s *UnitSuite) TestLockPermission(c *check.C) {
+	now := time.Now()
+	be := &memLockBackend{}
+	denied := errors.New("permission denied")
+	checks := 0
+	ls := &collectionLockSystem{backend: be, collection: lockTestCollection, persist: true, checkWrite: func() error {
+		checks++
+		return denied
+	}}
+
+	// Read-only client can't create a lock
+	_, err := ls.Create(now, webdav.LockDetails{Root: "/file", Duration: time.Minute})
+	c.Check(err, check.Equals, denied)
+	recs, _ := be.List(lockTestCollection)
+	c.Check(recs, check.HasLen, 0)
+
+	// ...or refresh someone else's lock
+	writer := &collectionLockSystem{backend: be, collection: lockTestCollection, persist: true, checkWrite: func() error { return nil }}
+	tok, err := writer.Create(now, webdav.LockDetails{Root: "/file", Duration: time.Minute})
+	c.Assert(err, check.IsNil)
+	_, err = ls.Refresh(now, tok, time.Hour)
+	c.Check(err, check.Equals, denied)
+	recs, _ = be.List(lockTestCollection)
+	c.Assert(recs, check.HasLen, 1)
+	c.Check(recs[0].Expires, check.Equals, now.Add(time.Minute))
+	c.Check(checks, check.Equals, 1)
+
+	// ...or remove it
+	err = ls.Unlock(now, tok)
+	c.Check(err, check.Equals, denied)
+	recs, _ = be.List(lockTestCollection)
+	c.Check(recs, check.HasLen, 1)
+	err = writer.Unlock(now, tok)
+	c.Check(err, check.IsNil)
+	recs, _ = be.List(lockTestCollection)
+	c.Check(recs, check.HasLen, 0)
+
+	// Temporary locks (for write requests, which are checked
+	// when the collection is saved) don't need the check
+	ls = &collectionLockSystem{backend: be, collection: lockTestCollection, checkWrite: func() error { return denied }}
+	_, err = ls.Create(now, webdav.LockDetails{Root: "/other", Duration: -1})
+	c.Check(err, check.IsNil)
+}
+
+// racingLockBackend simulates another keep-web process creating a
+// conflicting lock at the same time.
+type racingLockBackend struct {
+	memLockBackend
+	raced bool
+}
+
+func (be *racingLockBackend) Create(rec *lockRecord) error {
+	if !be.raced {
+		be.raced = true
+		rival := *rec
+		rival.Token = "opaquelocktoken:rival"
+		be.memLockBackend.Create(&rival)
+	}
+	return be.memLockBackend.Create(rec)
+}
+
+func (s *UnitSuite) TestLockRace(c *check.C) {
+	now := time.Now()
+	be := &racingLockBackend{}
+	ls := &collectionLockSystem{backend: be, collection: lockTestCollection, persist: true}
+	_, err := ls.Create(now, webdav.LockDetails{Root: "/file", Duration: time.Minute})
+	c.Check(err, check.Equals, webdav.ErrLocked)
+	recs, _ := be.List(lockTestCollection)
+	c.Assert(recs, check.HasLen, 1)
+	c.Check(recs[0].Token, check.Equals, "opaquelocktoken:rival")
+}
+
+func (s *UnitSuite) TestLockWebDAV(c *check.C) {
+	be := &memLockBackend{}
+	fs := webdav.NewMemFS()
+	do := func(method, path string, hdr map[string]string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://example/"+path, strings.NewReader(body))
+		for k, v := range hdr {
+			r.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		(&webdav.Handler{
+			FileSystem: fs,
+			LockSystem: &collectionLockSystem{backend: be, collection: lockTestCollection, persist: method == "LOCK", etag: func(name string) string {
+				return map[string]string{"/foo": `"fooetag"`}[name]
+			}},
+		}).ServeHTTP(resp, r)
+		return resp
+	}
+	lockBody := `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>alice</D:owner></D:lockinfo>`
+
+	c.Check(do("PUT", "foo", nil, "foo").Code, check.Equals, http.StatusCreated)
+	resp := do("LOCK", "foo", map[string]string{"Timeout": "Second-600"}, lockBody)
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	token := resp.Header().Get("Lock-Token")
+	c.Check(token, check.Matches, `<opaquelocktoken:.*>`)
+
+	// Second client can't lock or write
+	c.Check(do("LOCK", "foo", nil, lockBody).Code, check.Equals, http.StatusLocked)
+	c.Check(do("PUT", "foo", nil, "bar").Code, check.Equals, http.StatusLocked)
+	c.Check(do("DELETE", "foo", nil, "").Code, check.Equals, http.StatusLocked)
+	c.Check(do("PUT", "foo", map[string]string{"If": "(<opaquelocktoken:bogus>)"}, "bar").Code, check.Equals, http.StatusPreconditionFailed)
+
+	// Other files are not locked
+	c.Check(do("PUT", "bar", nil, "bar").Code, check.Equals, http.StatusCreated)
+
+	// Lock holder can write, unless the ETag doesn't match
+	c.Check(do("PUT", "foo", map[string]string{"If": "(" + token + ` ["wrongetag"])`}, "bar").Code, check.Equals, http.StatusPreconditionFailed)
+	c.Check(do("PUT", "foo", map[string]string{"If": "(" + token + ` ["fooetag"])`}, "bar").Code, check.Equals, http.StatusCreated)
+	c.Check(do("PUT", "foo", map[string]string{"If": "(" + token + ")"}, "bar").Code, check.Equals, http.StatusCreated)
+
+	// Refresh
+	resp = do("LOCK", "foo", map[string]string{"If": "(" + token + ")", "Timeout": "Second-60"}, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Matches, `(?s).*Second-60.*`)
+
+	c.Check(do("UNLOCK", "foo", map[string]string{"Lock-Token": "<opaquelocktoken:bogus>"}, "").Code, check.Equals, http.StatusConflict)
+	c.Check(do("UNLOCK", "foo", map[string]string{"Lock-Token": token}, "").Code, check.Equals, http.StatusNoContent)
+	c.Check(do("PUT", "foo", nil, "baz").Code, check.Equals, http.StatusCreated)
+}
+
+func (s *IntegrationSuite) TestLockReadOnlyToken(c *check.C) {
+	lockBody := `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>spectator</D:owner></D:lockinfo>`
+	s.testServer.Config.cluster.Services.WebDAVDownload.ExternalURL.Host = "example.com"
+	for _, trial := range []struct {
+		token string
+		code  int
+	}{
+		// The "bar_file" collection is readable, but not
+		// writable, by the spectator user.
+		{arvadostest.SpectatorToken, http.StatusForbidden},
+		{arvadostest.AnonymousToken, http.StatusForbidden},
+		{arvadostest.AdminToken, http.StatusOK},
+	} {
+		u := mustParseURL("http://example.com/c=zzzzz-4zz18-ehbhgtheo8909or/bar")
+		req := &http.Request{
+			Method:     "LOCK",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header: http.Header{
+				"Authorization": {"Bearer " + trial.token},
+				"Timeout":       {"Second-60"},
+			},
+			Body: ioutil.NopCloser(strings.NewReader(lockBody)),
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.code, check.Commentf("%+v", trial))
+		if resp.Code == http.StatusOK {
+			req.Method = "UNLOCK"
+			req.Header.Set("Lock-Token", resp.Header().Get("Lock-Token"))
+			req.Body = nil
+			resp = httptest.NewRecorder()
+			s.testServer.Handler.ServeHTTP(resp, req)
+			c.Check(resp.Code, check.Equals, http.StatusNoContent)
+		}
+	}
+}
@@ -0,0 +1,884 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	s3SignAlgorithm    = "AWS4-HMAC-SHA256"
+	s3MaxClockSkew     = 15 * time.Minute
+	s3MaxKeys          = 1000
+	s3XMLNamespace     = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimestampFormat  = "20060102T150405Z"
+	s3UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	s3LastModifiedTime = "2006-01-02T15:04:05.000Z"
+)
+
+var errS3Done = errors.New("listing is complete")
+
+// s3Error is an error response, as described at
+// https://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+	status   int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newS3Error(status int, code, message string) *s3Error {
+	return &s3Error{Code: code, Message: message, status: status}
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   struct {
+		ID          string
+		DisplayName string
+	}
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+// s3ListBucketResult is the response to both ListObjects (V1) and
+// ListObjectsV2. Fields that only apply to one version are omitted
+// when empty.
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	IsTruncated           bool
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	KeyCount              *int    `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+// serveS3 handles the request if it is signed with AWS Signature
+// Version 4, and returns true. Otherwise, it returns false and the
+// request is handled as a WebDAV/browser request.
+//
+// Buckets are collections (identified by UUID or PDH, with "-"
+// instead of "+") and projects (identified by UUID, with the first
+// component of each object key being a collection name).
+func (h *handler) serveS3(w httpserver.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), s3SignAlgorithm+" ") {
+		return false
+	}
+	arv := h.clientPool.Get()
+	if arv == nil {
+		s3ErrorResponse(w, r, newS3Error(http.StatusInternalServerError, "InternalError", "Pool failed: "+h.clientPool.Err().Error()))
+		return true
+	}
+	defer h.clientPool.Put(arv)
+
+	token, err := h.s3checksig(arv, r)
+	if err != nil {
+		s3ErrorResponse(w, r, err)
+		return true
+	}
+	arv.ApiToken = token
+	kc, err := keepclient.MakeKeepClient(arv)
+	if err != nil {
+		s3ErrorResponse(w, r, err)
+		return true
+	}
+	kc.RequestID = r.Header.Get("X-Request-Id")
+	kc.HedgeDelay = time.Duration(h.Config.cluster.API.KeepServiceHedgeDelay)
+	client := (&arvados.Client{
+		APIHost:   arv.ApiServer,
+		AuthToken: arv.ApiToken,
+		Insecure:  arv.ApiInsecure,
+	}).WithRequestID(r.Header.Get("X-Request-Id"))
+
+	bucket, key := r.URL.Path[1:], ""
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, key = bucket[:i], bucket[i+1:]
+	}
+	if bucket == "" {
+		if r.Method != "GET" {
+			s3ErrorResponse(w, r, newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed"))
+			return true
+		}
+		err = h.s3ListBuckets(w, client)
+	} else if id := s3BucketID(bucket); id == "" {
+		err = newS3Error(http.StatusNotFound, "NoSuchBucket", "bucket name is not a collection or project ID")
+	} else if key != "" && path.Clean("/"+key) != "/"+strings.TrimSuffix(key, "/") {
+		err = newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid object key")
+	} else if key == "" {
+		switch r.Method {
+		case "GET":
+			err = h.s3ListObjects(w, r, client, kc, bucket, id)
+		case "HEAD":
+			err = h.s3HeadBucket(w, client, kc, id)
+		default:
+			err = newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "creating and deleting buckets is not supported")
+		}
+	} else {
+		if ev := h.auditLog.start(r, token); ev != nil {
+			ev.setCollection(id, key)
+			defer h.auditLog.finish(ev, w)
+		}
+		switch r.Method {
+		case "GET", "HEAD":
+			err = h.s3GetObject(w, r, client, kc, id, key)
+		case "PUT", "DELETE":
+			err = h.s3WriteObject(w, r, arv, client, kc, id, key)
+		default:
+			err = newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+		}
+	}
+	if err != nil {
+		s3ErrorResponse(w, r, err)
+	}
+	return true
+}
+
+// s3BucketID returns the collection/project ID indicated by the
+// given bucket name, or "" if it isn't a valid bucket name.
+func s3BucketID(bucket string) string {
+	if id := parseCollectionIDFromURL(bucket); id != "" {
+		return id
+	}
+	if arvadosclient.UUIDMatch(bucket) && strings.Contains(bucket, "-j7d0g-") {
+		return bucket
+	}
+	return ""
+}
+
+// s3ErrorResponse sends an S3 error response. If err is not an
+// *s3Error, it is reported as an internal error.
+func s3ErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	s3err, ok := err.(*s3Error)
+	if !ok {
+		s3err = newS3Error(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+	s3err.Resource = r.URL.Path
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(s3err.status)
+	if r.Method == "HEAD" {
+		return
+	}
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(s3err); err != nil {
+		log.Printf("error encoding S3 error response: %s", err)
+	}
+}
+
+// s3APIError converts an error from the Arvados API to an S3 error.
+func s3APIError(err error, notFoundCode string) error {
+	status := 0
+	switch err := err.(type) {
+	case arvadosclient.APIServerError:
+		status = err.HttpStatusCode
+	case *arvados.TransactionError:
+		status = err.StatusCode
+	}
+	switch status {
+	case http.StatusNotFound:
+		return newS3Error(http.StatusNotFound, notFoundCode, err.Error())
+	case http.StatusForbidden:
+		return newS3Error(http.StatusForbidden, "AccessDenied", err.Error())
+	case http.StatusUnauthorized:
+		return newS3Error(http.StatusForbidden, "InvalidAccessKeyId", err.Error())
+	default:
+		return err
+	}
+}
+
+func s3WriteXML(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	return xml.NewEncoder(w).Encode(v)
+}
+
+func (h *handler) s3ListBuckets(w http.ResponseWriter, client *arvados.Client) error {
+	user, err := client.CurrentUser()
+	if err != nil {
+		return s3APIError(err, "AccessDenied")
+	}
+	resp := s3ListAllMyBucketsResult{Xmlns: s3XMLNamespace}
+	resp.Owner.ID = user.UUID
+	resp.Owner.DisplayName = user.Username
+	limit := s3MaxKeys
+	for _, list := range []struct {
+		path    string
+		filters []arvados.Filter
+	}{
+		{"arvados/v1/groups", []arvados.Filter{{Attr: "group_class", Operator: "=", Operand: "project"}}},
+		{"arvados/v1/collections", nil},
+	} {
+		// Page through the results in uuid order, since
+		// ListBuckets has no way to return a partial list.
+		filters := append(list.filters, arvados.Filter{Attr: "owner_uuid", Operator: "=", Operand: user.UUID})
+		for lastUUID := ""; ; {
+			var items struct {
+				Items []struct {
+					UUID      string    `json:"uuid"`
+					CreatedAt time.Time `json:"created_at"`
+				} `json:"items"`
+			}
+			err = client.RequestAndDecode(&items, "GET", list.path, nil, arvados.ResourceListParams{
+				Select:  []string{"uuid", "created_at"},
+				Filters: append(filters, arvados.Filter{Attr: "uuid", Operator: ">", Operand: lastUUID}),
+				Limit:   &limit,
+				Order:   "uuid",
+				Count:   "none",
+			})
+			if err != nil {
+				return s3APIError(err, "AccessDenied")
+			}
+			if len(items.Items) == 0 {
+				break
+			}
+			for _, item := range items.Items {
+				resp.Buckets = append(resp.Buckets, s3Bucket{
+					Name:         item.UUID,
+					CreationDate: item.CreatedAt.UTC().Format(s3LastModifiedTime),
+				})
+			}
+			lastUUID = items.Items[len(items.Items)-1].UUID
+		}
+	}
+	return s3WriteXML(w, http.StatusOK, resp)
+}
+
+func (h *handler) s3HeadBucket(w http.ResponseWriter, client *arvados.Client, kc *keepclient.KeepClient, id string) error {
+	fs := client.SiteFileSystem(kc)
+	if _, err := fs.Stat("/by_id/" + id); os.IsNotExist(err) {
+		return newS3Error(http.StatusNotFound, "NoSuchBucket", err.Error())
+	} else if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (h *handler) s3GetObject(w http.ResponseWriter, r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, id, key string) error {
+	fs := client.SiteFileSystem(kc)
+	fs.SetReadAhead(h.readAhead())
+	f, err := fs.Open("/by_id/" + id + "/" + key)
+	if os.IsNotExist(err) {
+		return newS3Error(http.StatusNotFound, "NoSuchKey", err.Error())
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() != strings.HasSuffix(key, "/") {
+		// "foo/" refers to a directory (as created by
+		// PutObject with a trailing slash), "foo" refers to a
+		// file.
+		return newS3Error(http.StatusNotFound, "NoSuchKey", "no such key")
+	}
+	if fi.IsDir() {
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	return nil
+}
+
+// s3WriteObject handles PutObject and DeleteObject requests.
+func (h *handler) s3WriteObject(w http.ResponseWriter, r *http.Request, arv *arvadosclient.ArvadosClient, client *arvados.Client, kc *keepclient.KeepClient, id, key string) error {
+	coll, fspath, err := h.s3Collection(arv, client, id, key, r.Method == "PUT")
+	if os.IsNotExist(err) && r.Method == "DELETE" {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	fs, err := coll.FileSystem(client, kc)
+	if err != nil {
+		return err
+	}
+	if r.Method == "DELETE" {
+		err = fs.Remove("/" + strings.TrimSuffix(fspath, "/"))
+		if os.IsNotExist(err) {
+			// S3 reports success when deleting a
+			// nonexistent object.
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		} else if err != nil {
+			return newS3Error(http.StatusConflict, "InvalidRequest", err.Error())
+		}
+	} else {
+		err = s3PutFile(fs, fspath, r)
+		if err != nil {
+			return err
+		}
+	}
+	err = h.Config.Cache.Update(client, *coll, fs)
+	if err != nil {
+		return s3APIError(err, "NoSuchBucket")
+	}
+	if r.Method == "DELETE" {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	return nil
+}
+
+// s3PutFile writes the request body to the given path in fs,
+// creating parent directories as needed. If fspath ends with "/", it
+// creates a directory instead.
+func s3PutFile(fs arvados.FileSystem, fspath string, r *http.Request) error {
+	dirs := strings.Split(fspath, "/")
+	dirs = dirs[:len(dirs)-1]
+	for i := range dirs {
+		err := fs.Mkdir("/"+strings.Join(dirs[:i+1], "/"), 0755)
+		if err != nil && !os.IsExist(err) {
+			return newS3Error(http.StatusConflict, "InvalidRequest", err.Error())
+		}
+	}
+	if strings.HasSuffix(fspath, "/") {
+		return nil
+	}
+
+	var hasher hash.Hash
+	var wantHash string
+	switch payload := r.Header.Get("X-Amz-Content-Sha256"); {
+	case payload == "" || payload == s3UnsignedPayload:
+	case strings.HasPrefix(payload, "STREAMING-"):
+		return newS3Error(http.StatusNotImplemented, "NotImplemented", "chunked uploads are not supported")
+	default:
+		hasher, wantHash = sha256.New(), payload
+	}
+	f, err := fs.OpenFile("/"+fspath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return newS3Error(http.StatusConflict, "InvalidRequest", err.Error())
+	}
+	defer f.Close()
+	var body io.Reader = r.Body
+	if hasher != nil {
+		body = io.TeeReader(body, hasher)
+	}
+	_, err = io.Copy(f, body)
+	if err != nil {
+		return err
+	}
+	if hasher != nil && fmt.Sprintf("%x", hasher.Sum(nil)) != wantHash {
+		return newS3Error(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "request body does not match X-Amz-Content-Sha256 header")
+	}
+	return f.Close()
+}
+
+// s3Collection returns the writable collection that contains the
+// given object, and the object's path within that collection. In a
+// project bucket, the first component of the key is the name of a
+// collection in the project; if create is true and there is no such
+// collection, it is created.
+func (h *handler) s3Collection(arv *arvadosclient.ArvadosClient, client *arvados.Client, id, key string, create bool) (*arvados.Collection, string, error) {
+	if _, _, isVersion := arvados.ParseCollectionVersion(id); isVersion || arvadosclient.PDHMatch(id) {
+		return nil, "", newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", errReadOnly.Error())
+	}
+	if strings.Contains(id, "-4zz18-") {
+		coll, err := h.Config.Cache.Get(arv, id, true)
+		if err != nil {
+			return nil, "", s3APIError(err, "NoSuchBucket")
+		}
+		return coll, key, nil
+	}
+	name, fspath := key, ""
+	if i := strings.Index(key, "/"); i >= 0 {
+		name, fspath = key[:i], key[i+1:]
+	}
+	if fspath == "" {
+		return nil, "", newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "cannot write a project entry (key must be \"{collection name}/{path}\")")
+	}
+	var colls arvados.CollectionList
+	err := client.RequestAndDecode(&colls, "GET", "arvados/v1/collections", nil, arvados.ResourceListParams{
+		Filters: []arvados.Filter{
+			{Attr: "owner_uuid", Operator: "=", Operand: id},
+			{Attr: "name", Operator: "=", Operand: name},
+		},
+	})
+	if err != nil {
+		return nil, "", s3APIError(err, "NoSuchBucket")
+	}
+	if len(colls.Items) > 0 {
+		return &colls.Items[0], fspath, nil
+	}
+	if !create {
+		return nil, "", os.ErrNotExist
+	}
+	var coll arvados.Collection
+	err = client.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"owner_uuid": id,
+			"name":       name,
+		},
+	})
+	if err != nil {
+		return nil, "", s3APIError(err, "NoSuchBucket")
+	}
+	return &coll, fspath, nil
+}
+
+func (h *handler) s3ListObjects(w http.ResponseWriter, r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, bucket, id string) error {
+	q := r.URL.Query()
+	resp := s3ListBucketResult{
+		Xmlns:     s3XMLNamespace,
+		Name:      bucket,
+		Prefix:    q.Get("prefix"),
+		Delimiter: q.Get("delimiter"),
+		MaxKeys:   s3MaxKeys,
+	}
+	if mk, err := strconv.Atoi(q.Get("max-keys")); err == nil && mk >= 0 && mk < s3MaxKeys {
+		resp.MaxKeys = mk
+	}
+	var marker string
+	if q.Get("list-type") == "2" {
+		resp.ContinuationToken = q.Get("continuation-token")
+		resp.StartAfter = q.Get("start-after")
+		marker = resp.StartAfter
+		if resp.ContinuationToken != "" {
+			marker = resp.ContinuationToken
+		}
+		resp.KeyCount = new(int)
+	} else {
+		marker = q.Get("marker")
+		resp.Marker = &marker
+	}
+
+	fs := client.SiteFileSystem(kc)
+	root := "/by_id/" + id
+	if _, err := fs.Stat(root); os.IsNotExist(err) {
+		return newS3Error(http.StatusNotFound, "NoSuchBucket", err.Error())
+	} else if err != nil {
+		return err
+	}
+	// last is the last key or common prefix added to the
+	// response.
+	var last string
+	full := func() bool {
+		if len(resp.Contents)+len(resp.CommonPrefixes) >= resp.MaxKeys {
+			resp.IsTruncated = true
+			return true
+		}
+		return false
+	}
+	commonPrefixes := map[string]bool{}
+	err := s3Walk(fs, root, resp.Prefix, marker, resp.Delimiter == "/", func(key string, fi os.FileInfo) error {
+		if resp.Delimiter != "" {
+			if i := strings.Index(key[len(resp.Prefix):], resp.Delimiter); i >= 0 {
+				cp := key[:len(resp.Prefix)+i+len(resp.Delimiter)]
+				if cp <= marker || commonPrefixes[cp] {
+					return nil
+				}
+				if full() {
+					return errS3Done
+				}
+				commonPrefixes[cp] = true
+				resp.CommonPrefixes = append(resp.CommonPrefixes, s3CommonPrefix{cp})
+				last = cp
+				return nil
+			}
+		}
+		if fi.IsDir() {
+			// Only reported as a common prefix.
+			return nil
+		}
+		if full() {
+			return errS3Done
+		}
+		last = key
+		resp.Contents = append(resp.Contents, s3Object{
+			Key:          key,
+			LastModified: fi.ModTime().UTC().Format(s3LastModifiedTime),
+			Size:         fi.Size(),
+			StorageClass: "STANDARD",
+		})
+		return nil
+	})
+	if err != nil && err != errS3Done {
+		return err
+	}
+	if resp.IsTruncated {
+		if resp.KeyCount != nil {
+			resp.NextContinuationToken = last
+		} else {
+			resp.NextMarker = last
+		}
+	}
+	if resp.KeyCount != nil {
+		*resp.KeyCount = len(resp.Contents) + len(resp.CommonPrefixes)
+	}
+	return s3WriteXML(w, http.StatusOK, resp)
+}
+
+// s3Walk calls fn, in lexical order of keys, for each file below root
+// whose key (path relative to root) starts with prefix and sorts
+// after marker. Directories are skipped when no such keys can be
+// found inside them.
+//
+// If dirsAsPrefixes is true, fn is called with key "dir/" for
+// directories that start with (but are not equal to) prefix, instead
+// of walking them.
+func s3Walk(fs arvados.FileSystem, root, prefix, marker string, dirsAsPrefixes bool, fn func(key string, fi os.FileInfo) error) error {
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		f, err := fs.Open(root + "/" + strings.TrimSuffix(dir, "/"))
+		if err != nil {
+			return err
+		}
+		ents, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		keys := make([]string, len(ents))
+		for i, fi := range ents {
+			keys[i] = dir + fi.Name()
+			if fi.IsDir() {
+				keys[i] += "/"
+			}
+		}
+		sort.Sort(byKey{keys, ents})
+		for i, fi := range ents {
+			key := keys[i]
+			if !fi.IsDir() {
+				if strings.HasPrefix(key, prefix) && key > marker {
+					if err := fn(key, fi); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+				// No keys in this dir can start with
+				// prefix.
+				continue
+			}
+			if key < marker && !strings.HasPrefix(marker, key) {
+				// All keys in this dir sort before
+				// marker.
+				continue
+			}
+			if dirsAsPrefixes && strings.HasPrefix(key, prefix) && key != prefix {
+				err = fn(key, fi)
+			} else {
+				err = walk(key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk("")
+}
+
+// byKey sorts directory entries by the corresponding keys.
+type byKey struct {
+	keys []string
+	ents []os.FileInfo
+}
+
+func (s byKey) Len() int           { return len(s.keys) }
+func (s byKey) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+func (s byKey) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.ents[i], s.ents[j] = s.ents[j], s.ents[i]
+}
+
+// s3SecretCache remembers the secret keys (and corresponding
+// tokens) of recently used access keys that are token UUIDs, so each
+// request doesn't need an API call with the root token. Unknown
+// access keys are remembered too, for a shorter time.
+type s3SecretCache struct {
+	entries map[string]*cachedS3Secret
+	mtx     sync.Mutex
+}
+
+type cachedS3Secret struct {
+	expire time.Time
+	secret string
+	token  string
+	err    *s3Error
+}
+
+// s3Secret returns the secret key and Arvados token for an access key
+// that is a token UUID. Positive results are cached for
+// WebDAVCache.TTL, negative results for WebDAVCache.UUIDTTL.
+func (h *handler) s3Secret(arv *arvadosclient.ArvadosClient, accessKey string) (string, string, error) {
+	h.s3Secrets.mtx.Lock()
+	if h.s3Secrets.entries == nil {
+		h.s3Secrets.entries = map[string]*cachedS3Secret{}
+	}
+	ent := h.s3Secrets.entries[accessKey]
+	h.s3Secrets.mtx.Unlock()
+	if ent != nil && time.Now().Before(ent.expire) {
+		return ent.result()
+	}
+
+	rootClient := &arvados.Client{
+		APIHost:   arv.ApiServer,
+		AuthToken: h.Config.cluster.SystemRootToken,
+		Insecure:  arv.ApiInsecure,
+	}
+	var aca arvados.APIClientAuthorization
+	err := rootClient.RequestAndDecode(&aca, "GET", "arvados/v1/api_client_authorizations/"+accessKey, nil, nil)
+	ent = &cachedS3Secret{secret: aca.APIToken, token: aca.TokenV2()}
+	ttl := h.Config.cluster.Collections.WebDAVCache.TTL
+	if err != nil {
+		s3err, ok := s3APIError(err, "InvalidAccessKeyId").(*s3Error)
+		if !ok {
+			// Don't cache transient errors.
+			log.Printf("error looking up access key %s: %s", accessKey, err)
+			return "", "", newS3Error(http.StatusServiceUnavailable, "ServiceUnavailable", "error looking up access key")
+		}
+		ent = &cachedS3Secret{err: s3err}
+		ttl = h.Config.cluster.Collections.WebDAVCache.UUIDTTL
+	}
+
+	h.s3Secrets.mtx.Lock()
+	defer h.s3Secrets.mtx.Unlock()
+	now := time.Now()
+	for key, ent := range h.s3Secrets.entries {
+		if now.After(ent.expire) {
+			delete(h.s3Secrets.entries, key)
+		}
+	}
+	ent.expire = now.Add(time.Duration(ttl))
+	h.s3Secrets.entries[accessKey] = ent
+	return ent.result()
+}
+
+// result returns the cached secret and token, or a copy of the
+// cached error (which the caller can modify).
+func (ent *cachedS3Secret) result() (string, string, error) {
+	if ent.err != nil {
+		err := *ent.err
+		return "", "", &err
+	}
+	return ent.secret, ent.token, nil
+}
+
+// s3checksig checks the request's AWS Signature Version 4, and
+// returns the Arvados token that the client used as its secret key.
+//
+// The access key ID can be either the UUID of an Arvados token (in
+// which case the secret key is the token's secret part) or the same
+// string as the secret key (in which case the secret key is a
+// complete Arvados token).
+//
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (h *handler) s3checksig(arv *arvadosclient.ArvadosClient, r *http.Request) (string, error) {
+	authstring := strings.TrimPrefix(r.Header.Get("Authorization"), s3SignAlgorithm+" ")
+	var credential, signedHeaders, signature string
+	for _, field := range strings.Split(authstring, ",") {
+		field = strings.TrimSpace(field)
+		if i := strings.Index(field, "="); i > 0 {
+			switch field[:i] {
+			case "Credential":
+				credential = field[i+1:]
+			case "SignedHeaders":
+				signedHeaders = field[i+1:]
+			case "Signature":
+				signature = field[i+1:]
+			}
+		}
+	}
+	// The credential is "{access key}/{date}/{region}/s3/aws4_request".
+	// The access key itself can contain "/" (e.g., a v2 token
+	// "v2/{uuid}/{secret}"), so the scope is taken from the end.
+	parts := strings.Split(credential, "/")
+	if len(parts) < 5 || signedHeaders == "" || signature == "" {
+		return "", newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "malformed Authorization header")
+	}
+	accessKey := strings.Join(parts[:len(parts)-4], "/")
+	scope := strings.Join(parts[len(parts)-4:], "/")
+	if parts[len(parts)-2] != "s3" || parts[len(parts)-1] != "aws4_request" {
+		return "", newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "credential scope must be {date}/{region}/s3/aws4_request")
+	}
+
+	timestamp, err := time.Parse(s3TimestampFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return "", newS3Error(http.StatusForbidden, "AccessDenied", "missing or invalid X-Amz-Date header")
+	}
+	if skew := time.Since(timestamp); skew > s3MaxClockSkew || skew < -s3MaxClockSkew {
+		return "", newS3Error(http.StatusForbidden, "RequestTimeTooSkewed", "request time is too far from server time")
+	}
+	if parts[len(parts)-4] != timestamp.Format("20060102") {
+		return "", newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "credential scope date does not match X-Amz-Date")
+	}
+
+	secret, token := accessKey, accessKey
+	if arvadosclient.UUIDMatch(accessKey) && strings.Contains(accessKey, "-gj3su-") {
+		if h.Config.cluster.SystemRootToken == "" {
+			return "", newS3Error(http.StatusForbidden, "InvalidAccessKeyId", "token UUIDs cannot be used as access keys because SystemRootToken is not configured")
+		}
+		secret, token, err = h.s3Secret(arv, accessKey)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	stringToSign, err := s3StringToSign(r, scope, signedHeaders)
+	if err != nil {
+		return "", err
+	}
+	expect := s3Signature(secret, scope, stringToSign)
+	if !hmac.Equal([]byte(expect), []byte(signature)) {
+		return "", newS3Error(http.StatusForbidden, "SignatureDoesNotMatch", "request signature does not match")
+	}
+	return token, nil
+}
+
+// s3StringToSign returns the string the client should have signed,
+// given the credential scope ("date/region/s3/aws4_request") and the
+// list of signed headers.
+func s3StringToSign(r *http.Request, scope, signedHeaders string) (string, error) {
+	var canonicalHeaders string
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else if vals, ok := r.Header[http.CanonicalHeaderKey(name)]; ok {
+			value = strings.Join(vals, ",")
+		} else {
+			return "", newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "signed header "+name+" is missing")
+		}
+		canonicalHeaders += name + ":" + strings.Join(strings.Fields(value), " ") + "\n"
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = fmt.Sprintf("%x", sha256.Sum256(nil))
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s3Escape(r.URL.Path, false),
+		s3CanonicalQuery(r.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	return strings.Join([]string{
+		s3SignAlgorithm,
+		r.Header.Get("X-Amz-Date"),
+		scope,
+		fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest))),
+	}, "\n"), nil
+}
+
+// s3CanonicalQuery returns the canonical query string: parameters
+// sorted by (escaped) name, then value.
+func s3CanonicalQuery(query url.Values) string {
+	var params [][2]string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, [2]string{s3Escape(k, true), s3Escape(v, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	var buf strings.Builder
+	for i, p := range params {
+		if i > 0 {
+			buf.WriteString("&")
+		}
+		buf.WriteString(p[0] + "=" + p[1])
+	}
+	return buf.String()
+}
+
+// s3Signature returns the hex-encoded signature of stringToSign,
+// using a signing key derived from the secret key and credential
+// scope.
+func s3Signature(secret, scope, stringToSign string) string {
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, data)
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes s as specified for SigV4 canonical
+// requests: all bytes except unreserved characters, and "/" unless
+// escapeSlash is true.
+func s3Escape(s string, escapeSlash bool) string {
+	var out strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '.', c == '_', c == '~',
+			c == '/' && !escapeSlash:
+			out.WriteByte(c)
+		default:
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,332 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+// s3sign adds AWS Signature Version 4 headers to req, the way an S3
+// client would.
+func s3sign(req *http.Request, accessKey, secret string, body []byte) {
+	now := time.Now().UTC()
+	scope := now.Format("20060102") + "/zzzzz/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", now.Format(s3TimestampFormat))
+	req.Header.Set("X-Amz-Content-Sha256", fmt.Sprintf("%x", sha256.Sum256(body)))
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	stringToSign, err := s3StringToSign(req, scope, signedHeaders)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignAlgorithm, accessKey, scope, signedHeaders, s3Signature(secret, scope, stringToSign)))
+}
+
+func (s *UnitSuite) TestS3Signature(c *check.C) {
+	// Example from
+	// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+	req, err := http.NewRequest("GET", "https://examplebucket.s3.amazonaws.com/test.txt", nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Range", "bytes=0-9")
+	req.Header.Set("X-Amz-Content-Sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	req.Header.Set("X-Amz-Date", "20130524T000000Z")
+	scope := "20130524/us-east-1/s3/aws4_request"
+	stringToSign, err := s3StringToSign(req, scope, "host;range;x-amz-content-sha256;x-amz-date")
+	c.Assert(err, check.IsNil)
+	c.Check(s3Signature("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", scope, stringToSign), check.Equals, "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41")
+}
+
+func (s *UnitSuite) TestS3CheckSignature(c *check.C) {
+	h := handler{Config: newConfig(s.Config)}
+	for _, trial := range []struct {
+		mangle func(*http.Request)
+		code   string
+	}{
+		{func(req *http.Request) {}, ""},
+		{func(req *http.Request) { req.URL.Path = "/other" }, "SignatureDoesNotMatch"},
+		{func(req *http.Request) { req.Header.Set("Authorization", s3SignAlgorithm+" Credential=foo") }, "AuthorizationHeaderMalformed"},
+		{func(req *http.Request) {
+			req.Header.Set("X-Amz-Date", time.Now().Add(-time.Hour).UTC().Format(s3TimestampFormat))
+		}, "RequestTimeTooSkewed"},
+		{func(req *http.Request) {
+			today := time.Now().UTC().Format("20060102")
+			yesterday := time.Now().UTC().Add(-24 * time.Hour).Format("20060102")
+			req.Header.Set("Authorization", strings.Replace(req.Header.Get("Authorization"), "/"+today+"/", "/"+yesterday+"/", 1))
+		}, "AuthorizationHeaderMalformed"},
+		{func(req *http.Request) {
+			req.Header.Set("Authorization", strings.Replace(req.Header.Get("Authorization"), "/s3/", "/ec2/", 1))
+		}, "AuthorizationHeaderMalformed"},
+	} {
+		req, err := http.NewRequest("GET", "http://keep-web.example/"+arvadostest.FooCollection+"/foo", nil)
+		c.Assert(err, check.IsNil)
+		s3sign(req, arvadostest.ActiveToken, arvadostest.ActiveToken, nil)
+		trial.mangle(req)
+		token, err := h.s3checksig(nil, req)
+		if trial.code == "" {
+			c.Check(err, check.IsNil)
+			c.Check(token, check.Equals, arvadostest.ActiveToken)
+		} else if c.Check(err, check.FitsTypeOf, &s3Error{}) {
+			c.Check(err.(*s3Error).Code, check.Equals, trial.code)
+		}
+	}
+
+	// A v2 token (which contains "/") as the access key.
+	req, err := http.NewRequest("GET", "http://keep-web.example/"+arvadostest.FooCollection+"/foo?b=1&a-b=2&a=3", nil)
+	c.Assert(err, check.IsNil)
+	s3sign(req, arvadostest.ActiveTokenV2, arvadostest.ActiveTokenV2, nil)
+	token, err := h.s3checksig(nil, req)
+	c.Check(err, check.IsNil)
+	c.Check(token, check.Equals, arvadostest.ActiveTokenV2)
+}
+
+func (s *UnitSuite) TestS3SecretCache(c *check.C) {
+	var lookups int32
+	apiStub := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		c.Check(r.Header.Get("Authorization"), check.Equals, "OAuth2 root-token")
+		switch r.URL.Path {
+		case "/arvados/v1/api_client_authorizations/zzzzz-gj3su-000000000000001":
+			w.Write([]byte(`{"uuid":"zzzzz-gj3su-000000000000001","api_token":"secret1"}`))
+		case "/arvados/v1/api_client_authorizations/zzzzz-gj3su-000000000000002":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":["not found"]}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"errors":["bad gateway"]}`))
+		}
+	}))
+	defer apiStub.Close()
+	arv := &arvadosclient.ArvadosClient{
+		ApiServer:   strings.TrimPrefix(apiStub.URL, "https://"),
+		ApiInsecure: true,
+	}
+
+	h := handler{Config: newConfig(s.Config)}
+	h.Config.cluster.SystemRootToken = "root-token"
+	h.Config.cluster.Collections.WebDAVCache.TTL = arvados.Duration(time.Minute)
+	h.Config.cluster.Collections.WebDAVCache.UUIDTTL = arvados.Duration(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		secret, token, err := h.s3Secret(arv, "zzzzz-gj3su-000000000000001")
+		c.Check(err, check.IsNil)
+		c.Check(secret, check.Equals, "secret1")
+		c.Check(token, check.Equals, "v2/zzzzz-gj3su-000000000000001/secret1")
+	}
+	c.Check(atomic.LoadInt32(&lookups), check.Equals, int32(1))
+
+	for i := 0; i < 3; i++ {
+		_, _, err := h.s3Secret(arv, "zzzzz-gj3su-000000000000002")
+		if c.Check(err, check.FitsTypeOf, &s3Error{}) {
+			c.Check(err.(*s3Error).Code, check.Equals, "InvalidAccessKeyId")
+		}
+	}
+	c.Check(atomic.LoadInt32(&lookups), check.Equals, int32(2))
+
+	// Transient errors are reported as S3 errors, and not
+	// cached.
+	for i := 0; i < 2; i++ {
+		_, _, err := h.s3Secret(arv, "zzzzz-gj3su-000000000000003")
+		if c.Check(err, check.FitsTypeOf, &s3Error{}) {
+			c.Check(err.(*s3Error).Code, check.Equals, "ServiceUnavailable")
+			c.Check(err.(*s3Error).status, check.Equals, http.StatusServiceUnavailable)
+		}
+	}
+	c.Check(atomic.LoadInt32(&lookups), check.Equals, int32(4))
+
+	// Expired entries are looked up again.
+	h.s3Secrets.entries["zzzzz-gj3su-000000000000001"].expire = time.Now().Add(-time.Second)
+	_, _, err := h.s3Secret(arv, "zzzzz-gj3su-000000000000001")
+	c.Check(err, check.IsNil)
+	c.Check(atomic.LoadInt32(&lookups), check.Equals, int32(5))
+}
+
+func (s *UnitSuite) TestS3CanonicalQuery(c *check.C) {
+	for _, trial := range []struct {
+		query  string
+		expect string
+	}{
+		{"", ""},
+		{"b=1&a-b=2&a=3", "a=3&a-b=2&b=1"},
+		{"a=2&a=1&prefix=x y", "a=1&a=2&prefix=x%20y"},
+		{"list-type=2&delimiter=/", "delimiter=%2F&list-type=2"},
+	} {
+		q, err := url.ParseQuery(trial.query)
+		c.Assert(err, check.IsNil)
+		c.Check(s3CanonicalQuery(q), check.Equals, trial.expect)
+	}
+}
+
+func (s *UnitSuite) TestS3Walk(c *check.C) {
+	fs, err := (&arvados.Collection{}).FileSystem(nil, nil)
+	c.Assert(err, check.IsNil)
+	for _, dir := range []string{"a", "a/b", "a-b", "c"} {
+		c.Assert(fs.Mkdir(dir, 0755), check.IsNil)
+	}
+	for _, fnm := range []string{"a0", "a/b/f", "a/f", "a-b/f", "c/f"} {
+		f, err := fs.OpenFile(fnm, os.O_CREATE|os.O_WRONLY, 0644)
+		c.Assert(err, check.IsNil)
+		f.Close()
+	}
+	for _, trial := range []struct {
+		prefix, marker string
+		dirsAsPrefixes bool
+		expect         []string
+	}{
+		{"", "", false, []string{"a-b/f", "a/b/f", "a/f", "a0", "c/f"}},
+		{"a/", "", false, []string{"a/b/f", "a/f"}},
+		{"a", "a/b/f", false, []string{"a/f", "a0"}},
+		{"", "", true, []string{"a-b/", "a/", "a0", "c/"}},
+		{"a/", "", true, []string{"a/b/", "a/f"}},
+	} {
+		var keys []string
+		err := s3Walk(fs, "", trial.prefix, trial.marker, trial.dirsAsPrefixes, func(key string, fi os.FileInfo) error {
+			keys = append(keys, key)
+			return nil
+		})
+		c.Check(err, check.IsNil)
+		c.Check(keys, check.DeepEquals, trial.expect, check.Commentf("%+v", trial))
+	}
+}
+
+func (s *IntegrationSuite) s3request(c *check.C, method, path string, body []byte, hdr http.Header) *http.Response {
+	req, err := http.NewRequest(method, "http://"+s.testServer.Addr+path, bytes.NewReader(body))
+	c.Assert(err, check.IsNil)
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	s3sign(req, arvadostest.ActiveToken, arvadostest.ActiveToken, body)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	return resp
+}
+
+func (s *IntegrationSuite) TestS3GetObject(c *check.C) {
+	resp := s.s3request(c, "GET", "/"+arvadostest.FooCollection+"/foo", nil, nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	buf, _ := ioutil.ReadAll(resp.Body)
+	c.Check(string(buf), check.Equals, "foo")
+
+	resp = s.s3request(c, "GET", "/"+arvadostest.FooCollection+"/foo", nil, http.Header{"Range": {"bytes=1-2"}})
+	c.Check(resp.StatusCode, check.Equals, http.StatusPartialContent)
+	buf, _ = ioutil.ReadAll(resp.Body)
+	c.Check(string(buf), check.Equals, "oo")
+
+	resp = s.s3request(c, "HEAD", "/"+strings.Replace(arvadostest.FooCollectionPDH, "+", "-", 1)+"/foo", nil, nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Check(resp.ContentLength, check.Equals, int64(3))
+
+	resp = s.s3request(c, "GET", "/"+arvadostest.FooCollection+"/nonexistent", nil, nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusNotFound)
+	var s3err s3Error
+	c.Check(xml.NewDecoder(resp.Body).Decode(&s3err), check.IsNil)
+	c.Check(s3err.Code, check.Equals, "NoSuchKey")
+}
+
+func (s *IntegrationSuite) TestS3ListObjects(c *check.C) {
+	for _, trial := range []struct {
+		query          string
+		keys, prefixes []string
+		truncated      bool
+	}{
+		{"", []string{"dir1/bar", "dir1/foo"}, nil, false},
+		{"?list-type=2&delimiter=/", nil, []string{"dir1/"}, false},
+		{"?list-type=2&prefix=dir1/&delimiter=/", []string{"dir1/bar", "dir1/foo"}, nil, false},
+		{"?list-type=2&max-keys=1", []string{"dir1/bar"}, nil, true},
+		{"?list-type=2&continuation-token=dir1/bar", []string{"dir1/foo"}, nil, false},
+		{"?marker=dir1/foo", nil, nil, false},
+	} {
+		resp := s.s3request(c, "GET", "/"+arvadostest.FooAndBarFilesInDirUUID+"/"+trial.query, nil, nil)
+		c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+		var list s3ListBucketResult
+		c.Assert(xml.NewDecoder(resp.Body).Decode(&list), check.IsNil)
+		var keys, prefixes []string
+		for _, obj := range list.Contents {
+			keys = append(keys, obj.Key)
+		}
+		for _, cp := range list.CommonPrefixes {
+			prefixes = append(prefixes, cp.Prefix)
+		}
+		c.Check(keys, check.DeepEquals, trial.keys, check.Commentf("%s", trial.query))
+		c.Check(prefixes, check.DeepEquals, trial.prefixes, check.Commentf("%s", trial.query))
+		c.Check(list.IsTruncated, check.Equals, trial.truncated, check.Commentf("%s", trial.query))
+	}
+}
+
+func (s *IntegrationSuite) TestS3PutDeleteObject(c *check.C) {
+	var coll arvados.Collection
+	arv := arvados.NewClientFromEnv()
+	arv.AuthToken = arvadostest.ActiveToken
+	err := arv.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{"collection": map[string]interface{}{}})
+	c.Assert(err, check.IsNil)
+
+	resp := s.s3request(c, "PUT", "/"+coll.UUID+"/dir/newfile", []byte("new data"), nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	resp = s.s3request(c, "GET", "/"+coll.UUID+"/dir/newfile", nil, nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	buf, _ := ioutil.ReadAll(resp.Body)
+	c.Check(string(buf), check.Equals, "new data")
+
+	err = arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.ManifestText, check.Matches, `\./dir [0-9a-f]{32}\+8\S* 0:8:newfile\n`)
+
+	// Wrong payload hash
+	req, err := http.NewRequest("PUT", "http://"+s.testServer.Addr+"/"+coll.UUID+"/badfile", strings.NewReader("bad data"))
+	c.Assert(err, check.IsNil)
+	s3sign(req, arvadostest.ActiveToken, arvadostest.ActiveToken, []byte("good data"))
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusBadRequest)
+
+	// Read-only bucket
+	resp = s.s3request(c, "PUT", "/"+strings.Replace(arvadostest.FooCollectionPDH, "+", "-", 1)+"/newfile", []byte("new data"), nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusMethodNotAllowed)
+
+	resp = s.s3request(c, "DELETE", "/"+coll.UUID+"/dir/newfile", nil, nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusNoContent)
+	resp = s.s3request(c, "GET", "/"+coll.UUID+"/dir/newfile", nil, nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusNotFound)
+	resp = s.s3request(c, "DELETE", "/"+coll.UUID+"/dir/newfile", nil, nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusNoContent)
+}
+
+func (s *IntegrationSuite) TestS3ProjectBucket(c *check.C) {
+	name := fmt.Sprintf("s3 test %d", time.Now().UnixNano())
+	resp := s.s3request(c, "PUT", "/"+arvadostest.AProjectUUID+"/"+name+"/file", []byte("data"), nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	resp = s.s3request(c, "GET", "/"+arvadostest.AProjectUUID+"/"+name+"/file", nil, nil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	buf, _ := ioutil.ReadAll(resp.Body)
+	c.Check(string(buf), check.Equals, "data")
+}
+
+func (s *IntegrationSuite) TestS3ListBuckets(c *check.C) {
+	resp := s.s3request(c, "GET", "/", nil, nil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var list s3ListAllMyBucketsResult
+	c.Assert(xml.NewDecoder(resp.Body).Decode(&list), check.IsNil)
+	c.Check(list.Owner.ID, check.Equals, arvadostest.ActiveUserUUID)
+	found := false
+	for _, b := range list.Buckets {
+		found = found || b.Name == arvadostest.AProjectUUID
+	}
+	c.Check(found, check.Equals, true)
+}
@@ -11,6 +11,7 @@ import (
 	"git.curoverse.com/arvados.git/sdk/go/arvados"
 	"git.curoverse.com/arvados.git/sdk/go/ctxlog"
 	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
@@ -22,8 +23,14 @@ type server struct {
 
 func (srv *server) Start() error {
 	h := &handler{Config: srv.Config}
+	auditLog, err := newAuditLogger(srv.Config.cluster)
+	if err != nil {
+		return err
+	}
+	h.auditLog = auditLog
 	reg := prometheus.NewRegistry()
 	h.Config.Cache.registry = reg
+	reg.MustRegister(keepclient.NewServerStatsCollector("keepweb"))
 	ctx := ctxlog.Context(context.Background(), logrus.StandardLogger())
 	mh := httpserver.Instrument(reg, nil, httpserver.HandlerWithContext(ctx, httpserver.AddRequestIDs(httpserver.LogRequests(h))))
 	h.MetricsAPI = mh.ServeAPI(h.Config.cluster.ManagementToken, http.NotFoundHandler())
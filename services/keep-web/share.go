@@ -0,0 +1,335 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/auth"
+)
+
+// Share links are recorded as links with this link_class, so users
+// can list and revoke (delete) them using the Arvados API.
+const shareLinkClass = "keep-web-share"
+
+var (
+	errShareInvalid = errors.New("invalid share link")
+	errShareExpired = errors.New("share link has expired")
+	errShareRevoked = errors.New("share link has been revoked")
+)
+
+// shareSignature returns the signature for a share link that allows
+// read-only access to the given collection, at and below prefix,
+// until the given expiry time (hex-encoded Unix timestamp).
+func shareSignature(key []byte, linkUUID, expiryHex, collectionID, prefix string) string {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, linkUUID+"@"+expiryHex+"@"+collectionID+"@"+prefix)
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// makeShareToken returns the "share=..." path component for a share
+// link.
+func makeShareToken(key []byte, linkUUID string, expiry time.Time, collectionID, prefix string) string {
+	expiryHex := fmt.Sprintf("%08x", expiry.Unix())
+	return "share=" + linkUUID + "." + expiryHex + "." + shareSignature(key, linkUUID, expiryHex, collectionID, prefix)
+}
+
+// verifyShareToken checks that share (the part of the "share=..."
+// path component after "=") grants access to targetPath in the given
+// collection, and returns the share link's UUID.
+//
+// The signed path prefix is not included in the share token: it is
+// whichever leading part of targetPath makes the signature valid.
+func verifyShareToken(key []byte, share, collectionID string, targetPath []string) (string, error) {
+	parts := strings.Split(share, ".")
+	if len(parts) != 3 || len(key) == 0 {
+		return "", errShareInvalid
+	}
+	linkUUID, expiryHex, sig := parts[0], parts[1], parts[2]
+	expiry, err := strconv.ParseInt(expiryHex, 16, 64)
+	if err != nil {
+		return "", errShareInvalid
+	}
+	for _, elt := range targetPath {
+		if elt == "." || elt == ".." {
+			return "", errShareInvalid
+		}
+	}
+	for i := 0; i <= len(targetPath); i++ {
+		prefix := strings.Join(targetPath[:i], "/")
+		if hmac.Equal([]byte(sig), []byte(shareSignature(key, linkUUID, expiryHex, collectionID, prefix))) {
+			if time.Now().Unix() > expiry {
+				return "", errShareExpired
+			}
+			return linkUUID, nil
+		}
+	}
+	return "", errShareInvalid
+}
+
+// Share link tokens remain valid for this long after they are last
+// used for new requests, so requests in progress can finish (and to
+// allow for clock skew between keep-web and the API server).
+const shareTokenSlack = 5 * time.Minute
+
+// shareLinkCache remembers which share links were recently confirmed
+// to exist (i.e., not revoked), and the tokens used to serve them.
+type shareLinkCache struct {
+	confirmed map[string]*confirmedShareLink
+	mtx       sync.Mutex
+}
+
+type confirmedShareLink struct {
+	expire time.Time
+	token  string
+}
+
+// checkShareLink returns errShareRevoked if the given share link no
+// longer exists. Otherwise, it returns a token that can be used to
+// serve the share link: an API token for the user who created the
+// link, which is only allowed to read the given collection. Serving
+// the link with that token (instead of a more powerful one) ensures
+// the link stops working if its creator loses permission to read the
+// collection.
+//
+// Results are cached for WebDAVCache.TTL, so revoking a link can take
+// that long to take effect.
+func (h *handler) checkShareLink(arv *arvadosclient.ArvadosClient, linkUUID, collectionID string) (string, error) {
+	if h.Config.cluster.SystemRootToken == "" {
+		return "", errShareInvalid
+	}
+	h.shareLinks.mtx.Lock()
+	if h.shareLinks.confirmed == nil {
+		h.shareLinks.confirmed = map[string]*confirmedShareLink{}
+	}
+	ent := h.shareLinks.confirmed[linkUUID]
+	h.shareLinks.mtx.Unlock()
+	if ent != nil && time.Now().Before(ent.expire) {
+		return ent.token, nil
+	}
+
+	client := &arvados.Client{
+		APIHost:   arv.ApiServer,
+		AuthToken: h.Config.cluster.SystemRootToken,
+		Insecure:  arv.ApiInsecure,
+	}
+	var link arvados.Link
+	err := client.RequestAndDecode(&link, "GET", "arvados/v1/links/"+linkUUID, nil, nil)
+	if err, ok := err.(*arvados.TransactionError); ok && err.StatusCode == http.StatusNotFound {
+		return "", errShareRevoked
+	} else if err != nil {
+		return "", err
+	} else if link.LinkClass != shareLinkClass || !strings.Contains(link.OwnerUUID, "-tpzed-") {
+		return "", errShareInvalid
+	}
+
+	ttl := time.Duration(h.Config.cluster.Collections.WebDAVCache.TTL)
+	now := time.Now()
+	var aca arvados.APIClientAuthorization
+	err = client.RequestAndDecode(&aca, "POST", "arvados/v1/api_client_authorizations", nil, map[string]interface{}{
+		"api_client_authorization": map[string]interface{}{
+			"owner_uuid": link.OwnerUUID,
+			"expires_at": now.Add(ttl + shareTokenSlack).UTC(),
+			"scopes": []string{
+				"GET /arvados/v1/collections/" + collectionID,
+				"GET /arvados/v1/keep_services/accessible",
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	ent = &confirmedShareLink{
+		expire: now.Add(ttl),
+		token:  aca.TokenV2(),
+	}
+
+	h.shareLinks.mtx.Lock()
+	defer h.shareLinks.mtx.Unlock()
+	for uuid, ent := range h.shareLinks.confirmed {
+		if now.After(ent.expire) {
+			delete(h.shareLinks.confirmed, uuid)
+		}
+	}
+	h.shareLinks.confirmed[linkUUID] = ent
+	return ent.token, nil
+}
+
+// serveShare handles requests to create ("POST /_share") and revoke
+// ("DELETE /_share/{link uuid}") share links.
+//
+// POST parameters are "collection" (UUID or PDH), "path" (optional:
+// directory or file to share, default is the entire collection), and
+// "ttl" (optional: duration like "24h", default and maximum is
+// Collections.MaxShareLinkTTL). The caller must be able to read the
+// collection. The response is a JSON object with the link UUID, the
+// share URL, and the expiry time.
+func (h *handler) serveShare(w http.ResponseWriter, r *http.Request) {
+	key := h.Config.cluster.Collections.ShareLinkSigningKey
+	if key == "" || h.Config.cluster.SystemRootToken == "" {
+		http.Error(w, "share links are not enabled", http.StatusNotFound)
+		return
+	}
+	tokens := auth.CredentialsFromRequest(r).Tokens
+	if len(tokens) == 0 {
+		w.Header().Add("WWW-Authenticate", "Basic realm=\"collections\"")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	arv := h.clientPool.Get()
+	if arv == nil {
+		http.Error(w, "Pool failed: "+h.clientPool.Err().Error(), http.StatusInternalServerError)
+		return
+	}
+	defer h.clientPool.Put(arv)
+	arv.ApiToken = tokens[0]
+	client := (&arvados.Client{
+		APIHost:   arv.ApiServer,
+		AuthToken: arv.ApiToken,
+		Insecure:  arv.ApiInsecure,
+	}).WithRequestID(r.Header.Get("X-Request-Id"))
+
+	switch {
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/_share/"):
+		linkUUID := strings.TrimPrefix(r.URL.Path, "/_share/")
+		var link arvados.Link
+		err := client.RequestAndDecode(&link, "GET", "arvados/v1/links/"+linkUUID, nil, nil)
+		if err == nil && link.LinkClass != shareLinkClass {
+			http.Error(w, errShareInvalid.Error(), http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			err = client.RequestAndDecode(nil, "DELETE", "arvados/v1/links/"+linkUUID, nil, nil)
+		}
+		if err != nil {
+			httpErrorFromAPI(w, err)
+			return
+		}
+		h.shareLinks.mtx.Lock()
+		delete(h.shareLinks.confirmed, linkUUID)
+		h.shareLinks.mtx.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && r.URL.Path == "/_share":
+		h.createShareLink(w, r, arv, client, []byte(key))
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handler) createShareLink(w http.ResponseWriter, r *http.Request, arv *arvadosclient.ArvadosClient, client *arvados.Client, key []byte) {
+	collectionID := parseCollectionIDFromURL(r.FormValue("collection"))
+	if collectionID == "" {
+		http.Error(w, "missing or invalid collection parameter", http.StatusBadRequest)
+		return
+	}
+	prefix := strings.Trim(path.Clean("/"+r.FormValue("path")), "/")
+	maxTTL := time.Duration(h.Config.cluster.Collections.MaxShareLinkTTL)
+	ttl := maxTTL
+	if s := r.FormValue("ttl"); s != "" {
+		var err error
+		ttl, err = time.ParseDuration(s)
+		if err != nil || ttl <= 0 || ttl > maxTTL {
+			http.Error(w, fmt.Sprintf("invalid ttl %q: must be a positive duration no longer than %s", s, maxTTL), http.StatusBadRequest)
+			return
+		}
+	}
+	expiry := time.Now().Add(ttl).Truncate(time.Second)
+
+	// Make sure the caller can read the collection, and the
+	// shared path exists.
+	coll, err := h.Config.Cache.Get(arv, collectionID, false)
+	if err != nil {
+		httpErrorFromAPI(w, err)
+		return
+	}
+	if _, _, ok := arvados.ParseCollectionVersion(collectionID); ok {
+		// Share the past version by its own UUID, which
+		// checkShareLink can grant access to.
+		collectionID = coll.UUID
+	}
+	fs, err := coll.FileSystem(client, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := fs.Stat("/" + prefix); os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("path %q does not exist in collection", prefix), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	attrs := map[string]interface{}{
+		"link_class": shareLinkClass,
+		"name":       strings.TrimSuffix(collectionID+"/"+prefix, "/"),
+		"properties": map[string]interface{}{
+			"collection": collectionID,
+			"path":       prefix,
+			"expires_at": expiry.UTC(),
+		},
+	}
+	if arvadosclient.UUIDMatch(collectionID) {
+		attrs["head_uuid"] = collectionID
+	}
+	var link arvados.Link
+	err = client.RequestAndDecode(&link, "POST", "arvados/v1/links", nil, map[string]interface{}{"link": attrs})
+	if err != nil {
+		httpErrorFromAPI(w, err)
+		return
+	}
+
+	base := h.Config.cluster.Services.WebDAVDownload.ExternalURL
+	if base.Host == "" {
+		base = h.Config.cluster.Services.WebDAV.ExternalURL
+	}
+	if base.Host == "" {
+		base.Scheme, base.Host = "https", r.Host
+		if r.URL.Scheme != "" {
+			base.Scheme = r.URL.Scheme
+		}
+	}
+	shareURL := (&url.URL{
+		Scheme: base.Scheme,
+		Host:   base.Host,
+		Path: "/c=" + strings.Replace(collectionID, "+", "-", -1) +
+			"/" + makeShareToken(key, link.UUID, expiry, collectionID, prefix) +
+			"/" + prefix,
+	}).String()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uuid":       link.UUID,
+		"url":        shareURL,
+		"expires_at": expiry.UTC(),
+	})
+}
+
+// httpErrorFromAPI sends an error response with the same status code
+// as the given API error (or 500 if it is not an API error).
+func httpErrorFromAPI(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch err := err.(type) {
+	case arvadosclient.APIServerError:
+		code = err.HttpStatusCode
+	case *arvados.TransactionError:
+		code = err.StatusCode
+	}
+	http.Error(w, err.Error(), code)
+}
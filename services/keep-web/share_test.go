@@ -0,0 +1,188 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestShareToken(c *check.C) {
+	key := []byte("abcdefghijklmnopqrstuvwxyz")
+	linkUUID := "zzzzz-o0j2j-abcdefghijklmno"
+	coll := arvadostest.FooAndBarFilesInDirUUID
+	share := strings.TrimPrefix(makeShareToken(key, linkUUID, time.Now().Add(time.Hour), coll, "dir1"), "share=")
+
+	for _, trial := range []struct {
+		key    []byte
+		share  string
+		coll   string
+		path   string
+		expect error
+	}{
+		{key, share, coll, "dir1", nil},
+		{key, share, coll, "dir1/", nil},
+		{key, share, coll, "dir1/foo", nil},
+		{key, share, coll, "", errShareInvalid},
+		{key, share, coll, "dir2/foo", errShareInvalid},
+		{key, share, coll, "dir1/../secret", errShareInvalid},
+		{key, share, arvadostest.FooCollection, "dir1/foo", errShareInvalid},
+		{[]byte("wrongkey"), share, coll, "dir1/foo", errShareInvalid},
+		{nil, share, coll, "dir1/foo", errShareInvalid},
+		{key, share + "0", coll, "dir1/foo", errShareInvalid},
+		{key, "zzzzz-o0j2j-abcdefghijklmno.00000001." + strings.Split(share, ".")[2], coll, "dir1/foo", errShareInvalid},
+		{key, strings.TrimPrefix(makeShareToken(key, linkUUID, time.Now().Add(-time.Second), coll, "dir1"), "share="), coll, "dir1/foo", errShareExpired},
+		{key, strings.TrimPrefix(makeShareToken(key, linkUUID, time.Now().Add(time.Hour), coll, ""), "share="), coll, "dir1/foo", nil},
+	} {
+		var targetPath []string
+		if trial.path != "" {
+			targetPath = strings.Split(trial.path, "/")
+		}
+		uuid, err := verifyShareToken(trial.key, trial.share, trial.coll, targetPath)
+		c.Check(err, check.Equals, trial.expect, check.Commentf("%+v", trial))
+		if trial.expect == nil {
+			c.Check(uuid, check.Equals, linkUUID)
+		}
+	}
+}
+
+func (s *IntegrationSuite) TestShareLink(c *check.C) {
+	s.testServer.Config.cluster.Collections.ShareLinkSigningKey = "abcdefghijklmnopqrstuvwxyz"
+	s.testServer.Config.cluster.SystemRootToken = arvadostest.AdminToken
+
+	// Paths that don't exist can't be shared
+	req, err := http.NewRequest("POST", "http://"+s.testServer.Addr+"/_share", strings.NewReader(url.Values{
+		"collection": {arvadostest.FooAndBarFilesInDirUUID},
+		"path":       {"dir1/nonexistent"},
+	}.Encode()))
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "OAuth2 "+arvadostest.ActiveToken)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusNotFound)
+
+	// Create a share link for dir1
+	req, err = http.NewRequest("POST", "http://"+s.testServer.Addr+"/_share", strings.NewReader(url.Values{
+		"collection": {arvadostest.FooAndBarFilesInDirUUID},
+		"path":       {"dir1"},
+		"ttl":        {"1h"},
+	}.Encode()))
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "OAuth2 "+arvadostest.ActiveToken)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var share struct {
+		UUID      string
+		URL       string
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&share), check.IsNil)
+	c.Check(share.ExpiresAt.After(time.Now().Add(59*time.Minute)), check.Equals, true)
+	u, err := url.Parse(share.URL)
+	c.Assert(err, check.IsNil)
+	c.Check(u.Path, check.Matches, `/c=`+arvadostest.FooAndBarFilesInDirUUID+`/share=[^/]+/dir1`)
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + s.testServer.Addr + path)
+		c.Assert(err, check.IsNil)
+		buf, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, check.IsNil)
+		return resp.StatusCode, string(buf)
+	}
+
+	// Files below the shared path are readable without a token
+	code, body := get(u.Path + "/foo")
+	c.Check(code, check.Equals, http.StatusOK)
+	c.Check(body, check.Equals, "foo")
+
+	// Other paths are not
+	code, _ = get(strings.Replace(u.Path, "/dir1", "/", 1))
+	c.Check(code, check.Equals, http.StatusNotFound)
+
+	// Writes are not allowed
+	req, err = http.NewRequest("PUT", "http://"+s.testServer.Addr+u.Path+"/newfile", strings.NewReader("data"))
+	c.Assert(err, check.IsNil)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusMethodNotAllowed)
+
+	// Revoke
+	req, err = http.NewRequest("DELETE", "http://"+s.testServer.Addr+"/_share/"+share.UUID, nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Authorization", "OAuth2 "+arvadostest.ActiveToken)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusNoContent)
+
+	code, _ = get(u.Path + "/foo")
+	c.Check(code, check.Equals, http.StatusNotFound)
+}
+
+func (s *IntegrationSuite) TestShareLinkCreatorLosesPermission(c *check.C) {
+	s.testServer.Config.cluster.Collections.ShareLinkSigningKey = "abcdefghijklmnopqrstuvwxyz"
+	s.testServer.Config.cluster.SystemRootToken = arvadostest.AdminToken
+	// Don't cache share links or permissions.
+	s.testServer.Config.cluster.Collections.WebDAVCache.TTL = arvados.Duration(time.Nanosecond)
+
+	// The spectator user can read the collection because of a
+	// permission link.
+	admin := arvados.NewClientFromEnv()
+	admin.AuthToken = arvadostest.AdminToken
+	var coll arvados.Collection
+	err := admin.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{"collection": map[string]interface{}{
+		"manifest_text": ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n",
+	}})
+	c.Assert(err, check.IsNil)
+	defer admin.RequestAndDecode(nil, "DELETE", "arvados/v1/collections/"+coll.UUID, nil, nil)
+	var perm arvados.Link
+	err = admin.RequestAndDecode(&perm, "POST", "arvados/v1/links", nil, map[string]interface{}{"link": map[string]interface{}{
+		"link_class": "permission",
+		"name":       "can_read",
+		"tail_uuid":  arvadostest.SpectatorUserUUID,
+		"head_uuid":  coll.UUID,
+	}})
+	c.Assert(err, check.IsNil)
+
+	req, err := http.NewRequest("POST", "http://"+s.testServer.Addr+"/_share", strings.NewReader(url.Values{
+		"collection": {coll.UUID},
+	}.Encode()))
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "OAuth2 "+arvadostest.SpectatorToken)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	var share struct {
+		URL string
+	}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&share), check.IsNil)
+	u, err := url.Parse(share.URL)
+	c.Assert(err, check.IsNil)
+
+	get := func() int {
+		resp, err := http.Get("http://" + s.testServer.Addr + u.Path + "foo")
+		c.Assert(err, check.IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	c.Check(get(), check.Equals, http.StatusOK)
+
+	// After the spectator loses permission to read the
+	// collection, the share link stops working.
+	err = admin.RequestAndDecode(nil, "DELETE", "arvados/v1/links/"+perm.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(get(), check.Equals, http.StatusNotFound)
+}
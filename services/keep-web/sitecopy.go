@@ -0,0 +1,260 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+	"golang.org/x/net/webdav"
+)
+
+// siteCopyTarget is the source or destination of a COPY or MOVE
+// request in the site filesystem.
+type siteCopyTarget struct {
+	uuid    string // collection UUID, "" if loaded by PDH
+	relpath string // path relative to collection root
+	cfs     arvados.CollectionFileSystem
+}
+
+// serveSiteCopyMove handles a WebDAV COPY or MOVE request in the site
+// filesystem (/by_id/ and /users/), where the source and destination
+// can be in different collections.
+//
+// No file data is read or written. Keep is content-addressed, so the
+// destination collection's manifest can simply refer to the same
+// blocks as the source collection's manifest.
+func (h *handler) serveSiteCopyMove(w http.ResponseWriter, r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, fs arvados.CustomFileSystem) {
+	dstPath, code := siteCopyDestination(r)
+	if code != 0 {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	srcPath := path.Clean(r.URL.Path)
+	if dstPath == srcPath {
+		http.Error(w, "source and destination are the same", http.StatusForbidden)
+		return
+	} else if strings.HasPrefix(dstPath, srcPath+"/") {
+		http.Error(w, "cannot copy or move a directory into itself", http.StatusForbidden)
+		return
+	}
+	if code := checkPreconditions(r, fs, srcPath); code != 0 {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	var src, dst siteCopyTarget
+	var err error
+	src.uuid, src.cfs, src.relpath, err = fs.LookupCollection(srcPath)
+	if os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err == arvados.ErrInvalidArgument || (r.Method == "MOVE" && src.relpath == "") {
+		http.Error(w, "source must be a file or directory in a collection", http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if depth := r.Header.Get("Depth"); depth != "" && depth != "infinity" {
+		// RFC 4918 allows "COPY Depth: 0" on a directory
+		// (copy the directory but not its contents), but
+		// that's not useful enough to support here.
+		if fi, err := src.cfs.Stat("/" + src.relpath); err != nil || fi.IsDir() {
+			http.Error(w, "Depth must be infinity", http.StatusBadRequest)
+			return
+		}
+	}
+	dstDir, dstName := path.Split(dstPath)
+	dst.uuid, _, dst.relpath, err = fs.LookupCollection(dstDir)
+	if os.IsNotExist(err) {
+		http.Error(w, "destination directory does not exist", http.StatusConflict)
+		return
+	} else if err == arvados.ErrInvalidArgument {
+		http.Error(w, "destination must be in a collection", http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dst.relpath = strings.TrimPrefix(dst.relpath+"/"+dstName, "/")
+
+	// Load the current versions of the collection(s) being
+	// modified.
+	dstColl, err := siteCopyLoad(client, dst.uuid)
+	if err == errReadOnly {
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+		return
+	} else if err != nil {
+		httpErrorFromAPI(w, err)
+		return
+	}
+	dst.cfs, err = dstColl.FileSystem(client, kc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sameColl := src.uuid == dst.uuid
+	var srcColl *arvados.Collection
+	if r.Method == "MOVE" && sameColl {
+		srcColl, src.cfs = dstColl, dst.cfs
+	} else if r.Method == "MOVE" {
+		srcColl, err = siteCopyLoad(client, src.uuid)
+		if err == errReadOnly {
+			http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+			return
+		} else if err != nil {
+			httpErrorFromAPI(w, err)
+			return
+		}
+		src.cfs, err = srcColl.FileSystem(client, kc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Like webdav.Handler, require the client to submit tokens
+	// for any locks held on the destination and (for MOVE) the
+	// source.
+	lockTargets := []siteCopyTarget{dst}
+	if r.Method == "MOVE" {
+		lockTargets = append(lockTargets, src)
+	}
+	lockTokens := requestLockTokens(r)
+	now := time.Now()
+	for _, target := range lockTargets {
+		ls := h.lockSystem(client, target.uuid, r)
+		if err := ls.checkLocked(now, target.relpath, lockTokens); err == webdav.ErrLocked {
+			http.Error(w, err.Error(), http.StatusLocked)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_, err = dst.cfs.Stat(dst.relpath)
+	overwrite := err == nil
+	if overwrite && r.Header.Get("Overwrite") == "F" {
+		http.Error(w, "destination exists", http.StatusPreconditionFailed)
+		return
+	}
+	if fi, err := dst.cfs.Stat(path.Dir("/" + dst.relpath)); err != nil || !fi.IsDir() {
+		http.Error(w, "destination directory does not exist", http.StatusConflict)
+		return
+	}
+
+	// Extract the manifest entries for the source file or
+	// directory, renamed to the destination path.
+	srcManifest, err := src.cfs.MarshalManifest(".")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	extracted := manifest.Manifest{Text: srcManifest}.Extract("./"+src.relpath, "./"+dst.relpath)
+	if extracted.Err != nil {
+		http.Error(w, extracted.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if overwrite {
+		err = dst.cfs.RemoveAll(dst.relpath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if r.Method == "MOVE" && sameColl {
+		err = dst.cfs.RemoveAll(src.relpath)
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	existing, err := dst.cfs.MarshalManifest(".")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mergedfs, err := (&arvados.Collection{ManifestText: existing + extracted.Text}).FileSystem(client, kc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = h.Config.Cache.Update(client, *dstColl, mergedfs)
+	if err != nil {
+		httpErrorFromAPI(w, err)
+		return
+	}
+
+	if r.Method == "MOVE" && !sameColl {
+		err = src.cfs.RemoveAll(src.relpath)
+		if err == nil {
+			err = h.Config.Cache.Update(client, *srcColl, src.cfs)
+		}
+		if err != nil {
+			// The destination has already been
+			// updated, so the result is a copy rather
+			// than a move.
+			httpErrorFromAPI(w, err)
+			return
+		}
+	}
+
+	if overwrite {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// siteCopyDestination returns the cleaned site filesystem path given
+// in r's Destination header. If the header is missing or refers to
+// something other than a file in the site filesystem, it returns a
+// non-zero HTTP status code.
+func siteCopyDestination(r *http.Request) (string, int) {
+	hdr := r.Header.Get("Destination")
+	if hdr == "" {
+		return "", http.StatusBadRequest
+	}
+	u, err := url.Parse(hdr)
+	if err != nil {
+		return "", http.StatusBadRequest
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return "", http.StatusBadGateway
+	}
+	dst := path.Clean("/" + u.Path)
+	if top := strings.Split(dst, "/")[1]; top == "" || !siteFSDir[top] {
+		return "", http.StatusBadGateway
+	}
+	return dst, 0
+}
+
+// siteCopyLoad returns the current version of the given collection,
+// or errReadOnly if it can't be modified.
+func siteCopyLoad(client *arvados.Client, uuid string) (*arvados.Collection, error) {
+	if uuid == "" {
+		return nil, errReadOnly
+	}
+	var coll arvados.Collection
+	err := client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+uuid, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if coll.CurrentVersionUUID != "" && coll.CurrentVersionUUID != coll.UUID {
+		// Past versions are read-only
+		return nil, errReadOnly
+	}
+	return &coll, nil
+}
@@ -0,0 +1,162 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	"golang.org/x/net/webdav"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestSiteCopyDestination(c *check.C) {
+	for _, trial := range []struct {
+		dest   string
+		path   string
+		status int
+	}{
+		{"", "", http.StatusBadRequest},
+		{"/by_id/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo", "/by_id/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo", 0},
+		{"http://collections.example.com/by_id/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo/", "/by_id/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo", 0},
+		{"/users/active/foo%20bar/baz", "/users/active/foo bar/baz", 0},
+		{"/users/active/../../by_id/x", "/by_id/x", 0},
+		{"http://other.example.com/by_id/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo", "", http.StatusBadGateway},
+		{"/c=zzzzz-4zz18-aaaaaaaaaaaaaaa/foo", "", http.StatusBadGateway},
+		{"/", "", http.StatusBadGateway},
+		{"%zz", "", http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest("COPY", "http://collections.example.com/by_id/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo", nil)
+		if trial.dest != "" {
+			r.Header.Set("Destination", trial.dest)
+		}
+		path, status := siteCopyDestination(r)
+		c.Check(path, check.Equals, trial.path, check.Commentf("%+v", trial))
+		c.Check(status, check.Equals, trial.status, check.Commentf("%+v", trial))
+	}
+}
+
+func (s *UnitSuite) TestCheckLocked(c *check.C) {
+	now := time.Now()
+	ls := &collectionLockSystem{backend: &memLockBackend{}, collection: lockTestCollection, persist: true}
+	tokA, err := ls.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	c.Assert(err, check.IsNil)
+	tokB, err := ls.Create(now, webdav.LockDetails{Root: "/b/file", Duration: time.Minute})
+	c.Assert(err, check.IsNil)
+
+	for _, trial := range []struct {
+		name   string
+		tokens []string
+		locked bool
+	}{
+		{"a", nil, true},
+		{"a/file", nil, true},
+		{"a/file", []string{tokA}, false},
+		{"a/file", []string{tokB}, true},
+		{"b", nil, true},
+		{"b", []string{tokB}, false},
+		{"b/other", nil, false},
+		{"", nil, true},
+		{"", []string{tokA, tokB}, false},
+		{"c", nil, false},
+	} {
+		err := ls.checkLocked(now, trial.name, trial.tokens)
+		if trial.locked {
+			c.Check(err, check.Equals, webdav.ErrLocked, check.Commentf("%+v", trial))
+		} else {
+			c.Check(err, check.IsNil, check.Commentf("%+v", trial))
+		}
+	}
+
+	r := httptest.NewRequest("MOVE", "/", nil)
+	c.Check(requestLockTokens(r), check.HasLen, 0)
+	r.Header.Set("If", `</by_id/x/a> (<`+tokA+`>) (Not <DAV:no-lock>) </by_id/y/b> (<`+tokB+`> ["etag"])`)
+	c.Check(requestLockTokens(r), check.DeepEquals, []string{tokA, tokB})
+}
+
+func (s *IntegrationSuite) TestSiteCopyMove(c *check.C) {
+	arv := arvados.NewClientFromEnv()
+	arv.AuthToken = arvadostest.ActiveToken
+	var src, dst arvados.Collection
+	err := arv.RequestAndDecode(&src, "POST", "arvados/v1/collections", nil, map[string]interface{}{"collection": map[string]interface{}{
+		"manifest_text": ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n./dir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n",
+	}})
+	c.Assert(err, check.IsNil)
+	err = arv.RequestAndDecode(&dst, "POST", "arvados/v1/collections", nil, map[string]interface{}{"collection": map[string]interface{}{
+		"manifest_text": ". 73feffa4b7f6bb68e44cf984c85f6e88+3 0:3:baz\n",
+	}})
+	c.Assert(err, check.IsNil)
+
+	do := func(method, path, dest string, hdr map[string]string) int {
+		u := mustParseURL("http://collections.example.com" + path)
+		req := &http.Request{
+			Method:     method,
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header: http.Header{
+				"Authorization": {"Bearer " + arvadostest.ActiveToken},
+				"Destination":   {"http://collections.example.com" + dest},
+			},
+		}
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		s.testServer.Handler.ServeHTTP(resp, req)
+		c.Logf("%s %s %s => %d %s", method, path, dest, resp.Code, resp.Body.String())
+		return resp.Code
+	}
+	manifest := func(uuid string) string {
+		var coll arvados.Collection
+		err := arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+uuid, nil, nil)
+		c.Assert(err, check.IsNil)
+		return coll.ManifestText
+	}
+	srcPath := "/by_id/" + src.UUID
+	dstPath := "/by_id/" + dst.UUID
+
+	// Copy a file to another collection
+	c.Check(do("COPY", srcPath+"/foo", dstPath+"/foo2", nil), check.Equals, http.StatusCreated)
+	c.Check(manifest(dst.UUID), check.Matches, `\. 73feffa4b7f6bb68e44cf984c85f6e88\+3\S* acbd18db4cc2f85cedef654fccc4a4d8\+3\S* 0:3:baz 3:3:foo2\n`)
+	c.Check(manifest(src.UUID), check.Matches, `(?ms)\. acbd18db4cc2f85cedef654fccc4a4d8\+3\S* 0:3:foo\n.*`)
+
+	// Overwrite: F
+	c.Check(do("COPY", srcPath+"/foo", dstPath+"/baz", map[string]string{"Overwrite": "F"}), check.Equals, http.StatusPreconditionFailed)
+
+	// Move a directory to another collection, replacing an
+	// existing file
+	c.Check(do("MOVE", srcPath+"/dir", dstPath+"/baz", nil), check.Equals, http.StatusNoContent)
+	c.Check(manifest(dst.UUID), check.Matches, `\. acbd18db4cc2f85cedef654fccc4a4d8\+3\S* 0:3:foo2\n\./baz 37b51d194a7513e45b56f6524f2d51f2\+3\S* 0:3:bar\n`)
+	c.Check(manifest(src.UUID), check.Matches, `\. acbd18db4cc2f85cedef654fccc4a4d8\+3\S* 0:3:foo\n`)
+
+	// Move within a collection
+	c.Check(do("MOVE", dstPath+"/foo2", dstPath+"/baz/foo3", nil), check.Equals, http.StatusCreated)
+	c.Check(manifest(dst.UUID), check.Matches, `\./baz 37b51d194a7513e45b56f6524f2d51f2\+3\S* acbd18db4cc2f85cedef654fccc4a4d8\+3\S* 0:3:bar 3:3:foo3\n`)
+
+	// Copy a whole collection into a subdirectory of another
+	c.Check(do("COPY", srcPath, dstPath+"/copy", nil), check.Equals, http.StatusCreated)
+	c.Check(manifest(dst.UUID), check.Matches, `(?ms).*\n\./copy acbd18db4cc2f85cedef654fccc4a4d8\+3\S* 0:3:foo\n`)
+
+	// Error cases
+	c.Check(do("COPY", srcPath+"/nonexistent", dstPath+"/x", nil), check.Equals, http.StatusNotFound)
+	c.Check(do("COPY", srcPath+"/foo", dstPath+"/nonexistent/x", nil), check.Equals, http.StatusConflict)
+	c.Check(do("COPY", srcPath+"/foo", srcPath+"/foo", nil), check.Equals, http.StatusForbidden)
+	c.Check(do("COPY", dstPath+"/baz", dstPath+"/baz/sub", nil), check.Equals, http.StatusForbidden)
+	c.Check(do("MOVE", srcPath, dstPath+"/x", nil), check.Equals, http.StatusForbidden)
+	c.Check(do("COPY", srcPath+"/foo", "/by_id/"+arvadostest.FooCollectionPDH+"/x", nil), check.Equals, http.StatusMethodNotAllowed)
+	c.Check(do("COPY", srcPath+"/foo", "/c="+dst.UUID+"/x", nil), check.Equals, http.StatusBadGateway)
+	c.Check(do("COPY", srcPath+"/foo", "/by_id/"+arvadostest.AProjectUUID+"/x", nil), check.Equals, http.StatusForbidden)
+
+	// Copy from a read-only (PDH) collection
+	c.Check(do("COPY", "/by_id/"+arvadostest.FooCollectionPDH+"/foo", dstPath+"/pdhfoo", nil), check.Equals, http.StatusCreated)
+	c.Check(manifest(dst.UUID), check.Matches, `(?ms).* 0:3:pdhfoo.*`)
+
+	c.Check(strings.Contains(manifest(src.UUID), "foo"), check.Equals, true)
+}
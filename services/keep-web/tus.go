@@ -0,0 +1,507 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/auth"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+// Resumable uploads implement the core protocol and the "creation"
+// and "termination" extensions of tus 1.0.0 (https://tus.io/).
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+
+	// Each upload is stored in a temporary collection, which has
+	// the upload's target and length in this property.
+	tusUploadProperty = "keep-web-upload"
+
+	// Name of the file in the temporary collection.
+	tusDataFile = "data"
+
+	// Timeout of the locks held while saving an upload. They are
+	// released as soon as the collection is saved; the timeout
+	// only matters if keep-web exits before then.
+	tusLockDuration = time.Minute
+)
+
+var (
+	tusCORSAllowHeaders  = "Authorization, Content-Type, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, X-HTTP-Method-Override, X-Requested-With"
+	tusCORSExposeHeaders = "Location, Tus-Extension, Tus-Resumable, Tus-Version, Upload-Length, Upload-Offset"
+
+	errTusNotUpload = errors.New("not a resumable upload")
+	errTusConflict  = errors.New("upload was modified by a concurrent request")
+)
+
+// tusUpload describes a resumable upload.
+type tusUpload struct {
+	Collection string `json:"collection"` // UUID of target collection
+	Path       string `json:"path"`       // target file path, without leading "/"
+	Length     int64  `json:"length"`
+}
+
+// parseTusMetadata parses an Upload-Metadata header: comma-separated
+// key-value pairs, where each value is base64-encoded and separated
+// from its key by a space.
+func parseTusMetadata(hdr string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(hdr, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, " ", 2)
+		if len(kv) == 1 {
+			meta[kv[0]] = ""
+			continue
+		}
+		val, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q: %s", kv[0], err)
+		}
+		meta[kv[0]] = string(val)
+	}
+	return meta, nil
+}
+
+// serveTus handles resumable upload requests: "POST /_tus" creates
+// an upload, and "HEAD", "PATCH", and "DELETE /_tus/{id}" get the
+// upload offset, append data, and cancel the upload, respectively.
+//
+// When the last byte has been received, the file is added to the
+// target collection (replacing any existing file with the same
+// name) and the temporary collection is deleted.
+func (h *handler) serveTus(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", tusCORSExposeHeaders)
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	method := r.Method
+	if m := r.Header.Get("X-HTTP-Method-Override"); m != "" && method == "POST" {
+		method = m
+	}
+	if method == "OPTIONS" {
+		if r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Headers", tusCORSAllowHeaders)
+			w.Header().Set("Access-Control-Allow-Methods", "DELETE, HEAD, OPTIONS, PATCH, POST")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+		}
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported Tus-Resumable version", http.StatusPreconditionFailed)
+		return
+	}
+	if h.Config.cluster.Collections.ResumableUploadTTL <= 0 {
+		http.Error(w, "resumable uploads are not enabled", http.StatusNotFound)
+		return
+	}
+	tokens := auth.CredentialsFromRequest(r).Tokens
+	if len(tokens) == 0 {
+		w.Header().Add("WWW-Authenticate", "Basic realm=\"collections\"")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	arv := h.clientPool.Get()
+	if arv == nil {
+		http.Error(w, "Pool failed: "+h.clientPool.Err().Error(), http.StatusInternalServerError)
+		return
+	}
+	defer h.clientPool.Put(arv)
+	arv.ApiToken = tokens[0]
+	kc, err := keepclient.MakeKeepClient(arv)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	kc.RequestID = r.Header.Get("X-Request-Id")
+	kc.HedgeDelay = time.Duration(h.Config.cluster.API.KeepServiceHedgeDelay)
+	client := (&arvados.Client{
+		APIHost:   arv.ApiServer,
+		AuthToken: arv.ApiToken,
+		Insecure:  arv.ApiInsecure,
+	}).WithRequestID(r.Header.Get("X-Request-Id"))
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_tus"), "/")
+	switch {
+	case method == "POST" && id == "":
+		h.tusCreate(w, r, client, kc)
+	case method == "HEAD" && id != "":
+		coll, upload, err := tusLoad(client, id)
+		if err != nil {
+			tusError(w, err)
+			return
+		}
+		offset, err := tusOffset(coll, client, kc)
+		if err != nil {
+			tusError(w, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Length", fmt.Sprintf("%d", upload.Length))
+		w.Header().Set("Upload-Offset", fmt.Sprintf("%d", offset))
+		w.WriteHeader(http.StatusOK)
+	case method == "PATCH" && id != "":
+		h.tusPatch(w, r, client, kc, id)
+	case method == "DELETE" && id != "":
+		if _, _, err := tusLoad(client, id); err != nil {
+			tusError(w, err)
+			return
+		}
+		if err := client.RequestAndDecode(nil, "DELETE", "arvados/v1/collections/"+id, nil, nil); err != nil {
+			tusError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handler) tusCreate(w http.ResponseWriter, r *http.Request, client *arvados.Client, kc *keepclient.KeepClient) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "missing or invalid Upload-Length header", http.StatusBadRequest)
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upload := tusUpload{
+		Collection: meta["collection"],
+		Path:       strings.Trim(path.Clean("/"+meta["filename"]), "/"),
+		Length:     length,
+	}
+	if !arvadosclient.UUIDMatch(upload.Collection) || !strings.Contains(upload.Collection, "-4zz18-") {
+		http.Error(w, "Upload-Metadata must include the UUID of a writable collection as \"collection\"", http.StatusBadRequest)
+		return
+	}
+	if upload.Path == "" {
+		http.Error(w, "Upload-Metadata must include a file name as \"filename\"", http.StatusBadRequest)
+		return
+	}
+	// Check write permission now, rather than letting the client
+	// upload all of the data before finding out it can't be
+	// saved.
+	if err := checkCollectionWritable(client, upload.Collection); err != nil {
+		tusError(w, err)
+		return
+	}
+
+	var coll arvados.Collection
+	err = client.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"collection": map[string]interface{}{
+			"name":       fmt.Sprintf("Partial upload of %s to %s", upload.Path, upload.Collection),
+			"trash_at":   time.Now().Add(time.Duration(h.Config.cluster.Collections.ResumableUploadTTL)).UTC(),
+			"properties": map[string]interface{}{tusUploadProperty: upload},
+		},
+	})
+	if err != nil {
+		tusError(w, err)
+		return
+	}
+	if length == 0 {
+		_, err = h.tusAppend(r, client, kc, &coll, &upload, 0, strings.NewReader(""))
+		if err != nil {
+			tusError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Location", "/_tus/"+coll.UUID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *handler) tusPatch(w http.ResponseWriter, r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	reqOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+	coll, upload, err := tusLoad(client, id)
+	if err != nil {
+		tusError(w, err)
+		return
+	}
+	offset, err := tusOffset(coll, client, kc)
+	if err != nil {
+		tusError(w, err)
+		return
+	}
+	if reqOffset != offset {
+		http.Error(w, fmt.Sprintf("Upload-Offset %d does not match current offset %d", reqOffset, offset), http.StatusConflict)
+		return
+	}
+	if r.ContentLength > upload.Length-offset {
+		http.Error(w, "request body extends past Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	offset, err = h.tusAppend(r, client, kc, coll, upload, offset, io.LimitReader(r.Body, upload.Length-offset))
+	if err != nil {
+		log.WithField("RequestID", r.Header.Get("X-Request-Id")).Printf("resumable upload %s: %s", id, err)
+		tusError(w, err)
+		return
+	}
+	w.Header().Set("Upload-Offset", fmt.Sprintf("%d", offset))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusLoad retrieves the temporary collection for the given upload
+// ID.
+func tusLoad(client *arvados.Client, id string) (*arvados.Collection, *tusUpload, error) {
+	var coll arvados.Collection
+	err := client.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+id, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	prop, ok := coll.Properties[tusUploadProperty]
+	if !ok {
+		return nil, nil, errTusNotUpload
+	}
+	buf, err := json.Marshal(prop)
+	if err != nil {
+		return nil, nil, err
+	}
+	var upload tusUpload
+	err = json.Unmarshal(buf, &upload)
+	if err != nil || upload.Collection == "" || upload.Path == "" {
+		return nil, nil, errTusNotUpload
+	}
+	return &coll, &upload, nil
+}
+
+// tusOffset returns the number of bytes received so far.
+func tusOffset(coll *arvados.Collection, client *arvados.Client, kc *keepclient.KeepClient) (int64, error) {
+	fs, err := coll.FileSystem(client, kc)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := fs.Stat(tusDataFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// tusLock acquires a lock on the named file in the given collection,
+// using the same lock system as WebDAV clients, and returns a
+// function that releases it.
+//
+// Keep-web saves a collection by replacing its whole manifest, so
+// uploads hold a lock while they load, modify, and save a collection
+// -- otherwise two requests (possibly handled by different keep-web
+// processes) could both load the same version, and the second save
+// would discard the first one's changes.
+func (h *handler) tusLock(r *http.Request, client *arvados.Client, collectionUUID, name string) (func(), error) {
+	ls := h.lockSystem(client, collectionUUID, r)
+	ls.persist = true
+	token, err := ls.Create(time.Now(), webdav.LockDetails{
+		Root:      name,
+		Duration:  tusLockDuration,
+		ZeroDepth: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := ls.Unlock(time.Now(), token); err != nil {
+			log.WithField("RequestID", r.Header.Get("X-Request-Id")).Printf("resumable upload: error releasing lock on %s in %s: %s", name, collectionUUID, err)
+		}
+	}, nil
+}
+
+// tusUnchanged returns errTusConflict if the collection has been
+// modified since coll was retrieved.
+func tusUnchanged(client *arvados.Client, coll *arvados.Collection) error {
+	var current arvados.Collection
+	err := client.RequestAndDecode(&current, "GET", "arvados/v1/collections/"+coll.UUID, nil, arvados.ResourceListParams{
+		Select: []string{"portable_data_hash"},
+	})
+	if err != nil {
+		return err
+	} else if current.PortableDataHash != coll.PortableDataHash {
+		return errTusConflict
+	}
+	return nil
+}
+
+// tusAppend appends data to the upload, saves the temporary
+// collection, and returns the new offset. If that completes the
+// upload, the file is added to the target collection.
+//
+// If reading the data fails partway (e.g., the client disconnects),
+// the data received so far is still saved, so the client can resume
+// from there.
+func (h *handler) tusAppend(r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, coll *arvados.Collection, upload *tusUpload, offset int64, data io.Reader) (int64, error) {
+	fs, err := coll.FileSystem(client, kc)
+	if err != nil {
+		return offset, err
+	}
+	f, err := fs.OpenFile(tusDataFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return offset, err
+	}
+	n, readErr := io.Copy(f, data)
+	err = f.Close()
+	if err != nil {
+		return offset, err
+	}
+
+	// Another request might have appended data since we loaded
+	// the collection. Holding the lock ensures it can't do so
+	// between our check and our update.
+	unlock, err := h.tusLock(r, client, coll.UUID, tusDataFile)
+	if err == webdav.ErrLocked {
+		return offset, errTusConflict
+	} else if err != nil {
+		return offset, err
+	}
+	err = tusUnchanged(client, coll)
+	if err == nil {
+		err = h.Config.Cache.Update(client, *coll, fs)
+	}
+	unlock()
+	if err != nil {
+		return offset, err
+	}
+	offset += n
+	if readErr != nil {
+		return offset, readErr
+	}
+	if offset < upload.Length {
+		return offset, nil
+	}
+	return offset, h.tusFinish(r, client, kc, coll, fs, upload)
+}
+
+// tusFinish adds the uploaded file to the target collection, and
+// deletes the temporary collection.
+//
+// The target file is locked while the target collection is updated,
+// so the upload fails with webdav.ErrLocked if a WebDAV client (or
+// another upload) holds a lock on it. If the target collection is
+// modified by a request that doesn't use locks, the upload is merged
+// into the modified version instead.
+func (h *handler) tusFinish(r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, coll *arvados.Collection, fs arvados.CollectionFileSystem, upload *tusUpload) error {
+	// Move the data file to the target path, so the temporary
+	// collection's manifest can be merged into the target
+	// collection's manifest without copying any data.
+	dirs := strings.Split(upload.Path, "/")
+	for i := 1; i < len(dirs); i++ {
+		err := fs.Mkdir(strings.Join(dirs[:i], "/"), 0755)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	err := fs.Rename(tusDataFile, upload.Path)
+	if err != nil {
+		return err
+	}
+	uploaded, err := fs.MarshalManifest(".")
+	if err != nil {
+		return err
+	}
+
+	unlock, err := h.tusLock(r, client, upload.Collection, upload.Path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for attempt := 1; ; attempt++ {
+		err = h.tusMerge(client, kc, upload, uploaded)
+		if err != errTusConflict || attempt >= 3 {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = client.RequestAndDecode(nil, "DELETE", "arvados/v1/collections/"+coll.UUID, nil, nil)
+	if err != nil {
+		log.Printf("resumable upload %s: error deleting temporary collection: %s", coll.UUID, err)
+	}
+	return nil
+}
+
+// tusMerge retrieves the current version of the target collection,
+// replaces the target file with the one in the uploaded manifest, and
+// saves the result. It returns errTusConflict (without saving
+// anything) if the target collection changes in the meantime.
+func (h *handler) tusMerge(client *arvados.Client, kc *keepclient.KeepClient, upload *tusUpload, uploaded string) error {
+	var target arvados.Collection
+	err := client.RequestAndDecode(&target, "GET", "arvados/v1/collections/"+upload.Collection, nil, nil)
+	if err != nil {
+		return err
+	}
+	targetfs, err := target.FileSystem(client, kc)
+	if err != nil {
+		return err
+	}
+	err = targetfs.Remove(upload.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existing, err := targetfs.MarshalManifest(".")
+	if err != nil {
+		return err
+	}
+	mergedfs, err := (&arvados.Collection{ManifestText: existing + uploaded}).FileSystem(client, kc)
+	if err != nil {
+		return err
+	}
+	err = tusUnchanged(client, &target)
+	if err != nil {
+		return err
+	}
+	return h.Config.Cache.Update(client, target, mergedfs)
+}
+
+// tusError sends an error response with an appropriate status code.
+func tusError(w http.ResponseWriter, err error) {
+	switch err {
+	case errTusNotUpload:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errTusConflict:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case webdav.ErrLocked:
+		http.Error(w, err.Error(), http.StatusLocked)
+	default:
+		httpErrorFromAPI(w, err)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestParseTusMetadata(c *check.C) {
+	b64 := base64.StdEncoding.EncodeToString
+	meta, err := parseTusMetadata("filename " + b64([]byte("dir/file name.txt")) + ", collection " + b64([]byte("zzzzz-4zz18-aaaaaaaaaaaaaaa")) + ",is_confidential")
+	c.Check(err, check.IsNil)
+	c.Check(meta, check.DeepEquals, map[string]string{
+		"filename":        "dir/file name.txt",
+		"collection":      "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+		"is_confidential": "",
+	})
+
+	meta, err = parseTusMetadata("")
+	c.Check(err, check.IsNil)
+	c.Check(meta, check.HasLen, 0)
+
+	_, err = parseTusMetadata("filename !!!")
+	c.Check(err, check.NotNil)
+}
+
+func (s *UnitSuite) TestTusOptions(c *check.C) {
+	h := handler{Config: newConfig(s.Config)}
+	r := httptest.NewRequest("OPTIONS", "/_tus", nil)
+	r.Header.Set("Origin", "https://workbench.example")
+	r.Header.Set("Access-Control-Request-Method", "PATCH")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, r)
+	c.Check(resp.Code, check.Equals, http.StatusNoContent)
+	c.Check(resp.Header().Get("Tus-Version"), check.Equals, "1.0.0")
+	c.Check(resp.Header().Get("Tus-Extension"), check.Equals, "creation,termination")
+	c.Check(resp.Header().Get("Access-Control-Allow-Methods"), check.Matches, `.*PATCH.*`)
+	c.Check(resp.Header().Get("Access-Control-Allow-Headers"), check.Matches, `.*Upload-Offset.*`)
+
+	r = httptest.NewRequest("POST", "/_tus", nil)
+	r.Header.Set("Tus-Resumable", "0.2.2")
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, r)
+	c.Check(resp.Code, check.Equals, http.StatusPreconditionFailed)
+	c.Check(resp.Header().Get("Tus-Version"), check.Equals, "1.0.0")
+}
+
+func (s *IntegrationSuite) tusRequest(c *check.C, method, path string, hdr map[string]string, body string) *http.Response {
+	req, err := http.NewRequest(method, "http://"+s.testServer.Addr+path, strings.NewReader(body))
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Authorization", "Bearer "+arvadostest.ActiveToken)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	return resp
+}
+
+func (s *IntegrationSuite) TestTusUpload(c *check.C) {
+	var coll arvados.Collection
+	arv := arvados.NewClientFromEnv()
+	arv.AuthToken = arvadostest.ActiveToken
+	err := arv.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{"collection": map[string]interface{}{
+		"manifest_text": ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n",
+	}})
+	c.Assert(err, check.IsNil)
+
+	b64 := base64.StdEncoding.EncodeToString
+	resp := s.tusRequest(c, "POST", "/_tus", map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "collection " + b64([]byte(coll.UUID)) + ",filename " + b64([]byte("dir/hello.txt")),
+	}, "")
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	location := resp.Header.Get("Location")
+	c.Check(location, check.Matches, `/_tus/zzzzz-4zz18-.*`)
+
+	// Wrong offset
+	resp = s.tusRequest(c, "PATCH", location, map[string]string{"Upload-Offset": "3", "Content-Type": "application/offset+octet-stream"}, "hello")
+	c.Check(resp.StatusCode, check.Equals, http.StatusConflict)
+
+	resp = s.tusRequest(c, "PATCH", location, map[string]string{"Upload-Offset": "0", "Content-Type": "application/offset+octet-stream"}, "hello")
+	c.Check(resp.StatusCode, check.Equals, http.StatusNoContent)
+	c.Check(resp.Header.Get("Upload-Offset"), check.Equals, "5")
+
+	resp = s.tusRequest(c, "HEAD", location, nil, "")
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Upload-Offset"), check.Equals, "5")
+	c.Check(resp.Header.Get("Upload-Length"), check.Equals, "11")
+
+	// File isn't in the target collection until the upload is
+	// complete
+	err = arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.ManifestText, check.Not(check.Matches), `(?ms).*hello.*`)
+
+	resp = s.tusRequest(c, "PATCH", location, map[string]string{"Upload-Offset": "5", "Content-Type": "application/offset+octet-stream"}, " world")
+	c.Check(resp.StatusCode, check.Equals, http.StatusNoContent)
+	c.Check(resp.Header.Get("Upload-Offset"), check.Equals, "11")
+
+	err = arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.ManifestText, check.Matches, `\. acbd18db4cc2f85cedef654fccc4a4d8\+3\S* 0:3:foo\n\./dir \S+ \S+ 0:11:hello.txt\n`)
+
+	// Temporary collection is gone
+	resp = s.tusRequest(c, "HEAD", location, nil, "")
+	c.Check(resp.StatusCode, check.Equals, http.StatusNotFound)
+
+	// Cancel an upload
+	resp = s.tusRequest(c, "POST", "/_tus", map[string]string{
+		"Upload-Length":   "100",
+		"Upload-Metadata": "collection " + b64([]byte(coll.UUID)) + ",filename " + b64([]byte("cancelled")),
+	}, "")
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	location = resp.Header.Get("Location")
+	resp = s.tusRequest(c, "DELETE", location, nil, "")
+	c.Check(resp.StatusCode, check.Equals, http.StatusNoContent)
+	resp = s.tusRequest(c, "HEAD", location, nil, "")
+	c.Check(resp.StatusCode, check.Equals, http.StatusNotFound)
+
+	// Not a resumable upload
+	resp = s.tusRequest(c, "HEAD", "/_tus/"+coll.UUID, nil, "")
+	c.Check(resp.StatusCode, check.Equals, http.StatusNotFound)
+}
+
+func (s *IntegrationSuite) TestTusUploadReadOnly(c *check.C) {
+	b64 := base64.StdEncoding.EncodeToString
+	// The "bar_file" collection is readable, but not writable,
+	// by the spectator user.
+	resp := s.tusRequest(c, "POST", "/_tus", map[string]string{
+		"Authorization":   "Bearer " + arvadostest.SpectatorToken,
+		"Upload-Length":   "11",
+		"Upload-Metadata": "collection " + b64([]byte("zzzzz-4zz18-ehbhgtheo8909or")) + ",filename " + b64([]byte("hello.txt")),
+	}, "")
+	c.Check(resp.StatusCode, check.Equals, http.StatusForbidden)
+	c.Check(resp.Header.Get("Location"), check.Equals, "")
+}
+
+func (s *IntegrationSuite) TestTusUploadLocked(c *check.C) {
+	var coll arvados.Collection
+	arv := arvados.NewClientFromEnv()
+	arv.AuthToken = arvadostest.ActiveToken
+	err := arv.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{"collection": map[string]interface{}{}})
+	c.Assert(err, check.IsNil)
+
+	// A WebDAV client locks the target file
+	s.testServer.Config.cluster.Services.WebDAVDownload.ExternalURL.Host = "example.com"
+	u := mustParseURL("http://example.com/c=" + coll.UUID + "/hello.txt")
+	req := &http.Request{
+		Method:     "LOCK",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header: http.Header{
+			"Authorization": {"Bearer " + arvadostest.ActiveToken},
+			"Timeout":       {"Second-60"},
+		},
+		Body: ioutil.NopCloser(strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>active</D:owner></D:lockinfo>`)),
+	}
+	lockResp := httptest.NewRecorder()
+	s.testServer.Handler.ServeHTTP(lockResp, req)
+	c.Assert(lockResp.Code, check.Equals, http.StatusOK)
+
+	b64 := base64.StdEncoding.EncodeToString
+	resp := s.tusRequest(c, "POST", "/_tus", map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": "collection " + b64([]byte(coll.UUID)) + ",filename " + b64([]byte("hello.txt")),
+	}, "")
+	c.Assert(resp.StatusCode, check.Equals, http.StatusCreated)
+	location := resp.Header.Get("Location")
+
+	// The data is saved, but the upload can't finish until the
+	// lock is released
+	resp = s.tusRequest(c, "PATCH", location, map[string]string{"Upload-Offset": "0", "Content-Type": "application/offset+octet-stream"}, "hello")
+	c.Check(resp.StatusCode, check.Equals, http.StatusLocked)
+	resp = s.tusRequest(c, "HEAD", location, nil, "")
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Upload-Offset"), check.Equals, "5")
+	err = arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.ManifestText, check.Equals, "")
+
+	req.Method = "UNLOCK"
+	req.Header.Set("Lock-Token", lockResp.Header().Get("Lock-Token"))
+	req.Body = nil
+	unlockResp := httptest.NewRecorder()
+	s.testServer.Handler.ServeHTTP(unlockResp, req)
+	c.Check(unlockResp.Code, check.Equals, http.StatusNoContent)
+
+	resp = s.tusRequest(c, "PATCH", location, map[string]string{"Upload-Offset": "5", "Content-Type": "application/offset+octet-stream"}, "")
+	c.Check(resp.StatusCode, check.Equals, http.StatusNoContent)
+	c.Check(resp.Header.Get("Upload-Offset"), check.Equals, "5")
+	err = arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.ManifestText, check.Matches, `\. \S+ 0:5:hello.txt\n`)
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	prand "math/rand"
+	"net/http"
 	"os"
 	"path"
 	"strings"
@@ -89,6 +90,7 @@ func (fs *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os
 	if fs.alwaysReadEOF {
 		f = readEOF{File: f}
 	}
+	f = etagFile{File: f}
 	return
 }
 
@@ -113,7 +115,98 @@ func (fs *webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error)
 	if fs.writing {
 		fs.makeparents(name)
 	}
-	return fs.collfs.Stat(name)
+	fi, err := fs.collfs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return etagFileInfo{fi}, nil
+}
+
+// fileETag returns the ETag of a file in a collection, or "" if the
+// file doesn't have one (e.g., it's a directory, or it has data that
+// hasn't been written to Keep yet).
+func fileETag(fi os.FileInfo) string {
+	if fi, ok := fi.(interface{ ETag() string }); ok {
+		return fi.ETag()
+	}
+	return ""
+}
+
+// etagFileInfo implements webdav.ETager, so PROPFIND and GET
+// responses use the same ETags as non-webdav GET responses.
+type etagFileInfo struct {
+	os.FileInfo
+}
+
+func (fi etagFileInfo) ETag(ctx context.Context) (string, error) {
+	if etag := fileETag(fi.FileInfo); etag != "" {
+		return etag, nil
+	}
+	return "", webdav.ErrNotImplemented
+}
+
+type etagFile struct {
+	webdav.File
+}
+
+func (f etagFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return etagFileInfo{fi}, nil
+}
+
+func (f etagFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	for i, fi := range fis {
+		fis[i] = etagFileInfo{fi}
+	}
+	return fis, err
+}
+
+// checkPreconditions evaluates the If-Match and If-None-Match headers
+// of a write request against the current state of the named file, as
+// specified in RFC 7232. It returns http.StatusPreconditionFailed if
+// the request must not proceed, otherwise 0.
+//
+// This lets WebDAV clients avoid overwriting changes made by others
+// ("PUT with If-Match: {etag}") or replacing existing files ("PUT
+// with If-None-Match: *").
+func checkPreconditions(r *http.Request, fs arvados.FileSystem, name string) int {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return 0
+	}
+	etag, exists := "", false
+	if fi, err := fs.Stat(name); err == nil {
+		etag, exists = fileETag(fi), true
+	}
+	if ifMatch != "" && !etagMatch(ifMatch, etag, exists) {
+		return http.StatusPreconditionFailed
+	}
+	if ifNoneMatch != "" && etagMatch(ifNoneMatch, etag, exists) {
+		return http.StatusPreconditionFailed
+	}
+	return 0
+}
+
+// etagMatch returns true if an If-Match or If-None-Match header value
+// matches a file with the given etag (or no etag). Only strong
+// comparison is used, so weak tags (W/"...") never match.
+func etagMatch(hdr, etag string, exists bool) bool {
+	if strings.TrimSpace(hdr) == "*" {
+		return exists
+	}
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(hdr, ",") {
+		if strings.TrimSpace(tag) == etag {
+			return true
+		}
+	}
+	return false
 }
 
 type writeFailer struct {
@@ -148,21 +241,11 @@ func (readEOF) Read(p []byte) (int, error) {
 // read-only webdav filesystem because webdav locks only apply to
 // writes.
 //
-// This is more suitable than webdav.NewMemLS() for two reasons:
-// First, it allows keep-web to use one locker for all collections
-// even though coll1.vhost/foo and coll2.vhost/foo have the same path
-// but represent different resources. Additionally, it returns valid
-// tokens (rfc2518 specifies that tokens are represented as URIs and
-// are unique across all resources for all time), which might improve
-// client compatibility.
-//
-// However, it does also permit impossible operations, like acquiring
-// conflicting locks and releasing non-existent locks.  This might
-// confuse some clients if they try to probe for correctness.
+// It returns valid tokens (rfc2518 specifies that tokens are
+// represented as URIs and are unique across all resources for all
+// time), which might improve client compatibility.
 //
-// Currently this is a moot point: the LOCK and UNLOCK methods are not
-// accepted by keep-web, so it suffices to implement the
-// webdav.LockSystem interface.
+// Writable collections use collectionLockSystem instead.
 type noLockSystem struct{}
 
 func (*noLockSystem) Confirm(time.Time, string, string, ...webdav.Condition) (func(), error) {
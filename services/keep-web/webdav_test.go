@@ -4,6 +4,80 @@
 
 package main
 
-import "golang.org/x/net/webdav"
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"golang.org/x/net/webdav"
+	check "gopkg.in/check.v1"
+)
 
 var _ webdav.FileSystem = &webdavFS{}
+
+var _ webdav.ETager = etagFileInfo{}
+
+func (s *UnitSuite) TestWebdavETag(c *check.C) {
+	fs, err := (&arvados.Collection{ManifestText: ". 3858f62230ac3c915f300c664312c63f+6+A12345@abcde 0:3:foo 3:3:bar\n"}).FileSystem(nil, nil)
+	c.Assert(err, check.IsNil)
+	wfs := &webdavFS{collfs: fs}
+
+	fi, err := wfs.Stat(context.Background(), "/foo")
+	c.Assert(err, check.IsNil)
+	foo, err := fi.(webdav.ETager).ETag(context.Background())
+	c.Check(err, check.IsNil)
+	c.Check(foo, check.Matches, `"[0-9a-f]{32}"`)
+	fi, err = wfs.Stat(context.Background(), "/bar")
+	c.Assert(err, check.IsNil)
+	bar, err := fi.(webdav.ETager).ETag(context.Background())
+	c.Check(err, check.IsNil)
+	c.Check(bar, check.Not(check.Equals), foo)
+
+	// Directories don't have ETags, so the webdav handler uses
+	// its default.
+	fi, err = wfs.Stat(context.Background(), "/")
+	c.Assert(err, check.IsNil)
+	_, err = fi.(webdav.ETager).ETag(context.Background())
+	c.Check(err, check.Equals, webdav.ErrNotImplemented)
+
+	f, err := wfs.OpenFile(context.Background(), "/", 0, 0)
+	c.Assert(err, check.IsNil)
+	fis, err := f.Readdir(-1)
+	c.Assert(err, check.IsNil)
+	c.Assert(fis, check.HasLen, 2)
+	for _, fi := range fis {
+		etag, err := fi.(webdav.ETager).ETag(context.Background())
+		c.Check(err, check.IsNil)
+		c.Check(etag, check.Equals, map[string]string{"foo": foo, "bar": bar}[fi.Name()])
+	}
+
+	for _, trial := range []struct {
+		path        string
+		ifMatch     string
+		ifNoneMatch string
+		expect      int
+	}{
+		{"/foo", "", "", 0},
+		{"/foo", foo, "", 0},
+		{"/foo", bar + ", " + foo, "", 0},
+		{"/foo", bar, "", http.StatusPreconditionFailed},
+		{"/foo", "W/" + foo, "", http.StatusPreconditionFailed},
+		{"/foo", "*", "", 0},
+		{"/new", "*", "", http.StatusPreconditionFailed},
+		{"/new", foo, "", http.StatusPreconditionFailed},
+		{"/foo", "", "*", http.StatusPreconditionFailed},
+		{"/new", "", "*", 0},
+		{"/foo", "", bar, 0},
+		{"/foo", "", foo, http.StatusPreconditionFailed},
+	} {
+		r := httptest.NewRequest("PUT", trial.path, nil)
+		if trial.ifMatch != "" {
+			r.Header.Set("If-Match", trial.ifMatch)
+		}
+		if trial.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", trial.ifNoneMatch)
+		}
+		c.Check(checkPreconditions(r, fs, trial.path), check.Equals, trial.expect, check.Commentf("%+v", trial))
+	}
+}
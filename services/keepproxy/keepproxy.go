@@ -5,6 +5,7 @@
 package main
 
 import (
+	"crypto/md5"
 	"errors"
 	"flag"
 	"fmt"
@@ -15,6 +16,7 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -29,6 +31,7 @@ import (
 	"github.com/coreos/go-systemd/daemon"
 	"github.com/ghodss/yaml"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -124,6 +127,7 @@ func run(logger log.FieldLogger, cluster *arvados.Cluster) error {
 		return fmt.Errorf("Error setting up keep client %v", err)
 	}
 	keepclient.RefreshServiceDiscoveryOnSIGHUP()
+	kc.HedgeDelay = time.Duration(cluster.API.KeepServiceHedgeDelay)
 
 	if cluster.Collections.DefaultReplication > 0 {
 		kc.Want_replicas = cluster.Collections.DefaultReplication
@@ -158,7 +162,10 @@ func run(logger log.FieldLogger, cluster *arvados.Cluster) error {
 
 	// Start serving requests.
 	router = MakeRESTRouter(kc, time.Duration(cluster.API.KeepServiceRequestTimeout), cluster.SystemRootToken)
-	return http.Serve(listener, httpserver.AddRequestIDs(httpserver.LogRequests(router)))
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(keepclient.NewServerStatsCollector("keepproxy"))
+	mh := httpserver.Instrument(reg, nil, httpserver.AddRequestIDs(httpserver.LogRequests(router)))
+	return http.Serve(listener, mh.ServeAPI(cluster.ManagementToken, mh))
 }
 
 type ApiTokenCache struct {
@@ -508,6 +515,7 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	// Now try to put the block through
+	var result keepclient.PutResult
 	if locatorIn == "" {
 		bytes, err2 := ioutil.ReadAll(req.Body)
 		if err2 != nil {
@@ -515,13 +523,23 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 			status = http.StatusInternalServerError
 			return
 		}
-		locatorOut, wroteReplicas, err = kc.PutB(bytes)
+		result, err = kc.PutHBResult(fmt.Sprintf("%x", md5.Sum(bytes)), bytes)
 	} else {
-		locatorOut, wroteReplicas, err = kc.PutHR(locatorIn, req.Body, expectLength)
+		result, err = kc.PutHRResult(locatorIn, req.Body, expectLength)
 	}
+	locatorOut, wroteReplicas = result.Locator, result.Replicas
 
-	// Tell the client how many successful PUTs we accomplished
+	// Tell the client how many successful PUTs we accomplished,
+	// and which storage classes the keepstore servers confirmed.
 	resp.Header().Set(keepclient.X_Keep_Replicas_Stored, fmt.Sprintf("%d", wroteReplicas))
+	if len(result.StorageClasses) > 0 {
+		var classes []string
+		for class, n := range result.StorageClasses {
+			classes = append(classes, fmt.Sprintf("%s=%d", class, n))
+		}
+		sort.Strings(classes)
+		resp.Header().Set(keepclient.X_Keep_Storage_Classes_Confirmed, strings.Join(classes, ", "))
+	}
 
 	switch err.(type) {
 	case nil:
@@ -200,6 +200,32 @@ func (s *ServerRequiredSuite) TestStorageClassesHeader(c *C) {
 	c.Check(hdr.Get("X-Keep-Storage-Classes"), Equals, "secure")
 }
 
+func (s *ServerRequiredSuite) TestStorageClassesConfirmedHeader(c *C) {
+	kc := runProxy(c, false)
+	defer closeListener()
+
+	// Set up fake keepstore that confirms the requested class
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Keep-Replicas-Stored", "1")
+			w.Header().Set("X-Keep-Storage-Classes-Confirmed", r.Header.Get("X-Keep-Storage-Classes")+"=1")
+			w.Write([]byte(r.URL.Path[1:] + "+19"))
+		}))
+	defer ts.Close()
+
+	sr := map[string]string{
+		TestProxyUUID: ts.URL,
+	}
+	router.(*proxyHandler).KeepClient.SetServiceRoots(sr, sr, sr)
+
+	kc.Want_replicas = 1
+	kc.StorageClasses = []string{"secure"}
+	content := []byte("Very important data")
+	result, err := kc.PutHBResult(fmt.Sprintf("%x", md5.Sum(content)), content)
+	c.Check(err, IsNil)
+	c.Check(result.StorageClasses, DeepEquals, map[string]int{"secure": 1})
+}
+
 func (s *ServerRequiredSuite) TestDesiredReplicas(c *C) {
 	kc := runProxy(c, false)
 	defer closeListener()
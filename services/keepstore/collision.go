@@ -10,6 +10,7 @@ import (
 	"crypto/md5"
 	"fmt"
 	"io"
+	"io/ioutil"
 )
 
 // Compute the MD5 digest of a data block (consisting of buf1 + buf2 +
@@ -98,3 +99,63 @@ func compareReaderWithBuf(ctx context.Context, rdr io.Reader, expect []byte, has
 		}
 	}
 }
+
+// errBlockMismatch is used by compareWriter to stop a ReadBlock call
+// as soon as the stored data differs from the expected data.
+var errBlockMismatch = fmt.Errorf("stored data differs from expected data")
+
+// compareWriter checks that the data written to it matches the next
+// bytes read from rdr.
+type compareWriter struct {
+	rdr io.Reader
+	buf []byte
+}
+
+func (cw *compareWriter) Write(p []byte) (int, error) {
+	if cap(cw.buf) < len(p) {
+		cw.buf = make([]byte, len(p))
+	}
+	buf := cw.buf[:len(p)]
+	n, err := io.ReadFull(cw.rdr, buf)
+	if n < len(p) && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		return n, errBlockMismatch
+	} else if err != nil {
+		return n, err
+	} else if !bytes.Equal(p, buf) {
+		return 0, errBlockMismatch
+	}
+	return len(p), nil
+}
+
+// compareReaderWithBlock is like compareReaderWithBuf, except that it
+// compares rdr with the block data that br.ReadBlock provides,
+// instead of an in-memory buffer.
+//
+// The caller must have already verified that the stored block
+// matches the expected hash. If rdr returns different data, all of
+// rdr is consumed in order to determine whether it also matches the
+// expected hash (CollisionError) or not (whatever error rdr returns
+// at EOF, typically RequestHashError).
+func compareReaderWithBlock(ctx context.Context, rdr io.Reader, br BlockReader, hash string) error {
+	cw := &compareWriter{rdr: rdr}
+	err := br.ReadBlock(ctx, hash, cw)
+	if err == nil {
+		// Make sure rdr doesn't have any extra data after
+		// the part we compared.
+		var n int
+		n, err = io.ReadFull(rdr, make([]byte, 1))
+		if n > 0 {
+			err = errBlockMismatch
+		} else if err == io.EOF {
+			return nil
+		}
+	}
+	if err != errBlockMismatch {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, rdr)
+	if err != nil {
+		return err
+	}
+	return CollisionError
+}
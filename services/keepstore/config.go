@@ -37,7 +37,11 @@ type Config struct {
 	TrashCheckInterval  arvados.Duration
 	PullWorkers         int
 	TrashWorkers        int
+	PullRate            float64
+	TrashRate           float64
 	EmptyTrashWorkers   int
+	ScrubInterval       arvados.Duration
+	ScrubRate           arvados.ByteSize
 	TLSCertificateFile  string
 	TLSKeyFile          string
 
@@ -76,6 +80,7 @@ func DefaultConfig() *Config {
 		BlobSignatureTTL:   arvados.Duration(14 * 24 * time.Hour),
 		TrashLifetime:      arvados.Duration(14 * 24 * time.Hour),
 		TrashCheckInterval: arvados.Duration(24 * time.Hour),
+		ScrubRate:          10 << 20,
 		Volumes:            []Volume{},
 	}
 }
@@ -0,0 +1,289 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// Evacuation states.
+const (
+	EvacuateRunning   = "running"
+	EvacuateDone      = "done"
+	EvacuateFailed    = "failed"
+	EvacuateCancelled = "cancelled"
+)
+
+// EvacuateStatus reports the progress of a mount evacuation.
+//
+// State is "done" only after every block found on the mount has been
+// confirmed to have at least as many replicas elsewhere (on other
+// local mounts or other keepstore servers) as the mount itself
+// provided. At that point the mount can be removed.
+type EvacuateStatus struct {
+	MountUUID    string
+	State        string
+	Started      time.Time
+	Finished     time.Time
+	BlocksFound  int64
+	BlocksDone   int64
+	BlocksCopied int64
+	BytesCopied  int64
+	Errors       int64
+	LastError    string
+}
+
+// An evacuator copies every block on a volume to other writable
+// volumes or keepstore servers, so the volume can be retired without
+// waiting for keep-balance. While an evacuation is in progress (or
+// finished) no new blocks are written to the volume.
+type evacuator struct {
+	uuid    string
+	volume  Volume
+	cluster *arvados.Cluster
+	cancel  context.CancelFunc
+
+	status EvacuateStatus
+	mtx    sync.Mutex
+}
+
+// Status returns a snapshot of the evacuation's current status.
+func (ev *evacuator) Status() *EvacuateStatus {
+	ev.mtx.Lock()
+	defer ev.mtx.Unlock()
+	st := ev.status
+	return &st
+}
+
+func (ev *evacuator) run(ctx context.Context) {
+	log.Printf("%s: evacuation starting", ev.volume)
+	for prefix := 0; prefix < 0x1000; prefix++ {
+		var index bytes.Buffer
+		err := ev.volume.IndexTo(fmt.Sprintf("%03x", prefix), &index)
+		if err != nil {
+			ev.countError(fmt.Errorf("IndexTo(%03x): %s", prefix, err))
+			continue
+		}
+		scanner := bufio.NewScanner(&index)
+		for scanner.Scan() {
+			if ctx.Err() != nil {
+				log.Printf("%s: evacuation cancelled", ev.volume)
+				ev.finish(EvacuateCancelled)
+				return
+			}
+			locator := strings.SplitN(scanner.Text(), " ", 2)[0]
+			if locator == "" {
+				continue
+			}
+			hash := locator
+			if i := strings.Index(locator, "+"); i >= 0 {
+				hash = locator[:i]
+			}
+			ev.mtx.Lock()
+			ev.status.BlocksFound++
+			ev.mtx.Unlock()
+			if err := ev.evacuateBlock(ctx, hash); err != nil {
+				ev.countError(fmt.Errorf("%s: %s", hash, err))
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		ev.finish(EvacuateCancelled)
+	} else if ev.Status().Errors > 0 {
+		ev.finish(EvacuateFailed)
+	} else {
+		ev.finish(EvacuateDone)
+	}
+	log.Printf("%s: evacuation %s", ev.volume, ev.Status().State)
+}
+
+func (ev *evacuator) finish(state string) {
+	ev.mtx.Lock()
+	defer ev.mtx.Unlock()
+	ev.status.State = state
+	ev.status.Finished = time.Now()
+}
+
+func (ev *evacuator) countError(err error) {
+	log.Printf("%s: evacuate: %s", ev.volume, err)
+	ev.mtx.Lock()
+	defer ev.mtx.Unlock()
+	ev.status.Errors++
+	ev.status.LastError = err.Error()
+}
+
+// isTarget returns true if vol can hold a replica that replaces one
+// on the volume being evacuated: it must not be evacuating itself,
+// and it must not be on the same device.
+func (ev *evacuator) isTarget(vol Volume) bool {
+	if evacuations.Has(vol) {
+		return false
+	}
+	dev := ev.volume.DeviceID()
+	return dev == "" || vol.DeviceID() != dev
+}
+
+// evacuateBlock ensures the given block has at least as many replicas
+// elsewhere as the evacuating volume provides. Existing intact copies
+// on other local volumes are touched and counted; if they aren't
+// enough, the block is written to other local volumes, and then
+// forwarded to other keepstore servers.
+func (ev *evacuator) evacuateBlock(ctx context.Context, hash string) error {
+	buf, err := getBufferWithContext(ctx, bufs, BlockSize)
+	if err != nil {
+		return err
+	}
+	defer bufs.Put(buf)
+	size, err := ev.volume.Get(ctx, hash, buf)
+	if os.IsNotExist(err) {
+		// Deleted since we got the index.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	data := buf[:size]
+	if fmt.Sprintf("%x", md5.Sum(data)) != hash {
+		return DiskHashError
+	}
+
+	want := ev.volume.Replication()
+	if want < 1 {
+		want = 1
+	}
+	have := 0
+	var candidates []Volume
+	for _, vol := range KeepVM.AllWritable() {
+		if !ev.isTarget(vol) {
+			continue
+		}
+		if vol.Compare(ctx, hash, data) == nil && vol.Touch(hash) == nil {
+			have += replicationOf(vol)
+		} else {
+			candidates = append(candidates, vol)
+		}
+	}
+	copied := false
+	for _, vol := range candidates {
+		if have >= want {
+			break
+		}
+		if err := vol.Put(ctx, hash, data); err != nil {
+			log.Printf("%s: evacuate: Put(%s) on %s: %s", ev.volume, hash, vol, err)
+			continue
+		}
+		have += replicationOf(vol)
+		copied = true
+	}
+	if have < want {
+		hdr := http.Header{}
+		hdr.Set("Authorization", "OAuth2 "+theConfig.systemAuthToken)
+		n, _ := forwardData(ctx, ev.cluster, hdr, hash, data, want-have)
+		have += n
+		copied = copied || n > 0
+	}
+	if have < want {
+		return fmt.Errorf("only %d of %d replicas stored elsewhere", have, want)
+	}
+
+	ev.mtx.Lock()
+	defer ev.mtx.Unlock()
+	ev.status.BlocksDone++
+	if copied {
+		ev.status.BlocksCopied++
+		ev.status.BytesCopied += int64(size)
+	}
+	return nil
+}
+
+// replicationOf returns the number of replicas a copy on vol counts
+// for.
+func replicationOf(vol Volume) int {
+	if n := vol.Replication(); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// evacuationSet keeps track of the volumes being evacuated.
+type evacuationSet struct {
+	byVolume map[Volume]*evacuator
+	mtx      sync.Mutex
+}
+
+var evacuations = &evacuationSet{}
+
+var errNotEvacuating = errors.New("mount is not being evacuated")
+
+// Has returns true if vol has an evacuation that is running,
+// finished, or failed, i.e., vol should not receive new blocks.
+func (es *evacuationSet) Has(vol Volume) bool {
+	es.mtx.Lock()
+	defer es.mtx.Unlock()
+	_, ok := es.byVolume[vol]
+	return ok
+}
+
+// Get returns the evacuation for vol, or nil if there is none.
+func (es *evacuationSet) Get(vol Volume) *evacuator {
+	es.mtx.Lock()
+	defer es.mtx.Unlock()
+	return es.byVolume[vol]
+}
+
+// Start starts evacuating the given volume, unless an evacuation is
+// already running or done, and returns the evacuator.
+func (es *evacuationSet) Start(uuid string, vol Volume, cluster *arvados.Cluster) *evacuator {
+	es.mtx.Lock()
+	defer es.mtx.Unlock()
+	if ev, ok := es.byVolume[vol]; ok {
+		if st := ev.Status().State; st == EvacuateRunning || st == EvacuateDone {
+			return ev
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ev := &evacuator{
+		uuid:    uuid,
+		volume:  vol,
+		cluster: cluster,
+		cancel:  cancel,
+		status: EvacuateStatus{
+			MountUUID: uuid,
+			State:     EvacuateRunning,
+			Started:   time.Now(),
+		},
+	}
+	if es.byVolume == nil {
+		es.byVolume = map[Volume]*evacuator{}
+	}
+	es.byVolume[vol] = ev
+	go ev.run(ctx)
+	return ev
+}
+
+// Cancel stops the evacuation of vol, if any, and returns vol to
+// normal service.
+func (es *evacuationSet) Cancel(vol Volume) error {
+	es.mtx.Lock()
+	defer es.mtx.Unlock()
+	ev, ok := es.byVolume[vol]
+	if !ok {
+		return errNotEvacuating
+	}
+	ev.cancel()
+	delete(es.byVolume, vol)
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&EvacuateSuite{})
+
+type EvacuateSuite struct {
+	vols []*MockVolume
+	rtr  http.Handler
+}
+
+func (s *EvacuateSuite) SetUpTest(c *check.C) {
+	s.vols = []*MockVolume{CreateMockVolume(), CreateMockVolume()}
+	s.vols[0].Device = "device-a"
+	s.vols[1].Device = "device-b"
+	KeepVM = MakeRRVolumeManager([]Volume{s.vols[0], s.vols[1]})
+	theConfig = DefaultConfig()
+	theConfig.systemAuthToken = arvadostest.DataManagerToken
+	r := prometheus.NewRegistry()
+	theConfig.Start(r)
+	s.rtr = MakeRESTRouter(testCluster, r)
+}
+
+func (s *EvacuateSuite) TearDownTest(c *check.C) {
+	KeepVM.Close()
+	KeepVM = nil
+	evacuations = &evacuationSet{}
+	theConfig = DefaultConfig()
+	theConfig.Start(prometheus.NewRegistry())
+}
+
+func (s *EvacuateSuite) call(method, path string, body []byte) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+arvadostest.DataManagerToken)
+	s.rtr.ServeHTTP(resp, req)
+	return resp
+}
+
+// wait polls the evacuation status of the given mount until it is no
+// longer running.
+func (s *EvacuateSuite) wait(c *check.C, uuid string) EvacuateStatus {
+	var st EvacuateStatus
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp := s.call("GET", "/mounts/"+uuid+"/evacuate", nil)
+		c.Assert(resp.Code, check.Equals, http.StatusOK)
+		c.Assert(json.Unmarshal(resp.Body.Bytes(), &st), check.IsNil)
+		if st.State != EvacuateRunning {
+			return st
+		}
+	}
+	c.Fatal("timed out waiting for evacuation")
+	return st
+}
+
+func (s *EvacuateSuite) TestEvacuate(c *check.C) {
+	ctx := context.Background()
+	s.vols[0].Put(ctx, TestHash, TestBlock)
+	s.vols[0].Put(ctx, TestHash2, TestBlock2)
+	s.vols[1].Put(ctx, TestHash, TestBlock)
+	uuid := KeepVM.Mounts()[0].UUID
+
+	resp := s.call("GET", "/mounts/"+uuid+"/evacuate", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+
+	resp = s.call("PUT", "/mounts/"+uuid+"/evacuate", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	st := s.wait(c, uuid)
+	c.Check(st.MountUUID, check.Equals, uuid)
+	c.Check(st.State, check.Equals, EvacuateDone)
+	c.Check(st.BlocksFound, check.Equals, int64(2))
+	c.Check(st.BlocksDone, check.Equals, int64(2))
+	c.Check(st.BlocksCopied, check.Equals, int64(1))
+	c.Check(st.BytesCopied, check.Equals, int64(len(TestBlock2)))
+	c.Check(st.Errors, check.Equals, int64(0))
+
+	buf := make([]byte, BlockSize)
+	n, err := s.vols[1].Get(ctx, TestHash2, buf)
+	c.Check(err, check.IsNil)
+	c.Check(buf[:n], check.DeepEquals, TestBlock2)
+
+	// New blocks are not written to the evacuated mount.
+	resp = s.call("PUT", "/"+TestHash3, TestBlock3)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	_, err = s.vols[0].Get(ctx, TestHash3, buf)
+	c.Check(err, check.NotNil)
+
+	// Cancelling returns the mount to service.
+	resp = s.call("DELETE", "/mounts/"+uuid+"/evacuate", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	resp = s.call("GET", "/mounts/"+uuid+"/evacuate", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+	c.Check(evacuations.Has(s.vols[0]), check.Equals, false)
+}
+
+func (s *EvacuateSuite) TestNowhereToGo(c *check.C) {
+	// Both mounts are on the same device, so copies on the other
+	// mount don't count, and there are no other servers.
+	s.vols[1].Device = s.vols[0].Device
+	s.vols[0].Put(context.Background(), TestHash, TestBlock)
+	uuid := KeepVM.Mounts()[0].UUID
+
+	resp := s.call("PUT", "/mounts/"+uuid+"/evacuate", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	st := s.wait(c, uuid)
+	c.Check(st.State, check.Equals, EvacuateFailed)
+	c.Check(st.BlocksFound, check.Equals, int64(1))
+	c.Check(st.BlocksDone, check.Equals, int64(0))
+	c.Check(st.Errors, check.Equals, int64(1))
+	c.Check(st.LastError, check.Matches, TestHash+`: only 0 of 1 replicas.*`)
+
+	// Retrying starts a new evacuation.
+	s.vols[1].Device = "device-b"
+	resp = s.call("PUT", "/mounts/"+uuid+"/evacuate", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(s.wait(c, uuid).State, check.Equals, EvacuateDone)
+}
+
+func (s *EvacuateSuite) TestUnauthorized(c *check.C) {
+	uuid := KeepVM.Mounts()[0].UUID
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/mounts/"+uuid+"/evacuate", nil)
+	s.rtr.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+	c.Check(evacuations.Has(s.vols[0]), check.Equals, false)
+
+	resp = s.call("PUT", "/mounts/X/evacuate", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *EvacuateSuite) TestReadOnlyWhileEvacuating(c *check.C) {
+	uuid := KeepVM.Mounts()[0].UUID
+	resp := s.call("PUT", "/mounts/"+uuid+"/evacuate", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	s.wait(c, uuid)
+
+	var mounts []arvados.KeepMount
+	resp = s.call("GET", "/mounts", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &mounts), check.IsNil)
+	c.Assert(mounts, check.HasLen, 2)
+	c.Check(mounts[0].UUID, check.Equals, uuid)
+	c.Check(mounts[0].ReadOnly, check.Equals, true)
+	c.Check(mounts[1].ReadOnly, check.Equals, false)
+
+	// Pull requests for the evacuated mount are rejected.
+	err := PullItemAndProcess(PullRequest{
+		Locator:   TestHash,
+		Servers:   []string{"http://server1"},
+		MountUUID: uuid,
+	}, nil)
+	c.Check(err, check.ErrorMatches, `pull req has mount being evacuated.*`)
+
+	// Cancelling makes the mount writable again.
+	resp = s.call("DELETE", "/mounts/"+uuid+"/evacuate", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	resp = s.call("GET", "/mounts", nil)
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &mounts), check.IsNil)
+	c.Check(mounts[0].ReadOnly, check.Equals, false)
+}
@@ -0,0 +1,282 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+)
+
+// forwardClient is used to send forwarded PUT requests to other
+// keepstore servers. It uses the same timeouts as keepclient uses
+// for keepstore servers, so a hung server can't tie up a handler
+// forever.
+var forwardClient = &http.Client{
+	Timeout: keepclient.DefaultRequestTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   keepclient.DefaultConnectTimeout,
+			KeepAlive: keepclient.DefaultKeepAlive,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   keepclient.DefaultTLSHandshakeTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+}
+
+// forwardServicesTTL is how long the list of keep services used for
+// forwarding is cached.
+const forwardServicesTTL = 5 * time.Minute
+
+var forwardServicesCache struct {
+	services []arvados.KeepService
+	expires  time.Time
+	sync.Mutex
+}
+
+// forwardResult is the outcome of forwarding a block to one server.
+type forwardResult struct {
+	target   string
+	replicas int
+	classes  map[string]int
+	err      error
+}
+
+// forwardBlock sends copies of a block that has already been stored
+// on a local volume to other keepstore servers, in rendezvous order,
+// until want more replicas have been stored or there are no more
+// servers to try.
+//
+// The block data is read back from the local volume, so the
+// forwarded copies are known to match what was stored here.
+//
+// It returns the number of replicas stored by other servers, and the
+// number of replicas stored in each storage class.
+func (rtr *router) forwardBlock(ctx context.Context, req *http.Request, hash string, blockSize int64, want int) (int, map[string]int) {
+	classes := map[string]int{}
+	targets := forwardTargets(rtr.cluster, hash)
+	if len(targets) == 0 {
+		return 0, classes
+	}
+
+	buf, err := getBufferWithContext(ctx, bufs, int(blockSize))
+	if err != nil {
+		log.Printf("%s: forward: %s", hash, err)
+		return 0, classes
+	}
+	defer bufs.Put(buf)
+	size, err := GetBlock(ctx, hash, buf, nil)
+	if err != nil {
+		log.Printf("%s: forward: reading stored block: %s", hash, err)
+		return 0, classes
+	}
+	return forwardData(ctx, rtr.cluster, req.Header, hash, buf[:size], want)
+}
+
+// forwardData sends copies of the given block data to other keepstore
+// servers, in rendezvous order, until want replicas have been stored
+// or there are no more servers to try. The Authorization,
+// X-Request-Id, and X-Keep-Storage-Classes headers are copied from
+// hdr.
+func forwardData(ctx context.Context, cluster *arvados.Cluster, hdr http.Header, hash string, data []byte, want int) (int, map[string]int) {
+	classes := map[string]int{}
+	targets := forwardTargets(cluster, hash)
+	stored := 0
+	for want > stored && len(targets) > 0 {
+		n := want - stored
+		if n > len(targets) {
+			n = len(targets)
+		}
+		batch := targets[:n]
+		targets = targets[n:]
+
+		results := make(chan forwardResult, len(batch))
+		for _, target := range batch {
+			go func(target string) {
+				results <- forwardTo(ctx, hdr, target, hash, data)
+			}(target)
+		}
+		for range batch {
+			res := <-results
+			if res.err != nil {
+				log.Printf("%s: forward to %s: %s", hash, res.target, res.err)
+				continue
+			}
+			stored += res.replicas
+			for class, n := range res.classes {
+				classes[class] += n
+			}
+		}
+	}
+	return stored, classes
+}
+
+// forwardTo sends a PUT request for the given block to a single
+// keepstore server. The forwarded request does not ask the other
+// server to forward the block any further.
+func forwardTo(ctx context.Context, hdr http.Header, target, hash string, data []byte) forwardResult {
+	res := forwardResult{target: target}
+	fwd, err := http.NewRequest("PUT", strings.TrimSuffix(target, "/")+"/"+hash, bytes.NewReader(data))
+	if err != nil {
+		res.err = err
+		return res
+	}
+	fwd = fwd.WithContext(ctx)
+	fwd.ContentLength = int64(len(data))
+	fwd.Header.Set("Content-Type", "application/octet-stream")
+	for _, h := range []string{"Authorization", httpserver.HeaderRequestID, keepclient.X_Keep_Storage_Classes} {
+		if v := hdr.Get(h); v != "" {
+			fwd.Header.Set(h, v)
+		}
+	}
+	resp, err := forwardClient.Do(fwd)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer resp.Body.Close()
+	defer io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		res.err = fmt.Errorf("%s", resp.Status)
+		return res
+	}
+	res.replicas = 1
+	if xr := resp.Header.Get(keepclient.X_Keep_Replicas_Stored); xr != "" {
+		if n, err := strconv.Atoi(xr); err == nil {
+			res.replicas = n
+		}
+	}
+	res.classes = parseStorageClassesConfirmed(resp.Header.Get(keepclient.X_Keep_Storage_Classes_Confirmed))
+	return res
+}
+
+// forwardTargets returns the URLs of the other writable keepstore
+// servers, in the rendezvous order clients use for the given hash.
+func forwardTargets(cluster *arvados.Cluster, hash string) []string {
+	if cluster == nil {
+		return nil
+	}
+	services, err := cachedForwardServices(cluster)
+	if err != nil {
+		log.Printf("%s: forward: listing keep services: %s", hash, err)
+		return nil
+	}
+	// Like keepclient, sort by service UUID.
+	roots := map[string]string{}
+	for _, svc := range services {
+		if svc.ServiceType != "disk" || svc.ReadOnly {
+			continue
+		}
+		scheme := "http"
+		if svc.ServiceSSLFlag {
+			scheme = "https"
+		}
+		u := url.URL{Scheme: scheme, Host: net.JoinHostPort(svc.ServiceHost, strconv.Itoa(svc.ServicePort))}
+		if isLocalURL(&u) {
+			continue
+		}
+		roots[svc.UUID] = u.String()
+	}
+	if len(roots) == 0 {
+		return nil
+	}
+	return keepclient.NewRootSorter(roots, hash).GetSortedRoots()
+}
+
+// cachedForwardServices returns the list of keep services, using a
+// cached copy if it is less than forwardServicesTTL old.
+func cachedForwardServices(cluster *arvados.Cluster) ([]arvados.KeepService, error) {
+	forwardServicesCache.Lock()
+	defer forwardServicesCache.Unlock()
+	if time.Now().Before(forwardServicesCache.expires) {
+		return forwardServicesCache.services, nil
+	}
+	services, err := forwardServices(cluster)
+	if err != nil {
+		return nil, err
+	}
+	forwardServicesCache.services = services
+	forwardServicesCache.expires = time.Now().Add(forwardServicesTTL)
+	return services, nil
+}
+
+// forwardServices retrieves the list of keep services from the API
+// server, using keepstore's own system token: the list is cached and
+// shared by all callers, so it must not depend on the client's
+// token. It is a variable so tests can override it.
+var forwardServices = func(cluster *arvados.Cluster) ([]arvados.KeepService, error) {
+	client, err := arvados.NewClientFromConfig(cluster)
+	if err != nil {
+		return nil, err
+	}
+	client.AuthToken = theConfig.systemAuthToken
+	var list arvados.KeepServiceList
+	err = client.RequestAndDecode(&list, "GET", "arvados/v1/keep_services/accessible", nil, nil)
+	return list.Items, err
+}
+
+// isLocalURL returns true if u refers to this keepstore server,
+// i.e., its port is the one we are listening on, and its host is one
+// of this host's addresses.
+var isLocalURL = func(u *url.URL) bool {
+	lhost, lport, err := net.SplitHostPort(theConfig.Listen)
+	if err != nil {
+		return false
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if port != lport {
+		return false
+	}
+	addrs, err := net.LookupHost(u.Hostname())
+	if err != nil {
+		return false
+	}
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if lhost != "" && lhost != "0.0.0.0" && lhost != "::" {
+			if ip.Equal(net.ParseIP(lhost)) {
+				return true
+			}
+			continue
+		}
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, ifaddr := range ifaddrs {
+			if ipnet, ok := ifaddr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
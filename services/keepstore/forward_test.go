@@ -0,0 +1,224 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stubKeepstore records PUT requests and responds with a fixed status
+// and storage class.
+type stubKeepstore struct {
+	status int
+	class  string
+	puts   []*http.Request
+	bodies [][]byte
+	mtx    sync.Mutex
+}
+
+func (sk *stubKeepstore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	sk.mtx.Lock()
+	sk.puts = append(sk.puts, r)
+	sk.bodies = append(sk.bodies, body)
+	sk.mtx.Unlock()
+	if sk.status != http.StatusOK {
+		http.Error(w, "stub error", sk.status)
+		return
+	}
+	w.Header().Set("X-Keep-Replicas-Stored", "1")
+	w.Header().Set("X-Keep-Storage-Classes-Confirmed", sk.class+"=1")
+	w.Write([]byte(TestHash + "+3\n"))
+}
+
+func TestPutForward(t *testing.T) {
+	defer teardown()
+	defer func(orig int) {
+		theConfig.MaxRequests = orig
+	}(theConfig.MaxRequests)
+	theConfig.MaxRequests = 2
+
+	KeepVM = MakeTestVolumeManager(2)
+	defer KeepVM.Close()
+
+	stubs := []*stubKeepstore{
+		{status: http.StatusOK, class: "default"},
+		{status: http.StatusServiceUnavailable},
+		{status: http.StatusOK, class: "archive"},
+	}
+	cluster := &arvados.Cluster{ClusterID: "zzzzz"}
+	var urls []string
+	for _, stub := range stubs {
+		srv := httptest.NewServer(stub)
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+	defer stubForwardServices(urls)()
+
+	put := func(forward bool) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", "/"+TestHash, bytes.NewReader(TestBlock))
+		req.Header.Set("X-Keep-Desired-Replicas", "3")
+		if forward {
+			req.Header.Set("X-Keep-Forward", "true")
+		}
+		resp := httptest.NewRecorder()
+		MakeRESTRouter(cluster, prometheus.NewRegistry()).ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Without X-Keep-Forward, the block is only stored locally.
+	resp := put(false)
+	ExpectStatusCode(t, "no forward", http.StatusOK, resp)
+	if got := resp.Header().Get("X-Keep-Replicas-Stored"); got != "1" {
+		t.Errorf("no forward: X-Keep-Replicas-Stored %q, expected 1", got)
+	}
+	if got := resp.Header().Get("X-Keep-Storage-Classes-Confirmed"); got != "default=1" {
+		t.Errorf("no forward: X-Keep-Storage-Classes-Confirmed %q, expected default=1", got)
+	}
+	for i, stub := range stubs {
+		if len(stub.puts) != 0 {
+			t.Errorf("no forward: stub %d got %d requests, expected 0", i, len(stub.puts))
+		}
+	}
+
+	// With X-Keep-Forward, the block is forwarded until 3
+	// replicas are stored, skipping the server that fails.
+	resp = put(true)
+	ExpectStatusCode(t, "forward", http.StatusOK, resp)
+	if got := resp.Header().Get("X-Keep-Replicas-Stored"); got != "3" {
+		t.Errorf("forward: X-Keep-Replicas-Stored %q, expected 3", got)
+	}
+	if got := resp.Header().Get("X-Keep-Storage-Classes-Confirmed"); got != "archive=1, default=2" {
+		t.Errorf("forward: X-Keep-Storage-Classes-Confirmed %q, expected \"archive=1, default=2\"", got)
+	}
+	for i, stub := range stubs {
+		if stub.status == http.StatusOK && len(stub.puts) != 1 {
+			t.Errorf("forward: stub %d got %d requests, expected 1", i, len(stub.puts))
+		}
+		for j, req := range stub.puts {
+			if req.Header.Get("X-Keep-Forward") != "" {
+				t.Errorf("forward: stub %d request %d has X-Keep-Forward header", i, j)
+			}
+			if !bytes.Equal(stub.bodies[j], TestBlock) {
+				t.Errorf("forward: stub %d request %d body %q, expected %q", i, j, stub.bodies[j], TestBlock)
+			}
+		}
+	}
+}
+
+// stubForwardServices makes forwardTargets use keepstore servers
+// at the given URLs instead of asking the API server, and returns a
+// func that restores the original behavior.
+func stubForwardServices(urls []string) func() {
+	var svcs []arvados.KeepService
+	for i, s := range urls {
+		u, _ := url.Parse(s)
+		port, _ := strconv.Atoi(u.Port())
+		svcs = append(svcs, arvados.KeepService{
+			UUID:           fmt.Sprintf("zzzzz-bi6l4-%015d", i),
+			ServiceHost:    u.Hostname(),
+			ServicePort:    port,
+			ServiceSSLFlag: u.Scheme == "https",
+			ServiceType:    "disk",
+		})
+	}
+	orig := forwardServices
+	forwardServices = func(*arvados.Cluster) ([]arvados.KeepService, error) {
+		return svcs, nil
+	}
+	forwardServicesCache.expires = time.Time{}
+	return func() {
+		forwardServices = orig
+		forwardServicesCache.expires = time.Time{}
+	}
+}
+
+func TestForwardTargetsExcludeSelf(t *testing.T) {
+	defer func(orig string) {
+		theConfig.Listen = orig
+	}(theConfig.Listen)
+	theConfig.Listen = ":25107"
+
+	defer stubForwardServices([]string{"http://127.0.0.1:25107/", "http://127.0.0.1:25108/", "http://keep.example:25107/"})()
+	targets := forwardTargets(&arvados.Cluster{}, TestHash)
+	if len(targets) != 2 {
+		t.Fatalf("got targets %q, expected 2", targets)
+	}
+	for _, target := range targets {
+		if strings.HasPrefix(target, "http://127.0.0.1:25107") {
+			t.Errorf("got self %q in targets %q", target, targets)
+		}
+	}
+}
+
+// Targets are sorted by service UUID, the same way keepclient sorts
+// them, and only writable disk services are used.
+func TestForwardTargetsOrder(t *testing.T) {
+	var urls []string
+	roots := map[string]string{}
+	for i := 0; i < 8; i++ {
+		u := fmt.Sprintf("http://keep%d.example:25107", i)
+		urls = append(urls, u)
+		roots[fmt.Sprintf("zzzzz-bi6l4-%015d", i)] = u
+	}
+	defer stubForwardServices(urls)()
+	svcs, _ := forwardServices(nil)
+	svcs[6].ServiceType = "proxy"
+	svcs[7].ReadOnly = true
+	delete(roots, svcs[6].UUID)
+	delete(roots, svcs[7].UUID)
+
+	for _, hash := range []string{TestHash, TestHash2, TestHash3} {
+		got := forwardTargets(&arvados.Cluster{}, hash)
+		expect := keepclient.NewRootSorter(roots, hash).GetSortedRoots()
+		if strings.Join(got, " ") != strings.Join(expect, " ") {
+			t.Errorf("%s: got targets %q, expected %q", hash, got, expect)
+		}
+	}
+}
+
+// The list of keep services is retrieved with keepstore's own token,
+// not the token of whichever client happens to fill the cache.
+func TestForwardServicesUseSystemToken(t *testing.T) {
+	defer func(orig string) {
+		theConfig.systemAuthToken = orig
+	}(theConfig.systemAuthToken)
+	theConfig.systemAuthToken = "fake-system-token"
+
+	var gotAuth string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		w.Write([]byte(`{"items":[{"uuid":"zzzzz-bi6l4-000000000000000","service_type":"disk"}]}`))
+	}))
+	defer srv.Close()
+
+	cluster := &arvados.Cluster{}
+	cluster.TLS.Insecure = true
+	cluster.Services.Controller.ExternalURL = arvados.URL{Scheme: "https", Host: srv.Listener.Addr().String()}
+	svcs, err := forwardServices(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 1 {
+		t.Errorf("got services %+v, expected 1", svcs)
+	}
+	if gotAuth != "OAuth2 fake-system-token" {
+		t.Errorf("got Authorization %q, expected system token", gotAuth)
+	}
+}
@@ -249,6 +249,41 @@ func TestPutHandler(t *testing.T) {
 		TestHashPutResp, response)
 }
 
+func TestPutHandlerStorageClasses(t *testing.T) {
+	defer teardown()
+	defer func(orig int) {
+		theConfig.MaxRequests = orig
+	}(theConfig.MaxRequests)
+	theConfig.MaxRequests = 2
+
+	vols := []*MockVolume{CreateMockVolume(), CreateMockVolume()}
+	vols[1].StorageClasses = []string{"fast"}
+	KeepVM = MakeRRVolumeManager([]Volume{vols[0], vols[1]})
+	defer KeepVM.Close()
+
+	for _, trial := range []struct {
+		storageClasses string
+		expectCode     int
+		expectClasses  string // regexp
+	}{
+		{"", http.StatusOK, `^(default|fast)=1$`},
+		{"fast", http.StatusOK, `^fast=1$`},
+		{"default, fast", http.StatusOK, `^default=1, fast=1$`},
+		{"bogus", StorageClassError.HTTPCode, `^$`},
+	} {
+		req, _ := http.NewRequest("PUT", "/"+TestHash, bytes.NewReader(TestBlock))
+		if trial.storageClasses != "" {
+			req.Header.Set("X-Keep-Storage-Classes", trial.storageClasses)
+		}
+		response := httptest.NewRecorder()
+		MakeRESTRouter(testCluster, prometheus.NewRegistry()).ServeHTTP(response, req)
+		ExpectStatusCode(t, trial.storageClasses, trial.expectCode, response)
+		if got := response.Header().Get("X-Keep-Storage-Classes-Confirmed"); !regexp.MustCompile(trial.expectClasses).MatchString(got) {
+			t.Errorf("%q: X-Keep-Storage-Classes-Confirmed %q, expected %q", trial.storageClasses, got, trial.expectClasses)
+		}
+	}
+}
+
 func TestPutAndDeleteSkipReadonlyVolumes(t *testing.T) {
 	defer teardown()
 	theConfig.systemAuthToken = "fake-data-manager-token"
@@ -1194,3 +1229,196 @@ func TestHealthCheckPing(t *testing.T) {
 		t.Errorf("expected response to include %s: got %s", want, response.Body.String())
 	}
 }
+
+// GET requests with a size hint, and PUT requests, should not need
+// any buffers from the pool when all volumes support streaming.
+func TestStreamingRequestsNeedNoBuffers(t *testing.T) {
+	defer teardown()
+
+	vols := []Volume{NewTestableUnixVolume(t, false, false), NewTestableUnixVolume(t, false, false)}
+	for _, v := range vols {
+		defer v.(*TestableUnixVolume).Teardown()
+	}
+	KeepVM = MakeRRVolumeManager(vols)
+	defer KeepVM.Close()
+
+	defer func(orig *bufferPool) {
+		bufs = orig
+	}(bufs)
+	bufs = newBufferPool(1, BlockSize)
+	// Hold the only buffer until the test is done.
+	defer bufs.Put(bufs.Get(BlockSize))
+
+	ok := make(chan struct{})
+	go func() {
+		defer close(ok)
+		for i := 0; i < 2; i++ {
+			response := IssueRequest(
+				&RequestTester{
+					method:      "PUT",
+					uri:         "/" + TestHash,
+					requestBody: TestBlock,
+				})
+			ExpectStatusCode(t, "streaming PUT", http.StatusOK, response)
+			ExpectBody(t, "streaming PUT", TestHashPutResp, response)
+
+			response = IssueRequest(
+				&RequestTester{
+					method: "GET",
+					uri:    fmt.Sprintf("/%s+%d", TestHash, len(TestBlock)),
+				})
+			ExpectStatusCode(t, "streaming GET", http.StatusOK, response)
+			ExpectBody(t, "streaming GET", string(TestBlock), response)
+			if cl := response.Header().Get("Content-Length"); cl != fmt.Sprintf("%d", len(TestBlock)) {
+				t.Errorf("streaming GET: got Content-Length %q", cl)
+			}
+		}
+
+		response := IssueRequest(
+			&RequestTester{
+				method:      "PUT",
+				uri:         "/" + TestHash,
+				requestBody: BadBlock,
+			})
+		ExpectStatusCode(t, "streaming PUT with bad data", RequestHashError.HTTPCode, response)
+
+		response = IssueRequest(
+			&RequestTester{
+				method: "GET",
+				uri:    fmt.Sprintf("/%s+%d", EmptyHash, 0),
+			})
+		ExpectStatusCode(t, "streaming GET nonexistent block", http.StatusNotFound, response)
+	}()
+
+	select {
+	case <-ok:
+	case <-time.After(10 * time.Second):
+		t.Fatal("streaming requests wait for buffers")
+	}
+}
+
+// Serialized volumes must not be streamed to/from clients, otherwise
+// a slow client would hold the volume's lock.
+func TestSerializedVolumesAreNotStreamed(t *testing.T) {
+	defer teardown()
+
+	vols := []Volume{NewTestableUnixVolume(t, true, false), NewTestableUnixVolume(t, false, false)}
+	for _, v := range vols {
+		defer v.(*TestableUnixVolume).Teardown()
+	}
+	KeepVM = MakeRRVolumeManager(vols)
+	defer KeepVM.Close()
+
+	if canStream(KeepVM.AllWritable()) {
+		t.Error("canStream returned true with a serialized volume")
+	}
+	if !canStream(vols[1:]) {
+		t.Error("canStream returned false without a serialized volume")
+	}
+
+	response := IssueRequest(
+		&RequestTester{
+			method:      "PUT",
+			uri:         "/" + TestHash,
+			requestBody: TestBlock,
+		})
+	ExpectStatusCode(t, "buffered PUT", http.StatusOK, response)
+
+	vols[1].(*TestableUnixVolume).PutRaw(TestHash, TestBlock)
+	response = IssueRequest(
+		&RequestTester{
+			method: "GET",
+			uri:    fmt.Sprintf("/%s+%d", TestHash, len(TestBlock)),
+		})
+	ExpectStatusCode(t, "GET", http.StatusOK, response)
+	ExpectBody(t, "GET", string(TestBlock), response)
+}
+
+// Test the "since" parameter of IndexHandler: only blocks written at
+// or after the given time are listed.
+func TestIndexHandlerSince(t *testing.T) {
+	defer teardown()
+
+	KeepVM = MakeTestVolumeManager(2)
+	defer KeepVM.Close()
+
+	vols := KeepVM.AllWritable()
+	vols[0].Put(context.Background(), TestHash, TestBlock)
+	vols[1].Put(context.Background(), TestHash2, TestBlock2)
+	since := time.Now().Add(-time.Hour)
+	vols[0].(*MockVolume).Timestamps[TestHash] = since.Add(-time.Second)
+	vols[1].(*MockVolume).Timestamps[TestHash2] = since
+
+	theConfig.systemAuthToken = "DATA MANAGER TOKEN"
+
+	response := IssueRequest(&RequestTester{
+		method:   "GET",
+		uri:      fmt.Sprintf("/index?since=%d", since.UnixNano()),
+		apiToken: theConfig.systemAuthToken,
+	})
+	ExpectStatusCode(t, "index since", http.StatusOK, response)
+	ExpectBody(t, "index since", fmt.Sprintf("%s+%d %d\n\n", TestHash2, len(TestBlock2), since.UnixNano()), response)
+
+	response = IssueRequest(&RequestTester{
+		method:   "GET",
+		uri:      "/mounts/" + KeepVM.Mounts()[0].UUID + "/blocks?since=" + fmt.Sprint(since.UnixNano()),
+		apiToken: theConfig.systemAuthToken,
+	})
+	ExpectStatusCode(t, "mount index since", http.StatusOK, response)
+	ExpectBody(t, "mount index since", "\n", response)
+
+	response = IssueRequest(&RequestTester{
+		method:   "GET",
+		uri:      "/index?since=yesterday",
+		apiToken: theConfig.systemAuthToken,
+	})
+	ExpectStatusCode(t, "invalid since", http.StatusBadRequest, response)
+}
+
+// The index generation reported with a mount index changes when a
+// block is removed from the mount, and not otherwise.
+func TestIndexGeneration(t *testing.T) {
+	defer teardown()
+
+	KeepVM = MakeTestVolumeManager(2)
+	defer KeepVM.Close()
+
+	vols := KeepVM.AllWritable()
+	vols[0].Put(context.Background(), TestHash, TestBlock)
+
+	theConfig.BlobSignatureTTL = arvados.Duration(0)
+	theConfig.systemAuthToken = "DATA MANAGER TOKEN"
+	theConfig.EnableDelete = true
+
+	generation := func(mnt int) string {
+		response := IssueRequest(&RequestTester{
+			method:   "GET",
+			uri:      "/mounts/" + KeepVM.Mounts()[mnt].UUID + "/blocks",
+			apiToken: theConfig.systemAuthToken,
+		})
+		ExpectStatusCode(t, "mount index", http.StatusOK, response)
+		gen := response.Header().Get("X-Keep-Index-Generation")
+		if gen == "" {
+			t.Errorf("mount %d: no X-Keep-Index-Generation header", mnt)
+		}
+		return gen
+	}
+
+	gen0, gen1 := generation(0), generation(1)
+	if gen := generation(0); gen != gen0 {
+		t.Errorf("generation changed from %q to %q without removing any blocks", gen0, gen)
+	}
+
+	response := IssueRequest(&RequestTester{
+		method:   "DELETE",
+		uri:      "/" + TestHash,
+		apiToken: theConfig.systemAuthToken,
+	})
+	ExpectStatusCode(t, "delete", http.StatusOK, response)
+	if gen := generation(0); gen == gen0 {
+		t.Errorf("generation %q did not change after deleting a block", gen)
+	}
+	if gen := generation(1); gen == gen1 {
+		t.Errorf("generation %q did not change after trying to delete a block", gen)
+	}
+}
@@ -5,10 +5,12 @@
 package main
 
 import (
+	"bytes"
 	"container/list"
 	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -70,6 +72,10 @@ func MakeRESTRouter(cluster *arvados.Cluster, reg *prometheus.Registry) http.Han
 	rtr.HandleFunc(`/mounts/{uuid}/blocks`, rtr.IndexHandler).Methods("GET")
 	rtr.HandleFunc(`/mounts/{uuid}/blocks/`, rtr.IndexHandler).Methods("GET")
 
+	// Start, check, or cancel evacuation of a mount. Privileged
+	// client only.
+	rtr.HandleFunc(`/mounts/{uuid}/evacuate`, rtr.EvacuateHandler).Methods("GET", "PUT", "DELETE")
+
 	// Replace the current pull queue.
 	rtr.HandleFunc(`/pull`, PullHandler).Methods("PUT")
 
@@ -124,6 +130,36 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	hash := mux.Vars(req)["hash"]
+
+	// If the client gave us a size hint, stream the data from
+	// the volume without buffering the whole block, using the
+	// hint as the Content-Length. GetBlockTo verifies the data
+	// as it is sent, and stops short of the promised length if
+	// it turns out to be corrupt or the hint is wrong.
+	if size, err := strconv.ParseInt(strings.SplitN(mux.Vars(req)["hints"], "+", 2)[0], 10, 64); err == nil && size >= 0 {
+		sw := &startWriter{ResponseWriter: resp}
+		err = GetBlockTo(ctx, hash, size, sw, sw.start)
+		if err == nil {
+			return
+		}
+		if sw.started {
+			// We have already sent a 200 status and
+			// part of the response body. All we can do
+			// is stop short of the promised
+			// Content-Length, so the client knows the
+			// response is incomplete.
+			log.Printf("GetBlockTo(%s): error after sending %d bytes: %s", hash, sw.sent, err)
+			return
+		}
+		code := http.StatusInternalServerError
+		if err, ok := err.(*KeepError); ok {
+			code = err.HTTPCode
+		}
+		http.Error(resp, err.Error(), code)
+		return
+	}
+
 	// TODO: Probe volumes to check whether the block _might_
 	// exist. Some volumes/types could support a quick existence
 	// check without causing other operations to suffer. If all
@@ -138,7 +174,7 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 	}
 	defer bufs.Put(buf)
 
-	size, err := GetBlock(ctx, mux.Vars(req)["hash"], buf, resp)
+	size, err := GetBlock(ctx, hash, buf, resp)
 	if err != nil {
 		code := http.StatusInternalServerError
 		if err, ok := err.(*KeepError); ok {
@@ -169,6 +205,35 @@ func contextForResponse(parent context.Context, resp http.ResponseWriter) (conte
 	return ctx, cancel
 }
 
+// startWriter is an http.ResponseWriter that sends the response
+// headers when start is called, just before the first byte of the
+// response body is written. Until then, the handler can still send
+// an error response instead.
+type startWriter struct {
+	http.ResponseWriter
+	started bool
+	sent    int64
+}
+
+func (sw *startWriter) start(size int64) {
+	if sw.started {
+		return
+	}
+	sw.started = true
+	sw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	sw.Header().Set("Content-Type", "application/octet-stream")
+	sw.WriteHeader(http.StatusOK)
+}
+
+func (sw *startWriter) Write(p []byte) (int, error) {
+	if !sw.started {
+		return 0, errors.New("startWriter: Write called before start")
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.sent += int64(n)
+	return n, err
+}
+
 // Get a buffer from the pool -- but give up and return a non-nil
 // error if ctx ends before we get a buffer.
 func getBufferWithContext(ctx context.Context, bufs *bufferPool, bufSize int) ([]byte, error) {
@@ -215,22 +280,33 @@ func (rtr *router) handlePUT(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	buf, err := getBufferWithContext(ctx, bufs, int(req.ContentLength))
-	if err != nil {
-		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
-		return
-	}
+	wantStorageClasses := parseStorageClasses(req.Header.Get("X-Keep-Storage-Classes"))
 
-	_, err = io.ReadFull(req.Body, buf)
-	if err != nil {
-		http.Error(resp, err.Error(), 500)
+	var result putProgress
+	var err error
+	if canStream(KeepVM.AllWritable()) {
+		// Write the request body directly to a volume,
+		// without buffering the whole block.
+		result, err = PutBlockFromReader(ctx, req.Body, req.ContentLength, hash, wantStorageClasses)
+	} else {
+		var buf []byte
+		buf, err = getBufferWithContext(ctx, bufs, int(req.ContentLength))
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		_, err = io.ReadFull(req.Body, buf)
+		if err != nil {
+			http.Error(resp, err.Error(), 500)
+			bufs.Put(buf)
+			return
+		}
+
+		result, err = PutBlock(ctx, buf, hash, wantStorageClasses)
 		bufs.Put(buf)
-		return
 	}
 
-	replication, err := PutBlock(ctx, buf, hash)
-	bufs.Put(buf)
-
 	if err != nil {
 		code := http.StatusInternalServerError
 		if err, ok := err.(*KeepError); ok {
@@ -248,24 +324,55 @@ func (rtr *router) handlePUT(resp http.ResponseWriter, req *http.Request) {
 		expiry := time.Now().Add(theConfig.BlobSignatureTTL.Duration())
 		returnHash = SignLocator(returnHash, apiToken, expiry)
 	}
+	replication := result.TotalReplication()
+	classes := result.ClassReplication()
+	if want, _ := strconv.Atoi(req.Header.Get("X-Keep-Desired-Replicas")); want > replication && req.Header.Get("X-Keep-Forward") == "true" {
+		// The client sent the block only once and wants us
+		// to store the other replicas on other servers.
+		n, fwdClasses := rtr.forwardBlock(ctx, req, hash, req.ContentLength, want-replication)
+		replication += n
+		for class, n := range fwdClasses {
+			classes[class] += n
+		}
+	}
 	resp.Header().Set("X-Keep-Replicas-Stored", strconv.Itoa(replication))
+	resp.Header().Set("X-Keep-Storage-Classes-Confirmed", formatStorageClassesConfirmed(classes))
 	resp.Write([]byte(returnHash + "\n"))
 }
 
 // IndexHandler responds to "/index", "/index/{prefix}", and
 // "/mounts/{uuid}/blocks" requests.
+//
+// If the "since" parameter is given (nanoseconds since Unix epoch),
+// only blocks with an mtime at or after that time are listed.
+//
+// Responses to "/mounts/{uuid}/blocks" requests include the mount's
+// index generation (see indexGenerations) in an
+// X-Keep-Index-Generation header. It is determined before the index
+// is listed, so if it is the same in two responses, no blocks have
+// been removed from the mount since the first one was listed.
 func (rtr *router) IndexHandler(resp http.ResponseWriter, req *http.Request) {
 	if !IsSystemAuth(GetAPIToken(req)) {
 		http.Error(resp, UnauthorizedError.Error(), UnauthorizedError.HTTPCode)
 		return
 	}
 
+	req.ParseForm()
 	prefix := mux.Vars(req)["prefix"]
 	if prefix == "" {
-		req.ParseForm()
 		prefix = req.Form.Get("prefix")
 	}
 
+	var w io.Writer = resp
+	if s := req.Form.Get("since"); s != "" {
+		since, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(resp, "invalid since parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w = &indexSinceWriter{w: resp, since: since}
+	}
+
 	uuid := mux.Vars(req)["uuid"]
 
 	var vols []Volume
@@ -276,10 +383,11 @@ func (rtr *router) IndexHandler(resp http.ResponseWriter, req *http.Request) {
 		return
 	} else {
 		vols = []Volume{v}
+		resp.Header().Set("X-Keep-Index-Generation", generations.Get(v))
 	}
 
 	for _, v := range vols {
-		if err := v.IndexTo(prefix, resp); err != nil {
+		if err := v.IndexTo(prefix, w); err != nil {
 			// We can't send an error message to the
 			// client because we might have already sent
 			// headers and index content. All we can do is
@@ -301,9 +409,93 @@ func (rtr *router) IndexHandler(resp http.ResponseWriter, req *http.Request) {
 	resp.Write([]byte{'\n'})
 }
 
+// indexSinceWriter passes through the index lines ("hash+size
+// mtime") written by Volume.IndexTo, except those with an mtime
+// before since.
+type indexSinceWriter struct {
+	w     io.Writer
+	since int64
+	buf   []byte
+}
+
+func (isw *indexSinceWriter) Write(p []byte) (int, error) {
+	isw.buf = append(isw.buf, p...)
+	for {
+		eol := bytes.IndexByte(isw.buf, '\n')
+		if eol < 0 {
+			break
+		}
+		line := isw.buf[:eol+1]
+		isw.buf = isw.buf[eol+1:]
+		if sp := bytes.LastIndexByte(line, ' '); sp >= 0 {
+			mtime, err := strconv.ParseInt(string(line[sp+1:eol]), 10, 64)
+			if err == nil && mtime < isw.since {
+				continue
+			}
+		}
+		if _, err := isw.w.Write(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
 // MountsHandler responds to "GET /mounts" requests.
+//
+// Mounts that are being evacuated are reported as read-only, so
+// keep-balance doesn't send pull requests for them.
 func (rtr *router) MountsHandler(resp http.ResponseWriter, req *http.Request) {
-	err := json.NewEncoder(resp).Encode(KeepVM.Mounts())
+	var mounts []*VolumeMount
+	for _, mnt := range KeepVM.Mounts() {
+		if !mnt.ReadOnly && evacuations.Has(mnt.volume) {
+			ro := *mnt
+			ro.ReadOnly = true
+			mnt = &ro
+		}
+		mounts = append(mounts, mnt)
+	}
+	err := json.NewEncoder(resp).Encode(mounts)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// EvacuateHandler responds to "/mounts/{uuid}/evacuate" requests.
+//
+// PUT starts copying every block on the mount to other mounts or
+// servers, and stops new blocks from being written to it. GET reports
+// progress. DELETE cancels the evacuation and returns the mount to
+// normal service.
+func (rtr *router) EvacuateHandler(resp http.ResponseWriter, req *http.Request) {
+	if !IsSystemAuth(GetAPIToken(req)) {
+		http.Error(resp, UnauthorizedError.Error(), UnauthorizedError.HTTPCode)
+		return
+	}
+	uuid := mux.Vars(req)["uuid"]
+	vol := KeepVM.Lookup(uuid, false)
+	if vol == nil {
+		http.Error(resp, "mount not found", http.StatusNotFound)
+		return
+	}
+
+	var ev *evacuator
+	switch req.Method {
+	case "PUT":
+		ev = evacuations.Start(uuid, vol, rtr.cluster)
+	case "DELETE":
+		if err := evacuations.Cancel(vol); err != nil {
+			http.Error(resp, err.Error(), http.StatusNotFound)
+			return
+		}
+		resp.WriteHeader(http.StatusOK)
+		return
+	default:
+		if ev = evacuations.Get(vol); ev == nil {
+			http.Error(resp, errNotEvacuating.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	err := json.NewEncoder(resp).Encode(ev.Status())
 	if err != nil {
 		http.Error(resp, err.Error(), http.StatusInternalServerError)
 	}
@@ -318,9 +510,11 @@ type PoolStatus struct {
 
 type volumeStatusEnt struct {
 	Label         string
-	Status        *VolumeStatus `json:",omitempty"`
-	VolumeStats   *ioStats      `json:",omitempty"`
-	InternalStats interface{}   `json:",omitempty"`
+	Status        *VolumeStatus   `json:",omitempty"`
+	VolumeStats   *ioStats        `json:",omitempty"`
+	InternalStats interface{}     `json:",omitempty"`
+	Scrub         *ScrubStatus    `json:",omitempty"`
+	Evacuate      *EvacuateStatus `json:",omitempty"`
 }
 
 // NodeStatus struct
@@ -378,10 +572,20 @@ func (rtr *router) readNodeStatus(st *NodeStatus) {
 		if vol, ok := vol.(InternalStatser); ok {
 			internalStats = vol.InternalStats()
 		}
+		var scrubStatus *ScrubStatus
+		if s := scrubberFor(vol); s != nil {
+			scrubStatus = s.Status()
+		}
+		var evacuateStatus *EvacuateStatus
+		if ev := evacuations.Get(vol); ev != nil {
+			evacuateStatus = ev.Status()
+		}
 		st.Volumes = append(st.Volumes, &volumeStatusEnt{
 			Label:         vol.String(),
 			Status:        vol.Status(),
 			InternalStats: internalStats,
+			Scrub:         scrubStatus,
+			Evacuate:      evacuateStatus,
 			//VolumeStats: KeepVM.VolumeStats(vol),
 		})
 	}
@@ -457,6 +661,7 @@ func DeleteHandler(resp http.ResponseWriter, req *http.Request) {
 		Failed  int `json:"copies_failed"`
 	}
 	for _, vol := range KeepVM.AllWritable() {
+		generations.Bump(vol)
 		if err := vol.Trash(hash); err == nil {
 			result.Deleted++
 		} else if os.IsNotExist(err) {
@@ -616,6 +821,7 @@ func UntrashHandler(resp http.ResponseWriter, req *http.Request) {
 	var untrashedOn, failedOn []string
 	var numNotFound int
 	for _, vol := range KeepVM.AllWritable() {
+		generations.Bump(vol)
 		err := vol.Untrash(hash)
 
 		if os.IsNotExist(err) {
@@ -713,16 +919,20 @@ func GetBlock(ctx context.Context, hash string, buf []byte, resp http.ResponseWr
 
 // PutBlock Stores the BLOCK (identified by the content id HASH) in Keep.
 //
-// PutBlock(ctx, block, hash)
+// PutBlock(ctx, block, hash, wantStorageClasses)
 //   Stores the BLOCK (identified by the content id HASH) in Keep.
 //
 //   The MD5 checksum of the block must be identical to the content id HASH.
 //   If not, an error is returned.
 //
-//   PutBlock stores the BLOCK on the first Keep volume with free space.
+//   If wantStorageClasses is empty, PutBlock stores the BLOCK on the
+//   first Keep volume with free space. Otherwise, it stores the BLOCK
+//   on enough volumes to cover each of the requested storage classes
+//   that is offered by at least one local volume.
 //   A failure code is returned to the user only if all volumes fail.
 //
-//   On success, PutBlock returns nil.
+//   On success, PutBlock returns nil, and a putProgress reporting
+//   the replication achieved in each storage class.
 //   On failure, it returns a KeepError with one of the following codes:
 //
 //   500 Collision
@@ -733,53 +943,61 @@ func GetBlock(ctx context.Context, hash string, buf []byte, resp http.ResponseWr
 //   503 Full
 //          There was not enough space left in any Keep volume to store
 //          the object.
+//   503 StorageClass
+//          None of the writable volumes offer any of the requested
+//          storage classes.
 //   500 Fail
 //          The object could not be stored for some other reason (e.g.
 //          all writes failed). The text of the error message should
 //          provide as much detail as possible.
 //
-func PutBlock(ctx context.Context, block []byte, hash string) (int, error) {
+func PutBlock(ctx context.Context, block []byte, hash string, wantStorageClasses []string) (putProgress, error) {
+	result := newPutProgress(wantStorageClasses)
+
 	// Check that BLOCK's checksum matches HASH.
 	blockhash := fmt.Sprintf("%x", md5.Sum(block))
 	if blockhash != hash {
 		log.Printf("%s: MD5 checksum %s did not match request", hash, blockhash)
-		return 0, RequestHashError
+		return result, RequestHashError
 	}
 
 	// If we already have this data, it's intact on disk, and we
 	// can update its timestamp, return success. If we have
 	// different data with the same hash, return failure.
-	if n, err := CompareAndTouch(ctx, hash, block); err == nil || err == CollisionError {
-		return n, err
+	if err := CompareAndTouch(ctx, hash, block, &result); err == CollisionError {
+		return result, err
 	} else if ctx.Err() != nil {
-		return 0, ErrClientDisconnect
+		return result, ErrClientDisconnect
 	}
-
-	// Choose a Keep volume to write to.
-	// If this volume fails, try all of the volumes in order.
-	if vol := KeepVM.NextWritable(); vol != nil {
-		if err := vol.Put(ctx, hash, block); err == nil {
-			return vol.Replication(), nil // success!
-		}
-		if ctx.Err() != nil {
-			return 0, ErrClientDisconnect
-		}
+	if result.Satisfied() {
+		return result, nil
 	}
 
-	writables := KeepVM.AllWritable()
+	writables := nextWritables()
 	if len(writables) == 0 {
 		log.Print("No writable volumes.")
-		return 0, FullError
+		return result, FullError
 	}
 
-	allFull := true
+	// Write to each volume that satisfies a storage class we
+	// still need, starting with the next volume in round-robin
+	// order.
+	tried, allFull := false, true
 	for _, vol := range writables {
+		if !result.Wants(vol) {
+			continue
+		}
+		tried = true
 		err := vol.Put(ctx, hash, block)
 		if ctx.Err() != nil {
-			return 0, ErrClientDisconnect
+			return result, ErrClientDisconnect
 		}
 		if err == nil {
-			return vol.Replication(), nil // success!
+			result.Add(vol)
+			if result.Satisfied() {
+				return result, nil // success!
+			}
+			continue
 		}
 		if err != FullError {
 			// The volume is not full but the
@@ -789,26 +1007,26 @@ func PutBlock(ctx context.Context, block []byte, hash string) (int, error) {
 			log.Printf("%s: Write(%s): %s", vol, hash, err)
 		}
 	}
-
-	if allFull {
-		log.Print("All volumes are full.")
-		return 0, FullError
-	}
-	// Already logged the non-full errors.
-	return 0, GenericError
+	return result, result.failure(tried, allFull)
 }
 
-// CompareAndTouch returns the current replication level if one of the
-// volumes already has the given content and it successfully updates
-// the relevant block's modification time in order to protect it from
-// premature garbage collection. Otherwise, it returns a non-nil
-// error.
-func CompareAndTouch(ctx context.Context, hash string, buf []byte) (int, error) {
-	var bestErr error = NotFoundError
+// CompareAndTouch looks for intact copies of the given content on
+// the writable volumes that satisfy storage classes still wanted by
+// result. It updates the modification time of each copy it finds,
+// in order to protect it from premature garbage collection, and
+// adds the volume to result.
+//
+// It returns CollisionError if a volume has different data with the
+// same hash, or ctx.Err() if ctx is cancelled. Other errors are
+// logged, and the volume is skipped.
+func CompareAndTouch(ctx context.Context, hash string, buf []byte, result *putProgress) error {
 	for _, vol := range KeepVM.AllWritable() {
+		if !result.Wants(vol) {
+			continue
+		}
 		err := vol.Compare(ctx, hash, buf)
 		if ctx.Err() != nil {
-			return 0, ctx.Err()
+			return ctx.Err()
 		} else if err == CollisionError {
 			// Stop if we have a block with same hash but
 			// different content. (It will be impossible
@@ -816,7 +1034,340 @@ func CompareAndTouch(ctx context.Context, hash string, buf []byte) (int, error)
 			// both, so there's no point writing it even
 			// on a different volume.)
 			log.Printf("%s: Compare(%s): %s", vol, hash, err)
-			return 0, err
+			return err
+		} else if os.IsNotExist(err) {
+			// Block does not exist. This is the only
+			// "normal" error: we don't log anything.
+			continue
+		} else if err != nil {
+			// Couldn't open file, data is corrupt on
+			// disk, etc.: log this abnormal condition,
+			// and try the next volume.
+			log.Printf("%s: Compare(%s): %s", vol, hash, err)
+			continue
+		}
+		if err := vol.Touch(hash); err != nil {
+			log.Printf("%s: Touch %s failed: %s", vol, hash, err)
+			continue
+		}
+		// Compare and Touch both worked --> this volume
+		// counts.
+		result.Add(vol)
+		if result.Satisfied() {
+			return nil
+		}
+	}
+	return nil
+}
+
+// nextWritables returns all writable volumes, starting with the next
+// one in round-robin order.
+func nextWritables() []Volume {
+	writables := KeepVM.AllWritable()
+	if len(writables) == 0 {
+		return nil
+	}
+	next := KeepVM.NextWritable()
+	vols := []Volume{next}
+	for _, vol := range writables {
+		if vol != next {
+			vols = append(vols, vol)
+		}
+	}
+	return vols
+}
+
+// A serializedVolume performs only one read or write at a time (see
+// UnixVolume.Serialize).
+type serializedVolume interface {
+	serialized() bool
+}
+
+// canStream returns true if all of the given volumes implement
+// BlockReader and BlockWriter, i.e., PutBlockFromReader can use them.
+//
+// Serialized volumes can't stream: the volume would stay locked
+// while waiting for the client, so one slow client would stall all
+// other requests. Their data is buffered instead, and the lock is
+// held only for disk I/O.
+func canStream(vols []Volume) bool {
+	for _, vol := range vols {
+		if sv, ok := vol.(serializedVolume); ok && sv.serialized() {
+			return false
+		}
+		if _, ok := vol.(BlockReader); !ok {
+			return false
+		}
+		if _, ok := vol.(BlockWriter); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// GetBlockTo is like GetBlock, but writes the block data to w instead
+// of a buffer. It calls start with the size of the block before
+// writing any data to w.
+//
+// Volumes that implement BlockReader (and are not serialized, see
+// canStream) stream the data to w, so no block-sized buffer is
+// needed. The caller must supply the expected size of the block,
+// which is passed to start before the first data is written. The
+// data is verified as it is sent: the last chunk read from the
+// volume is withheld until the whole block has been checked against
+// the hash and size, so w never receives a complete copy of a
+// corrupt block. If the error is detected before any data has been
+// written to w (e.g., the block fits in a single chunk), the copy
+// on the next volume is tried instead. Other volumes are read into
+// a buffer from the pool, as in GetBlock.
+//
+// If an error occurs after some data has already been written to w,
+// GetBlockTo returns that error without trying the remaining
+// volumes.
+func GetBlockTo(ctx context.Context, hash string, size int64, w io.Writer, start func(size int64)) error {
+	errorToCaller := NotFoundError
+
+	var buf []byte
+	defer func() {
+		if buf != nil {
+			bufs.Put(buf)
+		}
+	}()
+
+	for _, vol := range KeepVM.AllReadable() {
+		var err error
+		var sent int64
+		var filehash string
+		if br, ok := vol.(BlockReader); ok && canStream([]Volume{vol}) {
+			sw := &sizeCheckWriter{writer: w, size: size, start: start}
+			hcw := newHashCheckWriter(sw, hash)
+			err = br.ReadBlock(ctx, hash, hcw)
+			if err == nil {
+				err = hcw.Close()
+			}
+			if err == nil && sw.sent != size {
+				err = BadRequestError
+			} else if err == nil && !sw.started {
+				// Empty block: nothing was written, so
+				// start hasn't been called yet.
+				start(size)
+			}
+			sent, filehash = sw.sent, hcw.Sum()
+		} else {
+			if buf == nil {
+				buf, err = getBufferWithContext(ctx, bufs, BlockSize)
+				if err != nil {
+					return err
+				}
+			}
+			var size int
+			size, err = vol.Get(ctx, hash, buf)
+			if err == nil {
+				filehash = fmt.Sprintf("%x", md5.Sum(buf[:size]))
+				if filehash != hash {
+					err = DiskHashError
+				}
+			}
+			if err == nil {
+				start(int64(size))
+				var n int
+				n, err = w.Write(buf[:size])
+				sent = int64(n)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ErrClientDisconnect
+		default:
+		}
+		if err == nil {
+			if errorToCaller == DiskHashError {
+				log.Printf("%s: checksum mismatch for request %s but a good copy was found on another volume and returned",
+					vol, hash)
+			}
+			return nil
+		}
+		if err == DiskHashError {
+			// TODO: Try harder to tell a sysadmin about
+			// this.
+			log.Printf("%s: checksum mismatch for request %s (actual %s)",
+				vol, hash, filehash)
+		} else if !os.IsNotExist(err) {
+			log.Printf("%s: Get(%s): %s", vol, hash, err)
+		}
+		if sent > 0 {
+			return err
+		}
+		// If some volume returns a transient error, return it
+		// to the caller instead of "Not found" so it can
+		// retry.
+		if err == VolumeBusyError || err == DiskHashError || err == BadRequestError {
+			errorToCaller = err.(*KeepError)
+		}
+	}
+	return errorToCaller
+}
+
+// sizeCheckWriter calls start(size) just before passing the first
+// data through to the underlying writer, and refuses to write more
+// than size bytes.
+type sizeCheckWriter struct {
+	writer  io.Writer
+	size    int64
+	start   func(size int64)
+	started bool
+	sent    int64
+}
+
+func (sw *sizeCheckWriter) Write(p []byte) (int, error) {
+	if sw.sent+int64(len(p)) > sw.size {
+		return 0, BadRequestError
+	}
+	if !sw.started {
+		sw.started = true
+		sw.start(sw.size)
+	}
+	n, err := sw.writer.Write(p)
+	sw.sent += int64(n)
+	return n, err
+}
+
+// PutBlockFromReader is like PutBlock, but reads the block data from
+// rdr instead of a buffer, and stores it using the BlockWriter
+// interface. All writable volumes must implement BlockReader and
+// BlockWriter (see canStream).
+//
+// The data is verified against the hash and size as it is read. If
+// it doesn't match, the BlockWriter sees RequestHashError instead of
+// EOF, and the bad data is not stored.
+//
+// Since rdr can only be read once, PutBlockFromReader tries the next
+// writable volume only if the previous one failed before consuming
+// any data. If more volumes are needed to satisfy the requested
+// storage classes, the block is copied to them from the first one.
+func PutBlockFromReader(ctx context.Context, rdr io.Reader, size int64, hash string, wantStorageClasses []string) (putProgress, error) {
+	body := newHashCheckReader(rdr, hash, size)
+	result := newPutProgress(wantStorageClasses)
+
+	// If we already have this data, it's intact on disk, and we
+	// can update its timestamp, use it. If we have different
+	// data with the same hash, return failure.
+	src, err := CompareAndTouchReader(ctx, hash, body, &result)
+	if ctx.Err() != nil {
+		return result, ErrClientDisconnect
+	} else if err != nil {
+		return result, err
+	}
+
+	writables := nextWritables()
+	if len(writables) == 0 {
+		log.Print("No writable volumes.")
+		return result, FullError
+	}
+
+	if src == nil {
+		tried, allFull := false, true
+		for _, vol := range writables {
+			if !result.Wants(vol) {
+				continue
+			}
+			tried = true
+			err := vol.(BlockWriter).WriteBlock(ctx, hash, body)
+			if ctx.Err() != nil {
+				return result, ErrClientDisconnect
+			}
+			if err == nil {
+				result.Add(vol)
+				src = vol
+				break
+			}
+			if body.Consumed() {
+				// We can't retry on another volume
+				// because the data is gone.
+				if err, ok := err.(*KeepError); ok {
+					return result, err
+				}
+				log.Printf("%s: WriteBlock(%s): %s", vol, hash, err)
+				return result, GenericError
+			}
+			if err != FullError {
+				// The volume is not full but the
+				// write did not succeed.  Report the
+				// error and continue trying.
+				allFull = false
+				log.Printf("%s: WriteBlock(%s): %s", vol, hash, err)
+			}
+		}
+		if src == nil {
+			return result, result.failure(tried, allFull)
+		}
+	}
+
+	// Copy the stored block to any other volumes needed for the
+	// requested storage classes.
+	for _, vol := range writables {
+		if result.Satisfied() {
+			break
+		}
+		if !result.Wants(vol) {
+			continue
+		}
+		err := copyBlock(ctx, src, vol, hash, size)
+		if ctx.Err() != nil {
+			return result, ErrClientDisconnect
+		}
+		if err != nil {
+			log.Printf("%s: copy %s from %s: %s", vol, hash, src, err)
+			continue
+		}
+		result.Add(vol)
+	}
+	return result, nil
+}
+
+// copyBlock copies a block from one volume to another, verifying its
+// hash and size on the way. Both volumes must implement BlockReader
+// and BlockWriter.
+func copyBlock(ctx context.Context, src, dst Volume, hash string, size int64) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.(BlockReader).ReadBlock(ctx, hash, pw))
+	}()
+	err := dst.(BlockWriter).WriteBlock(ctx, hash, newHashCheckReader(pr, hash, size))
+	// Unblock the reader goroutine if WriteBlock returned early.
+	pr.CloseWithError(err)
+	return err
+}
+
+// CompareAndTouchReader is like CompareAndTouch, but compares the
+// stored data with the data read from body instead of a buffer. All
+// writable volumes must implement BlockReader.
+//
+// Each stored copy is checked against the hash before any data is
+// read from body. This way, if the stored copies turn out to be
+// corrupt or missing, body has not been consumed and the caller can
+// still write it to a volume.
+//
+// If an intact copy is found, body is compared with it before any
+// timestamps are updated, so a client that sends different data
+// with the same hash doesn't refresh the stored block or count
+// toward its replication. Once body has been found to match, that
+// volume and any other volumes with intact copies are touched and
+// added to result, and the volume body was compared with is
+// returned.
+func CompareAndTouchReader(ctx context.Context, hash string, body io.Reader, result *putProgress) (Volume, error) {
+	var found Volume
+	for _, vol := range KeepVM.AllWritable() {
+		if !result.Wants(vol) {
+			continue
+		}
+		h := md5.New()
+		err := vol.(BlockReader).ReadBlock(ctx, hash, h)
+		if err == nil && fmt.Sprintf("%x", h.Sum(nil)) != hash {
+			err = DiskHashError
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		} else if os.IsNotExist(err) {
 			// Block does not exist. This is the only
 			// "normal" error: we don't log anything.
@@ -828,15 +1379,38 @@ func CompareAndTouch(ctx context.Context, hash string, buf []byte) (int, error)
 			log.Printf("%s: Compare(%s): %s", vol, hash, err)
 			continue
 		}
+		if found == nil {
+			// Make sure the client sent the same data,
+			// and not a different block with the same
+			// hash, before touching anything.
+			err := compareReaderWithBlock(ctx, body, vol.(BlockReader), hash)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			} else if err == CollisionError {
+				// It will be impossible to tell which
+				// one is wanted if we have both, so
+				// there's no point writing it even on a
+				// different volume.
+				log.Printf("%s: Compare(%s): %s", vol, hash, err)
+				return nil, err
+			} else if err != nil {
+				return nil, err
+			}
+			// body has been consumed now, so even if
+			// Touch fails, the caller needs this copy
+			// as the source for writing other volumes.
+			found = vol
+		}
 		if err := vol.Touch(hash); err != nil {
 			log.Printf("%s: Touch %s failed: %s", vol, hash, err)
-			bestErr = err
 			continue
 		}
-		// Compare and Touch both worked --> done.
-		return vol.Replication(), nil
+		result.Add(vol)
+		if result.Satisfied() {
+			break
+		}
 	}
-	return 0, bestErr
+	return found, nil
 }
 
 var validLocatorRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
@@ -7,6 +7,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"time"
 )
 
 // A TestableVolumeManagerFactory creates a volume manager with at least two TestableVolume instances.
@@ -27,6 +28,15 @@ func DoHandlersWithGenericVolumeTests(t TB, factory TestableVolumeManagerFactory
 	testPutBlock(t, factory, EmptyHash, EmptyBlock)
 	testPutBlockCorrupt(t, factory, TestHash, TestBlock, []byte("baddata"))
 	testPutBlockCorrupt(t, factory, EmptyHash, EmptyBlock, []byte("baddata"))
+	testGetBlockTo(t, factory, TestHash, TestBlock)
+	testGetBlockTo(t, factory, EmptyHash, EmptyBlock)
+	testPutRawBadDataGetBlockTo(t, factory, TestHash, TestBlock, []byte("baddata"))
+	testPutRawBadDataFirstGetBlockTo(t, factory, TestHash, TestBlock, []byte("baddata"))
+	testPutBlockFromReader(t, factory, TestHash, TestBlock)
+	testPutBlockFromReader(t, factory, EmptyHash, EmptyBlock)
+	testPutBlockFromReaderCorrupt(t, factory, TestHash, TestBlock, []byte("baddata"))
+	testPutBlockFromReaderBadRequest(t, factory, TestHash, TestBlock)
+	testPutBlockFromReaderBadDataNoTouch(t, factory, TestHash, TestBlock)
 }
 
 // Setup RRVolumeManager with TestableVolumes
@@ -82,12 +92,12 @@ func testPutBlock(t TB, factory TestableVolumeManagerFactory, testHash string, t
 	setupHandlersWithGenericVolumeTest(t, factory)
 
 	// PutBlock
-	if _, err := PutBlock(context.Background(), testBlock, testHash); err != nil {
+	if _, err := PutBlock(context.Background(), testBlock, testHash, nil); err != nil {
 		t.Fatalf("Error during PutBlock: %s", err)
 	}
 
 	// Check that PutBlock succeeds again even after CompareAndTouch
-	if _, err := PutBlock(context.Background(), testBlock, testHash); err != nil {
+	if _, err := PutBlock(context.Background(), testBlock, testHash, nil); err != nil {
 		t.Fatalf("Error during PutBlock: %s", err)
 	}
 
@@ -111,7 +121,7 @@ func testPutBlockCorrupt(t TB, factory TestableVolumeManagerFactory,
 	testableVolumes[1].PutRaw(testHash, badData)
 
 	// Check that PutBlock with good data succeeds
-	if _, err := PutBlock(context.Background(), testBlock, testHash); err != nil {
+	if _, err := PutBlock(context.Background(), testBlock, testHash, nil); err != nil {
 		t.Fatalf("Error during PutBlock for %q: %s", testHash, err)
 	}
 
@@ -125,3 +135,160 @@ func testPutBlockCorrupt(t TB, factory TestableVolumeManagerFactory,
 		t.Errorf("Get response incorrect. Expected %q; found %q", testBlock, buf[:size])
 	}
 }
+
+// Put a block using PutRaw in just one volume and Get it using
+// GetBlockTo
+func testGetBlockTo(t TB, factory TestableVolumeManagerFactory, testHash string, testBlock []byte) {
+	testableVolumes := setupHandlersWithGenericVolumeTest(t, factory)
+
+	testableVolumes[1].PutRaw(testHash, testBlock)
+
+	var buf bytes.Buffer
+	err := GetBlockTo(context.Background(), testHash, int64(len(testBlock)), &buf, func(int64) {})
+	if err != nil {
+		t.Fatalf("Error while getting block %s", err)
+	}
+	if bytes.Compare(buf.Bytes(), testBlock) != 0 {
+		t.Errorf("Put succeeded but GetBlockTo returned %+v, expected %+v", buf.Bytes(), testBlock)
+	}
+}
+
+// Put a bad block using PutRaw and get it using GetBlockTo. The
+// corrupt data must not be written in full.
+func testPutRawBadDataGetBlockTo(t TB, factory TestableVolumeManagerFactory,
+	testHash string, testBlock []byte, badData []byte) {
+	testableVolumes := setupHandlersWithGenericVolumeTest(t, factory)
+
+	testableVolumes[0].PutRaw(testHash, badData)
+	testableVolumes[1].PutRaw(testHash, badData)
+
+	var buf bytes.Buffer
+	err := GetBlockTo(context.Background(), testHash, int64(len(testBlock)), &buf, func(int64) {})
+	if err == nil {
+		t.Fatalf("Got %+q, expected error while getting corrupt block %v", buf.Bytes(), testHash)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("GetBlockTo returned error but wrote corrupt data %+q", buf.Bytes())
+	}
+}
+
+// Put a bad block on the first volume and a good one on the second
+// volume using PutRaw, and get it using GetBlockTo. Only the good
+// data must be written.
+func testPutRawBadDataFirstGetBlockTo(t TB, factory TestableVolumeManagerFactory,
+	testHash string, testBlock []byte, badData []byte) {
+	testableVolumes := setupHandlersWithGenericVolumeTest(t, factory)
+
+	testableVolumes[0].PutRaw(testHash, badData)
+	testableVolumes[1].PutRaw(testHash, testBlock)
+
+	var buf bytes.Buffer
+	var size int64 = -1
+	err := GetBlockTo(context.Background(), testHash, int64(len(testBlock)), &buf, func(n int64) { size = n })
+	if err != nil {
+		t.Fatalf("Error during GetBlockTo for %q: %s", testHash, err)
+	}
+	if !bytes.Equal(buf.Bytes(), testBlock) {
+		t.Errorf("GetBlockTo wrote %+q, expected %+q", buf.Bytes(), testBlock)
+	}
+	if size != int64(len(testBlock)) {
+		t.Errorf("GetBlockTo reported size %d, expected %d", size, len(testBlock))
+	}
+}
+
+// Invoke PutBlockFromReader twice to ensure CompareAndTouchReader
+// path is tested.
+func testPutBlockFromReader(t TB, factory TestableVolumeManagerFactory, testHash string, testBlock []byte) {
+	setupHandlersWithGenericVolumeTest(t, factory)
+	if !canStream(KeepVM.AllWritable()) {
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := PutBlockFromReader(context.Background(), bytes.NewReader(testBlock), int64(len(testBlock)), testHash, nil); err != nil {
+			t.Fatalf("Error during PutBlockFromReader: %s", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := GetBlockTo(context.Background(), testHash, int64(len(testBlock)), &buf, func(int64) {})
+	if err != nil {
+		t.Fatalf("Error during GetBlockTo for %q: %s", testHash, err)
+	} else if bytes.Compare(buf.Bytes(), testBlock) != 0 {
+		t.Errorf("Get response incorrect. Expected %q; found %q", testBlock, buf.Bytes())
+	}
+}
+
+// Put a bad block using PutRaw, overwrite it using
+// PutBlockFromReader and get it.
+func testPutBlockFromReaderCorrupt(t TB, factory TestableVolumeManagerFactory,
+	testHash string, testBlock []byte, badData []byte) {
+	testableVolumes := setupHandlersWithGenericVolumeTest(t, factory)
+	if !canStream(KeepVM.AllWritable()) {
+		return
+	}
+
+	testableVolumes[0].PutRaw(testHash, badData)
+	testableVolumes[1].PutRaw(testHash, badData)
+
+	if _, err := PutBlockFromReader(context.Background(), bytes.NewReader(testBlock), int64(len(testBlock)), testHash, nil); err != nil {
+		t.Fatalf("Error during PutBlockFromReader for %q: %s", testHash, err)
+	}
+
+	var buf bytes.Buffer
+	err := GetBlockTo(context.Background(), testHash, int64(len(testBlock)), &buf, func(int64) {})
+	if err != nil {
+		t.Fatalf("Error during GetBlockTo for %q: %s", testHash, err)
+	} else if bytes.Compare(buf.Bytes(), testBlock) != 0 {
+		t.Errorf("Get response incorrect. Expected %q; found %q", testBlock, buf.Bytes())
+	}
+}
+
+// PutBlockFromReader with data that doesn't match the hash, both
+// before and after a good copy has been stored.
+func testPutBlockFromReaderBadRequest(t TB, factory TestableVolumeManagerFactory, testHash string, testBlock []byte) {
+	setupHandlersWithGenericVolumeTest(t, factory)
+	if !canStream(KeepVM.AllWritable()) {
+		return
+	}
+
+	badData := append([]byte(nil), testBlock...)
+	badData[0]++
+	for i := 0; i < 2; i++ {
+		if _, err := PutBlockFromReader(context.Background(), bytes.NewReader(badData), int64(len(badData)), testHash, nil); err != RequestHashError {
+			t.Errorf("PutBlockFromReader with bad data returned %v, expected %v", err, RequestHashError)
+		}
+		if _, err := PutBlockFromReader(context.Background(), bytes.NewReader(testBlock), int64(len(testBlock)), testHash, nil); err != nil {
+			t.Fatalf("Error during PutBlockFromReader for %q: %s", testHash, err)
+		}
+	}
+}
+
+// PutBlockFromReader with data that doesn't match the stored copy
+// must not update the stored copy's timestamp or count it as a
+// replica.
+func testPutBlockFromReaderBadDataNoTouch(t TB, factory TestableVolumeManagerFactory, testHash string, testBlock []byte) {
+	testableVolumes := setupHandlersWithGenericVolumeTest(t, factory)
+	if !canStream(KeepVM.AllWritable()) {
+		return
+	}
+
+	oldMtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	testableVolumes[0].PutRaw(testHash, testBlock)
+	testableVolumes[0].TouchWithDate(testHash, oldMtime)
+
+	badData := append([]byte(nil), testBlock...)
+	badData[0]++
+	result, err := PutBlockFromReader(context.Background(), bytes.NewReader(badData), int64(len(badData)), testHash, nil)
+	if err != RequestHashError {
+		t.Errorf("PutBlockFromReader with bad data returned %v, expected %v", err, RequestHashError)
+	}
+	if n := result.TotalReplication(); n != 0 {
+		t.Errorf("PutBlockFromReader with bad data reported replication %d, expected 0", n)
+	}
+	if mtime, err := testableVolumes[0].Mtime(testHash); err != nil {
+		t.Fatal(err)
+	} else if !mtime.Equal(oldMtime) {
+		t.Errorf("PutBlockFromReader with bad data updated mtime from %v to %v", oldMtime, mtime)
+	}
+}
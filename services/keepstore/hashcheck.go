@@ -0,0 +1,126 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// hashCheckWriter passes data through to an underlying writer while
+// computing its MD5 digest.
+//
+// The most recent Write is held back until Close. If the digest does
+// not match the expected hash, Close returns DiskHashError without
+// passing the held-back data through, so the recipient never
+// receives a complete copy of corrupt data.
+type hashCheckWriter struct {
+	writer  io.Writer
+	expect  string
+	hash    hash.Hash
+	pending []byte
+	sent    int64
+}
+
+func newHashCheckWriter(w io.Writer, expect string) *hashCheckWriter {
+	return &hashCheckWriter{
+		writer: w,
+		expect: expect,
+		hash:   md5.New(),
+	}
+}
+
+// Write implements io.Writer.
+func (hcw *hashCheckWriter) Write(p []byte) (int, error) {
+	if err := hcw.flush(); err != nil {
+		return 0, err
+	}
+	hcw.hash.Write(p)
+	hcw.pending = append(hcw.pending[:0], p...)
+	return len(p), nil
+}
+
+func (hcw *hashCheckWriter) flush() error {
+	if len(hcw.pending) == 0 {
+		return nil
+	}
+	n, err := hcw.writer.Write(hcw.pending)
+	hcw.sent += int64(n)
+	hcw.pending = hcw.pending[:0]
+	return err
+}
+
+// Close verifies the MD5 digest of all data written so far. If it
+// matches, the held-back data is passed through to the underlying
+// writer.
+func (hcw *hashCheckWriter) Close() error {
+	if hcw.Sum() != hcw.expect {
+		return DiskHashError
+	}
+	return hcw.flush()
+}
+
+// Sum returns the hex-encoded MD5 digest of the data written so far.
+func (hcw *hashCheckWriter) Sum() string {
+	return fmt.Sprintf("%x", hcw.hash.Sum(nil))
+}
+
+// Sent returns the number of bytes that have been passed through to
+// the underlying writer.
+func (hcw *hashCheckWriter) Sent() int64 {
+	return hcw.sent
+}
+
+// hashCheckReader reads from an underlying reader while computing
+// the MD5 digest of the data. When the underlying reader reaches
+// EOF, hashCheckReader returns RequestHashError instead of io.EOF if
+// the data did not have the expected size and MD5 digest.
+//
+// This allows a BlockWriter to consume a request body directly:
+// WriteBlock will see an error instead of EOF, and will not commit
+// the bad data.
+type hashCheckReader struct {
+	reader     io.Reader
+	expectHash string
+	expectSize int64
+	hash       hash.Hash
+	size       int64
+	consumed   bool
+}
+
+func newHashCheckReader(r io.Reader, expectHash string, expectSize int64) *hashCheckReader {
+	return &hashCheckReader{
+		reader:     r,
+		expectHash: expectHash,
+		expectSize: expectSize,
+		hash:       md5.New(),
+	}
+}
+
+// Read implements io.Reader.
+func (hcr *hashCheckReader) Read(p []byte) (int, error) {
+	hcr.consumed = true
+	n, err := hcr.reader.Read(p)
+	hcr.hash.Write(p[:n])
+	hcr.size += int64(n)
+	if hcr.size > hcr.expectSize {
+		return n, TooLongError
+	}
+	if err == io.EOF {
+		if sum := fmt.Sprintf("%x", hcr.hash.Sum(nil)); sum != hcr.expectHash || hcr.size != hcr.expectSize {
+			log.Printf("%s: MD5 checksum %s (size %d) did not match request", hcr.expectHash, sum, hcr.size)
+			err = RequestHashError
+		}
+	}
+	return n, err
+}
+
+// Consumed returns true if any data has been read from the
+// underlying reader.
+func (hcr *hashCheckReader) Consumed() bool {
+	return hcr.consumed
+}
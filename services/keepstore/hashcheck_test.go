@@ -0,0 +1,71 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&HashCheckSuite{})
+
+type HashCheckSuite struct{}
+
+func (s *HashCheckSuite) TestWriterGoodData(c *check.C) {
+	var buf bytes.Buffer
+	hcw := newHashCheckWriter(&buf, TestHash)
+	for _, chunk := range [][]byte{TestBlock[:10], TestBlock[10:20], TestBlock[20:]} {
+		n, err := hcw.Write(chunk)
+		c.Check(err, check.IsNil)
+		c.Check(n, check.Equals, len(chunk))
+	}
+	// The last chunk is held back until Close.
+	c.Check(buf.Len(), check.Equals, 20)
+	c.Check(hcw.Sent(), check.Equals, int64(20))
+	c.Check(hcw.Close(), check.IsNil)
+	c.Check(buf.Bytes(), check.DeepEquals, TestBlock)
+	c.Check(hcw.Sum(), check.Equals, TestHash)
+}
+
+func (s *HashCheckSuite) TestWriterBadData(c *check.C) {
+	var buf bytes.Buffer
+	hcw := newHashCheckWriter(&buf, TestHash)
+	hcw.Write(TestBlock[:10])
+	hcw.Write(BadBlock)
+	c.Check(hcw.Close(), check.Equals, DiskHashError)
+	c.Check(buf.Bytes(), check.DeepEquals, TestBlock[:10])
+}
+
+func (s *HashCheckSuite) TestWriterEmpty(c *check.C) {
+	var buf bytes.Buffer
+	hcw := newHashCheckWriter(&buf, EmptyHash)
+	c.Check(hcw.Close(), check.IsNil)
+	c.Check(buf.Len(), check.Equals, 0)
+	c.Check(newHashCheckWriter(&buf, TestHash).Close(), check.Equals, DiskHashError)
+}
+
+func (s *HashCheckSuite) TestReader(c *check.C) {
+	for _, trial := range []struct {
+		data   []byte
+		hash   string
+		size   int64
+		expect error
+	}{
+		{TestBlock, TestHash, int64(len(TestBlock)), nil},
+		{EmptyBlock, EmptyHash, 0, nil},
+		{BadBlock, TestHash, int64(len(BadBlock)), RequestHashError},
+		{TestBlock, TestHash, int64(len(TestBlock)) + 1, RequestHashError},
+		{TestBlock, TestHash, 10, TooLongError},
+	} {
+		hcr := newHashCheckReader(bytes.NewReader(trial.data), trial.hash, trial.size)
+		c.Check(hcr.Consumed(), check.Equals, false)
+		_, err := io.Copy(ioutil.Discard, hcr)
+		c.Check(err, check.Equals, trial.expect)
+		c.Check(hcr.Consumed(), check.Equals, true)
+	}
+}
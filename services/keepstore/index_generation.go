@@ -0,0 +1,57 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+// indexGenerations keeps track of the "index generation" of each
+// volume: a string that changes whenever this process removes a block
+// from the volume's index (or puts back one with an old timestamp, as
+// Untrash does).
+//
+// It is reported with each mount index, so a client that keeps a
+// copy of the index and only retrieves the blocks written since then
+// (see the "since" parameter of IndexHandler) can tell when its copy
+// might list blocks that no longer exist, and retrieve a full index
+// instead. The generation includes a random ID for this process, so
+// it also changes when keepstore restarts.
+type indexGenerations struct {
+	instance string
+	count    map[Volume]uint64
+	mtx      sync.Mutex
+}
+
+var generations = newIndexGenerations()
+
+func newIndexGenerations() *indexGenerations {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return &indexGenerations{
+		instance: fmt.Sprintf("%x", id),
+		count:    map[Volume]uint64{},
+	}
+}
+
+// Bump changes the generation of the given volume. It must be called
+// before a block is removed from the volume, so a client can't record
+// the new generation along with an index that still lists the block.
+func (ig *indexGenerations) Bump(v Volume) {
+	ig.mtx.Lock()
+	defer ig.mtx.Unlock()
+	ig.count[v]++
+}
+
+// Get returns the current generation of the given volume.
+func (ig *indexGenerations) Get(v Volume) string {
+	ig.mtx.Lock()
+	defer ig.mtx.Unlock()
+	return fmt.Sprintf("%s-%d", ig.instance, ig.count[v])
+}
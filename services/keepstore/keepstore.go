@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
@@ -58,6 +59,7 @@ var (
 	TooLongError        = &KeepError{413, "Block is too large"}
 	MethodDisabledError = &KeepError{405, "Method disabled"}
 	ErrNotImplemented   = &KeepError{500, "Unsupported configuration"}
+	StorageClassError   = &KeepError{503, "No writable volume with requested storage class"}
 	ErrClientDisconnect = &KeepError{503, "Client disconnected"}
 )
 
@@ -87,6 +89,10 @@ var KeepVM VolumeManager
 var pullq *WorkQueue
 var trashq *WorkQueue
 
+// scrubbers holds one integrity scrubber per volume, if ScrubInterval
+// is configured.
+var scrubbers []*scrubber
+
 func main() {
 	deprecated.beforeFlagParse(theConfig)
 
@@ -176,6 +182,13 @@ func main() {
 	// Start a round-robin VolumeManager with the volumes we have found.
 	KeepVM = MakeRRVolumeManager(theConfig.Volumes)
 
+	if theConfig.ScrubInterval > 0 {
+		sm := newScrubMetricsVecs(metricsRegistry)
+		for _, v := range theConfig.Volumes {
+			scrubbers = append(scrubbers, newScrubber(v, int64(theConfig.ScrubRate), sm))
+		}
+	}
+
 	// Middleware/handler stack
 	router := MakeRESTRouter(cluster, metricsRegistry)
 
@@ -193,12 +206,14 @@ func main() {
 
 	// Initialize the pullq and workers
 	pullq = NewWorkQueue()
+	pullq.SetRate(theConfig.PullRate)
 	for i := 0; i < 1 || i < theConfig.PullWorkers; i++ {
 		go RunPullWorker(pullq, keepClient)
 	}
 
 	// Initialize the trashq and workers
 	trashq = NewWorkQueue()
+	trashq.SetRate(theConfig.TrashRate)
 	for i := 0; i < 1 || i < theConfig.TrashWorkers; i++ {
 		go RunTrashWorker(trashq)
 	}
@@ -207,6 +222,12 @@ func main() {
 	doneEmptyingTrash := make(chan bool)
 	go emptyTrash(doneEmptyingTrash, theConfig.TrashCheckInterval.Duration())
 
+	// Start scrubbers
+	scrubCtx, cancelScrub := context.WithCancel(context.Background())
+	for _, s := range scrubbers {
+		go s.Run(scrubCtx, theConfig.ScrubInterval.Duration())
+	}
+
 	// Shut down the server gracefully (by closing the listener)
 	// if SIGTERM is received.
 	term := make(chan os.Signal, 1)
@@ -214,6 +235,7 @@ func main() {
 		s := <-sig
 		log.Println("caught signal:", s)
 		doneEmptyingTrash <- true
+		cancelScrub()
 		listener.Close()
 	}(term)
 	signal.Notify(term, syscall.SIGTERM)
@@ -137,8 +137,8 @@ func TestPutBlockOK(t *testing.T) {
 	defer KeepVM.Close()
 
 	// Check that PutBlock stores the data as expected.
-	if n, err := PutBlock(context.Background(), TestBlock, TestHash); err != nil || n < 1 {
-		t.Fatalf("PutBlock: n %d err %v", n, err)
+	if n, err := PutBlock(context.Background(), TestBlock, TestHash, nil); err != nil || n.TotalReplication() < 1 {
+		t.Fatalf("PutBlock: n %d err %v", n.TotalReplication(), err)
 	}
 
 	vols := KeepVM.AllReadable()
@@ -169,8 +169,8 @@ func TestPutBlockOneVol(t *testing.T) {
 	vols[0].(*MockVolume).BadVolumeError = errors.New("Bad volume")
 
 	// Check that PutBlock stores the data as expected.
-	if n, err := PutBlock(context.Background(), TestBlock, TestHash); err != nil || n < 1 {
-		t.Fatalf("PutBlock: n %d err %v", n, err)
+	if n, err := PutBlock(context.Background(), TestBlock, TestHash, nil); err != nil || n.TotalReplication() < 1 {
+		t.Fatalf("PutBlock: n %d err %v", n.TotalReplication(), err)
 	}
 
 	buf := make([]byte, BlockSize)
@@ -197,7 +197,7 @@ func TestPutBlockMD5Fail(t *testing.T) {
 
 	// Check that PutBlock returns the expected error when the hash does
 	// not match the block.
-	if _, err := PutBlock(context.Background(), BadBlock, TestHash); err != RequestHashError {
+	if _, err := PutBlock(context.Background(), BadBlock, TestHash, nil); err != RequestHashError {
 		t.Errorf("Expected RequestHashError, got %v", err)
 	}
 
@@ -222,8 +222,8 @@ func TestPutBlockCorrupt(t *testing.T) {
 	// Store a corrupted block under TestHash.
 	vols := KeepVM.AllWritable()
 	vols[0].Put(context.Background(), TestHash, BadBlock)
-	if n, err := PutBlock(context.Background(), TestBlock, TestHash); err != nil || n < 1 {
-		t.Errorf("PutBlock: n %d err %v", n, err)
+	if n, err := PutBlock(context.Background(), TestBlock, TestHash, nil); err != nil || n.TotalReplication() < 1 {
+		t.Errorf("PutBlock: n %d err %v", n.TotalReplication(), err)
 	}
 
 	// The block on disk should now match TestBlock.
@@ -253,10 +253,10 @@ func TestPutBlockCollision(t *testing.T) {
 
 	// Store one block, then attempt to store the other. Confirm that
 	// PutBlock reported a CollisionError.
-	if _, err := PutBlock(context.Background(), b1, locator); err != nil {
+	if _, err := PutBlock(context.Background(), b1, locator, nil); err != nil {
 		t.Error(err)
 	}
-	if _, err := PutBlock(context.Background(), b2, locator); err == nil {
+	if _, err := PutBlock(context.Background(), b2, locator, nil); err == nil {
 		t.Error("PutBlock did not report a collision")
 	} else if err != CollisionError {
 		t.Errorf("PutBlock returned %v", err)
@@ -287,8 +287,8 @@ func TestPutBlockTouchFails(t *testing.T) {
 	// vols[0].Touch will fail on the next call, so the volume
 	// manager will store a copy on vols[1] instead.
 	vols[0].(*MockVolume).Touchable = false
-	if n, err := PutBlock(context.Background(), TestBlock, TestHash); err != nil || n < 1 {
-		t.Fatalf("PutBlock: n %d err %v", n, err)
+	if n, err := PutBlock(context.Background(), TestBlock, TestHash, nil); err != nil || n.TotalReplication() < 1 {
+		t.Fatalf("PutBlock: n %d err %v", n.TotalReplication(), err)
 	}
 	vols[0].(*MockVolume).Touchable = true
 
@@ -312,6 +312,101 @@ func TestPutBlockTouchFails(t *testing.T) {
 	}
 }
 
+// TestPutBlockStorageClasses
+//     PutBlock writes only to volumes with the requested storage
+//     classes, and writes to enough volumes to cover all of them.
+//
+func TestPutBlockStorageClasses(t *testing.T) {
+	defer teardown()
+
+	for _, trial := range []struct {
+		want          []string
+		expectErr     error
+		expectRepl    int
+		expectClasses map[string]int
+		// Indexes of volumes that should (or should not)
+		// have the block. Volumes listed in neither may or
+		// may not have it.
+		expectStored    []int
+		expectNotStored []int
+	}{
+		{nil, nil, 1, nil, nil, nil},
+		{[]string{"archive"}, nil, 1, nil, nil, []int{0}},
+		{[]string{"default", "fast"}, nil, 2, map[string]int{"default": 1, "archive": 1, "fast": 1}, []int{0, 2}, []int{1}},
+		{[]string{"default", "bogus"}, nil, 1, map[string]int{"default": 1}, []int{0}, []int{1, 2}},
+		{[]string{"bogus"}, StorageClassError, 0, map[string]int{}, nil, []int{0, 1, 2}},
+	} {
+		vols := []*MockVolume{CreateMockVolume(), CreateMockVolume(), CreateMockVolume()}
+		vols[1].StorageClasses = []string{"archive"}
+		vols[2].StorageClasses = []string{"archive", "fast"}
+		KeepVM = MakeRRVolumeManager([]Volume{vols[0], vols[1], vols[2]})
+
+		result, err := PutBlock(context.Background(), TestBlock, TestHash, trial.want)
+		if err != trial.expectErr {
+			t.Errorf("%q: got error %v, expected %v", trial.want, err, trial.expectErr)
+		}
+		if n := result.TotalReplication(); n != trial.expectRepl {
+			t.Errorf("%q: got replication %d, expected %d", trial.want, n, trial.expectRepl)
+		}
+		if trial.expectClasses != nil && fmt.Sprint(result.ClassReplication()) != fmt.Sprint(trial.expectClasses) {
+			t.Errorf("%q: got classes %v, expected %v", trial.want, result.ClassReplication(), trial.expectClasses)
+		}
+		for _, i := range trial.expectStored {
+			if _, ok := vols[i].Store[TestHash]; !ok {
+				t.Errorf("%q: block not stored on vols[%d]", trial.want, i)
+			}
+		}
+		for _, i := range trial.expectNotStored {
+			if _, ok := vols[i].Store[TestHash]; ok {
+				t.Errorf("%q: block stored on vols[%d]", trial.want, i)
+			}
+		}
+		KeepVM.Close()
+	}
+}
+
+// TestPutBlockFromReaderStorageClasses
+//     PutBlockFromReader copies the block to a second volume when
+//     needed to cover all requested storage classes.
+//
+func TestPutBlockFromReaderStorageClasses(t *testing.T) {
+	defer teardown()
+
+	vols := []*TestableUnixVolume{
+		NewTestableUnixVolume(t, false, false),
+		NewTestableUnixVolume(t, false, false),
+	}
+	for _, v := range vols {
+		defer v.Teardown()
+	}
+	for _, v := range vols {
+		v.DirectoryReplication = 1
+	}
+	vols[0].StorageClasses = []string{"hot"}
+	vols[1].StorageClasses = []string{"cold"}
+	KeepVM = MakeRRVolumeManager([]Volume{vols[0], vols[1]})
+	defer KeepVM.Close()
+
+	for i := 0; i < 2; i++ {
+		result, err := PutBlockFromReader(context.Background(), bytes.NewReader(TestBlock), int64(len(TestBlock)), TestHash, []string{"hot", "cold"})
+		if err != nil {
+			t.Fatalf("PutBlockFromReader #%d: %s", i, err)
+		}
+		if got := formatStorageClassesConfirmed(result.ClassReplication()); got != "cold=1, hot=1" {
+			t.Errorf("PutBlockFromReader #%d: got classes %q", i, got)
+		}
+	}
+	for i, v := range vols {
+		buf := make([]byte, BlockSize)
+		n, err := v.Get(context.Background(), TestHash, buf)
+		if err != nil {
+			t.Errorf("vols[%d].Get: %s", i, err)
+		} else if !bytes.Equal(buf[:n], TestBlock) {
+			t.Errorf("vols[%d].Get: got %q", i, buf[:n])
+		}
+	}
+}
+
 func TestDiscoverTmpfs(t *testing.T) {
 	var tempVols [4]string
 	var err error
@@ -135,3 +135,48 @@ func (vm *volumeMetricsVecs) getCounterVecsFor(lbls prometheus.Labels) (opsCV, e
 	ioCV = vm.ioBytes.MustCurryWith(lbls)
 	return
 }
+
+type scrubMetricsVecs struct {
+	blocks  *prometheus.CounterVec
+	bytes   *prometheus.CounterVec
+	corrupt *prometheus.CounterVec
+	errors  *prometheus.CounterVec
+}
+
+func newScrubMetricsVecs(reg *prometheus.Registry) *scrubMetricsVecs {
+	newVec := func(name, help string) *prometheus.CounterVec {
+		cv := prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "arvados",
+				Subsystem: "keepstore",
+				Name:      name,
+				Help:      help,
+			},
+			[]string{"device_id"},
+		)
+		reg.MustRegister(cv)
+		return cv
+	}
+	return &scrubMetricsVecs{
+		blocks:  newVec("scrub_checked_blocks", "Number of blocks verified by the scrubber"),
+		bytes:   newVec("scrub_checked_bytes", "Number of bytes verified by the scrubber"),
+		corrupt: newVec("scrub_corrupt_blocks", "Number of corrupt blocks found by the scrubber"),
+		errors:  newVec("scrub_errors", "Number of scrubber read/index errors"),
+	}
+}
+
+type scrubMetrics struct {
+	blocks  prometheus.Counter
+	bytes   prometheus.Counter
+	corrupt prometheus.Counter
+	errors  prometheus.Counter
+}
+
+func (sm *scrubMetricsVecs) metricsFor(lbls prometheus.Labels) *scrubMetrics {
+	return &scrubMetrics{
+		blocks:  sm.blocks.With(lbls),
+		bytes:   sm.bytes.With(lbls),
+		corrupt: sm.corrupt.With(lbls),
+		errors:  sm.errors.With(lbls),
+	}
+}
@@ -37,8 +37,8 @@ func RunPullWorker(pullq *WorkQueue, keepClient *keepclient.KeepClient) {
 //
 // If the PR specifies a non-blank mount UUID, PullItemAndProcess will
 // only attempt to write the data to the corresponding
-// volume. Otherwise it writes to any local volume, as a PUT request
-// would.
+// volume, and fails if that volume is being evacuated. Otherwise it
+// writes to any local volume, as a PUT request would.
 func PullItemAndProcess(pullRequest PullRequest, keepClient *keepclient.KeepClient) error {
 	var vol Volume
 	if uuid := pullRequest.MountUUID; uuid != "" {
@@ -46,6 +46,9 @@ func PullItemAndProcess(pullRequest PullRequest, keepClient *keepclient.KeepClie
 		if vol == nil {
 			return fmt.Errorf("pull req has nonexistent mount: %v", pullRequest)
 		}
+		if evacuations.Has(vol) {
+			return fmt.Errorf("pull req has mount being evacuated: %v", pullRequest)
+		}
 	}
 
 	keepClient.Arvados.ApiToken = randomToken
@@ -92,7 +95,7 @@ var writePulledBlock = func(volume Volume, data []byte, locator string) {
 	if volume != nil {
 		err = volume.Put(context.Background(), locator, data)
 	} else {
-		_, err = PutBlock(context.Background(), data, locator)
+		_, err = PutBlock(context.Background(), data, locator, nil)
 	}
 	if err != nil {
 		log.Printf("error writing pulled block %q: %s", locator, err)
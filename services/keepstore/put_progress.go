@@ -0,0 +1,158 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// putProgress keeps track of the volumes a block has been stored on
+// during a PUT request, and which of the requested storage classes
+// are still unsatisfied.
+type putProgress struct {
+	classTodo        map[string]bool
+	classDone        map[string]int
+	mountUsed        map[Volume]bool
+	totalReplication int
+}
+
+func newPutProgress(wantStorageClasses []string) putProgress {
+	pr := putProgress{
+		classTodo: map[string]bool{},
+		classDone: map[string]int{},
+		mountUsed: map[Volume]bool{},
+	}
+	for _, class := range wantStorageClasses {
+		pr.classTodo[class] = true
+	}
+	return pr
+}
+
+// Satisfied returns true if the block has been stored on at least one
+// volume, and every requested storage class is covered.
+func (pr *putProgress) Satisfied() bool {
+	return len(pr.mountUsed) > 0 && len(pr.classTodo) == 0
+}
+
+// Wants returns true if storing the block on vol would make progress:
+// if no storage classes were requested, any volume will do until the
+// block has been stored once; otherwise, vol must offer a requested
+// class that isn't covered yet. Volumes that are being evacuated
+// never receive new blocks.
+func (pr *putProgress) Wants(vol Volume) bool {
+	if pr.mountUsed[vol] || evacuations.Has(vol) {
+		return false
+	}
+	if len(pr.classTodo) == 0 {
+		return len(pr.mountUsed) == 0
+	}
+	for _, class := range volumeStorageClasses(vol) {
+		if pr.classTodo[class] {
+			return true
+		}
+	}
+	return false
+}
+
+// Add records that the block is stored on vol.
+func (pr *putProgress) Add(vol Volume) {
+	if pr.mountUsed[vol] {
+		return
+	}
+	pr.mountUsed[vol] = true
+	pr.totalReplication += vol.Replication()
+	for _, class := range volumeStorageClasses(vol) {
+		pr.classDone[class] += vol.Replication()
+		delete(pr.classTodo, class)
+	}
+}
+
+// TotalReplication returns the number of replicas stored.
+func (pr *putProgress) TotalReplication() int {
+	return pr.totalReplication
+}
+
+// ClassReplication returns the number of replicas stored in each
+// storage class.
+func (pr *putProgress) ClassReplication() map[string]int {
+	classes := make(map[string]int, len(pr.classDone))
+	for class, n := range pr.classDone {
+		classes[class] = n
+	}
+	return classes
+}
+
+// failure returns the error to report after trying (or, if tried is
+// false, finding no) suitable volumes to write to. A partial success
+// -- some requested storage classes covered, but not all -- is not
+// an error.
+func (pr *putProgress) failure(tried, allFull bool) error {
+	if len(pr.mountUsed) > 0 {
+		return nil
+	} else if !tried {
+		log.Print("No writable volumes with requested storage classes.")
+		return StorageClassError
+	} else if allFull {
+		log.Print("All volumes are full.")
+		return FullError
+	}
+	// Already logged the non-full errors.
+	return GenericError
+}
+
+// volumeStorageClasses returns the storage classes offered by vol. A
+// volume with no configured storage classes is in the "default"
+// class.
+func volumeStorageClasses(vol Volume) []string {
+	if classes := vol.GetStorageClasses(); len(classes) > 0 {
+		return classes
+	}
+	return []string{"default"}
+}
+
+// parseStorageClasses parses the value of an X-Keep-Storage-Classes
+// request header, like "default, archive".
+func parseStorageClasses(hdr string) []string {
+	var classes []string
+	for _, class := range strings.Split(hdr, ",") {
+		if class = strings.TrimSpace(class); class != "" {
+			classes = append(classes, class)
+		}
+	}
+	return classes
+}
+
+// formatStorageClassesConfirmed returns the value of an
+// X-Keep-Storage-Classes-Confirmed header, like "default=2, archive=1".
+func formatStorageClassesConfirmed(classes map[string]int) string {
+	var parts []string
+	for class, n := range classes {
+		parts = append(parts, fmt.Sprintf("%s=%d", class, n))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// parseStorageClassesConfirmed parses the value of an
+// X-Keep-Storage-Classes-Confirmed header. Malformed entries are
+// ignored.
+func parseStorageClassesConfirmed(hdr string) map[string]int {
+	classes := map[string]int{}
+	for _, part := range strings.Split(hdr, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil {
+			continue
+		}
+		classes[kv[0]] += n
+	}
+	return classes
+}
@@ -0,0 +1,263 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxCorruptReported is the maximum number of corrupt block locators
+// reported in a ScrubStatus. Each locator is listed once, no matter
+// how many passes find it. Older entries are dropped first.
+const maxCorruptReported = 1000
+
+// ScrubStatus reports the progress of a volume's integrity scrubber.
+type ScrubStatus struct {
+	PassesCompleted  int
+	LastPassStarted  time.Time
+	LastPassFinished time.Time
+	BlocksChecked    int64
+	BytesChecked     int64
+	Errors           int64
+	CorruptBlocks    []string
+	CorruptTotal     int64
+}
+
+// A scrubber periodically reads every block on a volume and verifies
+// its MD5 digest. Corrupt blocks are trashed (if the volume is
+// writable and EnableDelete is set) so they no longer appear in the
+// volume's index, which lets keep-balance notice that they are
+// under-replicated and pull good copies from other servers.
+type scrubber struct {
+	volume Volume
+	// Maximum average read rate, in bytes per second. Zero means
+	// unlimited.
+	rate    int64
+	metrics *scrubMetrics
+
+	status ScrubStatus
+	// locators currently listed in status.CorruptBlocks, so a
+	// block found on every pass is only listed once
+	corruptListed map[string]bool
+	mtx           sync.Mutex
+}
+
+func newScrubber(v Volume, rate int64, sm *scrubMetricsVecs) *scrubber {
+	return &scrubber{
+		volume:  v,
+		rate:    rate,
+		metrics: sm.metricsFor(prometheus.Labels{"device_id": v.DeviceID()}),
+	}
+}
+
+// Run performs a scrub pass once per interval until ctx is done.
+func (s *scrubber) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.ScrubOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns a snapshot of the scrubber's current status.
+func (s *scrubber) Status() *ScrubStatus {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	st := s.status
+	st.CorruptBlocks = append([]string(nil), s.status.CorruptBlocks...)
+	return &st
+}
+
+// ScrubOnce checks every block on the volume, one index prefix at a
+// time.
+func (s *scrubber) ScrubOnce(ctx context.Context) {
+	s.mtx.Lock()
+	s.status.LastPassStarted = time.Now()
+	s.mtx.Unlock()
+
+	log.Printf("%s: scrub pass starting", s.volume)
+	start := time.Now()
+	var checked int64
+	for prefix := 0; prefix < 0x1000; prefix++ {
+		var index bytes.Buffer
+		err := s.volume.IndexTo(fmt.Sprintf("%03x", prefix), &index)
+		if err != nil {
+			log.Printf("%s: scrub: IndexTo(%03x): %s", s.volume, prefix, err)
+			s.countError()
+			continue
+		}
+		scanner := bufio.NewScanner(&index)
+		for scanner.Scan() {
+			if ctx.Err() != nil {
+				log.Printf("%s: scrub pass cancelled", s.volume)
+				return
+			}
+			locator := strings.SplitN(scanner.Text(), " ", 2)[0]
+			size, err := s.checkBlock(ctx, locator)
+			if err != nil {
+				continue
+			}
+			checked += size
+			s.throttle(ctx, start, checked)
+		}
+	}
+
+	s.mtx.Lock()
+	s.status.PassesCompleted++
+	s.status.LastPassFinished = time.Now()
+	s.mtx.Unlock()
+	log.Printf("%s: scrub pass finished in %v, %d bytes checked", s.volume, time.Since(start), checked)
+}
+
+// throttle sleeps long enough to keep the average read rate since
+// start at or below s.rate.
+func (s *scrubber) throttle(ctx context.Context, start time.Time, checked int64) {
+	if s.rate <= 0 {
+		return
+	}
+	wait := time.Until(start.Add(time.Duration(float64(checked) / float64(s.rate) * float64(time.Second))))
+	if wait <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(wait):
+	}
+}
+
+// checkBlock reads the given block and verifies its MD5 digest. It
+// returns the number of bytes checked.
+func (s *scrubber) checkBlock(ctx context.Context, locator string) (int64, error) {
+	hash := locator
+	if i := strings.Index(locator, "+"); i >= 0 {
+		hash = locator[:i]
+	}
+	hasher := md5.New()
+	var size int64
+	var err error
+	if br, ok := s.volume.(BlockReader); ok {
+		cw := &countingWriter{w: hasher}
+		err = br.ReadBlock(ctx, hash, cw)
+		size = cw.n
+	} else {
+		var buf []byte
+		buf, err = getBufferWithContext(ctx, bufs, BlockSize)
+		if err != nil {
+			return 0, err
+		}
+		defer bufs.Put(buf)
+		var n int
+		n, err = s.volume.Get(ctx, hash, buf)
+		hasher.Write(buf[:n])
+		size = int64(n)
+	}
+	if os.IsNotExist(err) {
+		// Deleted since we got the index.
+		return 0, err
+	} else if err != nil {
+		log.Printf("%s: scrub: reading %s: %s", s.volume, hash, err)
+		s.countError()
+		return 0, err
+	}
+
+	s.mtx.Lock()
+	s.status.BlocksChecked++
+	s.status.BytesChecked += size
+	s.mtx.Unlock()
+	s.metrics.blocks.Inc()
+	s.metrics.bytes.Add(float64(size))
+
+	if fmt.Sprintf("%x", hasher.Sum(nil)) != hash {
+		s.quarantine(hash + "+" + strconv.FormatInt(size, 10))
+		return size, DiskHashError
+	}
+	return size, nil
+}
+
+// quarantine records a corrupt block and, if permitted, trashes it.
+func (s *scrubber) quarantine(locator string) {
+	log.Printf("%s: scrub: block %s is corrupt", s.volume, locator)
+	s.mtx.Lock()
+	s.status.CorruptTotal++
+	if !s.corruptListed[locator] {
+		if s.corruptListed == nil {
+			s.corruptListed = map[string]bool{}
+		}
+		s.corruptListed[locator] = true
+		s.status.CorruptBlocks = append(s.status.CorruptBlocks, locator)
+		if n := len(s.status.CorruptBlocks); n > maxCorruptReported {
+			for _, dropped := range s.status.CorruptBlocks[:n-maxCorruptReported] {
+				delete(s.corruptListed, dropped)
+			}
+			s.status.CorruptBlocks = s.status.CorruptBlocks[n-maxCorruptReported:]
+		}
+	}
+	s.mtx.Unlock()
+	s.metrics.corrupt.Inc()
+
+	if !s.volume.Writable() || !theConfig.EnableDelete {
+		return
+	}
+	hash := locator[:32]
+	generations.Bump(s.volume)
+	if err := s.volume.Trash(hash); err != nil {
+		log.Printf("%s: scrub: trashing corrupt block %s: %s", s.volume, hash, err)
+	} else if _, err := s.volume.Mtime(hash); err == nil {
+		// Trash returns success without doing anything if
+		// the block was written less than BlobSignatureTTL
+		// ago. It will still be in the index next time.
+		log.Printf("%s: scrub: corrupt block %s is too new to trash, will retry on next pass", s.volume, hash)
+	} else {
+		log.Printf("%s: scrub: trashed corrupt block %s", s.volume, hash)
+	}
+}
+
+func (s *scrubber) countError() {
+	s.mtx.Lock()
+	s.status.Errors++
+	s.mtx.Unlock()
+	s.metrics.errors.Inc()
+}
+
+// scrubberFor returns the running scrubber for the given volume, or
+// nil if there isn't one.
+func scrubberFor(v Volume) *scrubber {
+	for _, s := range scrubbers {
+		if s.volume == v {
+			return s
+		}
+	}
+	return nil
+}
+
+// countingWriter passes writes through to w and counts the bytes
+// written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,129 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ScrubSuite{})
+
+type ScrubSuite struct {
+	volume    *TestableUnixVolume
+	oldConfig *Config
+}
+
+func (s *ScrubSuite) SetUpTest(c *check.C) {
+	s.oldConfig = theConfig
+	cfg := *theConfig
+	theConfig = &cfg
+	theConfig.EnableDelete = true
+	theConfig.BlobSignatureTTL = arvados.Duration(time.Hour)
+	s.volume = NewTestableUnixVolume(c, false, false)
+}
+
+func (s *ScrubSuite) TearDownTest(c *check.C) {
+	s.volume.Teardown()
+	theConfig = s.oldConfig
+}
+
+func (s *ScrubSuite) index(c *check.C) string {
+	var buf bytes.Buffer
+	c.Assert(s.volume.IndexTo("", &buf), check.IsNil)
+	return buf.String()
+}
+
+func (s *ScrubSuite) setup(c *check.C) {
+	old := time.Now().Add(-2 * time.Hour)
+	s.volume.PutRaw(TestHash, TestBlock)
+	s.volume.TouchWithDate(TestHash, old)
+	s.volume.PutRaw(TestHash2, []byte("corrupt"))
+	s.volume.TouchWithDate(TestHash2, old)
+}
+
+func (s *ScrubSuite) TestTrashCorrupt(c *check.C) {
+	s.setup(c)
+	scr := newScrubber(s.volume, 0, newScrubMetricsVecs(prometheus.NewRegistry()))
+	scr.ScrubOnce(context.Background())
+
+	st := scr.Status()
+	c.Check(st.PassesCompleted, check.Equals, 1)
+	c.Check(st.BlocksChecked, check.Equals, int64(2))
+	c.Check(st.BytesChecked, check.Equals, int64(len(TestBlock)+len("corrupt")))
+	c.Check(st.CorruptTotal, check.Equals, int64(1))
+	c.Check(st.CorruptBlocks, check.DeepEquals, []string{TestHash2 + "+7"})
+	c.Check(st.Errors, check.Equals, int64(0))
+
+	idx := s.index(c)
+	c.Check(idx, check.Matches, `(?ms).*^`+TestHash+`\+.*`)
+	c.Check(idx, check.Not(check.Matches), `(?ms).*^`+TestHash2+`\+.*`)
+}
+
+func (s *ScrubSuite) TestCorruptTooNewToTrash(c *check.C) {
+	s.setup(c)
+	s.volume.TouchWithDate(TestHash2, time.Now())
+	scr := newScrubber(s.volume, 0, newScrubMetricsVecs(prometheus.NewRegistry()))
+	scr.ScrubOnce(context.Background())
+	c.Check(scr.Status().CorruptBlocks, check.DeepEquals, []string{TestHash2 + "+7"})
+	c.Check(s.index(c), check.Matches, `(?ms).*^`+TestHash2+`\+.*`)
+
+	// Once the block is older than BlobSignatureTTL, the next
+	// pass trashes it.
+	s.volume.TouchWithDate(TestHash2, time.Now().Add(-2*time.Hour))
+	scr.ScrubOnce(context.Background())
+	c.Check(scr.Status().CorruptTotal, check.Equals, int64(2))
+	c.Check(s.index(c), check.Not(check.Matches), `(?ms).*^`+TestHash2+`\+.*`)
+}
+
+func (s *ScrubSuite) TestReportOnly(c *check.C) {
+	s.setup(c)
+	theConfig.EnableDelete = false
+	scr := newScrubber(s.volume, 0, newScrubMetricsVecs(prometheus.NewRegistry()))
+	scr.ScrubOnce(context.Background())
+
+	st := scr.Status()
+	c.Check(st.CorruptBlocks, check.DeepEquals, []string{TestHash2 + "+7"})
+	c.Check(s.index(c), check.Matches, `(?ms).*^`+TestHash2+`\+.*`)
+}
+
+func (s *ScrubSuite) TestReportOnce(c *check.C) {
+	s.setup(c)
+	theConfig.EnableDelete = false
+	scr := newScrubber(s.volume, 0, newScrubMetricsVecs(prometheus.NewRegistry()))
+	for i := 0; i < 3; i++ {
+		scr.ScrubOnce(context.Background())
+	}
+
+	st := scr.Status()
+	c.Check(st.PassesCompleted, check.Equals, 3)
+	c.Check(st.CorruptTotal, check.Equals, int64(3))
+	c.Check(st.CorruptBlocks, check.DeepEquals, []string{TestHash2 + "+7"})
+}
+
+func (s *ScrubSuite) TestRateLimit(c *check.C) {
+	s.volume.PutRaw(TestHash, TestBlock)
+	scr := newScrubber(s.volume, int64(len(TestBlock))*5, newScrubMetricsVecs(prometheus.NewRegistry()))
+	t0 := time.Now()
+	scr.ScrubOnce(context.Background())
+	c.Check(time.Since(t0) >= 200*time.Millisecond, check.Equals, true)
+	c.Check(scr.Status().BlocksChecked, check.Equals, int64(1))
+}
+
+func (s *ScrubSuite) TestCancel(c *check.C) {
+	s.setup(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	scr := newScrubber(s.volume, 0, newScrubMetricsVecs(prometheus.NewRegistry()))
+	scr.ScrubOnce(ctx)
+	st := scr.Status()
+	c.Check(st.PassesCompleted, check.Equals, 0)
+	c.Check(st.BlocksChecked, check.Equals, int64(0))
+}
@@ -62,6 +62,7 @@ func TrashItem(trashRequest TrashRequest) {
 		if !theConfig.EnableDelete {
 			err = errors.New("skipping because EnableDelete is false")
 		} else {
+			generations.Bump(volume)
 			err = volume.Trash(trashRequest.Locator)
 		}
 
@@ -672,6 +672,12 @@ func (v *UnixVolume) InternalStats() interface{} {
 	return &v.os.stats
 }
 
+// serialized returns true if the volume performs only one read or
+// write at a time.
+func (v *UnixVolume) serialized() bool {
+	return v.locker != nil
+}
+
 // lock acquires the serialize lock, if one is in use. If ctx is done
 // before the lock is acquired, lock returns ctx.Err() instead of
 // acquiring the lock.
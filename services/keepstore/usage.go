@@ -70,6 +70,12 @@ MaxBuffers:
     buffers (like GET and PUT) will wait for buffer space to be
     released.
 
+    Requests are streamed without buffers when the volumes support
+    it (currently Directory volumes): GET requests with a size hint
+    in the locator, and PUT requests when all writable volumes
+    support streaming. These requests are limited by MaxRequests
+    only.
+
 MaxRequests:
 
     Maximum concurrent requests. When this limit is reached, new
@@ -128,11 +134,35 @@ EmptyTrashWorkers:
     Maximum number of concurrent block deletion operations (per
     volume) when emptying trash. Default is 1.
 
+ScrubInterval:
+
+    How often to start a scrub pass, which reads every block on every
+    volume and verifies its MD5 digest. Corrupt blocks are reported
+    in /status.json and Prometheus metrics, and (if EnableDelete is
+    true and the volume is writable) moved to trash so keep-balance
+    can replace them with good copies from other servers. Default is
+    0, i.e., scrubbing is disabled.
+
+ScrubRate:
+
+    Maximum average rate, in bytes per second, at which the scrubber
+    reads data from each volume. Default is 10Mi.
+
 PullWorkers:
 
     Maximum number of concurrent pull operations. Default is 1, i.e.,
     pull lists are processed serially.
 
+PullRate:
+
+    Maximum number of pull operations started per second, regardless
+    of PullWorkers. Default is 0, i.e., no limit.
+
+TrashRate:
+
+    Maximum number of trash operations started per second, regardless
+    of TrashWorkers. Default is 0, i.e., no limit.
+
 TLSCertificateFile:
 
     Path to server certificate file in X509 format. Enables TLS mode.
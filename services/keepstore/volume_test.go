@@ -55,6 +55,12 @@ type MockVolume struct {
 	// Touch.
 	Readonly bool
 
+	// StorageClasses is returned by GetStorageClasses.
+	StorageClasses []string
+
+	// Device is returned by DeviceID, if not empty.
+	Device string
+
 	// Gate is a "starting gate", allowing test cases to pause
 	// volume operations long enough to inspect state. Every
 	// operation (except Status) starts by receiving from
@@ -184,7 +190,7 @@ func (v *MockVolume) IndexTo(prefix string, w io.Writer) error {
 			continue
 		}
 		_, err := fmt.Fprintf(w, "%s+%d %d\n",
-			loc, len(block), 123456789)
+			loc, len(block), v.Timestamps[loc].UnixNano())
 		if err != nil {
 			return err
 		}
@@ -209,6 +215,9 @@ func (v *MockVolume) Trash(loc string) error {
 }
 
 func (v *MockVolume) DeviceID() string {
+	if v.Device != "" {
+		return v.Device
+	}
 	return "mock-device-id"
 }
 
@@ -248,5 +257,5 @@ func (v *MockVolume) EmptyTrash() {
 }
 
 func (v *MockVolume) GetStorageClasses() []string {
-	return nil
+	return v.StorageClasses
 }
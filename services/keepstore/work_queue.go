@@ -81,12 +81,18 @@ package main
             processing a list item when ReplaceQueue is called, it
             finishes processing before receiving items from the new
             list.
+		SetRate(itemsPerSecond)
+			Limits the rate at which items are given to workers.
 		Close()
 			Shuts down the manager goroutine. When Close is called,
 			the manager closes the NextItem channel.
 */
 
-import "container/list"
+import (
+	"container/list"
+	"sync/atomic"
+	"time"
+)
 
 // WorkQueue definition
 type WorkQueue struct {
@@ -99,6 +105,10 @@ type WorkQueue struct {
 	// working on that item (regardless of whether the work was
 	// successful).
 	DoneItem chan<- struct{}
+
+	// Minimum time between items sent to NextItem (nanoseconds,
+	// accessed atomically). Zero means no limit.
+	interval int64
 }
 
 // WorkQueueStatus reflects the queue status.
@@ -113,7 +123,7 @@ func NewWorkQueue() *WorkQueue {
 	nextItem := make(chan interface{})
 	reportDone := make(chan struct{})
 	newList := make(chan *list.List)
-	b := WorkQueue{
+	b := &WorkQueue{
 		getStatus: make(chan WorkQueueStatus),
 		newlist:   newList,
 		NextItem:  nextItem,
@@ -141,7 +151,16 @@ func NewWorkQueue() *WorkQueue {
 		var nextChan chan interface{}
 		var nextVal interface{}
 
+		// throttle is non-nil while we are waiting for the
+		// rate limit interval to pass before sending the next
+		// item.
+		var throttle <-chan time.Time
+
 		for newList != nil || status.InProgress > 0 {
+			sendChan := nextChan
+			if throttle != nil {
+				sendChan = nil
+			}
 			select {
 			case p, ok := <-newList:
 				if !ok {
@@ -161,7 +180,12 @@ func NewWorkQueue() *WorkQueue {
 					nextChan = nextItem
 					nextVal = todo.Front().Value
 				}
-			case nextChan <- nextVal:
+			case <-throttle:
+				throttle = nil
+			case sendChan <- nextVal:
+				if interval := atomic.LoadInt64(&b.interval); interval > 0 {
+					throttle = time.After(time.Duration(interval))
+				}
 				todo.Remove(todo.Front())
 				status.InProgress++
 				status.Queued--
@@ -178,7 +202,18 @@ func NewWorkQueue() *WorkQueue {
 			}
 		}
 	}()
-	return &b
+	return b
+}
+
+// SetRate limits the rate at which work items are given to workers,
+// regardless of the number of workers. Zero or negative means no
+// limit.
+func (b *WorkQueue) SetRate(itemsPerSecond float64) {
+	var interval int64
+	if itemsPerSecond > 0 {
+		interval = int64(float64(time.Second) / itemsPerSecond)
+	}
+	atomic.StoreInt64(&b.interval, interval)
 }
 
 // ReplaceQueue abandons any work items left in the existing queue,
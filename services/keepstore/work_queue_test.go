@@ -120,6 +120,28 @@ func TestWorkQueueDoneness(t *testing.T) {
 	expectChannelEmpty(t, b.NextItem)
 }
 
+// With a rate limit, items are given to workers no faster than the
+// given rate, even when workers are waiting.
+func TestWorkQueueRate(t *testing.T) {
+	var input = []interface{}{1, 2, 3, 4, 5}
+
+	b := NewWorkQueue()
+	defer b.Close()
+	b.SetRate(100)
+	b.ReplaceQueue(makeTestWorkList(input))
+	t0 := time.Now()
+	doWorkItems(t, b, input)
+	if elapsed := time.Since(t0); elapsed < 40*time.Millisecond {
+		t.Fatalf("got %d items in %v, expected >= 40ms at 100 items/s", len(input), elapsed)
+	}
+
+	// Removing the limit takes effect after the next item.
+	b.SetRate(0)
+	b.ReplaceQueue(makeTestWorkList(input))
+	doWorkItems(t, b, input)
+	expectQueued(t, b, 0)
+}
+
 // Create a WorkQueue, generate a list for it, and instantiate a worker.
 func TestWorkQueueReadWrite(t *testing.T) {
 	var input = []interface{}{1, 1, 2, 3, 5, 8, 13, 21, 34}